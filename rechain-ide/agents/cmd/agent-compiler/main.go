@@ -11,6 +11,7 @@ import (
   "time"
 
   "rechain-ide/shared/logging"
+  "rechain-ide/shared/tracing"
 )
 
 const schemaVersion = "0.1.0"
@@ -128,7 +129,7 @@ func main() {
 
   addr := ":8086"
   log.Printf("agent-compiler listening on %s", addr)
-  if err := http.ListenAndServe(addr, logging.WithRequestID(mux)); err != nil {
+  if err := http.ListenAndServe(addr, logging.WithRequestID(tracing.WithTrace(mux))); err != nil {
     log.Fatal(err)
   }
 }
@@ -11,12 +11,16 @@ import (
   "time"
 )
 
+var apiToken string
+
 func main() {
   server := flag.String("server", "http://localhost:8081", "orchestrator base url")
   cmd := flag.String("cmd", "health", "health|submit|status|result|metrics")
   input := flag.String("input", "", "task input")
   task := flag.String("task", "", "task id")
+  token := flag.String("token", os.Getenv("RECHAIN_API_TOKEN"), "orchestrator API token (default $RECHAIN_API_TOKEN)")
   flag.Parse()
+  apiToken = *token
 
   switch *cmd {
   case "health":
@@ -61,6 +65,7 @@ func submit(server string, input string) {
     fatal(err.Error())
   }
   req.Header.Set("Content-Type", "application/json")
+  authorize(req)
   client := &http.Client{Timeout: 5 * time.Second}
   resp, err := client.Do(req)
   if err != nil {
@@ -72,8 +77,13 @@ func submit(server string, input string) {
 }
 
 func get(url string) {
+  req, err := http.NewRequest(http.MethodGet, url, nil)
+  if err != nil {
+    fatal(err.Error())
+  }
+  authorize(req)
   client := &http.Client{Timeout: 5 * time.Second}
-  resp, err := client.Get(url)
+  resp, err := client.Do(req)
   if err != nil {
     fatal(err.Error())
   }
@@ -82,6 +92,12 @@ func get(url string) {
   fmt.Println(string(data))
 }
 
+func authorize(req *http.Request) {
+  if apiToken != "" {
+    req.Header.Set("Authorization", "Bearer "+apiToken)
+  }
+}
+
 func fatal(msg string) {
   fmt.Fprintln(os.Stderr, msg)
   os.Exit(1)
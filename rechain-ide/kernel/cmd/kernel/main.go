@@ -8,6 +8,7 @@ import (
   "net/http"
   "os"
   "os/exec"
+  "path/filepath"
   "regexp"
   "runtime"
   "strconv"
@@ -16,6 +17,7 @@ import (
   "time"
 
   "rechain-ide/shared/logging"
+  "rechain-ide/shared/tracing"
 )
 
 const schemaVersion = "0.1.0"
@@ -26,6 +28,7 @@ type ExecSpec struct {
   Command       string   `json:"command"`
   Args          []string `json:"args"`
   TimeoutMs     int      `json:"timeout_ms"`
+  Dir           string   `json:"dir,omitempty"`
 }
 
 type ExecResult struct {
@@ -139,7 +142,7 @@ func main() {
     ctx, cancel := context.WithTimeout(context.Background(), timeout)
     defer cancel()
 
-    out, code, err := runSandboxed(ctx, spec.Command, spec.Args)
+    out, code, err := runSandboxed(ctx, spec.Command, spec.Args, spec.Dir)
     result.CompletedAt = time.Now().UTC().Format(time.RFC3339)
     result.Output = out
     result.ExitCode = code
@@ -175,7 +178,7 @@ func main() {
 
   addr := ":8082"
   log.Printf("kernel listening on %s", addr)
-  if err := http.ListenAndServe(addr, logging.WithRequestID(mux)); err != nil {
+  if err := http.ListenAndServe(addr, logging.WithRequestID(tracing.WithTrace(mux))); err != nil {
     log.Fatal(err)
   }
 }
@@ -229,9 +232,12 @@ func enforcePolicy(spec ExecSpec) PolicyDecision {
   if !isAllowedCommand(spec.Command) {
     return PolicyDecision{Allowed: false, Reason: "command not allowed"}
   }
-  if !argsSafe(spec.Args) {
+  if !argsSafe(spec.Args, spec.Dir) {
     return PolicyDecision{Allowed: false, Reason: "unsafe args"}
   }
+  if spec.Dir != "" && !dirAllowed(spec.Dir) {
+    return PolicyDecision{Allowed: false, Reason: "dir not allowed"}
+  }
   return PolicyDecision{Allowed: true, Reason: ""}
 }
 
@@ -258,28 +264,82 @@ func isDeniedCommand(cmd string) bool {
   return denied[strings.ToLower(cmd)]
 }
 
-func argsSafe(args []string) bool {
-  re := regexp.MustCompile(`^[a-zA-Z0-9_\-\. ]*$`)
+// argsSafe allows plain words. Only when the command runs in a directory
+// inside KERNEL_WORKDIR_ROOT may args also be relative paths such as ./...
+// or flag=value words, and then without absolute paths or parent-directory
+// segments. Flags that make go run another program are never allowed.
+func argsSafe(args []string, dir string) bool {
+  plain := regexp.MustCompile(`^[a-zA-Z0-9_\-\. ]*$`)
+  scoped := regexp.MustCompile(`^[a-zA-Z0-9_\-\.\/=]*$`)
+  inRoot := dir != "" && dirAllowed(dir)
   for _, a := range args {
-    if !re.MatchString(a) {
+    if isExecFlag(a) {
+      return false
+    }
+    if plain.MatchString(a) {
+      continue
+    }
+    if !inRoot || !scoped.MatchString(a) {
       return false
     }
+    for _, part := range strings.Split(a, "=") {
+      if strings.HasPrefix(part, "/") {
+        return false
+      }
+      for _, seg := range strings.Split(part, "/") {
+        if seg == ".." {
+          return false
+        }
+      }
+    }
   }
   return true
 }
 
-func runSandboxed(ctx context.Context, cmd string, args []string) (string, int, error) {
+// isExecFlag reports whether a is a go flag naming a program to run, such as
+// -exec, -toolexec or -vettool, in either -flag or -flag=value form.
+func isExecFlag(a string) bool {
+  name := strings.TrimLeft(a, "-")
+  if name == a {
+    return false
+  }
+  name, _, _ = strings.Cut(name, "=")
+  switch strings.ToLower(name) {
+  case "exec", "toolexec", "vettool":
+    return true
+  }
+  return false
+}
+
+// dirAllowed reports whether dir is an existing directory inside
+// KERNEL_WORKDIR_ROOT. Without a root no working directory may be chosen.
+func dirAllowed(dir string) bool {
+  root := strings.TrimSpace(os.Getenv("KERNEL_WORKDIR_ROOT"))
+  if root == "" || !filepath.IsAbs(dir) {
+    return false
+  }
+  rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(dir))
+  if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+    return false
+  }
+  info, err := os.Stat(dir)
+  return err == nil && info.IsDir()
+}
+
+func runSandboxed(ctx context.Context, cmd string, args []string, dir string) (string, int, error) {
   if runtime.GOOS == "windows" {
     cmdline := cmd
     if len(args) > 0 {
       cmdline = cmdline + " " + strings.Join(args, " ")
     }
     c := exec.CommandContext(ctx, "cmd", "/C", cmdline)
+    c.Dir = dir
     out, err := c.CombinedOutput()
     return string(out), exitCode(c, err), err
   }
 
   c := exec.CommandContext(ctx, cmd, args...)
+  c.Dir = dir
   out, err := c.CombinedOutput()
   return string(out), exitCode(c, err), err
 }
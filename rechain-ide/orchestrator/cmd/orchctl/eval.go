@@ -0,0 +1,736 @@
+﻿package main
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "net/http"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "gopkg.in/yaml.v3"
+)
+
+// EvalSuite is a suite file: tasks with expected outcomes, plus the drivers
+// and policies to run them with unless the command line picks others.
+type EvalSuite struct {
+  Name     string       `json:"name"`
+  Drivers  []string     `json:"drivers,omitempty"`
+  Policies []EvalPolicy `json:"policies,omitempty"`
+  Cases    []EvalCase   `json:"cases"`
+}
+
+// EvalPolicy is a routing and merge configuration to compare. Merge "hunk"
+// sets merge_strategy; any other value forces that merge source.
+type EvalPolicy struct {
+  Name        string       `json:"name"`
+  Routing     string       `json:"routing,omitempty"`
+  Merge       string       `json:"merge,omitempty"`
+  Constraints []Constraint `json:"constraints,omitempty"`
+}
+
+type EvalCase struct {
+  ID     string     `json:"id"`
+  Task   EvalTask   `json:"task"`
+  Expect EvalExpect `json:"expect"`
+}
+
+// EvalTask is the TaskSpec submitted for a case; its id is always left to
+// the orchestrator.
+type EvalTask struct {
+  SchemaVersion string                 `json:"schema_version,omitempty"`
+  Type          string                 `json:"type"`
+  Input         string                 `json:"input"`
+  Context       []json.RawMessage      `json:"context"`
+  Constraints   []Constraint           `json:"constraints"`
+  Metadata      map[string]interface{} `json:"metadata,omitempty"`
+}
+
+type Constraint struct {
+  Key   string      `json:"key"`
+  Value interface{} `json:"value"`
+}
+
+// EvalExpect is what a run must produce to pass. Diff (or DiffFile, relative
+// to the suite) is a reference diff whose changed lines the result must match
+// at MinSimilarity or better (default 1); Tests run through the orchestrator
+// verifier and must pass; TouchedFiles must all appear in the result diff.
+type EvalExpect struct {
+  Diff          string   `json:"diff,omitempty"`
+  DiffFile      string   `json:"diff_file,omitempty"`
+  MinSimilarity float64  `json:"min_similarity,omitempty"`
+  Tests         []string `json:"tests,omitempty"`
+  TouchedFiles  []string `json:"touched_files,omitempty"`
+}
+
+// evalVariant is one column of the report: a policy run with a driver set.
+type evalVariant struct {
+  name    string
+  policy  EvalPolicy
+  drivers []string
+}
+
+type EvalCheck struct {
+  Name   string `json:"name"`
+  Passed bool   `json:"passed"`
+  Detail string `json:"detail,omitempty"`
+}
+
+type EvalRun struct {
+  Case           string      `json:"case"`
+  Variant        string      `json:"variant"`
+  TaskID         string      `json:"task_id,omitempty"`
+  State          string      `json:"state,omitempty"`
+  Passed         bool        `json:"passed"`
+  Checks         []EvalCheck `json:"checks,omitempty"`
+  DiffSimilarity float64     `json:"diff_similarity"`
+  LatencyMs      int64       `json:"latency_ms"`
+  CostUSD        float64     `json:"cost_usd"`
+  Models         []string    `json:"models,omitempty"`
+  MergeSource    string      `json:"merge_source,omitempty"`
+  Error          string      `json:"error,omitempty"`
+}
+
+type EvalSummary struct {
+  Variant      string  `json:"variant"`
+  Runs         int     `json:"runs"`
+  Passed       int     `json:"passed"`
+  PassRate     float64 `json:"pass_rate"`
+  LatencyP50Ms int64   `json:"latency_p50_ms"`
+  LatencyP90Ms int64   `json:"latency_p90_ms"`
+  LatencyP99Ms int64   `json:"latency_p99_ms"`
+  CostUSD      float64 `json:"cost_usd"`
+  MeanCostUSD  float64 `json:"mean_cost_usd"`
+  Wins         int     `json:"wins"`
+}
+
+// EvalReport is written as JSON and rendered as Markdown. Wins[a][b] counts
+// the cases where variant a beat variant b.
+type EvalReport struct {
+  Suite      string                    `json:"suite"`
+  Server     string                    `json:"server"`
+  StartedAt  string                    `json:"started_at"`
+  FinishedAt string                    `json:"finished_at"`
+  Cases      int                       `json:"cases"`
+  Variants   []EvalSummary             `json:"variants"`
+  Wins       map[string]map[string]int `json:"wins"`
+  Runs       []EvalRun                 `json:"runs"`
+}
+
+type evalClient struct {
+  server string
+  token  string
+  poll   time.Duration
+  client *http.Client
+}
+
+func runEvalCommand(args []string) {
+  fs := flag.NewFlagSet("eval", flag.ExitOnError)
+  server := fs.String("server", "http://localhost:8081", "orchestrator base URL")
+  token := fs.String("token", os.Getenv("RECHAIN_API_TOKEN"), "orchestrator API token (default $RECHAIN_API_TOKEN)")
+  suitePath := fs.String("suite", "", "suite file (JSON or YAML)")
+  drivers := fs.String("drivers", "", "comma-separated driver IDs (default: the suite's drivers, else the orchestrator's choice)")
+  eachDriver := fs.Bool("each-driver", false, "run every policy with each driver alone instead of all drivers together")
+  policies := fs.String("policies", "", "comma-separated suite policy names or routing[/merge] pairs, e.g. latency,quality/hunk (default: the suite's policies)")
+  out := fs.String("out", "eval-report", "report path prefix; writes <out>.json and <out>.md")
+  parallel := fs.Int("parallel", 1, "tasks in flight at once")
+  timeout := fs.Duration("timeout", 10*time.Minute, "per-task timeout; late tasks are canceled")
+  poll := fs.Duration("poll", 500*time.Millisecond, "task status poll interval")
+  minPassRate := fs.Float64("min-pass-rate", 0, "exit 1 when any variant passes fewer cases than this fraction")
+  fs.Parse(args)
+
+  if *suitePath == "" {
+    fatal("missing -suite")
+  }
+  suite, err := loadEvalSuite(*suitePath)
+  if err != nil {
+    fatal(err.Error())
+  }
+  variants, err := evalVariants(suite, splitFiles(*policies), splitFiles(*drivers), *eachDriver)
+  if err != nil {
+    fatal(err.Error())
+  }
+  c := &evalClient{
+    server: strings.TrimRight(*server, "/"),
+    token:  *token,
+    poll:   *poll,
+    client: &http.Client{Timeout: 30 * time.Second},
+  }
+  report := runEval(context.Background(), c, suite, variants, *parallel, *timeout)
+
+  data, _ := json.MarshalIndent(report, "", "  ")
+  if err := os.WriteFile(*out+".json", append(data, '\n'), 0644); err != nil {
+    fatal(err.Error())
+  }
+  md := renderEvalMarkdown(report)
+  if err := os.WriteFile(*out+".md", []byte(md), 0644); err != nil {
+    fatal(err.Error())
+  }
+  fmt.Print(md)
+  for _, v := range report.Variants {
+    if v.PassRate < *minPassRate {
+      fatal(fmt.Sprintf("variant %s pass rate %.2f is below %.2f", v.Variant, v.PassRate, *minPassRate))
+    }
+  }
+}
+
+// loadEvalSuite reads a JSON or, by extension, YAML suite and resolves
+// diff_file references relative to it.
+func loadEvalSuite(path string) (EvalSuite, error) {
+  var suite EvalSuite
+  raw, err := os.ReadFile(path)
+  if err != nil {
+    return suite, err
+  }
+  raw = bytes.TrimPrefix(raw, []byte("\xef\xbb\xbf"))
+  if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+    var doc interface{}
+    if err := yaml.Unmarshal(raw, &doc); err != nil {
+      return suite, fmt.Errorf("suite %s: %v", path, err)
+    }
+    if raw, err = json.Marshal(doc); err != nil {
+      return suite, fmt.Errorf("suite %s: %v", path, err)
+    }
+  }
+  dec := json.NewDecoder(bytes.NewReader(raw))
+  dec.DisallowUnknownFields()
+  if err := dec.Decode(&suite); err != nil {
+    return suite, fmt.Errorf("suite %s: %v", path, err)
+  }
+  if len(suite.Cases) == 0 {
+    return suite, fmt.Errorf("suite %s: no cases", path)
+  }
+  if suite.Name == "" {
+    suite.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+  }
+  seen := map[string]bool{}
+  for i := range suite.Cases {
+    cs := &suite.Cases[i]
+    if cs.ID == "" {
+      cs.ID = "case_" + strconv.Itoa(i+1)
+    }
+    if seen[cs.ID] {
+      return suite, fmt.Errorf("suite %s: duplicate case id %s", path, cs.ID)
+    }
+    seen[cs.ID] = true
+    if cs.Task.Type == "" || cs.Task.Input == "" {
+      return suite, fmt.Errorf("suite %s: case %s needs task type and input", path, cs.ID)
+    }
+    if cs.Expect.DiffFile != "" {
+      ref, err := os.ReadFile(filepath.Join(filepath.Dir(path), cs.Expect.DiffFile))
+      if err != nil {
+        return suite, fmt.Errorf("suite %s: case %s: %v", path, cs.ID, err)
+      }
+      cs.Expect.Diff = string(ref)
+    }
+  }
+  return suite, nil
+}
+
+// evalVariants crosses the chosen policies with the driver sets. Names that
+// are not suite policies are read as routing[/merge].
+func evalVariants(suite EvalSuite, policyNames []string, drivers []string, eachDriver bool) ([]evalVariant, error) {
+  policies := suite.Policies
+  if len(policyNames) > 0 {
+    policies = nil
+    for _, name := range policyNames {
+      var found *EvalPolicy
+      for i := range suite.Policies {
+        if suite.Policies[i].Name == name {
+          found = &suite.Policies[i]
+          break
+        }
+      }
+      if found != nil {
+        policies = append(policies, *found)
+        continue
+      }
+      routing, merge, _ := strings.Cut(name, "/")
+      policies = append(policies, EvalPolicy{Name: name, Routing: routing, Merge: merge})
+    }
+  }
+  if len(policies) == 0 {
+    policies = []EvalPolicy{{Name: "latency", Routing: "latency"}}
+  }
+  if len(drivers) == 0 {
+    drivers = suite.Drivers
+  }
+  sets := [][]string{drivers}
+  if eachDriver {
+    if len(drivers) == 0 {
+      return nil, errors.New("-each-driver needs -drivers or suite drivers")
+    }
+    sets = nil
+    for _, d := range drivers {
+      sets = append(sets, []string{d})
+    }
+  }
+  out := []evalVariant{}
+  seen := map[string]bool{}
+  for _, p := range policies {
+    if p.Name == "" {
+      p.Name = p.Routing
+      if p.Merge != "" {
+        p.Name += "/" + p.Merge
+      }
+    }
+    for _, set := range sets {
+      name := p.Name
+      if eachDriver {
+        name += "@" + set[0]
+      }
+      if seen[name] {
+        return nil, fmt.Errorf("duplicate variant %s", name)
+      }
+      seen[name] = true
+      out = append(out, evalVariant{name: name, policy: p, drivers: set})
+    }
+  }
+  return out, nil
+}
+
+// evalKeys are the constraints a variant or expectation controls; the case's
+// own values for them are dropped.
+var evalKeys = map[string]bool{
+  "routing": true, "models": true, "merge_strategy": true, "force_merge_source": true,
+  "verify": true, "verify_commands": true, "no_cache": true,
+}
+
+// evalTaskSpec is the spec submitted for a case under a variant. The result
+// cache is always skipped so every run reaches the drivers.
+func evalTaskSpec(cs EvalCase, v evalVariant) EvalTask {
+  spec := cs.Task
+  spec.Constraints = []Constraint{}
+  for _, c := range cs.Task.Constraints {
+    if !evalKeys[c.Key] {
+      spec.Constraints = append(spec.Constraints, c)
+    }
+  }
+  if spec.Context == nil {
+    spec.Context = []json.RawMessage{}
+  }
+  if spec.Metadata == nil {
+    spec.Metadata = map[string]interface{}{}
+  }
+  if _, ok := spec.Metadata["requester"]; !ok {
+    spec.Metadata["requester"] = "eval"
+  }
+  add := func(key string, value interface{}) {
+    spec.Constraints = append(spec.Constraints, Constraint{Key: key, Value: value})
+  }
+  add("no_cache", true)
+  if v.policy.Routing != "" {
+    add("routing", v.policy.Routing)
+  }
+  switch v.policy.Merge {
+  case "":
+  case "hunk":
+    add("merge_strategy", "hunk")
+  default:
+    add("force_merge_source", v.policy.Merge)
+  }
+  if len(v.drivers) > 0 {
+    add("models", strings.Join(v.drivers, ","))
+  }
+  if len(cs.Expect.Tests) > 0 {
+    add("verify", true)
+    add("verify_commands", strings.Join(cs.Expect.Tests, ","))
+  }
+  for _, c := range v.policy.Constraints {
+    if !evalKeys[c.Key] {
+      spec.Constraints = append(spec.Constraints, c)
+    }
+  }
+  return spec
+}
+
+// runEval runs every case under every variant, at most parallel at a time.
+func runEval(ctx context.Context, c *evalClient, suite EvalSuite, variants []evalVariant, parallel int, timeout time.Duration) EvalReport {
+  report := EvalReport{
+    Suite:     suite.Name,
+    Server:    c.server,
+    StartedAt: time.Now().UTC().Format(time.RFC3339),
+    Cases:     len(suite.Cases),
+  }
+  if parallel < 1 {
+    parallel = 1
+  }
+  runs := make([]EvalRun, len(suite.Cases)*len(variants))
+  sem := make(chan struct{}, parallel)
+  var wg sync.WaitGroup
+  for i, cs := range suite.Cases {
+    for j, v := range variants {
+      wg.Add(1)
+      sem <- struct{}{}
+      go func(idx int, cs EvalCase, v evalVariant) {
+        defer wg.Done()
+        defer func() { <-sem }()
+        runCtx, cancel := context.WithTimeout(ctx, timeout)
+        defer cancel()
+        runs[idx] = c.runCase(runCtx, cs, v)
+      }(i*len(variants)+j, cs, v)
+    }
+  }
+  wg.Wait()
+  report.Runs = runs
+  report.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+  report.Wins = evalWins(runs, variants)
+  report.Variants = evalSummaries(runs, variants, report.Wins)
+  return report
+}
+
+// evalTrace is the part of the orchestrator task trace the report uses.
+type evalTrace struct {
+  State       string   `json:"state"`
+  Selected    []string `json:"selected_models"`
+  MergeSource string   `json:"merge_source"`
+  Error       string   `json:"error"`
+  Results     []struct {
+    CostUSD float64 `json:"cost_usd"`
+  } `json:"results"`
+  Merge *struct {
+    Diff string `json:"diff"`
+  } `json:"merge"`
+  Verifications []struct {
+    Candidate string `json:"candidate"`
+    Passed    bool   `json:"passed"`
+  } `json:"verifications"`
+  Spans []struct {
+    Name       string  `json:"name"`
+    DurationMs float64 `json:"duration_ms"`
+  } `json:"spans"`
+}
+
+func (c *evalClient) runCase(ctx context.Context, cs EvalCase, v evalVariant) EvalRun {
+  run := EvalRun{Case: cs.ID, Variant: v.name}
+  start := time.Now()
+  var status struct {
+    ID    string `json:"id"`
+    State string `json:"state"`
+  }
+  if err := c.do(ctx, http.MethodPost, "/tasks", evalTaskSpec(cs, v), &status); err != nil {
+    run.Error = "submit: " + err.Error()
+    return run
+  }
+  run.TaskID = status.ID
+  for status.State != "completed" && status.State != "failed" && status.State != "canceled" {
+    select {
+    case <-ctx.Done():
+      cancelCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+      c.do(cancelCtx, http.MethodPost, "/tasks/"+run.TaskID+"/cancel", nil, nil)
+      cancel()
+      run.State = status.State
+      run.Error = "timed out after " + time.Since(start).Round(time.Millisecond).String()
+      run.LatencyMs = time.Since(start).Milliseconds()
+      return run
+    case <-time.After(c.poll):
+    }
+    if err := c.do(ctx, http.MethodGet, "/tasks/"+run.TaskID, nil, &status); err != nil && ctx.Err() == nil {
+      run.Error = "status: " + err.Error()
+      return run
+    }
+  }
+  run.State = status.State
+  run.LatencyMs = time.Since(start).Milliseconds()
+
+  var trace evalTrace
+  if err := c.do(ctx, http.MethodGet, "/tasks/"+run.TaskID+"/trace", nil, &trace); err != nil {
+    run.Error = "trace: " + err.Error()
+    return run
+  }
+  // The task span covers processing only, without queueing and polling.
+  for _, s := range trace.Spans {
+    if s.Name == "task" && s.DurationMs > 0 {
+      run.LatencyMs = int64(s.DurationMs)
+    }
+  }
+  run.Models = trace.Selected
+  run.MergeSource = trace.MergeSource
+  for _, r := range trace.Results {
+    run.CostUSD += r.CostUSD
+  }
+  run.Error = trace.Error
+  diff := ""
+  if trace.Merge != nil {
+    diff = trace.Merge.Diff
+  }
+  verified := len(trace.Verifications) > 0 && trace.Verifications[len(trace.Verifications)-1].Passed
+  run.Checks, run.DiffSimilarity = evalChecks(cs.Expect, run.State, diff, verified)
+  run.Passed = true
+  for _, check := range run.Checks {
+    run.Passed = run.Passed && check.Passed
+  }
+  return run
+}
+
+// evalChecks scores a finished run against the expectations; the task must
+// always complete.
+func evalChecks(expect EvalExpect, state string, diff string, verified bool) ([]EvalCheck, float64) {
+  checks := []EvalCheck{{Name: "completed", Passed: state == "completed", Detail: state}}
+  similarity := 0.0
+  if strings.TrimSpace(expect.Diff) != "" {
+    similarity = diffSimilarity(expect.Diff, diff)
+    min := expect.MinSimilarity
+    if min <= 0 {
+      min = 1
+    }
+    checks = append(checks, EvalCheck{
+      Name:   "reference_diff",
+      Passed: similarity >= min,
+      Detail: fmt.Sprintf("similarity %.2f, need %.2f", similarity, min),
+    })
+  }
+  if len(expect.Tests) > 0 {
+    detail := "tests passed"
+    if !verified {
+      detail = "tests did not pass (or no verification ran)"
+    }
+    checks = append(checks, EvalCheck{Name: "tests", Passed: verified, Detail: detail})
+  }
+  if len(expect.TouchedFiles) > 0 {
+    touched := map[string]bool{}
+    for _, f := range diffFiles(diff) {
+      touched[f] = true
+    }
+    missing := []string{}
+    for _, f := range expect.TouchedFiles {
+      if !touched[strings.TrimPrefix(f, "./")] {
+        missing = append(missing, f)
+      }
+    }
+    check := EvalCheck{Name: "touched_files", Passed: len(missing) == 0}
+    if len(missing) > 0 {
+      check.Detail = "not touched: " + strings.Join(missing, ", ")
+    }
+    checks = append(checks, check)
+  }
+  return checks, similarity
+}
+
+// diffSimilarity is the Jaccard similarity of the added and removed lines of
+// two unified diffs, ignoring trailing whitespace; two empty diffs match.
+func diffSimilarity(a string, b string) float64 {
+  la, lb := changedLines(a), changedLines(b)
+  if len(la) == 0 && len(lb) == 0 {
+    return 1
+  }
+  shared := 0
+  for line := range la {
+    if lb[line] {
+      shared++
+    }
+  }
+  return float64(shared) / float64(len(la)+len(lb)-shared)
+}
+
+func changedLines(diff string) map[string]bool {
+  out := map[string]bool{}
+  for _, line := range strings.Split(diff, "\n") {
+    line = strings.TrimRight(line, " \t\r")
+    if strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---") {
+      continue
+    }
+    if strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") {
+      out[line] = true
+    }
+  }
+  return out
+}
+
+// diffFiles lists the paths a unified diff changes.
+func diffFiles(diff string) []string {
+  out := []string{}
+  seen := map[string]bool{}
+  add := func(path string) {
+    path = strings.TrimPrefix(strings.TrimSpace(path), "b/")
+    if path == "" || path == "/dev/null" || seen[path] {
+      return
+    }
+    seen[path] = true
+    out = append(out, path)
+  }
+  for _, line := range strings.Split(diff, "\n") {
+    if rest, ok := strings.CutPrefix(line, "diff --git "); ok {
+      if i := strings.LastIndex(rest, " b/"); i >= 0 {
+        add(rest[i+1:])
+      }
+    } else if rest, ok := strings.CutPrefix(line, "+++ "); ok {
+      add(rest)
+    }
+  }
+  return out
+}
+
+// evalWins compares the variants case by case: a passing run beats a failing
+// one, and between runs that both pass or both fail the closer reference diff
+// wins. Equal runs are ties.
+func evalWins(runs []EvalRun, variants []evalVariant) map[string]map[string]int {
+  wins := map[string]map[string]int{}
+  for _, a := range variants {
+    wins[a.name] = map[string]int{}
+    for _, b := range variants {
+      if a.name != b.name {
+        wins[a.name][b.name] = 0
+      }
+    }
+  }
+  byCase := map[string][]EvalRun{}
+  for _, r := range runs {
+    byCase[r.Case] = append(byCase[r.Case], r)
+  }
+  for _, caseRuns := range byCase {
+    for _, a := range caseRuns {
+      for _, b := range caseRuns {
+        if a.Variant == b.Variant {
+          continue
+        }
+        if (a.Passed && !b.Passed) || (a.Passed == b.Passed && a.DiffSimilarity > b.DiffSimilarity) {
+          wins[a.Variant][b.Variant]++
+        }
+      }
+    }
+  }
+  return wins
+}
+
+func evalSummaries(runs []EvalRun, variants []evalVariant, wins map[string]map[string]int) []EvalSummary {
+  out := []EvalSummary{}
+  for _, v := range variants {
+    s := EvalSummary{Variant: v.name}
+    latencies := []int64{}
+    for _, r := range runs {
+      if r.Variant != v.name {
+        continue
+      }
+      s.Runs++
+      if r.Passed {
+        s.Passed++
+      }
+      s.CostUSD += r.CostUSD
+      latencies = append(latencies, r.LatencyMs)
+    }
+    if s.Runs > 0 {
+      s.PassRate = float64(s.Passed) / float64(s.Runs)
+      s.MeanCostUSD = s.CostUSD / float64(s.Runs)
+    }
+    s.LatencyP50Ms = percentile(latencies, 50)
+    s.LatencyP90Ms = percentile(latencies, 90)
+    s.LatencyP99Ms = percentile(latencies, 99)
+    for _, n := range wins[v.name] {
+      s.Wins += n
+    }
+    out = append(out, s)
+  }
+  return out
+}
+
+// percentile is the nearest-rank percentile of values.
+func percentile(values []int64, p int) int64 {
+  if len(values) == 0 {
+    return 0
+  }
+  sorted := append([]int64{}, values...)
+  sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+  rank := (p*len(sorted) + 99) / 100
+  if rank < 1 {
+    rank = 1
+  }
+  return sorted[rank-1]
+}
+
+func renderEvalMarkdown(r EvalReport) string {
+  var b strings.Builder
+  fmt.Fprintf(&b, "# Eval: %s\n\n", r.Suite)
+  fmt.Fprintf(&b, "%d case(s) x %d variant(s) against %s, %s to %s.\n\n", r.Cases, len(r.Variants), r.Server, r.StartedAt, r.FinishedAt)
+  b.WriteString("| Variant | Runs | Passed | Pass rate | p50 ms | p90 ms | p99 ms | Cost USD | Mean cost USD | Wins |\n")
+  b.WriteString("|---|---|---|---|---|---|---|---|---|---|\n")
+  for _, s := range r.Variants {
+    fmt.Fprintf(&b, "| %s | %d | %d | %.1f%% | %d | %d | %d | %.4f | %.4f | %d |\n",
+      s.Variant, s.Runs, s.Passed, s.PassRate*100, s.LatencyP50Ms, s.LatencyP90Ms, s.LatencyP99Ms, s.CostUSD, s.MeanCostUSD, s.Wins)
+  }
+
+  b.WriteString("\n## Win matrix\n\nCases where the row variant beat the column variant.\n\n|  |")
+  for _, s := range r.Variants {
+    b.WriteString(" " + s.Variant + " |")
+  }
+  b.WriteString("\n|---|" + strings.Repeat("---|", len(r.Variants)) + "\n")
+  for _, row := range r.Variants {
+    b.WriteString("| " + row.Variant + " |")
+    for _, col := range r.Variants {
+      if row.Variant == col.Variant {
+        b.WriteString(" - |")
+        continue
+      }
+      b.WriteString(" " + strconv.Itoa(r.Wins[row.Variant][col.Variant]) + " |")
+    }
+    b.WriteString("\n")
+  }
+
+  failures := []string{}
+  for _, run := range r.Runs {
+    if run.Passed {
+      continue
+    }
+    reasons := []string{}
+    if run.Error != "" {
+      reasons = append(reasons, run.Error)
+    }
+    for _, c := range run.Checks {
+      if !c.Passed {
+        reasons = append(reasons, c.Name+": "+c.Detail)
+      }
+    }
+    task := ""
+    if run.TaskID != "" {
+      task = " (" + run.TaskID + ")"
+    }
+    failures = append(failures, "- `"+run.Case+"` / `"+run.Variant+"`"+task+": "+strings.Join(reasons, "; "))
+  }
+  if len(failures) > 0 {
+    b.WriteString("\n## Failures\n\n" + strings.Join(failures, "\n") + "\n")
+  }
+  return b.String()
+}
+
+func (c *evalClient) do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+  var body io.Reader
+  if in != nil {
+    data, err := json.Marshal(in)
+    if err != nil {
+      return err
+    }
+    body = bytes.NewReader(data)
+  }
+  req, err := http.NewRequestWithContext(ctx, method, c.server+path, body)
+  if err != nil {
+    return err
+  }
+  if in != nil {
+    req.Header.Set("Content-Type", "application/json")
+  }
+  if c.token != "" {
+    req.Header.Set("Authorization", "Bearer "+c.token)
+  }
+  resp, err := c.client.Do(req)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  data, _ := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+  if resp.StatusCode/100 != 2 {
+    return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+  }
+  if out == nil {
+    return nil
+  }
+  return json.Unmarshal(data, out)
+}
@@ -0,0 +1,152 @@
+﻿package main
+
+import (
+  "context"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+const refDiff = "diff --git a/main.go b/main.go\n--- a/main.go\n+++ b/main.go\n@@ -1 +1,2 @@\n package main\n+import \"log\"\n"
+
+// fakeOrchestrator completes every task at once; routing=quality produces the
+// reference diff and anything else a diff touching another file.
+func fakeOrchestrator(t *testing.T) (*httptest.Server, *[]EvalTask) {
+  t.Helper()
+  var mu sync.Mutex
+  specs := []EvalTask{}
+  srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    mu.Lock()
+    defer mu.Unlock()
+    switch {
+    case r.Method == http.MethodPost && r.URL.Path == "/tasks":
+      var spec EvalTask
+      if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+        http.Error(w, "invalid json", 400)
+        return
+      }
+      specs = append(specs, spec)
+      json.NewEncoder(w).Encode(map[string]string{"id": "task_" + strconv.Itoa(len(specs)-1), "state": "queued"})
+    case strings.HasSuffix(r.URL.Path, "/trace"):
+      n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/tasks/task_"), "/trace"))
+      spec := specs[n]
+      diff := "diff --git a/other.go b/other.go\n+++ b/other.go\n+// todo\n"
+      verify := false
+      for _, c := range spec.Constraints {
+        if c.Key == "routing" && c.Value == "quality" {
+          diff = refDiff
+        }
+        if c.Key == "verify" && c.Value == true {
+          verify = true
+        }
+      }
+      trace := map[string]interface{}{
+        "state":           "completed",
+        "selected_models": []string{"model_a"},
+        "merge_source":    "policy_merge",
+        "results":         []map[string]interface{}{{"model_id": "model_a", "cost_usd": 0.01}},
+        "merge":           map[string]string{"diff": diff},
+        "spans":           []map[string]interface{}{{"name": "task", "duration_ms": 100 * (n + 1)}},
+      }
+      if verify {
+        trace["verifications"] = []map[string]interface{}{{"candidate": "policy_merge", "passed": diff == refDiff}}
+      }
+      json.NewEncoder(w).Encode(trace)
+    case strings.HasPrefix(r.URL.Path, "/tasks/"):
+      json.NewEncoder(w).Encode(map[string]string{"id": strings.TrimPrefix(r.URL.Path, "/tasks/"), "state": "completed"})
+    default:
+      http.NotFound(w, r)
+    }
+  }))
+  t.Cleanup(srv.Close)
+  return srv, &specs
+}
+
+func TestRunEval_ComparesPolicies(t *testing.T) {
+  dir := t.TempDir()
+  os.WriteFile(filepath.Join(dir, "ref.diff"), []byte(refDiff), 0644)
+  suitePath := filepath.Join(dir, "suite.yaml")
+  os.WriteFile(suitePath, []byte(`cases:
+  - id: add-import
+    task: {type: patch, input: "import log", constraints: [{key: routing, value: cost}]}
+    expect: {diff_file: ref.diff, touched_files: [main.go]}
+  - id: tested
+    task: {type: patch, input: "import log"}
+    expect: {tests: ["go test ./..."]}
+`), 0644)
+  suite, err := loadEvalSuite(suitePath)
+  if err != nil {
+    t.Fatalf("load suite: %v", err)
+  }
+  if suite.Name != "suite" || suite.Cases[0].Expect.Diff != refDiff {
+    t.Fatalf("unexpected suite %+v", suite)
+  }
+  variants, err := evalVariants(suite, []string{"latency", "quality/hunk"}, []string{"model_a"}, false)
+  if err != nil {
+    t.Fatalf("variants: %v", err)
+  }
+
+  srv, specs := fakeOrchestrator(t)
+  c := &evalClient{server: srv.URL, poll: time.Millisecond, client: srv.Client()}
+  report := runEval(context.Background(), c, suite, variants, 2, 5*time.Second)
+
+  if len(report.Runs) != 4 || len(*specs) != 4 {
+    t.Fatalf("expected 4 runs, got %+v", report.Runs)
+  }
+  latency, quality := report.Variants[0], report.Variants[1]
+  if latency.Variant != "latency" || latency.Passed != 0 || quality.Variant != "quality/hunk" || quality.Passed != 2 || quality.PassRate != 1 {
+    t.Fatalf("unexpected summaries %+v", report.Variants)
+  }
+  if quality.CostUSD != 0.02 || quality.LatencyP50Ms == 0 || quality.LatencyP99Ms < quality.LatencyP50Ms {
+    t.Fatalf("unexpected cost or latency %+v", quality)
+  }
+  if report.Wins["quality/hunk"]["latency"] != 2 || report.Wins["latency"]["quality/hunk"] != 0 {
+    t.Fatalf("unexpected win matrix %+v", report.Wins)
+  }
+
+  keys := map[string]interface{}{}
+  for _, spec := range *specs {
+    for _, c := range spec.Constraints {
+      keys[c.Key] = c.Value
+    }
+  }
+  if keys["no_cache"] != true || keys["models"] != "model_a" || keys["merge_strategy"] != "hunk" || keys["verify_commands"] != "go test ./..." {
+    t.Fatalf("unexpected submitted constraints %+v", keys)
+  }
+  for _, spec := range *specs {
+    for _, c := range spec.Constraints {
+      if c.Key == "routing" && c.Value == "cost" {
+        t.Fatalf("expected the variant routing to replace the case's, got %+v", spec.Constraints)
+      }
+    }
+  }
+
+  md := renderEvalMarkdown(report)
+  if !strings.Contains(md, "| quality/hunk | 2 | 2 | 100.0% |") || !strings.Contains(md, "| quality/hunk | 2 | - |") || !strings.Contains(md, "touched_files: not touched: main.go") {
+    t.Fatalf("unexpected markdown:\n%s", md)
+  }
+}
+
+func TestDiffHelpers(t *testing.T) {
+  if got := diffSimilarity(refDiff, refDiff+"+extra\n"); got != 0.5 {
+    t.Fatalf("expected 0.5 similarity, got %v", got)
+  }
+  if got := diffSimilarity("", ""); got != 1 {
+    t.Fatalf("expected empty diffs to match, got %v", got)
+  }
+  files := diffFiles(refDiff + "diff --git a/old.go b/old.go\n--- a/old.go\n+++ /dev/null\n")
+  if len(files) != 2 || files[0] != "main.go" || files[1] != "old.go" {
+    t.Fatalf("unexpected files %v", files)
+  }
+  values := []int64{50, 10, 40, 20, 30}
+  if percentile(values, 50) != 30 || percentile(values, 90) != 50 || percentile(values, 1) != 10 || percentile(nil, 50) != 0 {
+    t.Fatalf("unexpected percentiles")
+  }
+}
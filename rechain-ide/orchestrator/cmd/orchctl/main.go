@@ -7,6 +7,7 @@ import (
   "fmt"
   "io"
   "net/http"
+  "os"
 )
 
 type IndexRequest struct {
@@ -16,6 +17,11 @@ type IndexRequest struct {
 }
 
 func main() {
+  if len(os.Args) > 1 && os.Args[1] == "eval" {
+    runEvalCommand(os.Args[2:])
+    return
+  }
+
   ragURL := flag.String("rag", "http://localhost:8083", "rag base URL")
   repo := flag.String("repo", "", "repo name")
   files := flag.String("files", "", "comma-separated file paths")
@@ -62,3 +68,8 @@ func splitFiles(s string) []string {
   }
   return out
 }
+
+func fatal(msg string) {
+  fmt.Fprintln(os.Stderr, msg)
+  os.Exit(1)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	contentTypeDiff = "text/x-diff; charset=utf-8"
+	contentTypeText = "text/plain; charset=utf-8"
+)
+
+// ArtifactStore keeps artifact bodies content-addressed by SHA-256 under a
+// root directory, so identical candidate diffs are stored once.
+type ArtifactStore struct {
+	root string
+}
+
+func NewArtifactStore(root string) (*ArtifactStore, error) {
+	if strings.TrimSpace(root) == "" {
+		return nil, errors.New("empty artifact dir")
+	}
+	if err := os.MkdirAll(filepath.Join(root, "sha256"), 0755); err != nil {
+		return nil, err
+	}
+	return &ArtifactStore{root: root}, nil
+}
+
+func (s *ArtifactStore) blobPath(sum string) string {
+	return filepath.Join(s.root, "sha256", sum[:2], sum)
+}
+
+// Put stores data and returns its hex SHA-256. Existing blobs are not
+// rewritten.
+func (s *ArtifactStore) Put(data []byte) (string, error) {
+	sum := sha256Hex(data)
+	path := s.blobPath(sum)
+	if _, err := os.Stat(path); err == nil {
+		return sum, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+sum[:8]+"-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return sum, nil
+}
+
+// Get returns the blob for sum after checking that its content still hashes
+// to sum.
+func (s *ArtifactStore) Get(sum string) ([]byte, error) {
+	if len(sum) != sha256.Size*2 {
+		return nil, errors.New("invalid artifact digest")
+	}
+	data, err := os.ReadFile(s.blobPath(sum))
+	if err != nil {
+		return nil, err
+	}
+	if sha256Hex(data) != sum {
+		return nil, errors.New("artifact " + sum + " failed integrity check")
+	}
+	return data, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// buildTaskArtifacts writes the merged diff, every candidate diff and every
+// raw model output of a task and returns their metadata. Bodies that cannot
+// be written are logged and left out.
+func buildTaskArtifacts(blobs *ArtifactStore, taskID string, merge MergeResult, results []ModelResult) []Artifact {
+	now := time.Now().UTC().Format(time.RFC3339)
+	out := []Artifact{}
+	add := func(kind string, name string, modelID string, contentType string, body string) {
+		data := []byte(body)
+		sum := sha256Hex(data)
+		if blobs != nil {
+			var err error
+			if sum, err = blobs.Put(data); err != nil {
+				log.Printf("artifacts: task %s: store %s failed: %v", taskID, name, err)
+				return
+			}
+		}
+		out = append(out, Artifact{
+			SchemaVersion: schemaVersion,
+			ID:            "artifact_" + randString(8),
+			Type:          kind,
+			Path:          "artifacts/" + taskID + "/" + name,
+			Sha256:        sum,
+			CreatedAt:     now,
+			ContentType:   contentType,
+			Size:          int64(len(data)),
+			ModelID:       modelID,
+		})
+	}
+
+	add("diff", "patch.diff", "", contentTypeDiff, merge.Diff)
+	for i, r := range results {
+		name := artifactName(r.ModelID, i)
+		add("candidate_diff", "candidates/"+name+".diff", r.ModelID, contentTypeDiff, r.Diff)
+		if r.Output != "" {
+			add("raw_output", "outputs/"+name+".txt", r.ModelID, contentTypeText, r.Output)
+		}
+	}
+	return out
+}
+
+func artifactName(modelID string, index int) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, modelID)
+	if name == "" {
+		name = "model"
+	}
+	return strconv.Itoa(index) + "_" + name
+}
+
+// serveArtifact writes an artifact body with its content type and integrity
+// headers (ETag, Digest and Repr-Digest carry the SHA-256).
+func serveArtifact(w http.ResponseWriter, r *http.Request, store *TaskStore, taskID string, artifactID string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	store.mu.Lock()
+	var found *Artifact
+	for _, a := range store.artifacts[taskID] {
+		if a.ID == artifactID {
+			a := a
+			found = &a
+			break
+		}
+	}
+	blobs := store.blobs
+	store.mu.Unlock()
+	if found == nil || blobs == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := blobs.Get(found.Sha256)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "artifact body missing", http.StatusGone)
+		return
+	}
+	if err != nil {
+		log.Printf("artifacts: task %s artifact %s: %v", taskID, artifactID, err)
+		http.Error(w, "artifact integrity check failed", http.StatusInternalServerError)
+		return
+	}
+
+	raw, _ := hex.DecodeString(found.Sha256)
+	b64 := base64.StdEncoding.EncodeToString(raw)
+	contentType := found.ContentType
+	if contentType == "" {
+		contentType = contentTypeDiff
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+found.Sha256+`"`)
+	w.Header().Set("Digest", "sha-256="+b64)
+	w.Header().Set("Repr-Digest", "sha-256=:"+b64+":")
+	w.Header().Set("X-Content-Sha256", found.Sha256)
+	w.Header().Set("Content-Disposition", `inline; filename="`+filepath.Base(found.Path)+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	modTime, _ := time.Parse(time.RFC3339, found.CreatedAt)
+	http.ServeContent(w, r, filepath.Base(found.Path), modTime, bytes.NewReader(data))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestArtifactStore_ContentAddressed(t *testing.T) {
+	blobs, err := NewArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	first, err := blobs.Put([]byte("diff --git a/x b/x\n"))
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	second, _ := blobs.Put([]byte("diff --git a/x b/x\n"))
+	if first != second || first != sha256Hex([]byte("diff --git a/x b/x\n")) {
+		t.Fatalf("expected identical content to share a digest, got %s and %s", first, second)
+	}
+
+	os.WriteFile(blobs.blobPath(first), []byte("tampered"), 0644)
+	if _, err := blobs.Get(first); err == nil {
+		t.Fatal("expected tampered blob to fail the integrity check")
+	}
+}
+
+func TestServeArtifact(t *testing.T) {
+	blobs, _ := NewArtifactStore(t.TempDir())
+	store := NewTaskStore()
+	store.blobs = blobs
+	merge := MergeResult{Diff: "diff --git a/a b/a\n+merged\n"}
+	results := []ModelResult{
+		{ModelID: "model_a", Diff: "diff --git a/a b/a\n+a\n", Output: "raw a"},
+		{ModelID: "hf/gigachat", Diff: "diff --git a/a b/a\n+b\n"},
+	}
+	artifacts := buildTaskArtifacts(blobs, "task_art", merge, results)
+	if len(artifacts) != 4 {
+		t.Fatalf("expected merged, 2 candidate and 1 raw artifact, got %+v", artifacts)
+	}
+	if artifacts[3].Path != "artifacts/task_art/candidates/1_hf_gigachat.diff" || artifacts[3].ModelID != "hf/gigachat" {
+		t.Fatalf("unexpected candidate artifact: %+v", artifacts[3])
+	}
+	store.artifacts["task_art"] = artifacts
+
+	cases := []struct {
+		name       string
+		artifactID string
+		wantStatus int
+		wantType   string
+		wantBody   string
+	}{
+		{name: "merged diff", artifactID: artifacts[0].ID, wantStatus: http.StatusOK, wantType: contentTypeDiff, wantBody: merge.Diff},
+		{name: "raw output", artifactID: artifacts[2].ID, wantStatus: http.StatusOK, wantType: contentTypeText, wantBody: "raw a"},
+		{name: "unknown", artifactID: "artifact_missing", wantStatus: http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			serveArtifact(rec, httptest.NewRequest(http.MethodGet, "/tasks/task_art/artifacts/"+tc.artifactID, nil), store, "task_art", tc.artifactID)
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("expected %d, got %d", tc.wantStatus, rec.Code)
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			if rec.Header().Get("Content-Type") != tc.wantType || rec.Body.String() != tc.wantBody {
+				t.Fatalf("unexpected response %q %q", rec.Header().Get("Content-Type"), rec.Body.String())
+			}
+			sum := sha256Hex([]byte(tc.wantBody))
+			if rec.Header().Get("ETag") != `"`+sum+`"` || rec.Header().Get("X-Content-Sha256") != sum || rec.Header().Get("Digest") == "" {
+				t.Fatalf("missing integrity headers: %v", rec.Header())
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"rechain-ide/shared/auth"
+)
+
+// requiredRole is the orchestrator's access policy: reads need viewer,
+// writes need submitter (ownership of the task is checked by the handler),
+// replays and driver administration need admin. /health stays open for
+// probes.
+func requiredRole(r *http.Request) auth.Role {
+	path := r.URL.Path
+	switch {
+	case path == "/health":
+		return auth.RoleNone
+	case strings.HasPrefix(path, "/admin/"):
+		return auth.RoleAdmin
+	case strings.HasPrefix(path, "/tasks/") && (strings.HasSuffix(path, "/replay") || strings.HasSuffix(path, "/replay/batch")):
+		return auth.RoleAdmin
+	case strings.HasPrefix(path, "/tasks/") && strings.HasSuffix(strings.TrimSuffix(path, "/"), "/debug"):
+		return auth.RoleSubmitter
+	case r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions:
+		return auth.RoleViewer
+	}
+	return auth.RoleSubmitter
+}
+
+// authenticatedRequester returns the principal name when the request was
+// authenticated.
+func authenticatedRequester(r *http.Request) (string, bool) {
+	p, ok := auth.FromContext(r.Context())
+	if !ok {
+		return "", false
+	}
+	return p.Name, true
+}
+
+// canActOn reports whether the caller may cancel, debug or rate a task:
+// admins may act on any task, other principals only on tasks they submitted.
+// Without authentication every caller may.
+func canActOn(r *http.Request, store *TaskStore, id string) bool {
+	p, ok := auth.FromContext(r.Context())
+	if !ok || p.Can(auth.RoleAdmin) {
+		return true
+	}
+	store.mu.Lock()
+	spec, found := store.specs[id]
+	store.mu.Unlock()
+	if !found {
+		return true
+	}
+	return requesterKey(spec) == p.Name
+}
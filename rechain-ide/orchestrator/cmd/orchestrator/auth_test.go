@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rechain-ide/shared/auth"
+)
+
+func TestRequiredRole(t *testing.T) {
+	cases := []struct {
+		method string
+		path   string
+		want   auth.Role
+	}{
+		{http.MethodGet, "/health", auth.RoleNone},
+		{http.MethodGet, "/metrics", auth.RoleViewer},
+		{http.MethodGet, "/tasks/task_1/trace", auth.RoleViewer},
+		{http.MethodGet, "/tasks/task_1/debug", auth.RoleSubmitter},
+		{http.MethodPost, "/tasks", auth.RoleSubmitter},
+		{http.MethodPost, "/tasks/task_1/cancel", auth.RoleSubmitter},
+		{http.MethodPost, "/tasks/task_1/replay", auth.RoleAdmin},
+		{http.MethodPost, "/tasks/task_1/replay/batch", auth.RoleAdmin},
+		{http.MethodGet, "/tasks/task_1/replay-chain", auth.RoleViewer},
+		{http.MethodPost, "/admin/drivers/reload", auth.RoleAdmin},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if got := requiredRole(r); got != tc.want {
+			t.Errorf("%s %s: got %s, want %s", tc.method, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestAuthMiddleware_RolesAndOwnership(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	os.WriteFile(path, []byte(`{"tokens":[
+		{"token":"view-tok","principal":"dash","role":"viewer"},
+		{"token":"alice-tok","principal":"alice","role":"submitter"},
+		{"token":"bob-tok","principal":"bob","role":"submitter"},
+		{"token":"root-tok","principal":"ops","role":"admin"}]}`), 0600)
+	tokens, err := auth.LoadTokens(path)
+	if err != nil {
+		t.Fatalf("load tokens: %v", err)
+	}
+
+	store := NewTaskStore()
+	setTaskState(store, "task_alice", "running")
+	store.specs["task_alice"] = TaskSpec{ID: "task_alice", Metadata: Metadata{Requester: "alice"}}
+	handler := auth.WithAuth(tokens, requiredRole, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/tasks/"), "/cancel")
+		if r.Method == http.MethodPost && !canActOn(r, store, id) {
+			http.Error(w, "forbidden: not your task", http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"health is open", http.MethodGet, "/health", "", 200},
+		{"health ignores a bad token", http.MethodGet, "/health", "nope", 200},
+		{"missing token", http.MethodGet, "/tasks/task_alice", "", 401},
+		{"unknown token", http.MethodGet, "/tasks/task_alice", "nope", 401},
+		{"viewer reads", http.MethodGet, "/tasks/task_alice", "view-tok", 200},
+		{"viewer cannot cancel", http.MethodPost, "/tasks/task_alice/cancel", "view-tok", 403},
+		{"owner cancels", http.MethodPost, "/tasks/task_alice/cancel", "alice-tok", 200},
+		{"other submitter cannot cancel", http.MethodPost, "/tasks/task_alice/cancel", "bob-tok", 403},
+		{"admin cancels any task", http.MethodPost, "/tasks/task_alice/cancel", "root-tok", 200},
+		{"owner cannot replay", http.MethodPost, "/tasks/task_alice/replay", "alice-tok", 403},
+		{"admin replays any task", http.MethodPost, "/tasks/task_alice/replay", "root-tok", 200},
+		{"submitter cannot reload drivers", http.MethodPost, "/admin/drivers/reload", "alice-tok", 403},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestLoadTokens_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"unknown role":  `{"tokens":[{"token":"t","principal":"a","role":"root"}]}`,
+		"no principal":  `{"tokens":[{"token":"t","role":"viewer"}]}`,
+		"no token":      `{"tokens":[{"principal":"a","role":"viewer"}]}`,
+		"duplicate":     `{"tokens":[{"token":"t","principal":"a","role":"viewer"},{"token":"t","principal":"b","role":"admin"}]}`,
+		"unknown field": `{"tokens":[{"token":"t","principal":"a","role":"viewer","scope":"x"}]}`,
+	}
+	for name, body := range cases {
+		path := filepath.Join(t.TempDir(), "tokens.json")
+		os.WriteFile(path, []byte(body), 0600)
+		if _, err := auth.LoadTokens(path); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"rechain-ide/shared/auth"
+)
+
+// Routing decisions recorded per selected driver.
+const (
+	decisionExplore = "explore"
+	decisionExploit = "exploit"
+	decisionStatic  = "static"
+)
+
+// Reward sources.
+const (
+	rewardMerge    = "merge"
+	rewardVerify   = "verify"
+	rewardFeedback = "feedback"
+)
+
+// BanditArm is the Beta posterior of one driver in one context. Rewards in
+// [0, 1] add r to Alpha and 1-r to Beta, starting from Beta(1, 1).
+type BanditArm struct {
+	Alpha     float64        `json:"alpha"`
+	Beta      float64        `json:"beta"`
+	Rewards   int            `json:"rewards"`
+	Explore   int            `json:"explore"`
+	Exploit   int            `json:"exploit"`
+	BySource  map[string]int `json:"by_source,omitempty"`
+	UpdatedAt string         `json:"updated_at,omitempty"`
+}
+
+func (a BanditArm) mean() float64 {
+	return a.Alpha / (a.Alpha + a.Beta)
+}
+
+// TraceBandit records the bandit context of a task, the decision for each
+// selected driver and which drivers produced the final result.
+type TraceBandit struct {
+	Context   string            `json:"context"`
+	Decisions map[string]string `json:"decisions,omitempty"`
+	Winners   []string          `json:"winners,omitempty"`
+}
+
+// BanditRouter learns which drivers win per task type and requester with
+// Thompson sampling over Beta-Bernoulli arms. Rewards are recorded for every
+// task, whatever its routing policy; only routing=bandit uses them to select
+// drivers. When a path is set, updates are saved to it at most once per
+// saveDelay, and on Close.
+type BanditRouter struct {
+	arms      int
+	path      string
+	saveDelay time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	rng      *rand.Rand
+	contexts map[string]map[string]*BanditArm
+	dirty    bool
+	timer    *time.Timer
+
+	// saveMu serializes Flush, so snapshots reach the file in the order
+	// they were taken.
+	saveMu sync.Mutex
+}
+
+// banditSaveDelay is how long updates are batched before the state is saved.
+const banditSaveDelay = time.Second
+
+// banditGlobal ranks drivers for routing=bandit and receives task rewards.
+var banditGlobal *BanditRouter
+
+func NewBanditRouter(arms int, seed int64) *BanditRouter {
+	if arms <= 0 {
+		arms = 1
+	}
+	return &BanditRouter{
+		arms:     arms,
+		now:      time.Now,
+		rng:      rand.New(rand.NewSource(seed)),
+		contexts: map[string]map[string]*BanditArm{},
+	}
+}
+
+// OpenBanditRouter loads the state saved at path, if any, and saves to it
+// from then on; Close saves what is still pending.
+func OpenBanditRouter(path string, arms int) (*BanditRouter, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, errors.New("empty bandit state path")
+	}
+	b := NewBanditRouter(arms, time.Now().UnixNano())
+	b.path = path
+	b.saveDelay = banditSaveDelay
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state struct {
+		Contexts map[string]map[string]*BanditArm `json:"contexts"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.New("bandit state " + path + ": " + err.Error())
+	}
+	for ctx, arms := range state.Contexts {
+		for model, arm := range arms {
+			if arm == nil || arm.Alpha <= 0 || arm.Beta <= 0 {
+				continue
+			}
+			if b.contexts[ctx] == nil {
+				b.contexts[ctx] = map[string]*BanditArm{}
+			}
+			b.contexts[ctx][model] = arm
+		}
+	}
+	return b, nil
+}
+
+// banditRouting reports whether spec asks for routing=bandit.
+func banditRouting(spec TaskSpec) bool {
+	return strings.EqualFold(constraintString(spec.Constraints, "routing"), "bandit")
+}
+
+func banditContext(spec TaskSpec) string {
+	taskType := strings.ToLower(strings.TrimSpace(spec.Type))
+	if taskType == "" {
+		taskType = "default"
+	}
+	return taskType + "|" + requesterKey(spec)
+}
+
+func (b *BanditRouter) armLocked(ctx string, model string) *BanditArm {
+	if b.contexts[ctx] == nil {
+		b.contexts[ctx] = map[string]*BanditArm{}
+	}
+	arm, ok := b.contexts[ctx][model]
+	if !ok {
+		arm = &BanditArm{Alpha: 1, Beta: 1}
+		b.contexts[ctx][model] = arm
+	}
+	return arm
+}
+
+// Rank orders drivers by a posterior sample of each arm, best first.
+func (b *BanditRouter) Rank(spec TaskSpec, drivers []Driver) []Driver {
+	ctx := banditContext(spec)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	samples := map[string]float64{}
+	for _, d := range drivers {
+		arm := b.armLocked(ctx, d.ID())
+		samples[d.ID()] = sampleBeta(b.rng, arm.Alpha, arm.Beta)
+	}
+	out := append([]Driver{}, drivers...)
+	sort.SliceStable(out, func(i, j int) bool { return samples[out[i].ID()] > samples[out[j].ID()] })
+	return out
+}
+
+// Decide labels each selected driver: exploit when it is among the best
+// len(selected) candidates by posterior mean, explore otherwise. The counts
+// are kept per arm.
+func (b *BanditRouter) Decide(spec TaskSpec, candidates []Driver, selected []Driver) map[string]string {
+	ctx := banditContext(spec)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	byMean := append([]Driver{}, candidates...)
+	sort.SliceStable(byMean, func(i, j int) bool {
+		return b.armLocked(ctx, byMean[i].ID()).mean() > b.armLocked(ctx, byMean[j].ID()).mean()
+	})
+	best := map[string]bool{}
+	for i := 0; i < len(selected) && i < len(byMean); i++ {
+		best[byMean[i].ID()] = true
+	}
+	out := map[string]string{}
+	for _, d := range selected {
+		arm := b.armLocked(ctx, d.ID())
+		if best[d.ID()] {
+			out[d.ID()] = decisionExploit
+			arm.Exploit++
+		} else {
+			out[d.ID()] = decisionExplore
+			arm.Explore++
+		}
+	}
+	return out
+}
+
+// Observe records a reward in [0, 1] per driver for the task's context.
+func (b *BanditRouter) Observe(spec TaskSpec, rewards map[string]float64, source string) {
+	b.ObserveContext(banditContext(spec), rewards, source)
+}
+
+func (b *BanditRouter) ObserveContext(ctx string, rewards map[string]float64, source string) {
+	if b == nil || len(rewards) == 0 {
+		return
+	}
+	b.mu.Lock()
+	now := b.now().UTC().Format(time.RFC3339)
+	for model, r := range rewards {
+		r = math.Max(0, math.Min(1, r))
+		arm := b.armLocked(ctx, model)
+		arm.Alpha += r
+		arm.Beta += 1 - r
+		arm.Rewards++
+		if arm.BySource == nil {
+			arm.BySource = map[string]int{}
+		}
+		arm.BySource[source]++
+		arm.UpdatedAt = now
+	}
+	b.dirty = true
+	if b.path != "" && b.timer == nil {
+		b.timer = time.AfterFunc(b.saveDelay, b.Flush)
+	}
+	b.mu.Unlock()
+}
+
+// Flush saves the state now if it changed since the last save.
+func (b *BanditRouter) Flush() {
+	if b == nil || b.path == "" {
+		return
+	}
+	b.saveMu.Lock()
+	defer b.saveMu.Unlock()
+	b.mu.Lock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if !b.dirty {
+		b.mu.Unlock()
+		return
+	}
+	b.dirty = false
+	data, _ := json.Marshal(map[string]interface{}{"algorithm": "thompson", "contexts": b.contexts})
+	b.mu.Unlock()
+	if err := b.save(data); err != nil {
+		log.Printf("bandit: save state failed: %v", err)
+		b.mu.Lock()
+		b.dirty = true
+		b.mu.Unlock()
+	}
+}
+
+// Close saves any pending state.
+func (b *BanditRouter) Close() error {
+	b.Flush()
+	return nil
+}
+
+func (b *BanditRouter) save(data []byte) error {
+	if b.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path), 0755); err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// BanditArmStats is one arm as shown at /routing/bandit.
+type BanditArmStats struct {
+	Model string  `json:"model"`
+	Mean  float64 `json:"mean"`
+	BanditArm
+}
+
+// BanditContextStats lists the arms of one type and requester by mean.
+type BanditContextStats struct {
+	Context   string           `json:"context"`
+	Type      string           `json:"type"`
+	Requester string           `json:"requester"`
+	Arms      []BanditArmStats `json:"arms"`
+}
+
+// Stats returns the contexts matching taskType and requester (empty matches
+// all), sorted by context.
+func (b *BanditRouter) Stats(taskType string, requester string) []BanditContextStats {
+	out := []BanditContextStats{}
+	if b == nil {
+		return out
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ctx, arms := range b.contexts {
+		t, who, _ := strings.Cut(ctx, "|")
+		if (taskType != "" && t != taskType) || (requester != "" && who != requester) {
+			continue
+		}
+		cs := BanditContextStats{Context: ctx, Type: t, Requester: who}
+		for model, arm := range arms {
+			a := *arm
+			a.BySource = map[string]int{}
+			for k, v := range arm.BySource {
+				a.BySource[k] = v
+			}
+			cs.Arms = append(cs.Arms, BanditArmStats{Model: model, Mean: math.Round(arm.mean()*1e4) / 1e4, BanditArm: a})
+		}
+		sort.Slice(cs.Arms, func(i, j int) bool {
+			if cs.Arms[i].Mean == cs.Arms[j].Mean {
+				return cs.Arms[i].Model < cs.Arms[j].Model
+			}
+			return cs.Arms[i].Mean > cs.Arms[j].Mean
+		})
+		out = append(out, cs)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Context < out[j].Context })
+	return out
+}
+
+// mergeRewards scores the drivers of a merge: 1 for drivers whose diff is the
+// merged diff or contributed hunks to it, 0 for the other drivers with results
+// and for the selected drivers without one. It also returns the winners.
+func mergeRewards(merge MergeResult, results []ModelResult, selected []string) (map[string]float64, []string) {
+	contributed := map[string]bool{}
+	if merge.HunkMerge != nil {
+		for _, src := range merge.HunkMerge.Sources {
+			contributed[src.Candidate] = true
+		}
+	}
+	rewards := map[string]float64{}
+	winners := []string{}
+	for _, r := range results {
+		if strings.TrimSpace(r.Diff) == strings.TrimSpace(merge.Diff) || contributed[r.ModelID] {
+			rewards[r.ModelID] = 1
+			winners = append(winners, r.ModelID)
+		} else if _, ok := rewards[r.ModelID]; !ok {
+			rewards[r.ModelID] = 0
+		}
+	}
+	for _, id := range selected {
+		if _, ok := rewards[id]; !ok {
+			rewards[id] = 0
+		}
+	}
+	return rewards, winners
+}
+
+// verifyRewards scores the drivers behind each verified candidate by whether
+// it passed; the first candidate is the pre-verification merge.
+func verifyRewards(runs []TraceVerification, merged MergeResult, results []ModelResult) map[string]float64 {
+	rewards := map[string]float64{}
+	for i, run := range runs {
+		score := 0.0
+		if run.Passed {
+			score = 1
+		}
+		if model, ok := strings.CutPrefix(run.Candidate, "model:"); ok {
+			rewards[model] = score
+			continue
+		}
+		if i == 0 {
+			for _, r := range results {
+				if strings.TrimSpace(r.Diff) == strings.TrimSpace(merged.Diff) {
+					rewards[r.ModelID] = score
+				}
+			}
+		}
+	}
+	return rewards
+}
+
+// sampleBeta draws from Beta(a, b) as X/(X+Y) with X ~ Gamma(a), Y ~ Gamma(b).
+func sampleBeta(rng *rand.Rand, a float64, b float64) float64 {
+	x := sampleGamma(rng, a)
+	y := sampleGamma(rng, b)
+	if x+y == 0 {
+		return 0.5
+	}
+	return x / (x + y)
+}
+
+// sampleGamma uses Marsaglia and Tsang's method, boosting shapes below one.
+func sampleGamma(rng *rand.Rand, shape float64) float64 {
+	if shape < 1 {
+		return sampleGamma(rng, shape+1) * math.Pow(rng.Float64(), 1/shape)
+	}
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rng.Float64()
+		if u < 1-0.0331*x*x*x*x || math.Log(u) < 0.5*x*x+d*(1-v+math.Log(v)) {
+			return d * v
+		}
+	}
+}
+
+// serveBandit answers GET /routing/bandit with the arm statistics, filtered
+// by type and requester. Principals that are not admins only see their own
+// contexts.
+func serveBandit(w http.ResponseWriter, r *http.Request, bandit *BanditRouter) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	q := r.URL.Query()
+	requester := strings.TrimSpace(q.Get("requester"))
+	if p, ok := auth.FromContext(r.Context()); ok && !p.Can(auth.RoleAdmin) {
+		requester = p.Name
+	}
+	arms := 0
+	if bandit != nil {
+		arms = bandit.arms
+	}
+	writeJSON(w, map[string]interface{}{
+		"algorithm":    "thompson",
+		"default_arms": arms,
+		"contexts":     bandit.Stats(strings.ToLower(strings.TrimSpace(q.Get("type"))), requester),
+	})
+}
+
+// TaskFeedback is a user's rating of a completed task.
+type TaskFeedback struct {
+	Score   float64 `json:"score"`
+	Comment string  `json:"comment,omitempty"`
+	By      string  `json:"by,omitempty"`
+	At      string  `json:"at"`
+}
+
+// serveTaskFeedback answers POST /tasks/{id}/feedback with {"rating":
+// "up"|"down"} or {"score": 0..1}. The score rewards the drivers that
+// produced the task's result; each task takes one rating.
+func serveTaskFeedback(w http.ResponseWriter, r *http.Request, store *TaskStore, bandit *BanditRouter, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	if !canActOn(r, store, id) {
+		http.Error(w, "forbidden: not your task", http.StatusForbidden)
+		return
+	}
+	var body struct {
+		Rating  string   `json:"rating"`
+		Score   *float64 `json:"score"`
+		Comment string   `json:"comment"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil {
+		http.Error(w, "invalid json", 400)
+		return
+	}
+	var score float64
+	switch {
+	case body.Score != nil && *body.Score >= 0 && *body.Score <= 1:
+		score = *body.Score
+	case body.Score != nil:
+		http.Error(w, "score must be between 0 and 1", 400)
+		return
+	case strings.EqualFold(body.Rating, "up"):
+		score = 1
+	case strings.EqualFold(body.Rating, "down"):
+		score = 0
+	default:
+		http.Error(w, "rating must be up or down, or set a score", 400)
+		return
+	}
+
+	store.mu.Lock()
+	trace, ok := store.traces[id]
+	if !ok {
+		store.mu.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	if trace.State != "completed" || trace.Bandit == nil || len(trace.Bandit.Winners) == 0 {
+		store.mu.Unlock()
+		http.Error(w, "feedback needs a task completed by its drivers", http.StatusConflict)
+		return
+	}
+	if trace.Feedback != nil {
+		store.mu.Unlock()
+		http.Error(w, "feedback already recorded", http.StatusConflict)
+		return
+	}
+	fb := TaskFeedback{Score: score, Comment: body.Comment, At: time.Now().UTC().Format(time.RFC3339)}
+	if name, ok := authenticatedRequester(r); ok {
+		fb.By = name
+	}
+	trace.Feedback = &fb
+	store.traces[id] = trace
+	store.saveLocked(id)
+	store.mu.Unlock()
+
+	rewards := map[string]float64{}
+	for _, model := range trace.Bandit.Winners {
+		rewards[model] = score
+	}
+	bandit.ObserveContext(trace.Bandit.Context, rewards, rewardFeedback)
+	writeJSON(w, map[string]interface{}{"task_id": id, "feedback": fb, "rewarded": trace.Bandit.Winners})
+}
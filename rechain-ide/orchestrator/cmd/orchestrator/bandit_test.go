@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"rechain-ide/shared/auth"
+)
+
+func TestBanditRouter_LearnsAndPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bandit.json")
+	b, err := OpenBanditRouter(path, 1)
+	if err != nil {
+		t.Fatalf("open bandit: %v", err)
+	}
+	b.saveDelay = time.Hour
+	spec := TaskSpec{Type: "patch", Metadata: Metadata{Requester: "alice"}}
+	for i := 0; i < 20; i++ {
+		b.Observe(spec, map[string]float64{"good": 1, "bad": 0}, rewardMerge)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected updates to be batched until the save delay, got %v", err)
+	}
+	b.Close()
+
+	reopened, err := OpenBanditRouter(path, 1)
+	if err != nil {
+		t.Fatalf("reopen bandit: %v", err)
+	}
+	drivers := []Driver{stub("bad", 0), stub("good", 0)}
+	wins := 0
+	for i := 0; i < 50; i++ {
+		if reopened.Rank(spec, drivers)[0].ID() == "good" {
+			wins++
+		}
+	}
+	if wins < 48 {
+		t.Fatalf("expected the rewarded arm to be ranked first, won %d of 50", wins)
+	}
+
+	stats := reopened.Stats("patch", "alice")
+	if len(stats) != 1 || stats[0].Context != "patch|alice" || len(stats[0].Arms) != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	good := stats[0].Arms[0]
+	if good.Model != "good" || good.Rewards != 20 || good.BySource[rewardMerge] != 20 || good.Mean < 0.9 {
+		t.Fatalf("unexpected arm %+v", good)
+	}
+	if other := reopened.Stats("review", ""); len(other) != 0 {
+		t.Fatalf("expected contexts per task type, got %+v", other)
+	}
+}
+
+func TestProcessTask_BanditRoutingAndFeedback(t *testing.T) {
+	bandit := NewBanditRouter(1, 1)
+	prev := banditGlobal
+	banditGlobal = bandit
+	defer func() { banditGlobal = prev }()
+
+	spec := TaskSpec{
+		ID:          "task_bandit",
+		Type:        "patch",
+		Metadata:    Metadata{Requester: "alice"},
+		Constraints: []Constraint{{Key: "routing", Value: "bandit"}},
+	}
+	for i := 0; i < 30; i++ {
+		bandit.Observe(spec, map[string]float64{"model_a": 0, "model_b": 1}, rewardFeedback)
+	}
+
+	store := NewTaskStore()
+	setTaskState(store, spec.ID, "queued")
+	metrics := &Metrics{}
+	processTask(store, []Driver{stub("model_a", 0), stub("model_b", 0)}, map[string]DriverMeta{}, spec.ID, spec, "", metrics)
+
+	store.mu.Lock()
+	trace := store.traces[spec.ID]
+	store.mu.Unlock()
+	if trace.State != "completed" || len(trace.Selected) != 1 || trace.Selected[0] != "model_b" {
+		t.Fatalf("expected the learned driver alone, got %+v", trace)
+	}
+	if trace.Bandit == nil || trace.Bandit.Decisions["model_b"] != decisionExploit || len(trace.Bandit.Winners) != 1 || trace.Bandit.Winners[0] != "model_b" {
+		t.Fatalf("unexpected bandit trace %+v", trace.Bandit)
+	}
+	if got := metrics.RoutingByModelSnapshot()["model_b"]["bandit|exploit"]; got != 1 {
+		t.Fatalf("expected an exploit routing count, got %v", metrics.RoutingByModelSnapshot())
+	}
+	arm := bandit.Stats("patch", "alice")[0].Arms[0]
+	if arm.Model != "model_b" || arm.BySource[rewardMerge] != 1 || arm.Exploit != 1 {
+		t.Fatalf("expected a merge reward for the winner, got %+v", arm)
+	}
+
+	feedback := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/tasks/"+spec.ID+"/feedback", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		serveTaskFeedback(rec, req, store, bandit, spec.ID)
+		return rec
+	}
+	if rec := feedback(`{"rating":"sideways"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown rating, got %d", rec.Code)
+	}
+	if rec := feedback(`{"rating":"down","comment":"broke the build"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected feedback to be accepted, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := feedback(`{"rating":"up"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("expected a second rating to conflict, got %d", rec.Code)
+	}
+	arm = bandit.Stats("patch", "alice")[0].Arms[0]
+	if arm.BySource[rewardFeedback] != 31 || arm.Rewards != 32 {
+		t.Fatalf("expected one feedback reward, got %+v", arm)
+	}
+	store.mu.Lock()
+	fb := store.traces[spec.ID].Feedback
+	store.mu.Unlock()
+	if fb == nil || fb.Score != 0 || fb.Comment != "broke the build" {
+		t.Fatalf("expected feedback on the trace, got %+v", fb)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/routing/bandit?requester=alice", nil)
+	req = req.WithContext(auth.WithPrincipal(req.Context(), auth.Principal{Name: "bob", Role: auth.RoleViewer}))
+	rec := httptest.NewRecorder()
+	serveBandit(rec, req, bandit)
+	var body struct {
+		Contexts []BanditContextStats `json:"contexts"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(body.Contexts) != 0 {
+		t.Fatalf("expected non-admins to see only their own arms, got %+v", body.Contexts)
+	}
+}
+
+func TestBanditRouter_ConcurrentSavesKeepTheNewestState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bandit.json")
+	b, err := OpenBanditRouter(path, 1)
+	if err != nil {
+		t.Fatalf("open bandit: %v", err)
+	}
+	b.saveDelay = time.Millisecond
+	spec := TaskSpec{Type: "patch", Metadata: Metadata{Requester: "alice"}}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				b.Observe(spec, map[string]float64{"model_a": 1}, rewardMerge)
+				b.Flush()
+			}
+		}()
+	}
+	wg.Wait()
+	b.Close()
+
+	reopened, err := OpenBanditRouter(path, 1)
+	if err != nil {
+		t.Fatalf("reopen bandit: %v", err)
+	}
+	if arm := reopened.Stats("patch", "alice")[0].Arms[0]; arm.Rewards != 200 {
+		t.Fatalf("expected every reward in the saved state, got %+v", arm)
+	}
+}
+
+func TestServeTaskFeedback_DoesNotResendWebhook(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	store := NewTaskStore()
+	// A dispatcher that no longer remembers the delivery, as after a restart.
+	store.webhooks = NewWebhookDispatcher(time.Second, 1, time.Millisecond, time.Millisecond, "", 0)
+	id := "task_fb"
+	store.mu.Lock()
+	store.statuses[id] = TaskStatus{ID: id, State: "completed"}
+	store.specs[id] = TaskSpec{ID: id, Constraints: []Constraint{{Key: "callback_url", Value: srv.URL}}}
+	store.traces[id] = TaskTrace{TaskID: id, State: "completed", Bandit: &TraceBandit{Context: "patch|alice", Winners: []string{"model_a"}}}
+	store.mu.Unlock()
+
+	req := httptest.NewRequest(http.MethodPost, "/tasks/"+id+"/feedback", strings.NewReader(`{"rating":"up"}`))
+	rec := httptest.NewRecorder()
+	serveTaskFeedback(rec, req, store, NewBanditRouter(1, 1), id)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected feedback to be accepted, got %d %s", rec.Code, rec.Body.String())
+	}
+	store.webhooks.Wait()
+	if calls != 0 || len(store.webhooks.Deliveries(id)) != 0 {
+		t.Fatalf("expected feedback to only save the record, got %d webhook call(s)", calls)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+var breakerStates = []string{breakerClosed, breakerOpen, breakerHalfOpen}
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// breakersGlobal is the registry's breaker set, reachable from driver runs the
+// same way pingSvcGlobal and metricsGlobal are.
+var breakersGlobal *CircuitBreakers
+
+// BreakerStatus is the externally visible state of one driver's breaker.
+type BreakerStatus struct {
+	DriverID      string `json:"driver_id"`
+	State         string `json:"state"`
+	Failures      int    `json:"consecutive_failures"`
+	Trips         int    `json:"trips"`
+	Probes        int    `json:"half_open_probes"`
+	OpenUntilUnix int64  `json:"open_until_unix,omitempty"`
+	LastError     string `json:"last_error,omitempty"`
+}
+
+type breaker struct {
+	state     string
+	failures  int
+	trips     int
+	probes    int
+	openUntil time.Time
+	lastError string
+}
+
+// CircuitBreakers tracks a closed/open/half-open breaker per driver. A driver
+// opens after threshold consecutive failed runs, rejects work for openFor,
+// then lets up to probes concurrent runs through; a successful probe closes
+// it and a failed one opens it again.
+type CircuitBreakers struct {
+	mu        sync.Mutex
+	threshold int
+	openFor   time.Duration
+	probes    int
+	m         map[string]*breaker
+	now       func() time.Time
+}
+
+func NewCircuitBreakers(threshold int, openFor time.Duration, probes int) *CircuitBreakers {
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if openFor <= 0 {
+		openFor = 30 * time.Second
+	}
+	if probes <= 0 {
+		probes = 1
+	}
+	return &CircuitBreakers{threshold: threshold, openFor: openFor, probes: probes, m: map[string]*breaker{}, now: time.Now}
+}
+
+func (c *CircuitBreakers) getLocked(id string) *breaker {
+	b, ok := c.m[id]
+	if !ok {
+		b = &breaker{state: breakerClosed}
+		c.m[id] = b
+	}
+	if b.state == breakerOpen && !c.now().Before(b.openUntil) {
+		b.state = breakerHalfOpen
+		b.probes = 0
+	}
+	return b
+}
+
+// Allow reports whether a driver may be selected, without reserving a probe.
+func (c *CircuitBreakers) Allow(id string) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.getLocked(id)
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		return b.probes < c.probes
+	}
+	return true
+}
+
+// Begin reserves the right to run a driver. Every successful Begin must be
+// followed by Record.
+func (c *CircuitBreakers) Begin(id string) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.getLocked(id)
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		if b.probes >= c.probes {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// Record feeds the outcome of a run started with Begin. Runs canceled by the
+// caller (task cancel, quorum, a winning hedge) say nothing about the driver
+// and only release the probe.
+func (c *CircuitBreakers) Record(id string, err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.getLocked(id)
+	if b.state == breakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err == nil {
+		b.state = breakerClosed
+		b.failures = 0
+		b.lastError = ""
+		return
+	}
+	b.failures++
+	b.lastError = err.Error()
+	if b.state == breakerHalfOpen || b.failures >= c.threshold {
+		b.state = breakerOpen
+		b.trips++
+		b.openUntil = c.now().Add(c.openFor)
+	}
+}
+
+func (c *CircuitBreakers) Status(id string) BreakerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.statusLocked(id, c.getLocked(id))
+}
+
+func (c *CircuitBreakers) statusLocked(id string, b *breaker) BreakerStatus {
+	st := BreakerStatus{DriverID: id, State: b.state, Failures: b.failures, Trips: b.trips, Probes: b.probes, LastError: b.lastError}
+	if b.state == breakerOpen {
+		st.OpenUntilUnix = b.openUntil.Unix()
+	}
+	return st
+}
+
+// Snapshot returns the breaker state of the given drivers, sorted by ID.
+func (c *CircuitBreakers) Snapshot(ids []string) []BreakerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sorted := append([]string{}, ids...)
+	sort.Strings(sorted)
+	out := make([]BreakerStatus, 0, len(sorted))
+	for _, id := range sorted {
+		out = append(out, c.statusLocked(id, c.getLocked(id)))
+	}
+	return out
+}
+
+// allowedDrivers drops drivers whose breaker is open.
+func allowedDrivers(drivers []Driver) []Driver {
+	if breakersGlobal == nil {
+		return drivers
+	}
+	out := make([]Driver, 0, len(drivers))
+	for _, d := range drivers {
+		if breakersGlobal.Allow(d.ID()) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type failingDriver struct {
+	id string
+}
+
+func (d failingDriver) ID() string { return d.id }
+
+func (d failingDriver) Run(ctx context.Context, spec TaskSpec) (ModelResult, error) {
+	return ModelResult{}, errors.New("upstream down")
+}
+
+func TestCircuitBreakers_Transitions(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cb := NewCircuitBreakers(2, 10*time.Second, 1)
+	cb.now = func() time.Time { return now }
+	fail := errors.New("boom")
+
+	steps := []struct {
+		name  string
+		run   func()
+		state string
+		allow bool
+	}{
+		{name: "first failure stays closed", run: func() { cb.Begin("d"); cb.Record("d", fail) }, state: breakerClosed, allow: true},
+		{name: "cancellation is ignored", run: func() { cb.Begin("d"); cb.Record("d", context.Canceled) }, state: breakerClosed, allow: true},
+		{name: "threshold opens", run: func() { cb.Begin("d"); cb.Record("d", context.DeadlineExceeded) }, state: breakerOpen, allow: false},
+		{name: "open rejects runs", run: func() {
+			if cb.Begin("d") {
+				t.Fatal("expected open breaker to reject Begin")
+			}
+		}, state: breakerOpen, allow: false},
+		{name: "half-open after cool-down", run: func() { now = now.Add(10 * time.Second) }, state: breakerHalfOpen, allow: true},
+		{name: "probe slot is exclusive", run: func() {
+			if !cb.Begin("d") || cb.Begin("d") {
+				t.Fatal("expected exactly one half-open probe")
+			}
+		}, state: breakerHalfOpen, allow: false},
+		{name: "failed probe reopens", run: func() { cb.Record("d", fail) }, state: breakerOpen, allow: false},
+		{name: "successful probe closes", run: func() {
+			now = now.Add(10 * time.Second)
+			cb.Begin("d")
+			cb.Record("d", nil)
+		}, state: breakerClosed, allow: true},
+	}
+	for _, step := range steps {
+		step.run()
+		st := cb.Status("d")
+		if st.State != step.state || cb.Allow("d") != step.allow {
+			t.Fatalf("%s: expected %s/allow=%v, got %+v", step.name, step.state, step.allow, st)
+		}
+	}
+	if st := cb.Status("d"); st.Trips != 2 || st.Failures != 0 {
+		t.Fatalf("unexpected counters: %+v", st)
+	}
+}
+
+func TestSelectDrivers_SkipsOpenBreakers(t *testing.T) {
+	breakersGlobal = NewCircuitBreakers(1, time.Minute, 1)
+	defer func() { breakersGlobal = nil }()
+	bad := failingDriver{id: "bad"}
+	good := stub("good", 0)
+	spec := TaskSpec{Constraints: []Constraint{{Key: "models", Value: "bad,good"}}}
+
+	if _, err := runWithRetry(context.Background(), bad, spec, &Metrics{}); err == nil {
+		t.Fatal("expected failing driver to fail")
+	}
+	selected := selectDrivers(spec, []Driver{bad, good}, map[string]DriverMeta{})
+	if len(selected) != 1 || selected[0].ID() != "good" {
+		t.Fatalf("expected only the healthy driver, got %d drivers", len(selected))
+	}
+	if _, err := runWithRetry(context.Background(), bad, spec, &Metrics{}); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected open breaker to short-circuit, got %v", err)
+	}
+}
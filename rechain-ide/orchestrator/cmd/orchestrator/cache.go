@@ -0,0 +1,253 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	cacheHit    = "hit"
+	cacheMiss   = "miss"
+	cacheBypass = "bypass"
+)
+
+// cacheKeyConstraints are the constraints that can change a task's result.
+// Deadlines, retries, hedging and callbacks only change how the result is
+// obtained or reported, so they are left out of the key.
+var cacheKeyConstraints = map[string]bool{
+	"models":             true,
+	"min_models":         true,
+	"max_models":         true,
+	"routing":            true,
+	"weight_cost":        true,
+	"weight_latency":     true,
+	"weight_quality":     true,
+	"budget_usd":         true,
+	"quorum":             true,
+	"fallback_models":    true,
+	"max_new_tokens":     true,
+	"max_tokens":         true,
+	"temperature":        true,
+	"force_merge_source": true,
+	"merge_strategy":     true,
+	"verify":             true,
+	"verify_commands":    true,
+	"prompt_max_chars":   true,
+	"prompt_max_tokens":  true,
+}
+
+// CachedResult is a completed task result that identical specs can reuse.
+type CachedResult struct {
+	Key         string
+	TaskID      string
+	MergeSource string
+	Merge       MergeResult
+	Results     []ModelResult
+	CreatedAt   time.Time
+	size        int
+}
+
+// ResultCache maps a canonical hash of a task spec to the result of the last
+// task that completed with it. Entries expire after ttl and the least recently
+// used ones are evicted beyond maxEntries or maxBytes. A ttl of zero disables
+// the cache.
+type ResultCache struct {
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int
+	workspace  string
+	now        func() time.Time
+
+	mu        sync.Mutex
+	lru       *list.List
+	entries   map[string]*list.Element
+	bytes     int
+	lookups   map[string]int
+	evictions int
+}
+
+// resultCacheGlobal is consulted by submitTask and filled by processTask.
+var resultCacheGlobal *ResultCache
+
+func NewResultCache(ttl time.Duration, maxEntries int, maxBytes int, workspace string) *ResultCache {
+	return &ResultCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		workspace:  workspace,
+		now:        time.Now,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+		lookups:    map[string]int{},
+	}
+}
+
+func resultCacheFromEnv() *ResultCache {
+	return NewResultCache(
+		time.Duration(envInt("ORCH_CACHE_TTL_MS", 3600000))*time.Millisecond,
+		envInt("ORCH_CACHE_MAX_ENTRIES", 1000),
+		envInt("ORCH_CACHE_MAX_BYTES", 64<<20),
+		envOr("ORCH_WORKSPACE_ROOT", "."),
+	)
+}
+
+// Key returns the content address of a spec: type, input, context refs with
+// their revs, and the result-relevant constraints in key order. File refs
+// without a rev are pinned by the hash of their current workspace content.
+// It is empty when the cache is disabled.
+func (c *ResultCache) Key(spec TaskSpec) string {
+	if c == nil || c.ttl <= 0 {
+		return ""
+	}
+	type keyRef struct {
+		Type string `json:"type"`
+		Path string `json:"path"`
+		Rev  string `json:"rev"`
+	}
+	type keyConstraint struct {
+		Key   string      `json:"key"`
+		Value interface{} `json:"value"`
+	}
+	refs := make([]keyRef, 0, len(spec.Context))
+	var files map[string]string
+	for _, ref := range spec.Context {
+		kr := keyRef{Type: ref.Type, Path: ref.Path, Rev: ref.Rev}
+		if kr.Rev == "" && (ref.Type == "" || ref.Type == "file") {
+			if files == nil {
+				files = loadContextFiles(c.workspace, spec.Context)
+			}
+			if rel, ok := workspacePath(ref.Path); ok {
+				if body, ok := files[rel]; ok {
+					kr.Rev = "sha256:" + sha256Hex([]byte(body))
+				}
+			}
+		}
+		refs = append(refs, kr)
+	}
+	constraints := []keyConstraint{}
+	for _, ct := range spec.Constraints {
+		if cacheKeyConstraints[ct.Key] {
+			constraints = append(constraints, keyConstraint{Key: ct.Key, Value: ct.Value})
+		}
+	}
+	sort.SliceStable(constraints, func(i, j int) bool { return constraints[i].Key < constraints[j].Key })
+	data, _ := json.Marshal(struct {
+		Type        string          `json:"type"`
+		Input       string          `json:"input"`
+		Context     []keyRef        `json:"context"`
+		Constraints []keyConstraint `json:"constraints"`
+	}{spec.Type, spec.Input, refs, constraints})
+	return sha256Hex(data)
+}
+
+// Lookup returns the cached result for spec, counting a hit, a miss or, for
+// specs with the no_cache constraint, a bypass.
+func (c *ResultCache) Lookup(spec TaskSpec) (CachedResult, bool) {
+	if c == nil || c.ttl <= 0 {
+		return CachedResult{}, false
+	}
+	if constraintBool(spec.Constraints, "no_cache", false) {
+		c.count(cacheBypass)
+		return CachedResult{}, false
+	}
+	key := c.Key(spec)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if ok && c.now().Sub(el.Value.(*CachedResult).CreatedAt) >= c.ttl {
+		c.removeLocked(el)
+		ok = false
+	}
+	if !ok {
+		c.lookups[cacheMiss]++
+		return CachedResult{}, false
+	}
+	c.lookups[cacheHit]++
+	c.lru.MoveToFront(el)
+	return *el.Value.(*CachedResult), true
+}
+
+// Put stores the result of a completed task under key, replacing an older
+// entry, and evicts least recently used entries over the limits. Results
+// larger than maxBytes are not cached.
+func (c *ResultCache) Put(key string, taskID string, source string, merge MergeResult, results []ModelResult) {
+	if c == nil || c.ttl <= 0 || key == "" {
+		return
+	}
+	entry := &CachedResult{
+		Key:         key,
+		TaskID:      taskID,
+		MergeSource: source,
+		Merge:       merge,
+		Results:     append([]ModelResult{}, results...),
+		CreatedAt:   c.now(),
+	}
+	data, _ := json.Marshal(entry)
+	entry.size = len(data)
+	if c.maxBytes > 0 && entry.size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.removeLocked(el)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.bytes += entry.size
+	for c.lru.Len() > 0 && ((c.maxEntries > 0 && c.lru.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)) {
+		c.removeLocked(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *ResultCache) removeLocked(el *list.Element) {
+	entry := el.Value.(*CachedResult)
+	c.lru.Remove(el)
+	delete(c.entries, entry.Key)
+	c.bytes -= entry.size
+}
+
+func (c *ResultCache) count(result string) {
+	c.mu.Lock()
+	c.lookups[result]++
+	c.mu.Unlock()
+}
+
+// Stats returns lookups by result, evictions, and the current entry count and
+// size in bytes.
+func (c *ResultCache) Stats() (map[string]int, int, int, int) {
+	lookups := map[string]int{}
+	if c == nil {
+		return lookups, 0, 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.lookups {
+		lookups[k] = v
+	}
+	return lookups, c.evictions, c.lru.Len(), c.bytes
+}
+
+// completeFromCache finishes a just-submitted task with a cached result
+// instead of queueing it.
+func completeFromCache(store *TaskStore, metrics *Metrics, id string, trace TaskTrace, hit CachedResult) TaskStatus {
+	merge := hit.Merge
+	trace.CachedFrom = hit.TaskID
+	for _, r := range hit.Results {
+		trace.Results = append(trace.Results, traceModelResult(r))
+	}
+	store.logs.Log(id, logInfo, "cache_hit", "", "served the cached result of task "+hit.TaskID, nil)
+	store.publish(TaskEvent{Type: "merge", TaskID: id, Merge: &merge, MergeSource: "cache"})
+	trace.MergeSource = "cache"
+	trace.Merge = &merge
+	if store.completeRun(id, "completed", trace, &merge, buildTaskArtifacts(store.blobs, id, merge, hit.Results)) {
+		metrics.IncMergeChoice("cache")
+		metrics.IncCompleted()
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.statuses[id]
+}
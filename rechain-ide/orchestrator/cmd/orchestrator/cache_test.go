@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResultCache_KeyIsCanonical(t *testing.T) {
+	workspace := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workspace, "a.go"), []byte("package a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := NewResultCache(time.Hour, 0, 0, workspace)
+	base := TaskSpec{
+		ID:      "task_1",
+		Type:    "patch",
+		Input:   "fix it",
+		Context: []ContextRef{{Type: "file", Path: "a.go"}},
+		Constraints: []Constraint{
+			{Key: "routing", Value: "cost"},
+			{Key: "max_models", Value: float64(2)},
+			{Key: "budget_ms", Value: float64(1000)},
+		},
+		Metadata: Metadata{Requester: "alice"},
+	}
+	key := c.Key(base)
+
+	same := base
+	same.ID = "task_2"
+	same.Metadata = Metadata{Requester: "bob", Priority: "high"}
+	same.Constraints = []Constraint{
+		{Key: "max_models", Value: 2},
+		{Key: "callback_url", Value: "http://example.test/hook"},
+		{Key: "routing", Value: "cost"},
+	}
+	if c.Key(same) != key {
+		t.Fatal("expected ID, metadata, constraint order and irrelevant constraints to be ignored")
+	}
+
+	cases := map[string]func(s *TaskSpec){
+		"input":      func(s *TaskSpec) { s.Input = "fix it properly" },
+		"type":       func(s *TaskSpec) { s.Type = "review" },
+		"rev":        func(s *TaskSpec) { s.Context = []ContextRef{{Type: "file", Path: "a.go", Rev: "abc123"}} },
+		"constraint": func(s *TaskSpec) { s.Constraints = []Constraint{{Key: "routing", Value: "latency"}} },
+	}
+	for name, change := range cases {
+		spec := base
+		change(&spec)
+		if c.Key(spec) == key {
+			t.Fatalf("%s: expected a different key", name)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(workspace, "a.go"), []byte("package a // edited\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if c.Key(base) == key {
+		t.Fatal("expected file content to pin context refs without a rev")
+	}
+	if NewResultCache(0, 0, 0, workspace).Key(base) != "" {
+		t.Fatal("expected no key when the cache is disabled")
+	}
+}
+
+func TestResultCache_TTLAndLimits(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+	c := NewResultCache(time.Minute, 2, 0, "")
+	c.now = clock.now
+	specs := []TaskSpec{{Input: "one"}, {Input: "two"}, {Input: "three"}}
+	for i, s := range specs {
+		c.Put(c.Key(s), s.Input, "policy_merge", MergeResult{Diff: s.Input}, nil)
+		if i == 1 {
+			if _, ok := c.Lookup(specs[0]); !ok {
+				t.Fatal("expected a hit for the first entry")
+			}
+		}
+	}
+	if _, ok := c.Lookup(specs[1]); ok {
+		t.Fatal("expected the least recently used entry to be evicted")
+	}
+	if hit, ok := c.Lookup(specs[0]); !ok || hit.TaskID != "one" {
+		t.Fatalf("expected the recently used entry to survive, got %+v", hit)
+	}
+
+	clock.advance(time.Minute)
+	if _, ok := c.Lookup(specs[2]); ok {
+		t.Fatal("expected the entry to expire after the ttl")
+	}
+	lookups, evictions, entries, _ := c.Stats()
+	if lookups[cacheHit] != 2 || lookups[cacheMiss] != 2 || evictions != 1 || entries != 1 {
+		t.Fatalf("unexpected stats %v evictions=%d entries=%d", lookups, evictions, entries)
+	}
+
+	small := NewResultCache(time.Minute, 0, 300, "")
+	small.Put("a", "task_a", "policy_merge", MergeResult{Diff: "a"}, nil)
+	small.Put("b", "task_b", "policy_merge", MergeResult{Diff: "b"}, nil)
+	if _, _, entries, bytes := small.Stats(); entries != 1 || bytes > 300 {
+		t.Fatalf("expected the byte limit to keep one entry, got %d entries, %d bytes", entries, bytes)
+	}
+}
+
+func TestSubmitTask_ServesCachedResult(t *testing.T) {
+	prev := resultCacheGlobal
+	resultCacheGlobal = NewResultCache(time.Hour, 10, 0, "")
+	defer func() { resultCacheGlobal = prev }()
+
+	store := NewTaskStore()
+	queue := NewTaskQueue(10, time.Second)
+	metrics := &Metrics{}
+	spec := TaskSpec{ID: "task_first", Type: "patch", Input: "add logging", Constraints: []Constraint{{Key: "routing", Value: "latency"}}}
+	if status, err := submitTask(store, queue, metrics, spec, TaskTrace{}); err != nil || status.State != "queued" {
+		t.Fatalf("expected a miss to queue the task, got %+v %v", status, err)
+	}
+	processTask(store, []Driver{stub("model_a", 0)}, map[string]DriverMeta{}, spec.ID, spec, "", metrics)
+
+	repeat := spec
+	repeat.ID = "task_repeat"
+	repeat.Constraints = append(repeat.Constraints, Constraint{Key: "budget_ms", Value: float64(9000)})
+	status, err := submitTask(store, queue, metrics, repeat, TaskTrace{})
+	if err != nil || status.State != "completed" {
+		t.Fatalf("expected a cache hit to complete immediately, got %+v %v", status, err)
+	}
+	if queue.Depth() != 1 {
+		t.Fatalf("expected the cached task not to be queued, depth %d", queue.Depth())
+	}
+	store.mu.Lock()
+	trace, result, first := store.traces[repeat.ID], store.results[repeat.ID], store.results[spec.ID]
+	store.mu.Unlock()
+	if trace.MergeSource != "cache" || trace.CachedFrom != spec.ID || len(trace.Results) != 1 {
+		t.Fatalf("unexpected cached trace %+v", trace)
+	}
+	if result.Diff != first.Diff {
+		t.Fatal("expected the cached merge result")
+	}
+
+	bypass := spec
+	bypass.ID = "task_bypass"
+	bypass.Constraints = append(bypass.Constraints, Constraint{Key: "no_cache", Value: true})
+	if status, _ := submitTask(store, queue, metrics, bypass, TaskTrace{}); status.State != "queued" {
+		t.Fatalf("expected no_cache to queue the task, got %s", status.State)
+	}
+	lookups, _, _, _ := resultCacheGlobal.Stats()
+	if lookups[cacheHit] != 1 || lookups[cacheMiss] != 1 || lookups[cacheBypass] != 1 {
+		t.Fatalf("unexpected lookups %v", lookups)
+	}
+}
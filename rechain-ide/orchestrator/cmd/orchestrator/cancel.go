@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	errTaskNotFound = errors.New("task not found")
+	errTaskFinished = errors.New("task already finished")
+)
+
+func isTerminalState(state string) bool {
+	switch state {
+	case "completed", "failed", "canceled":
+		return true
+	}
+	return false
+}
+
+// beginRun registers the cancel func of a task a worker is about to run. It
+// reports false when the task was canceled before the worker got to it.
+func (s *TaskStore) beginRun(id string, cancel context.CancelFunc) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.statuses[id].State == "canceled" {
+		return false
+	}
+	if s.cancels == nil {
+		s.cancels = map[string]context.CancelFunc{}
+	}
+	s.cancels[id] = cancel
+	return true
+}
+
+func (s *TaskStore) endRun(id string) {
+	s.mu.Lock()
+	delete(s.cancels, id)
+	s.mu.Unlock()
+}
+
+// Cancel moves a queued or running task into the terminal canceled state.
+// Queued tasks are removed from the queue; running tasks have their context
+// canceled so in-flight driver calls stop.
+func (s *TaskStore) Cancel(id string, queue *TaskQueue) (TaskStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.statuses[id]
+	if !ok {
+		return TaskStatus{}, errTaskNotFound
+	}
+	if isTerminalState(status.State) {
+		return status, errTaskFinished
+	}
+	if queue != nil {
+		queue.Remove(id)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	status.State = "canceled"
+	status.UpdatedAt = now
+	s.statuses[id] = status
+	trace := s.traces[id]
+	trace.State = "canceled"
+	trace.FinishedAt = now
+	s.traces[id] = trace
+	s.finishLocked(id)
+	if cancel, ok := s.cancels[id]; ok {
+		cancel()
+	}
+	return status, nil
+}
+
+// finishCanceled records the worker's view of a task that was canceled while
+// running. The canceled state set by Cancel is kept; only what the worker
+// learned (selected and interrupted drivers, partial results) is added.
+func (s *TaskStore) finishCanceled(id string, trace TaskTrace) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.traces[id]
+	trace.State = "canceled"
+	trace.FinishedAt = current.FinishedAt
+	if trace.FinishedAt == "" {
+		trace.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	s.traces[id] = trace
+	s.finishLocked(id)
+}
+
+// failQueued marks a task that could not be put on the queue as failed.
+func (s *TaskStore) failQueued(id string, reason string) TaskStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC().Format(time.RFC3339)
+	status := s.statuses[id]
+	status.State = "failed"
+	status.Progress = 1.0
+	status.UpdatedAt = now
+	s.statuses[id] = status
+	trace := s.traces[id]
+	trace.State = "failed"
+	trace.FinishedAt = now
+	trace.Error = reason
+	s.traces[id] = trace
+	s.finishLocked(id)
+	return status
+}
+
+// completeRun stores the final outcome of a worker run. It reports false and
+// keeps the canceled state when the task was canceled while running.
+func (s *TaskStore) completeRun(id string, state string, trace TaskTrace, result *MergeResult, artifacts []Artifact) bool {
+	s.mu.Lock()
+	status := s.statuses[id]
+	if status.State == "canceled" {
+		s.mu.Unlock()
+		trace.Error = ""
+		s.finishCanceled(id, trace)
+		return false
+	}
+	defer s.mu.Unlock()
+	now := time.Now().UTC().Format(time.RFC3339)
+	status.State = state
+	status.Progress = 1.0
+	status.UpdatedAt = now
+	s.statuses[id] = status
+	trace.State = state
+	trace.FinishedAt = now
+	s.traces[id] = trace
+	if result != nil {
+		s.results[id] = *result
+	}
+	if artifacts != nil {
+		s.artifacts[id] = artifacts
+	}
+	s.finishLocked(id)
+	return true
+}
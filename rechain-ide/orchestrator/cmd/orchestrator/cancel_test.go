@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCancelRemovesQueuedTask(t *testing.T) {
+	store := NewTaskStore()
+	queue := NewTaskQueue(10, 0)
+	spec := TaskSpec{ID: "task_q"}
+	store.statuses[spec.ID] = TaskStatus{ID: spec.ID, State: "queued"}
+	if err := queue.Enqueue(queuedTask{id: spec.ID, spec: spec, enqueued: time.Now()}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	status, err := store.Cancel(spec.ID, queue)
+	if err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	if status.State != "canceled" {
+		t.Fatalf("expected canceled, got %s", status.State)
+	}
+	if queue.Depth() != 0 {
+		t.Fatalf("expected task removed from queue, depth %d", queue.Depth())
+	}
+	if _, err := store.Cancel(spec.ID, queue); err != errTaskFinished {
+		t.Fatalf("expected errTaskFinished on second cancel, got %v", err)
+	}
+}
+
+func TestCancelInterruptsRunningDrivers(t *testing.T) {
+	store := NewTaskStore()
+	spec := TaskSpec{
+		ID:          "task_r",
+		Constraints: []Constraint{{Key: "budget_ms", Value: float64(5000)}, {Key: "routing", Value: "latency"}},
+		Metadata:    Metadata{Priority: "high"},
+	}
+	store.statuses[spec.ID] = TaskStatus{ID: spec.ID, State: "running"}
+	store.traces[spec.ID] = TaskTrace{TaskID: spec.ID, State: "running"}
+	slow := StubDriver{id: "slow", latency: 5 * time.Second, diff: "diff --git a/x b/x\n+x\n"}
+
+	done := make(chan struct{})
+	go func() {
+		processTask(store, []Driver{slow}, map[string]DriverMeta{}, spec.ID, spec, "", &Metrics{})
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		store.mu.Lock()
+		_, running := store.cancels[spec.ID]
+		store.mu.Unlock()
+		if running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("worker never registered the running task")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := store.Cancel(spec.ID, nil); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("processTask did not stop after cancel")
+	}
+	if got := store.statuses[spec.ID].State; got != "canceled" {
+		t.Fatalf("expected canceled status, got %s", got)
+	}
+	trace := store.traces[spec.ID]
+	if trace.State != "canceled" {
+		t.Fatalf("expected canceled trace, got %s", trace.State)
+	}
+	if len(trace.Interrupted) != 1 || trace.Interrupted[0] != "slow" {
+		t.Fatalf("expected slow driver to be recorded as interrupted, got %v", trace.Interrupted)
+	}
+}
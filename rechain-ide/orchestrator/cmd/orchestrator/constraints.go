@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"rechain-ide/orchestrator/internal"
+)
+
+// Constraint value types.
+const (
+	constraintInteger = "integer"
+	constraintNumber  = "number"
+	constraintBoolean = "boolean"
+	constraintText    = "string"
+	constraintCSV     = "csv"
+)
+
+// ConstraintDef describes a known constraint key and the values it accepts.
+type ConstraintDef struct {
+	Key         string   `json:"key"`
+	Type        string   `json:"type"`
+	Min         *float64 `json:"min,omitempty"`
+	Max         *float64 `json:"max,omitempty"`
+	Enum        []string `json:"enum,omitempty"`
+	Description string   `json:"description"`
+}
+
+func bound(v float64) *float64 { return &v }
+
+// constraintRegistry lists every constraint key the orchestrator reads. Keys
+// not listed here are rejected at submit time.
+var constraintRegistry = []ConstraintDef{
+	{Key: "models", Type: constraintCSV, Description: "driver IDs to run, comma-separated"},
+	{Key: "min_models", Type: constraintInteger, Min: bound(1), Description: "minimum number of drivers to select"},
+	{Key: "max_models", Type: constraintInteger, Min: bound(1), Description: "maximum number of drivers to select"},
+	{Key: "routing", Type: constraintText, Enum: []string{"latency", "cost", "quality", "weighted", "weighted_quality", "quantum", "bandit"}, Description: "driver routing policy"},
+	{Key: "weight_cost", Type: constraintNumber, Min: bound(0), Description: "cost weight for weighted routing and merging"},
+	{Key: "weight_latency", Type: constraintNumber, Min: bound(0), Description: "latency weight for weighted routing and merging"},
+	{Key: "weight_quality", Type: constraintNumber, Min: bound(0), Description: "quality weight for weighted routing and merging"},
+	{Key: "budget_ms", Type: constraintInteger, Min: bound(1), Description: "overall task deadline in milliseconds"},
+	{Key: "budget_usd", Type: constraintNumber, Min: bound(0), Description: "cost budget for driver selection"},
+	{Key: "driver_timeout_ms", Type: constraintInteger, Min: bound(1), Description: "per-driver timeout in milliseconds"},
+	{Key: "retries", Type: constraintInteger, Min: bound(0), Max: bound(10), Description: "retries per driver"},
+	{Key: "retry_backoff_ms", Type: constraintInteger, Min: bound(0), Description: "backoff between driver retries"},
+	{Key: "quorum", Type: constraintInteger, Min: bound(1), Description: "successful results after which remaining drivers are canceled"},
+	{Key: "hedge", Type: constraintBoolean, Description: "start a hedge driver when a primary is slow"},
+	{Key: "hedge_percentile", Type: constraintNumber, Min: bound(1), Max: bound(100), Description: "latency percentile that triggers a hedge"},
+	{Key: "hedge_after_ms", Type: constraintInteger, Min: bound(0), Description: "hedge delay while there is no latency history"},
+	{Key: "hedge_models", Type: constraintCSV, Description: "drivers used for hedging, comma-separated"},
+	{Key: "fallback_models", Type: constraintCSV, Description: "drivers tried when all selected drivers fail"},
+	{Key: "max_new_tokens", Type: constraintInteger, Min: bound(1), Description: "generation length for HuggingFace drivers"},
+	{Key: "max_tokens", Type: constraintInteger, Min: bound(1), Description: "completion length for OpenAI-compatible drivers"},
+	{Key: "temperature", Type: constraintNumber, Min: bound(0), Max: bound(2), Description: "sampling temperature for OpenAI-compatible drivers"},
+	{Key: "force_merge_source", Type: constraintText, Enum: []string{"agent_compiler", "agent_compiler_soft", "policy_merge", "hunk_merge"}, Description: "merge path to use instead of the default chain"},
+	{Key: "merge_strategy", Type: constraintText, Enum: []string{"hunk"}, Description: "try the hunk-level ensemble merge first"},
+	{Key: "verify", Type: constraintBoolean, Description: "run test commands on the merged diff through the kernel and fall back to the next-best candidate on failure"},
+	{Key: "verify_commands", Type: constraintCSV, Description: "test commands for verification, comma-separated (default: agent compiler suggestions)"},
+	{Key: "prompt_max_chars", Type: constraintInteger, Min: bound(1), Description: "character budget of the rendered prompt; context files and RAG snippets beyond it are truncated or left out"},
+	{Key: "prompt_max_tokens", Type: constraintInteger, Min: bound(1), Description: "prompt budget in tokens (about four characters each); the smaller of the two budgets applies"},
+	{Key: "no_cache", Type: constraintBoolean, Description: "skip the result cache lookup and run the drivers; the fresh result replaces the cached one"},
+	{Key: "callback_url", Type: constraintText, Description: "absolute http(s) URL notified when the task finishes"},
+	{Key: "callback_secret", Type: constraintText, Description: "HMAC-SHA256 secret for the completion webhook signature"},
+}
+
+func findConstraintDef(key string) (ConstraintDef, bool) {
+	for _, def := range constraintRegistry {
+		if def.Key == key {
+			return def, true
+		}
+	}
+	return ConstraintDef{}, false
+}
+
+// validateConstraints checks keys and value types against the registry.
+// Field paths are relative to the spec ("constraints[i].value").
+func validateConstraints(constraints []Constraint) []internal.FieldError {
+	errs := []internal.FieldError{}
+	seen := map[string]int{}
+	for i, c := range constraints {
+		field := "constraints[" + strconv.Itoa(i) + "]"
+		def, ok := findConstraintDef(c.Key)
+		if !ok {
+			errs = append(errs, internal.FieldError{Field: field + ".key", Message: "unknown constraint " + strconv.Quote(c.Key)})
+			continue
+		}
+		if first, dup := seen[c.Key]; dup {
+			errs = append(errs, internal.FieldError{Field: field + ".key", Message: "duplicate of constraints[" + strconv.Itoa(first) + "]"})
+			continue
+		}
+		seen[c.Key] = i
+		if msg := def.check(c.Value); msg != "" {
+			errs = append(errs, internal.FieldError{Field: field + ".value", Message: c.Key + " " + msg})
+		}
+	}
+	return errs
+}
+
+// check returns why value is not acceptable, or "".
+func (d ConstraintDef) check(value interface{}) string {
+	switch d.Type {
+	case constraintInteger, constraintNumber:
+		n, ok := value.(float64)
+		if !ok {
+			article := "a "
+			if d.Type == constraintInteger {
+				article = "an "
+			}
+			return "must be " + article + d.Type + ", got " + valueKind(value)
+		}
+		if d.Type == constraintInteger && n != math.Trunc(n) {
+			return "must be an integer"
+		}
+		if d.Min != nil && n < *d.Min {
+			return "must be >= " + strconv.FormatFloat(*d.Min, 'f', -1, 64)
+		}
+		if d.Max != nil && n > *d.Max {
+			return "must be <= " + strconv.FormatFloat(*d.Max, 'f', -1, 64)
+		}
+	case constraintBoolean:
+		if _, ok := value.(bool); !ok {
+			return "must be a boolean, got " + valueKind(value)
+		}
+	case constraintText, constraintCSV:
+		s, ok := value.(string)
+		if !ok {
+			return "must be a string, got " + valueKind(value)
+		}
+		if len(d.Enum) > 0 && !containsString(d.Enum, strings.ToLower(strings.TrimSpace(s))) {
+			return "must be one of " + strings.Join(d.Enum, ", ")
+		}
+		if d.Type == constraintCSV && strings.TrimSpace(s) != "" && len(splitCSV(s)) == 0 {
+			return "must list at least one value"
+		}
+	}
+	return ""
+}
+
+func valueKind(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DriverConfig declares one driver in the drivers file (ORCH_DRIVERS_FILE).
+// API keys are never stored in the file; api_key_env names the variable that
+// holds them.
+type DriverConfig struct {
+	ID                  string            `json:"id" yaml:"id"`
+	Kind                string            `json:"kind" yaml:"kind"`
+	Endpoint            string            `json:"endpoint,omitempty" yaml:"endpoint"`
+	Model               string            `json:"model,omitempty" yaml:"model"`
+	Fallbacks           []string          `json:"fallbacks,omitempty" yaml:"fallbacks"`
+	APIKeyEnv           string            `json:"api_key_env,omitempty" yaml:"api_key_env"`
+	CostUSD             float64           `json:"cost_usd,omitempty" yaml:"cost_usd"`
+	CostPer1KPrompt     float64           `json:"cost_per_1k_prompt,omitempty" yaml:"cost_per_1k_prompt"`
+	CostPer1KCompletion float64           `json:"cost_per_1k_completion,omitempty" yaml:"cost_per_1k_completion"`
+	Capabilities        []string          `json:"capabilities,omitempty" yaml:"capabilities"`
+	Description         string            `json:"description,omitempty" yaml:"description"`
+	TimeoutMs           int               `json:"timeout_ms,omitempty" yaml:"timeout_ms"`
+	PingTimeoutMs       int               `json:"ping_timeout_ms,omitempty" yaml:"ping_timeout_ms"`
+	LatencyMs           int               `json:"latency_ms,omitempty" yaml:"latency_ms"`
+	Quality             float64           `json:"quality,omitempty" yaml:"quality"`
+	Diff                string            `json:"diff,omitempty" yaml:"diff"`
+	SystemPrompts       map[string]string `json:"system_prompts,omitempty" yaml:"system_prompts"`
+	Disabled            bool              `json:"disabled,omitempty" yaml:"disabled"`
+}
+
+type DriversFile struct {
+	Drivers []DriverConfig `json:"drivers" yaml:"drivers"`
+}
+
+type driverEntry struct {
+	driver Driver
+	meta   DriverMeta
+}
+
+// DriverReload describes the registry after a successful reload.
+type DriverReload struct {
+	Path       string   `json:"path"`
+	Drivers    []string `json:"drivers"`
+	ReloadedAt string   `json:"reloaded_at"`
+}
+
+// Replace swaps the registered drivers. Tasks already running keep the
+// drivers they were started with; queued tasks pick from the new set.
+func (r *DriverRegistry) Replace(entries []driverEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.drivers = make([]Driver, 0, len(entries))
+	r.meta = map[string]DriverMeta{}
+	for _, e := range entries {
+		r.drivers = append(r.drivers, e.driver)
+		r.meta[e.driver.ID()] = e.meta
+	}
+}
+
+// defaultDriverSet is the built-in registry used when no drivers file is
+// configured.
+func defaultDriverSet() []driverEntry {
+	entries := []driverEntry{
+		{
+			driver: StubDriver{id: "model_a", latency: 120 * time.Millisecond, diff: "diff --git a/file b/file\n+stub change A\n", costUSD: 0.01, quality: 0.7},
+			meta: DriverMeta{
+				ID:           "model_a",
+				Kind:         "stub",
+				CostUSD:      0.01,
+				Capabilities: []string{"patch", "review"},
+				Description:  "local stub driver A",
+			},
+		},
+		{
+			driver: StubDriver{id: "model_b", latency: 140 * time.Millisecond, diff: "diff --git a/file b/file\n+stub change B\n", costUSD: 0.02, quality: 0.6},
+			meta: DriverMeta{
+				ID:           "model_b",
+				Kind:         "stub",
+				CostUSD:      0.02,
+				Capabilities: []string{"patch", "testgen"},
+				Description:  "local stub driver B",
+			},
+		},
+		{
+			driver: HuggingFaceDriver{
+				id:          "hf_gigachat3_702b_preview",
+				modelID:     envOr("HF_MODEL_ID", "ai-sage/GigaChat3-702B-A36B-preview"),
+				apiURL:      envOr("HF_API_URL", "https://router.huggingface.co/hf-inference/models"),
+				apiToken:    os.Getenv("HF_TOKEN"),
+				latency:     180 * time.Millisecond,
+				timeout:     time.Duration(envInt("HF_TIMEOUT_MS", 8000)) * time.Millisecond,
+				fallback:    splitCSV(os.Getenv("HF_FALLBACK_MODELS")),
+				pingTimeout: time.Duration(envInt("HF_PING_TIMEOUT_MS", 1500)) * time.Millisecond,
+				workspace:   envOr("ORCH_WORKSPACE_ROOT", "."),
+			},
+			meta: DriverMeta{
+				ID:           "hf_gigachat3_702b_preview",
+				Kind:         "huggingface",
+				CostUSD:      0.05,
+				Capabilities: []string{"patch", "review", "analysis"},
+				Description:  "HuggingFace Inference API driver",
+			},
+		},
+	}
+	if d, meta, ok := openAIDriverFromEnv(); ok {
+		entries = append(entries, driverEntry{driver: d, meta: meta})
+	}
+	return entries
+}
+
+// loadDriverSet reads the drivers file, or returns the built-in set when path
+// is empty. Files ending in .json are decoded as JSON, anything else as YAML;
+// both reject unknown fields.
+func loadDriverSet(path string) ([]driverEntry, error) {
+	if strings.TrimSpace(path) == "" {
+		return defaultDriverSet(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file DriversFile
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(strings.NewReader(string(data)))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&file)
+	} else {
+		dec := yaml.NewDecoder(strings.NewReader(string(data)))
+		dec.KnownFields(true)
+		if err = dec.Decode(&file); err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, errors.New("parse " + path + ": " + err.Error())
+	}
+
+	entries := []driverEntry{}
+	seen := map[string]bool{}
+	workspace := envOr("ORCH_WORKSPACE_ROOT", ".")
+	for i, cfg := range file.Drivers {
+		if cfg.Disabled {
+			continue
+		}
+		cfg.ID = strings.TrimSpace(cfg.ID)
+		if cfg.ID == "" {
+			return nil, errors.New("drivers[" + strconv.Itoa(i) + "]: id is required")
+		}
+		if seen[cfg.ID] {
+			return nil, errors.New("drivers[" + strconv.Itoa(i) + "]: duplicate id " + cfg.ID)
+		}
+		seen[cfg.ID] = true
+		entry, err := buildDriver(cfg, workspace)
+		if err != nil {
+			return nil, errors.New("driver " + cfg.ID + ": " + err.Error())
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no enabled drivers in " + path)
+	}
+	return entries, nil
+}
+
+func buildDriver(cfg DriverConfig, workspace string) (driverEntry, error) {
+	kind := strings.ToLower(strings.TrimSpace(cfg.Kind))
+	timeout := time.Duration(cfg.TimeoutMs) * time.Millisecond
+	apiKey := ""
+	if cfg.APIKeyEnv != "" {
+		apiKey = os.Getenv(cfg.APIKeyEnv)
+	}
+	meta := DriverMeta{
+		ID:           cfg.ID,
+		Kind:         kind,
+		CostUSD:      cfg.CostUSD,
+		Capabilities: append([]string{}, cfg.Capabilities...),
+		Description:  cfg.Description,
+	}
+
+	switch kind {
+	case "stub":
+		diff := cfg.Diff
+		if diff == "" {
+			diff = "diff --git a/file b/file\n+stub change " + cfg.ID + "\n"
+		}
+		return driverEntry{
+			driver: StubDriver{id: cfg.ID, latency: time.Duration(cfg.LatencyMs) * time.Millisecond, diff: diff, costUSD: cfg.CostUSD, quality: cfg.Quality},
+			meta:   meta,
+		}, nil
+	case "huggingface":
+		if cfg.Model == "" {
+			return driverEntry{}, errors.New("model is required")
+		}
+		if timeout <= 0 {
+			timeout = 8000 * time.Millisecond
+		}
+		pingTimeout := time.Duration(cfg.PingTimeoutMs) * time.Millisecond
+		if pingTimeout <= 0 {
+			pingTimeout = 1500 * time.Millisecond
+		}
+		endpoint := cfg.Endpoint
+		if endpoint == "" {
+			endpoint = "https://router.huggingface.co/hf-inference/models"
+		}
+		return driverEntry{
+			driver: HuggingFaceDriver{
+				id:          cfg.ID,
+				modelID:     cfg.Model,
+				apiURL:      endpoint,
+				apiToken:    apiKey,
+				timeout:     timeout,
+				fallback:    cfg.Fallbacks,
+				pingTimeout: pingTimeout,
+				workspace:   workspace,
+			},
+			meta: meta,
+		}, nil
+	case "openai":
+		if cfg.Endpoint == "" {
+			return driverEntry{}, errors.New("endpoint is required")
+		}
+		if cfg.Model == "" {
+			return driverEntry{}, errors.New("model is required")
+		}
+		if timeout <= 0 {
+			timeout = 60000 * time.Millisecond
+		}
+		if meta.CostUSD == 0 {
+			meta.CostUSD = cfg.CostPer1KPrompt + cfg.CostPer1KCompletion
+		}
+		return driverEntry{
+			driver: OpenAIDriver{
+				id:                  cfg.ID,
+				baseURL:             cfg.Endpoint,
+				apiKey:              apiKey,
+				model:               cfg.Model,
+				fallback:            cfg.Fallbacks,
+				timeout:             timeout,
+				systemPrompts:       lowerKeys(cfg.SystemPrompts),
+				promptCostPer1K:     cfg.CostPer1KPrompt,
+				completionCostPer1K: cfg.CostPer1KCompletion,
+				workspace:           workspace,
+			},
+			meta: meta,
+		}, nil
+	}
+	return driverEntry{}, errors.New("unknown kind " + strings.TrimSpace(cfg.Kind) + " (want stub, huggingface or openai)")
+}
+
+func lowerKeys(m map[string]string) map[string]string {
+	out := map[string]string{}
+	for k, v := range m {
+		out[strings.ToLower(k)] = v
+	}
+	return out
+}
+
+// driverReloader re-reads the drivers file into the live registry. A file
+// that fails to load leaves the current registry untouched.
+type driverReloader struct {
+	mu       sync.Mutex
+	path     string
+	registry *DriverRegistry
+	metrics  *Metrics
+}
+
+func (l *driverReloader) Reload() (DriverReload, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path == "" {
+		return DriverReload{}, errors.New("no drivers file configured (ORCH_DRIVERS_FILE)")
+	}
+	entries, err := loadDriverSet(l.path)
+	if err != nil {
+		if l.metrics != nil {
+			l.metrics.IncDriverReload(false)
+		}
+		return DriverReload{}, err
+	}
+	l.registry.Replace(entries)
+	if l.metrics != nil {
+		l.metrics.IncDriverReload(true)
+	}
+	ids := l.registry.List()
+	sort.Strings(ids)
+	return DriverReload{Path: l.path, Drivers: ids, ReloadedAt: time.Now().UTC().Format(time.RFC3339)}, nil
+}
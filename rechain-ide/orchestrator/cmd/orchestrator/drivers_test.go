@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const driversYAML = `
+drivers:
+  - id: local_stub
+    kind: stub
+    cost_usd: 0.001
+    latency_ms: 5
+    capabilities: [patch]
+  - id: local_vllm
+    kind: openai
+    endpoint: http://localhost:8000/v1
+    model: qwen2.5-coder
+    fallbacks: [llama3]
+    api_key_env: TEST_VLLM_KEY
+    cost_per_1k_prompt: 0.01
+    cost_per_1k_completion: 0.02
+    timeout_ms: 2000
+    system_prompts:
+      Patch: "only diffs"
+  - id: hf_off
+    kind: huggingface
+    model: some/model
+    disabled: true
+`
+
+func writeDriversFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("write drivers file: %v", err)
+	}
+	return path
+}
+
+func TestLoadDriverSet_YAML(t *testing.T) {
+	t.Setenv("TEST_VLLM_KEY", "k")
+	entries, err := loadDriverSet(writeDriversFile(t, "drivers.yaml", driversYAML))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected disabled driver to be skipped, got %d entries", len(entries))
+	}
+	vllm, ok := entries[1].driver.(OpenAIDriver)
+	if !ok {
+		t.Fatalf("expected OpenAIDriver, got %T", entries[1].driver)
+	}
+	if vllm.apiKey != "k" || vllm.model != "qwen2.5-coder" || len(vllm.fallback) != 1 || vllm.systemPrompt("patch") != "only diffs" {
+		t.Fatalf("unexpected driver config: %+v", vllm)
+	}
+	if entries[1].meta.CostUSD != 0.03 || entries[1].meta.Kind != "openai" {
+		t.Fatalf("unexpected meta: %+v", entries[1].meta)
+	}
+}
+
+func TestLoadDriverSet_Errors(t *testing.T) {
+	cases := []struct {
+		name    string
+		file    string
+		content string
+		wantErr string
+	}{
+		{name: "unknown kind", file: "d.yaml", content: "drivers:\n  - id: x\n    kind: grpc\n", wantErr: "unknown kind"},
+		{name: "duplicate id", file: "d.yaml", content: "drivers:\n  - id: x\n    kind: stub\n  - id: x\n    kind: stub\n", wantErr: "duplicate id"},
+		{name: "openai without endpoint", file: "d.yaml", content: "drivers:\n  - id: x\n    kind: openai\n    model: m\n", wantErr: "endpoint is required"},
+		{name: "yaml unknown field", file: "d.yaml", content: "drivers:\n  - id: x\n    kind: stub\n    timout_ms: 5\n", wantErr: "timout_ms"},
+		{name: "json unknown field", file: "d.json", content: `{"drivers":[{"id":"x","kind":"stub","costs":1}]}`, wantErr: "unknown field"},
+		{name: "empty", file: "d.json", content: `{"drivers":[]}`, wantErr: "no enabled drivers"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadDriverSet(writeDriversFile(t, tc.file, tc.content))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDriverReloader_KeepsRegistryOnFailure(t *testing.T) {
+	path := writeDriversFile(t, "drivers.json", `{"drivers":[{"id":"first","kind":"stub"}]}`)
+	registry := NewDriverRegistry()
+	metrics := &Metrics{}
+	reloader := &driverReloader{path: path, registry: registry, metrics: metrics}
+
+	if _, err := reloader.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	os.WriteFile(path, []byte(`{"drivers":[{"id":"second","kind":"openai","endpoint":"http://x/v1","model":"m","fallbacks":["m2"]}]}`), 0644)
+	res, err := reloader.Reload()
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if len(res.Drivers) != 1 || res.Drivers[0] != "second" {
+		t.Fatalf("expected live registry to be replaced, got %v", res.Drivers)
+	}
+	if entries := registry.ModelEntries(); len(entries) != 2 || entries[0].ID != "m" || entries[1].Source != "fallback" {
+		t.Fatalf("expected /models entries for the new driver, got %+v", entries)
+	}
+
+	os.WriteFile(path, []byte(`{"drivers":[{"id":"broken","kind":"nope"}]}`), 0644)
+	if _, err := reloader.Reload(); err == nil {
+		t.Fatal("expected invalid file to fail")
+	}
+	if ids := registry.List(); len(ids) != 1 || ids[0] != "second" {
+		t.Fatalf("expected registry to be unchanged after a failed reload, got %v", ids)
+	}
+	snap := metrics.Snapshot()
+	if snap["driver_reloads"] != 2 || snap["driver_reload_errs"] != 1 {
+		t.Fatalf("unexpected reload counters: %v", snap)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TaskEvent is a single task lifecycle update. Status and Trace carry the same
+// payloads as /tasks/{id} and /tasks/{id}/trace.
+type TaskEvent struct {
+	ID          int64             `json:"id"`
+	Type        string            `json:"type"`
+	TaskID      string            `json:"task_id"`
+	At          string            `json:"at"`
+	Status      *TaskStatus       `json:"status,omitempty"`
+	Trace       *TaskTrace        `json:"trace,omitempty"`
+	Result      *TraceModelResult `json:"result,omitempty"`
+	Merge       *MergeResult      `json:"merge,omitempty"`
+	MergeSource string            `json:"merge_source,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+type eventSub struct {
+	taskID string
+	ch     chan TaskEvent
+}
+
+// EventHub fans task events out to SSE subscribers and keeps a bounded
+// backlog so clients can resume with Last-Event-ID.
+type EventHub struct {
+	mu      sync.Mutex
+	lastID  int64
+	backlog []TaskEvent
+	max     int
+	subs    map[*eventSub]bool
+}
+
+func NewEventHub(size int) *EventHub {
+	if size <= 0 {
+		size = 1024
+	}
+	return &EventHub{max: size, subs: map[*eventSub]bool{}}
+}
+
+func (h *EventHub) Publish(ev TaskEvent) TaskEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID++
+	ev.ID = h.lastID
+	if ev.At == "" {
+		ev.At = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	h.backlog = append(h.backlog, ev)
+	if len(h.backlog) > h.max {
+		h.backlog = h.backlog[len(h.backlog)-h.max:]
+	}
+	for sub := range h.subs {
+		if sub.taskID != "" && sub.taskID != ev.TaskID {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			// Slow consumer: drop it so it reconnects and resumes from the backlog.
+			close(sub.ch)
+			delete(h.subs, sub)
+		}
+	}
+	return ev
+}
+
+// Subscribe registers a subscriber for one task (or all tasks when taskID is
+// empty). It returns the buffered events after lastID and the current last
+// event ID.
+func (h *EventHub) Subscribe(taskID string, lastID int64) ([]TaskEvent, int64, *eventSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	missed := []TaskEvent{}
+	if lastID > 0 {
+		for _, ev := range h.backlog {
+			if ev.ID > lastID && (taskID == "" || ev.TaskID == taskID) {
+				missed = append(missed, ev)
+			}
+		}
+	}
+	sub := &eventSub{taskID: taskID, ch: make(chan TaskEvent, 64)}
+	h.subs[sub] = true
+	return missed, h.lastID, sub
+}
+
+func (h *EventHub) Unsubscribe(sub *eventSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[sub] {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+}
+
+func (s *TaskStore) publish(ev TaskEvent) {
+	if s.events != nil {
+		s.events.Publish(ev)
+	}
+}
+
+// publishLocked announces the current status and trace of a task. Callers
+// must hold s.mu.
+func (s *TaskStore) publishLocked(id string) {
+	if s.events == nil {
+		return
+	}
+	status := s.statuses[id]
+	trace := s.traces[id]
+	s.events.Publish(TaskEvent{Type: status.State, TaskID: id, Status: &status, Trace: &trace})
+}
+
+func serveEvents(w http.ResponseWriter, r *http.Request, hub *EventHub, store *TaskStore, taskID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	snapshot := func() (TaskEvent, bool) {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		status, ok := store.statuses[taskID]
+		trace := store.traces[taskID]
+		return TaskEvent{Type: "snapshot", TaskID: taskID, Status: &status, Trace: &trace}, ok
+	}
+	if taskID != "" {
+		if _, ok := snapshot(); !ok {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	lastID := int64(0)
+	raw := strings.TrimSpace(r.Header.Get("Last-Event-ID"))
+	if raw == "" {
+		raw = strings.TrimSpace(r.URL.Query().Get("last_event_id"))
+	}
+	if raw != "" {
+		if n, err := strconv.ParseInt(raw, 10, 64); err == nil && n > 0 {
+			lastID = n
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); errors.Is(err, http.ErrNotSupported) {
+		return
+	}
+
+	missed, currentID, sub := hub.Subscribe(taskID, lastID)
+	defer hub.Unsubscribe(sub)
+
+	done := false
+	send := func(ev TaskEvent) bool {
+		data, _ := json.Marshal(ev)
+		if _, err := w.Write([]byte("id: " + strconv.FormatInt(ev.ID, 10) + "\nevent: " + ev.Type + "\ndata: " + string(data) + "\n\n")); err != nil {
+			return false
+		}
+		if rc.Flush() != nil {
+			return false
+		}
+		if taskID != "" && ev.Type != "snapshot" && isTerminalState(ev.Type) {
+			done = true
+		}
+		return true
+	}
+
+	for _, ev := range missed {
+		if !send(ev) || done {
+			return
+		}
+	}
+	if taskID != "" {
+		// Send the current state on a fresh connection, or when resuming on a
+		// task whose terminal event already fell out of the backlog.
+		snap, _ := snapshot()
+		terminal := isTerminalState(snap.Status.State)
+		if lastID == 0 || terminal {
+			snap.ID = currentID
+			snap.At = time.Now().UTC().Format(time.RFC3339Nano)
+			if !send(snap) || terminal {
+				return
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-sub.ch:
+			if !ok || !send(ev) || done {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(": ping\n\n")); err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rechain-ide/shared/logging"
+)
+
+func setTaskState(store *TaskStore, id string, state string) {
+	store.mu.Lock()
+	store.statuses[id] = TaskStatus{SchemaVersion: schemaVersion, ID: id, State: state}
+	store.traces[id] = TaskTrace{SchemaVersion: schemaVersion, TaskID: id, State: state}
+	store.persistLocked(id)
+	store.mu.Unlock()
+}
+
+func readEventTypes(t *testing.T, body *bufio.Reader, n int) ([]string, string) {
+	t.Helper()
+	types := []string{}
+	lastID := ""
+	for len(types) < n {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read stream after %v: %v", types, err)
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "id: ") {
+			lastID = strings.TrimPrefix(line, "id: ")
+		}
+		if strings.HasPrefix(line, "event: ") {
+			types = append(types, strings.TrimPrefix(line, "event: "))
+		}
+	}
+	return types, lastID
+}
+
+func TestTaskEventsStreamAndResume(t *testing.T) {
+	store := NewTaskStore()
+	store.events = NewEventHub(16)
+	setTaskState(store, "task_sse", "queued")
+
+	srv := httptest.NewServer(logging.WithRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(w, r, store.events, store, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/tasks/"), "/events"))
+	})))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/tasks/task_sse/events")
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	body := bufio.NewReader(resp.Body)
+	types, _ := readEventTypes(t, body, 1)
+	if types[0] != "snapshot" {
+		t.Fatalf("expected snapshot first, got %v", types)
+	}
+
+	setTaskState(store, "task_sse", "running")
+	store.publish(TaskEvent{Type: "driver_result", TaskID: "task_sse", Result: &TraceModelResult{ModelID: "model_a"}})
+	types, runningID := readEventTypes(t, body, 1)
+	if types[0] != "running" {
+		t.Fatalf("expected running, got %v", types)
+	}
+
+	setTaskState(store, "task_sse", "completed")
+	types, _ = readEventTypes(t, body, 2)
+	if types[0] != "driver_result" || types[1] != "completed" {
+		t.Fatalf("expected driver_result then completed, got %v", types)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/tasks/task_sse/events", nil)
+	req.Header.Set("Last-Event-ID", runningID)
+	client := &http.Client{Timeout: 2 * time.Second}
+	resumed, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("resume stream: %v", err)
+	}
+	defer resumed.Body.Close()
+	types, _ = readEventTypes(t, bufio.NewReader(resumed.Body), 2)
+	if types[0] != "driver_result" || types[1] != "completed" {
+		t.Fatalf("expected resumed stream to replay missed events, got %v", types)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"rechain-ide/shared/tracing"
+)
+
+const hedgeMinSamples = 5
+
+// TraceHedge records a hedged request: the fallback driver started because the
+// primary ran past its latency percentile, and which of the two won.
+type TraceHedge struct {
+	Primary string `json:"primary"`
+	Hedge   string `json:"hedge"`
+	AfterMs int64  `json:"after_ms"`
+	Winner  string `json:"winner,omitempty"`
+}
+
+type fanOutOptions struct {
+	driverTimeout time.Duration
+	quorum        int
+	hedge         bool
+	hedgePct      float64
+	hedgeAfter    time.Duration
+	hedgePool     []Driver
+}
+
+type driverOutcome struct {
+	driver string
+	res    ModelResult
+	err    error
+}
+
+type slotOutcome struct {
+	slot     int
+	ok       bool
+	res      ModelResult
+	failures []driverOutcome
+	hedge    *TraceHedge
+}
+
+type fanOutReport struct {
+	results []ModelResult
+	failed  []string
+	skipped []string
+	hedges  []TraceHedge
+}
+
+// hedgePool hands out each hedge driver at most once per task.
+type hedgePool struct {
+	mu      sync.Mutex
+	drivers []Driver
+}
+
+func (p *hedgePool) take() Driver {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.drivers) == 0 {
+		return nil
+	}
+	d := p.drivers[0]
+	p.drivers = p.drivers[1:]
+	return d
+}
+
+func fanOutOptionsFor(spec TaskSpec, drivers []Driver, selected []Driver) fanOutOptions {
+	opts := fanOutOptions{
+		driverTimeout: time.Duration(constraintInt(spec.Constraints, "driver_timeout_ms", 0)) * time.Millisecond,
+		quorum:        constraintInt(spec.Constraints, "quorum", 0),
+		hedge:         constraintBool(spec.Constraints, "hedge", false),
+		hedgePct:      constraintFloat(spec.Constraints, "hedge_percentile", 95),
+		hedgeAfter:    time.Duration(constraintInt(spec.Constraints, "hedge_after_ms", 0)) * time.Millisecond,
+	}
+	if !opts.hedge {
+		return opts
+	}
+	ids := splitCSV(constraintString(spec.Constraints, "hedge_models"))
+	if len(ids) == 0 {
+		ids = splitCSV(constraintString(spec.Constraints, "fallback_models"))
+	}
+	inUse := map[string]bool{}
+	for _, d := range selected {
+		inUse[d.ID()] = true
+	}
+	for _, id := range ids {
+		if inUse[id] {
+			continue
+		}
+		if d := findDriverByID(drivers, id); d != nil && breakersGlobal.Allow(id) {
+			inUse[id] = true
+			opts.hedgePool = append(opts.hedgePool, d)
+		}
+	}
+	return opts
+}
+
+// hedgeDelay is how long a primary may run before a hedge is started: the
+// configured percentile of its observed latency, or hedge_after_ms while there
+// is not enough history.
+func (o fanOutOptions) hedgeDelay(driverID string, metrics *Metrics) time.Duration {
+	if metrics != nil {
+		if ms, ok := metrics.ModelLatencyPercentile(driverID, o.hedgePct, hedgeMinSamples); ok {
+			return time.Duration(ms) * time.Millisecond
+		}
+	}
+	return o.hedgeAfter
+}
+
+// runFanOut runs the selected drivers concurrently. It returns once every
+// driver finished, or as soon as the quorum of successful results is reached,
+// in which case the remaining drivers are canceled and reported as skipped.
+func runFanOut(ctx context.Context, store *TaskStore, taskID string, selected []Driver, spec TaskSpec, metrics *Metrics, opts fanOutOptions) fanOutReport {
+	fanCtx, stopAll := context.WithCancel(ctx)
+	defer stopAll()
+	pool := &hedgePool{drivers: opts.hedgePool}
+	outcomes := make(chan slotOutcome, len(selected))
+	for i, d := range selected {
+		go func(i int, d Driver) {
+			outcomes <- runSlot(fanCtx, i, d, spec, metrics, opts, pool, store, taskID)
+		}(i, d)
+	}
+
+	report := fanOutReport{}
+	bySlot := make([]*ModelResult, len(selected))
+	successes := 0
+	quorumReached := false
+	for n := 0; n < len(selected); n++ {
+		o := <-outcomes
+		if o.hedge != nil {
+			report.hedges = append(report.hedges, *o.hedge)
+		}
+		if o.ok {
+			res := o.res
+			bySlot[o.slot] = &res
+			successes++
+			if opts.quorum > 0 && successes >= opts.quorum && !quorumReached {
+				quorumReached = true
+				logTask(ctx, logInfo, "quorum", "", "quorum of "+strconv.Itoa(opts.quorum)+" reached; canceling the remaining drivers", nil)
+				stopAll()
+			}
+			continue
+		}
+		for _, f := range o.failures {
+			if quorumReached && ctx.Err() == nil {
+				report.skipped = append(report.skipped, f.driver)
+			} else {
+				report.failed = append(report.failed, f.driver)
+			}
+		}
+	}
+	for _, r := range bySlot {
+		if r != nil {
+			report.results = append(report.results, *r)
+		}
+	}
+	return report
+}
+
+func runSlot(ctx context.Context, slot int, primary Driver, spec TaskSpec, metrics *Metrics, opts fanOutOptions, pool *hedgePool, store *TaskStore, taskID string) slotOutcome {
+	slotCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan driverOutcome, 2)
+	launch := func(d Driver) {
+		go func() {
+			dctx := slotCtx
+			if opts.driverTimeout > 0 {
+				var stop context.CancelFunc
+				dctx, stop = context.WithTimeout(slotCtx, opts.driverTimeout)
+				defer stop()
+			}
+			dctx, span := tracing.Start(dctx, "driver "+d.ID(), tracing.KindInternal)
+			res, err := runWithRetry(dctx, d, spec, metrics)
+			span.End(err)
+			ch <- driverOutcome{driver: d.ID(), res: res, err: err}
+		}()
+	}
+
+	out := slotOutcome{slot: slot}
+	launch(primary)
+	running := 1
+	var hedgeTimer <-chan time.Time
+	after := time.Duration(0)
+	if opts.hedge && len(opts.hedgePool) > 0 {
+		if after = opts.hedgeDelay(primary.ID(), metrics); after > 0 {
+			t := time.NewTimer(after)
+			defer t.Stop()
+			hedgeTimer = t.C
+		}
+	}
+	for running > 0 {
+		select {
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			if d := pool.take(); d != nil {
+				launch(d)
+				running++
+				out.hedge = &TraceHedge{Primary: primary.ID(), Hedge: d.ID(), AfterMs: after.Milliseconds()}
+				logTask(ctx, logInfo, "hedge", d.ID(), primary.ID()+" still running after "+after.String()+"; started hedge", nil)
+				if metrics != nil {
+					metrics.IncHedge()
+				}
+			}
+		case o := <-ch:
+			running--
+			publishDriverResult(store, taskID, o.driver, o.res, o.err)
+			ledgerGlobal.RecordDriverCall(spec, taskID, o.driver, o.res, o.err)
+			if o.err != nil {
+				if ctx.Err() != nil {
+					logTask(ctx, logInfo, "driver_canceled", o.driver, o.err.Error(), nil)
+				} else {
+					logTask(ctx, logError, "driver_failed", o.driver, o.err.Error(), nil)
+				}
+				out.failures = append(out.failures, o)
+				continue
+			}
+			logTask(ctx, logInfo, "driver_result", o.driver, "result in "+strconv.FormatFloat(metricValue(o.res, "latency_ms"), 'f', -1, 64)+"ms", nil)
+			if metrics != nil {
+				metrics.ObserveModelLatency(o.res.ModelID, int64(metricValue(o.res, "latency_ms")))
+			}
+			if out.hedge != nil {
+				out.hedge.Winner = o.driver
+			}
+			out.ok = true
+			out.res = o.res
+			// Stop the other driver of a hedged slot, but wait for it so its
+			// call is still booked: it may have been billed before it
+			// stopped.
+			cancel()
+			for ; running > 0; running-- {
+				l := <-ch
+				publishDriverResult(store, taskID, l.driver, l.res, l.err)
+				ledgerGlobal.RecordDriverCall(spec, taskID, l.driver, l.res, l.err)
+				if l.err != nil {
+					logTask(ctx, logInfo, "driver_canceled", l.driver, "lost the hedge to "+o.driver+": "+l.err.Error(), nil)
+				}
+			}
+			return out
+		}
+	}
+	return out
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func stub(id string, latency time.Duration) StubDriver {
+	return StubDriver{id: id, latency: latency, diff: "diff --git a/" + id + " b/" + id + "\n+" + id + "\n"}
+}
+
+func TestRunFanOut_RunsDriversConcurrently(t *testing.T) {
+	drivers := []Driver{stub("a", 150*time.Millisecond), stub("b", 150*time.Millisecond), stub("c", 150*time.Millisecond)}
+	spec := TaskSpec{ID: "task_fan"}
+
+	start := time.Now()
+	report := runFanOut(context.Background(), NewTaskStore(), spec.ID, drivers, spec, &Metrics{}, fanOutOptionsFor(spec, drivers, drivers))
+	elapsed := time.Since(start)
+
+	if len(report.results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(report.results))
+	}
+	if report.results[0].ModelID != "a" || report.results[2].ModelID != "c" {
+		t.Fatalf("expected results in selection order, got %s..%s", report.results[0].ModelID, report.results[2].ModelID)
+	}
+	if elapsed > 400*time.Millisecond {
+		t.Fatalf("expected concurrent fan-out, took %s", elapsed)
+	}
+}
+
+func TestRunFanOut_PerDriverTimeout(t *testing.T) {
+	drivers := []Driver{stub("fast", 10*time.Millisecond), stub("slow", 2*time.Second)}
+	spec := TaskSpec{ID: "task_timeout", Constraints: []Constraint{{Key: "driver_timeout_ms", Value: float64(100)}}}
+
+	report := runFanOut(context.Background(), NewTaskStore(), spec.ID, drivers, spec, &Metrics{}, fanOutOptionsFor(spec, drivers, drivers))
+
+	if len(report.results) != 1 || report.results[0].ModelID != "fast" {
+		t.Fatalf("expected only fast result, got %+v", report.results)
+	}
+	if len(report.failed) != 1 || report.failed[0] != "slow" {
+		t.Fatalf("expected slow driver to time out, got %v", report.failed)
+	}
+}
+
+func TestRunFanOut_QuorumReturnsEarly(t *testing.T) {
+	drivers := []Driver{stub("fast", 10*time.Millisecond), stub("slow", 2*time.Second)}
+	spec := TaskSpec{ID: "task_quorum", Constraints: []Constraint{{Key: "quorum", Value: float64(1)}}}
+
+	start := time.Now()
+	report := runFanOut(context.Background(), NewTaskStore(), spec.ID, drivers, spec, &Metrics{}, fanOutOptionsFor(spec, drivers, drivers))
+
+	if time.Since(start) > time.Second {
+		t.Fatal("expected quorum to cancel the slow driver")
+	}
+	if len(report.results) != 1 || report.results[0].ModelID != "fast" {
+		t.Fatalf("expected fast result, got %+v", report.results)
+	}
+	if len(report.skipped) != 1 || report.skipped[0] != "slow" {
+		t.Fatalf("expected slow driver reported as skipped, got %v", report.skipped)
+	}
+}
+
+func TestRunFanOut_HedgeAfterLatencyPercentile(t *testing.T) {
+	primary := stub("primary", 2*time.Second)
+	backup := stub("backup", 10*time.Millisecond)
+	all := []Driver{primary, backup}
+	spec := TaskSpec{ID: "task_hedge", Constraints: []Constraint{
+		{Key: "hedge", Value: true},
+		{Key: "hedge_percentile", Value: float64(90)},
+		{Key: "fallback_models", Value: "backup"},
+	}}
+	metrics := &Metrics{}
+	for i := 0; i < 10; i++ {
+		metrics.ObserveModelLatency("primary", 50)
+	}
+	ledger := NewCostLedger()
+	prev := ledgerGlobal
+	ledgerGlobal = ledger
+	defer func() { ledgerGlobal = prev }()
+
+	start := time.Now()
+	report := runFanOut(context.Background(), NewTaskStore(), spec.ID, []Driver{primary}, spec, metrics, fanOutOptionsFor(spec, all, []Driver{primary}))
+
+	if time.Since(start) > time.Second {
+		t.Fatal("expected hedge to win before the primary finished")
+	}
+	if len(report.results) != 1 || report.results[0].ModelID != "backup" {
+		t.Fatalf("expected backup result, got %+v", report.results)
+	}
+	if len(report.hedges) != 1 || report.hedges[0].Winner != "backup" || report.hedges[0].AfterMs != 50 {
+		t.Fatalf("unexpected hedge record: %+v", report.hedges)
+	}
+	if metrics.Snapshot()["hedges"] != 1 {
+		t.Fatalf("expected hedge counter to be incremented")
+	}
+	rows := ledger.Aggregate([]string{"model"}, BillingFilter{})
+	if len(rows) != 2 || rows[0].Model != "backup" || rows[1].Model != "primary" || rows[1].FailedCalls != 1 {
+		t.Fatalf("expected the canceled primary booked next to the hedge, got %+v", rows)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeHF(t *testing.T, generations map[string]string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			return
+		}
+		model := strings.TrimPrefix(r.URL.Path, "/")
+		json.NewEncoder(w).Encode([]map[string]string{{"generated_text": generations[model]}})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHuggingFaceDriver_RewriteBecomesDiff(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "pkg"), 0755)
+	os.WriteFile(filepath.Join(root, "pkg", "greet.go"), []byte("package pkg\n\nconst Greeting = \"hi\"\n"), 0644)
+	srv := fakeHF(t, map[string]string{
+		"primary": "Updated pkg/greet.go:\n```go\npackage pkg\n\nconst Greeting = \"hello\"\n```\n",
+	})
+	d := HuggingFaceDriver{id: "hf", modelID: "primary", apiURL: srv.URL, timeout: time.Second, pingTimeout: time.Second, workspace: root}
+
+	res, err := d.Run(context.Background(), TaskSpec{Input: "greet", Context: []ContextRef{{Type: "file", Path: "pkg/greet.go"}}})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	for _, want := range []string{"diff --git a/pkg/greet.go b/pkg/greet.go", "-const Greeting = \"hi\"", "+const Greeting = \"hello\""} {
+		if !strings.Contains(res.Diff, want) {
+			t.Fatalf("expected %q in diff:\n%s", want, res.Diff)
+		}
+	}
+}
+
+func TestHuggingFaceDriver_UnparseableGenerationFallsBack(t *testing.T) {
+	srv := fakeHF(t, map[string]string{
+		"primary":  "Sorry, I cannot help with that.",
+		"fallback": "```diff\n--- a/README.md\n+++ b/README.md\n@@ -1 +1 @@\n-old\n+new\n```",
+	})
+	metricsGlobal = &Metrics{}
+	defer func() { metricsGlobal = nil }()
+	d := HuggingFaceDriver{id: "hf", modelID: "primary", fallback: []string{"fallback"}, apiURL: srv.URL, timeout: time.Second, pingTimeout: time.Second}
+
+	res, err := d.Run(context.Background(), TaskSpec{Input: "readme"})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if !strings.Contains(res.Diff, "+new") {
+		t.Fatalf("expected fallback model diff, got %q", res.Diff)
+	}
+	if metricsGlobal.Snapshot()["hf_diff_errors"] != 1 {
+		t.Fatalf("expected one diff parse error, got %v", metricsGlobal.Snapshot())
+	}
+
+	d.fallback = nil
+	if _, err := d.Run(context.Background(), TaskSpec{Input: "readme"}); err == nil || !strings.Contains(err.Error(), "no valid diff") {
+		t.Fatalf("expected parse failure to surface as driver error, got %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	errTaskExists          = errors.New("task id already exists")
+	errIdempotencyConflict = errors.New("idempotency key reused with a different request")
+)
+
+type idempotencyEntry struct {
+	taskID      string
+	fingerprint string
+	at          time.Time
+}
+
+// IdempotencyIndex remembers which task an Idempotency-Key created, per
+// requester, for the retention window.
+type IdempotencyIndex struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]idempotencyEntry
+	replayed  int
+	conflicts int
+	now       func() time.Time
+}
+
+func NewIdempotencyIndex(ttl time.Duration) *IdempotencyIndex {
+	return &IdempotencyIndex{ttl: ttl, entries: map[string]idempotencyEntry{}, now: time.Now}
+}
+
+// specFingerprint identifies a submission by its body. The task ID is left
+// out since it is generated when the client does not supply one, and so is
+// the callback secret, which the store never keeps.
+func specFingerprint(spec TaskSpec) string {
+	spec, _ = splitCallbackSecret(spec)
+	spec.ID = ""
+	if spec.SchemaVersion == "" {
+		spec.SchemaVersion = schemaVersion
+	}
+	raw, _ := json.Marshal(spec)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func idempotencyScope(requester string, key string) string {
+	return requester + "\n" + key
+}
+
+// Reserve claims key for taskID. When the key is already held it returns
+// the original task ID, or errIdempotencyConflict if the request differs
+// (another body, or another client-supplied task ID).
+func (x *IdempotencyIndex) Reserve(requester string, key string, fingerprint string, clientID string, taskID string) (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	now := x.now()
+	x.pruneLocked(now)
+	scope := idempotencyScope(requester, key)
+	if e, ok := x.entries[scope]; ok {
+		if e.fingerprint != fingerprint || (clientID != "" && clientID != e.taskID) {
+			x.conflicts++
+			return "", errIdempotencyConflict
+		}
+		x.replayed++
+		return e.taskID, nil
+	}
+	x.entries[scope] = idempotencyEntry{taskID: taskID, fingerprint: fingerprint, at: now}
+	return "", nil
+}
+
+// Release forgets a reservation whose task was never created.
+func (x *IdempotencyIndex) Release(requester string, key string, taskID string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	scope := idempotencyScope(requester, key)
+	if e, ok := x.entries[scope]; ok && e.taskID == taskID {
+		delete(x.entries, scope)
+	}
+}
+
+// Restore re-registers a key loaded from the task store.
+func (x *IdempotencyIndex) Restore(requester string, key string, fingerprint string, taskID string, at time.Time) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.now().Sub(at) >= x.ttl {
+		return
+	}
+	x.entries[idempotencyScope(requester, key)] = idempotencyEntry{taskID: taskID, fingerprint: fingerprint, at: at}
+}
+
+// Fresh reports whether a task started at startedAt is inside the
+// retention window.
+func (x *IdempotencyIndex) Fresh(startedAt string) bool {
+	at, err := time.Parse(time.RFC3339, startedAt)
+	return err == nil && x.now().Sub(at) < x.ttl
+}
+
+// CountReplay and CountConflict record outcomes decided outside Reserve
+// (client-supplied task ID collisions).
+func (x *IdempotencyIndex) CountReplay() {
+	x.mu.Lock()
+	x.replayed++
+	x.mu.Unlock()
+}
+
+func (x *IdempotencyIndex) CountConflict() {
+	x.mu.Lock()
+	x.conflicts++
+	x.mu.Unlock()
+}
+
+func (x *IdempotencyIndex) Stats() (int, int, int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.pruneLocked(x.now())
+	return x.replayed, x.conflicts, len(x.entries)
+}
+
+func (x *IdempotencyIndex) pruneLocked(now time.Time) {
+	for scope, e := range x.entries {
+		if now.Sub(e.at) >= x.ttl {
+			delete(x.entries, scope)
+		}
+	}
+}
+
+// restoreIdempotencyKeys rebuilds the index from persisted task traces.
+func (s *TaskStore) restoreIdempotencyKeys(x *IdempotencyIndex) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, trace := range s.traces {
+		if trace.IdempotencyKey == "" {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, trace.StartedAt)
+		if err != nil {
+			continue
+		}
+		spec := s.specs[id]
+		x.Restore(requesterKey(spec), trace.IdempotencyKey, specFingerprint(spec), id, at)
+	}
+}
+
+// repeatOf checks a client-supplied task ID against the store. It returns
+// the existing status when the submission repeats that task within the
+// retention window, errTaskExists when the ID is taken otherwise, and false
+// when the ID is new.
+func (s *TaskStore) repeatOf(x *IdempotencyIndex, id string, fingerprint string) (TaskStatus, bool, error) {
+	s.mu.Lock()
+	status, ok := s.statuses[id]
+	spec := s.specs[id]
+	s.mu.Unlock()
+	if !ok {
+		return TaskStatus{}, false, nil
+	}
+	if specFingerprint(spec) != fingerprint || !x.Fresh(status.StartedAt) {
+		x.CountConflict()
+		return TaskStatus{}, true, errTaskExists
+	}
+	x.CountReplay()
+	return status, true, nil
+}
+
+func writeIdempotentReplay(w http.ResponseWriter, status TaskStatus) {
+	w.Header().Set("Idempotent-Replayed", "true")
+	writeJSON(w, status)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyIndex_Reserve(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+	x := NewIdempotencyIndex(time.Hour)
+	x.now = clock.now
+	body := specFingerprint(TaskSpec{Type: "patch", Input: "add logging"})
+	other := specFingerprint(TaskSpec{Type: "patch", Input: "remove logging"})
+
+	if id, err := x.Reserve("ci", "k1", body, "", "task_1"); id != "" || err != nil {
+		t.Fatalf("first use should reserve, got %q %v", id, err)
+	}
+	cases := []struct {
+		name        string
+		requester   string
+		fingerprint string
+		clientID    string
+		wantID      string
+		wantErr     error
+	}{
+		{"same body repeats", "ci", body, "", "task_1", nil},
+		{"same body and task id repeats", "ci", body, "task_1", "task_1", nil},
+		{"different body conflicts", "ci", other, "", "", errIdempotencyConflict},
+		{"different task id conflicts", "ci", body, "task_2", "", errIdempotencyConflict},
+		{"keys are per requester", "bot", other, "", "", nil},
+	}
+	for _, tc := range cases {
+		id, err := x.Reserve(tc.requester, "k1", tc.fingerprint, tc.clientID, "task_new")
+		if id != tc.wantID || !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: got %q %v, want %q %v", tc.name, id, err, tc.wantID, tc.wantErr)
+		}
+	}
+
+	clock.advance(time.Hour)
+	if id, _ := x.Reserve("ci", "k1", other, "", "task_3"); id != "" {
+		t.Fatalf("expired key should be reusable, got %q", id)
+	}
+	x.Release("ci", "k1", "task_3")
+	if id, _ := x.Reserve("ci", "k1", body, "", "task_4"); id != "" {
+		t.Fatalf("released key should be reusable, got %q", id)
+	}
+	if replayed, conflicts, _ := x.Stats(); replayed != 2 || conflicts != 2 {
+		t.Fatalf("unexpected stats: replayed=%d conflicts=%d", replayed, conflicts)
+	}
+}
+
+func TestTaskIDCollision(t *testing.T) {
+	store := NewTaskStore()
+	queue := NewTaskQueue(10, time.Second)
+	x := NewIdempotencyIndex(time.Hour)
+	spec := TaskSpec{ID: "task_ci_42", Type: "patch", Input: "add logging"}
+	if _, err := submitTask(store, queue, &Metrics{}, spec, TaskTrace{IdempotencyKey: "k"}); err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+
+	status, found, err := store.repeatOf(x, spec.ID, specFingerprint(spec))
+	if !found || err != nil || status.ID != spec.ID || status.State != "queued" {
+		t.Fatalf("expected repeat of queued task, got %+v %v %v", status, found, err)
+	}
+	changed := spec
+	changed.Input = "something else"
+	if _, _, err := store.repeatOf(x, spec.ID, specFingerprint(changed)); !errors.Is(err, errTaskExists) {
+		t.Fatalf("expected conflict for a different body, got %v", err)
+	}
+	if _, err := submitTask(store, queue, &Metrics{}, spec, TaskTrace{}); !errors.Is(err, errTaskExists) {
+		t.Fatalf("submitTask must not overwrite an existing task, got %v", err)
+	}
+	if queue.Depth() != 1 {
+		t.Fatalf("expected one queued task, got %d", queue.Depth())
+	}
+
+	restored := NewIdempotencyIndex(time.Hour)
+	store.restoreIdempotencyKeys(restored)
+	if id, _ := restored.Reserve("anonymous", "k", specFingerprint(spec), "", "task_x"); id != spec.ID {
+		t.Fatalf("expected key restored from the store, got %q", id)
+	}
+
+	signed := TaskSpec{ID: "task_ci_43", Type: "patch", Input: "add logging", Constraints: []Constraint{
+		{Key: "callback_url", Value: "https://ci.example.com/hook"},
+		{Key: "callback_secret", Value: "s3cret"},
+	}}
+	if _, err := submitTask(store, queue, &Metrics{}, signed, TaskTrace{IdempotencyKey: "signed"}); err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	if status, found, err := store.repeatOf(x, signed.ID, specFingerprint(signed)); !found || err != nil || status.ID != signed.ID {
+		t.Fatalf("expected a retry with a callback secret to repeat the task, got %+v %v %v", status, found, err)
+	}
+	restored = NewIdempotencyIndex(time.Hour)
+	store.restoreIdempotencyKeys(restored)
+	if id, err := restored.Reserve("anonymous", "signed", specFingerprint(signed), "", "task_y"); err != nil || id != signed.ID {
+		t.Fatalf("expected the restored key to match a retry with a callback secret, got %q %v", id, err)
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rechain-ide/shared/auth"
+)
+
+// billingGroups are the dimensions /billing can aggregate by.
+var billingGroups = []string{"requester", "model", "day", "month"}
+
+// LedgerEntry is one driver call.
+type LedgerEntry struct {
+	At               string  `json:"at"`
+	TaskID           string  `json:"task_id"`
+	Requester        string  `json:"requester"`
+	Model            string  `json:"model"`
+	CostUSD          float64 `json:"cost_usd"`
+	PromptTokens     int     `json:"prompt_tokens,omitempty"`
+	CompletionTokens int     `json:"completion_tokens,omitempty"`
+	LatencyMs        int64   `json:"latency_ms,omitempty"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// BillingRow aggregates ledger entries for one group. Group columns not
+// requested are left empty.
+type BillingRow struct {
+	Requester        string  `json:"requester,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Day              string  `json:"day,omitempty"`
+	Month            string  `json:"month,omitempty"`
+	Calls            int     `json:"calls"`
+	FailedCalls      int     `json:"failed_calls"`
+	CostUSD          float64 `json:"cost_usd"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+}
+
+// BillingFilter selects ledger entries by requester, model and an inclusive
+// range of UTC days (YYYY-MM-DD); empty fields match everything.
+type BillingFilter struct {
+	Requester string
+	Model     string
+	From      string
+	To        string
+}
+
+// CostLedger records every driver call with its cost and token usage. Calls
+// are rolled up per day, requester and model in memory and, when a path is
+// set, appended to a JSON-lines file. The rollups are snapshotted next to the
+// file on rotation and on Close, so startup only replays the lines written
+// since; once the file reaches maxBytes it is moved to path.1 and a new one is
+// started.
+type CostLedger struct {
+	mu       sync.Mutex
+	rollups  map[ledgerKey]*BillingRow
+	calls    int
+	byModel  map[string]float64
+	monthly  map[string]map[string]float64
+	path     string
+	file     *os.File
+	size     int64
+	head     string
+	maxBytes int64
+	now      func() time.Time
+}
+
+type ledgerKey struct {
+	day, requester, model string
+}
+
+// ledgerSnapshot holds the rollups covering the first Offset bytes of the
+// ledger file whose first line is Head.
+type ledgerSnapshot struct {
+	Offset  int64        `json:"offset"`
+	Head    string       `json:"head"`
+	Rollups []BillingRow `json:"rollups"`
+}
+
+// ledgerGlobal receives an entry from every driver run.
+var ledgerGlobal *CostLedger
+
+func NewCostLedger() *CostLedger {
+	return &CostLedger{
+		rollups: map[ledgerKey]*BillingRow{},
+		byModel: map[string]float64{},
+		monthly: map[string]map[string]float64{},
+		now:     time.Now,
+	}
+}
+
+// OpenCostLedger loads the rollup snapshot and the ledger file at path and
+// appends new entries to the file, rotating it once it reaches maxBytes (0
+// never rotates). Lines the snapshot already covers are not read again unless
+// the file was replaced since; malformed lines are skipped.
+func OpenCostLedger(path string, maxBytes int64) (*CostLedger, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, errors.New("empty ledger path")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	var snap ledgerSnapshot
+	if raw, err := os.ReadFile(path + ".rollups"); err == nil {
+		if err := json.Unmarshal(raw, &snap); err != nil {
+			log.Printf("ledger %s: ignoring unreadable rollup snapshot: %v", path, err)
+			snap = ledgerSnapshot{}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l := NewCostLedger()
+	l.path, l.maxBytes, l.size = path, maxBytes, info.Size()
+	l.head, _ = bufio.NewReader(io.NewSectionReader(f, 0, 1<<20)).ReadString('\n')
+	l.head = strings.TrimSuffix(l.head, "\n")
+	for _, row := range snap.Rollups {
+		l.addRowLocked(row)
+	}
+	start := int64(0)
+	if snap.Head == l.head && snap.Offset <= l.size {
+		start = snap.Offset
+	}
+	scanner := bufio.NewScanner(io.NewSectionReader(f, start, l.size-start))
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	skipped := 0
+	for scanner.Scan() {
+		var e LedgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.At == "" {
+			skipped++
+			continue
+		}
+		l.addLocked(e)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if skipped > 0 {
+		log.Printf("ledger %s: skipped %d malformed line(s)", path, skipped)
+	}
+	l.file = f
+	return l, nil
+}
+
+// Close snapshots the rollups and closes the ledger file.
+func (l *CostLedger) Close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.snapshotLocked(); err != nil {
+		log.Printf("ledger: snapshot failed: %v", err)
+	}
+	return l.file.Close()
+}
+
+func (l *CostLedger) addLocked(e LedgerEntry) {
+	row := BillingRow{Requester: e.Requester, Model: e.Model, Day: e.At, Calls: 1, CostUSD: e.CostUSD, PromptTokens: e.PromptTokens, CompletionTokens: e.CompletionTokens}
+	if len(row.Day) > 10 {
+		row.Day = row.Day[:10]
+	}
+	if e.Error != "" {
+		row.FailedCalls = 1
+	}
+	l.addRowLocked(row)
+}
+
+func (l *CostLedger) addRowLocked(row BillingRow) {
+	k := ledgerKey{day: row.Day, requester: row.Requester, model: row.Model}
+	r := l.rollups[k]
+	if r == nil {
+		r = &BillingRow{Day: row.Day, Requester: row.Requester, Model: row.Model}
+		l.rollups[k] = r
+	}
+	r.Calls += row.Calls
+	r.FailedCalls += row.FailedCalls
+	r.CostUSD += row.CostUSD
+	r.PromptTokens += row.PromptTokens
+	r.CompletionTokens += row.CompletionTokens
+	l.calls += row.Calls
+	l.byModel[row.Model] += row.CostUSD
+	if len(row.Day) < 7 {
+		return
+	}
+	month := row.Day[:7]
+	if l.monthly[month] == nil {
+		l.monthly[month] = map[string]float64{}
+	}
+	l.monthly[month][row.Requester] += row.CostUSD
+}
+
+// Record appends one entry, stamping it with the current time.
+func (l *CostLedger) Record(e LedgerEntry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.At = l.now().UTC().Format(time.RFC3339)
+	l.addLocked(e)
+	if l.file == nil {
+		return
+	}
+	line, _ := json.Marshal(e)
+	n, err := l.file.Write(append(line, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("ledger: append failed: %v", err)
+		return
+	}
+	if l.head == "" {
+		l.head = string(line)
+	}
+	if l.maxBytes > 0 && l.size >= l.maxBytes {
+		l.rotateLocked()
+	}
+}
+
+// rotateLocked moves the ledger file to path.1, replacing an older one, and
+// starts a new file. The snapshot is written first, so the moved lines stay
+// counted even if the process stops halfway.
+func (l *CostLedger) rotateLocked() {
+	if err := l.snapshotLocked(); err != nil {
+		log.Printf("ledger: snapshot before rotation failed: %v", err)
+		return
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		log.Printf("ledger: rotate failed: %v", err)
+		return
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("ledger: reopen after rotation failed, appending to %s.1: %v", l.path, err)
+		return
+	}
+	l.file.Close()
+	l.file, l.size, l.head = f, 0, ""
+	if err := l.snapshotLocked(); err != nil {
+		log.Printf("ledger: snapshot after rotation failed: %v", err)
+	}
+}
+
+func (l *CostLedger) snapshotLocked() error {
+	snap := ledgerSnapshot{Offset: l.size, Head: l.head, Rollups: make([]BillingRow, 0, len(l.rollups))}
+	for _, r := range l.rollups {
+		snap.Rollups = append(snap.Rollups, *r)
+	}
+	raw, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".rollups.tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path+".rollups")
+}
+
+// RecordDriverCall books a driver run of a task. Failed runs are recorded
+// too, so call counts stay complete, with whatever usage the driver reports
+// was billed before it failed.
+func (l *CostLedger) RecordDriverCall(spec TaskSpec, taskID string, driverID string, res ModelResult, err error) {
+	e := LedgerEntry{TaskID: taskID, Requester: requesterKey(spec), Model: driverID}
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		e.LatencyMs = int64(metricValue(res, "latency_ms"))
+	}
+	e.CostUSD = metricValue(res, "cost_usd")
+	e.PromptTokens = int(metricValue(res, "prompt_tokens"))
+	e.CompletionTokens = int(metricValue(res, "completion_tokens"))
+	l.Record(e)
+}
+
+// usageMetrics are the metrics a driver run is billed by.
+var usageMetrics = []string{"cost_usd", "prompt_tokens", "completion_tokens"}
+
+// addUsage adds the usage metrics of src to dst, so attempts that were billed
+// but produced no result are still accounted for.
+func addUsage(dst *ModelResult, src ModelResult) {
+	for _, name := range usageMetrics {
+		v := metricValue(src, name)
+		if v == 0 {
+			continue
+		}
+		found := false
+		for i := range dst.Metrics {
+			if dst.Metrics[i].Name == name {
+				dst.Metrics[i].Value += v
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst.Metrics = append(dst.Metrics, Metric{Name: name, Value: v})
+		}
+	}
+}
+
+// MonthSpend is the requester's spend in the current UTC calendar month.
+func (l *CostLedger) MonthSpend(requester string) float64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.monthly[l.now().UTC().Format("2006-01")][requester]
+}
+
+// Aggregate sums the daily rollups matching f per distinct combination of the
+// groupBy dimensions, sorted by group.
+func (l *CostLedger) Aggregate(groupBy []string, f BillingFilter) []BillingRow {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	group := map[string]bool{}
+	for _, g := range groupBy {
+		group[g] = true
+	}
+	rows := map[string]*BillingRow{}
+	keys := []string{}
+	for _, r := range l.rollups {
+		if (f.Requester != "" && r.Requester != f.Requester) || (f.Model != "" && r.Model != f.Model) ||
+			(f.From != "" && r.Day < f.From) || (f.To != "" && r.Day > f.To) {
+			continue
+		}
+		var key BillingRow
+		if group["requester"] {
+			key.Requester = r.Requester
+		}
+		if group["model"] {
+			key.Model = r.Model
+		}
+		if group["day"] {
+			key.Day = r.Day
+		}
+		if group["month"] {
+			key.Month = r.Day
+			if len(r.Day) > 7 {
+				key.Month = r.Day[:7]
+			}
+		}
+		k := key.Requester + "\x00" + key.Model + "\x00" + key.Day + "\x00" + key.Month
+		row, ok := rows[k]
+		if !ok {
+			row = &key
+			rows[k] = row
+			keys = append(keys, k)
+		}
+		row.Calls += r.Calls
+		row.FailedCalls += r.FailedCalls
+		row.CostUSD += r.CostUSD
+		row.PromptTokens += r.PromptTokens
+		row.CompletionTokens += r.CompletionTokens
+	}
+	sort.Strings(keys)
+	out := make([]BillingRow, 0, len(keys))
+	for _, k := range keys {
+		row := *rows[k]
+		row.CostUSD = roundUSD(row.CostUSD)
+		out = append(out, row)
+	}
+	return out
+}
+
+// Stats returns the number of recorded calls and the total cost per model.
+func (l *CostLedger) Stats() (int, map[string]float64) {
+	costs := map[string]float64{}
+	if l == nil {
+		return 0, costs
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for model, cost := range l.byModel {
+		costs[model] = cost
+	}
+	return l.calls, costs
+}
+
+func roundUSD(v float64) float64 {
+	return math.Round(v*1e6) / 1e6
+}
+
+// budgetDowngrade reports whether the requester of spec is over a monthly
+// budget whose action is downgrade.
+func budgetDowngrade(spec TaskSpec) bool {
+	if quotasGlobal == nil {
+		return false
+	}
+	limits := quotasGlobal.LimitsFor(requesterKey(spec))
+	return limits.MonthlyBudgetUSD > 0 && limits.OverBudget == overBudgetDowngrade &&
+		ledgerGlobal.MonthSpend(requesterKey(spec)) >= limits.MonthlyBudgetUSD
+}
+
+// downgradeDrivers keeps only the cheapest of the selected drivers (and any
+// free ones).
+func downgradeDrivers(selected []Driver, meta map[string]DriverMeta) []Driver {
+	if len(selected) <= 1 {
+		return selected
+	}
+	return selectByBudget(selected, meta, 0)
+}
+
+// serveBilling answers GET /billing: ledger totals grouped by group_by
+// (requester, model, day, month; default requester,model,day) and filtered by
+// requester, model, from and to, as JSON or, with format=csv, as CSV.
+// Principals that are not admins only see their own spend.
+func serveBilling(w http.ResponseWriter, r *http.Request, ledger *CostLedger, quotas *QuotaManager) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	q := r.URL.Query()
+	groupBy := splitCSV(q.Get("group_by"))
+	if len(groupBy) == 0 {
+		groupBy = []string{"requester", "model", "day"}
+	}
+	for _, g := range groupBy {
+		if !containsString(billingGroups, g) {
+			http.Error(w, "invalid group_by: "+g, 400)
+			return
+		}
+	}
+	filter := BillingFilter{
+		Requester: strings.TrimSpace(q.Get("requester")),
+		Model:     strings.TrimSpace(q.Get("model")),
+		From:      strings.TrimSpace(q.Get("from")),
+		To:        strings.TrimSpace(q.Get("to")),
+	}
+	for _, d := range []string{filter.From, filter.To} {
+		if _, err := time.Parse("2006-01-02", d); d != "" && err != nil {
+			http.Error(w, "invalid date: "+d, 400)
+			return
+		}
+	}
+	if p, ok := auth.FromContext(r.Context()); ok && !p.Can(auth.RoleAdmin) {
+		filter.Requester = p.Name
+	}
+	rows := ledger.Aggregate(groupBy, filter)
+
+	if strings.EqualFold(q.Get("format"), "csv") {
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		cw.Write(append(append([]string{}, groupBy...), "calls", "failed_calls", "cost_usd", "prompt_tokens", "completion_tokens"))
+		for _, row := range rows {
+			rec := []string{}
+			for _, g := range groupBy {
+				switch g {
+				case "requester":
+					rec = append(rec, row.Requester)
+				case "model":
+					rec = append(rec, row.Model)
+				case "day":
+					rec = append(rec, row.Day)
+				case "month":
+					rec = append(rec, row.Month)
+				}
+			}
+			rec = append(rec,
+				strconv.Itoa(row.Calls),
+				strconv.Itoa(row.FailedCalls),
+				strconv.FormatFloat(row.CostUSD, 'f', -1, 64),
+				strconv.Itoa(row.PromptTokens),
+				strconv.Itoa(row.CompletionTokens),
+			)
+			cw.Write(rec)
+		}
+		cw.Flush()
+		return
+	}
+
+	total := BillingRow{}
+	requesters := map[string]bool{}
+	for _, row := range rows {
+		total.Calls += row.Calls
+		total.FailedCalls += row.FailedCalls
+		total.CostUSD += row.CostUSD
+		total.PromptTokens += row.PromptTokens
+		total.CompletionTokens += row.CompletionTokens
+		if row.Requester != "" {
+			requesters[row.Requester] = true
+		}
+	}
+	total.CostUSD = roundUSD(total.CostUSD)
+	if filter.Requester != "" {
+		requesters[filter.Requester] = true
+	}
+	budgets := []map[string]interface{}{}
+	names := make([]string, 0, len(requesters))
+	for name := range requesters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		limits := quotas.LimitsFor(name)
+		if limits.MonthlyBudgetUSD <= 0 {
+			continue
+		}
+		spent := roundUSD(ledger.MonthSpend(name))
+		budgets = append(budgets, map[string]interface{}{
+			"requester":   name,
+			"budget_usd":  limits.MonthlyBudgetUSD,
+			"spent_usd":   spent,
+			"action":      limits.OverBudget,
+			"over_budget": spent >= limits.MonthlyBudgetUSD,
+		})
+	}
+	writeJSON(w, map[string]interface{}{
+		"group_by": groupBy,
+		"from":     filter.From,
+		"to":       filter.To,
+		"rows":     rows,
+		"total":    total,
+		"budgets":  budgets,
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"rechain-ide/shared/auth"
+)
+
+func newTestLedger(t *testing.T, path string) (*CostLedger, *fakeClock) {
+	t.Helper()
+	l, err := OpenCostLedger(path, 0)
+	if err != nil {
+		t.Fatalf("open ledger: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	clock := &fakeClock{t: time.Date(2026, 3, 31, 23, 0, 0, 0, time.UTC)}
+	l.now = clock.now
+	return l, clock
+}
+
+func costResult(model string, cost float64, prompt int) ModelResult {
+	return ModelResult{ModelID: model, Metrics: []Metric{{Name: "cost_usd", Value: cost}, {Name: "prompt_tokens", Value: float64(prompt)}}}
+}
+
+func TestCostLedger_PersistsAndAggregates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, clock := newTestLedger(t, path)
+	alice := TaskSpec{Metadata: Metadata{Requester: "alice"}}
+	l.RecordDriverCall(alice, "t1", "model_a", costResult("model_a", 0.01, 100), nil)
+	l.RecordDriverCall(alice, "t1", "model_b", ModelResult{}, errors.New("timeout"))
+	clock.advance(2 * time.Hour)
+	l.RecordDriverCall(alice, "t2", "model_a", costResult("model_a", 0.02, 50), nil)
+	l.RecordDriverCall(TaskSpec{}, "t3", "model_a", costResult("model_a", 0.5, 0), nil)
+	l.Close()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("not json\n")
+	f.Close()
+
+	reopened, clock := newTestLedger(t, path)
+	clock.advance(2 * time.Hour)
+	rows := reopened.Aggregate([]string{"requester", "day"}, BillingFilter{})
+	want := []BillingRow{
+		{Requester: "alice", Day: "2026-03-31", Calls: 2, FailedCalls: 1, CostUSD: 0.01, PromptTokens: 100},
+		{Requester: "alice", Day: "2026-04-01", Calls: 1, CostUSD: 0.02, PromptTokens: 50},
+		{Requester: "anonymous", Day: "2026-04-01", Calls: 1, CostUSD: 0.5},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("expected %d rows, got %+v", len(want), rows)
+	}
+	for i := range want {
+		if rows[i] != want[i] {
+			t.Fatalf("row %d: got %+v, want %+v", i, rows[i], want[i])
+		}
+	}
+	if got := reopened.Aggregate([]string{"model"}, BillingFilter{Requester: "alice", From: "2026-04-01"}); len(got) != 1 || got[0].CostUSD != 0.02 {
+		t.Fatalf("unexpected filtered rows %+v", got)
+	}
+	if spent := reopened.MonthSpend("alice"); spent != 0.02 {
+		t.Fatalf("expected April spend only, got %v", spent)
+	}
+}
+
+func TestServeBilling(t *testing.T) {
+	l, _ := newTestLedger(t, filepath.Join(t.TempDir(), "ledger.jsonl"))
+	l.RecordDriverCall(TaskSpec{Metadata: Metadata{Requester: "alice"}}, "t1", "model_a", costResult("model_a", 0.25, 10), nil)
+	l.RecordDriverCall(TaskSpec{Metadata: Metadata{Requester: "bob"}}, "t2", "model_b", costResult("model_b", 1, 0), nil)
+	quotas := NewQuotaManager(QuotaConfig{Requesters: map[string]QuotaLimits{"alice": {MonthlyBudgetUSD: 0.2, OverBudget: overBudgetDowngrade}}})
+	quotas.monthSpend = l.MonthSpend
+
+	rec := httptest.NewRecorder()
+	serveBilling(rec, httptest.NewRequest(http.MethodGet, "/billing?group_by=requester", nil), l, quotas)
+	var body struct {
+		Rows    []BillingRow             `json:"rows"`
+		Total   BillingRow               `json:"total"`
+		Budgets []map[string]interface{} `json:"budgets"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(body.Rows) != 2 || body.Total.CostUSD != 1.25 || body.Total.Calls != 2 {
+		t.Fatalf("unexpected billing %+v", body)
+	}
+	if len(body.Budgets) != 1 || body.Budgets[0]["requester"] != "alice" || body.Budgets[0]["over_budget"] != true || body.Budgets[0]["action"] != "downgrade" {
+		t.Fatalf("unexpected budgets %+v", body.Budgets)
+	}
+
+	rec = httptest.NewRecorder()
+	serveBilling(rec, httptest.NewRequest(http.MethodGet, "/billing?format=csv&group_by=model", nil), l, quotas)
+	if ct := rec.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 3 || lines[0] != "model,calls,failed_calls,cost_usd,prompt_tokens,completion_tokens" || lines[1] != "model_a,1,0,0.25,10,0" {
+		t.Fatalf("unexpected csv %q", rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/billing", nil)
+	req = req.WithContext(auth.WithPrincipal(req.Context(), auth.Principal{Name: "bob", Role: auth.RoleViewer}))
+	rec = httptest.NewRecorder()
+	serveBilling(rec, req, l, quotas)
+	if strings.Contains(rec.Body.String(), "alice") {
+		t.Fatalf("expected non-admins to see only their own spend, got %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	serveBilling(rec, httptest.NewRequest(http.MethodGet, "/billing?group_by=task", nil), l, quotas)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown group, got %d", rec.Code)
+	}
+}
+
+func TestMonthlyBudget_BlocksOrDowngrades(t *testing.T) {
+	l, clock := newTestLedger(t, filepath.Join(t.TempDir(), "ledger.jsonl"))
+	quotas := NewQuotaManager(QuotaConfig{
+		Default: QuotaLimits{MonthlyBudgetUSD: 1},
+		Requesters: map[string]QuotaLimits{
+			"cheap": {OverBudget: overBudgetDowngrade},
+		},
+	})
+	quotas.now = clock.now
+	quotas.monthSpend = l.MonthSpend
+	for _, who := range []string{"heavy", "cheap"} {
+		l.RecordDriverCall(TaskSpec{Metadata: Metadata{Requester: who}}, "t", "model_a", costResult("model_a", 1.5, 0), nil)
+	}
+
+	rej := quotas.Admit("heavy")
+	if rej == nil || rej.Reason != "monthly_budget" || rej.RetryAfter != time.Hour {
+		t.Fatalf("expected a monthly budget rejection until the month ends, got %+v", rej)
+	}
+	if rej := quotas.Admit("cheap"); rej != nil {
+		t.Fatalf("expected downgrade requesters to be admitted, got %+v", rej)
+	}
+	if rej := quotas.Admit("light"); rej != nil {
+		t.Fatalf("expected requesters under budget to be admitted, got %+v", rej)
+	}
+
+	prevQuotas, prevLedger, prevCache := quotasGlobal, ledgerGlobal, resultCacheGlobal
+	quotasGlobal, ledgerGlobal, resultCacheGlobal = quotas, l, NewResultCache(time.Hour, 10, 0, "")
+	defer func() { quotasGlobal, ledgerGlobal, resultCacheGlobal = prevQuotas, prevLedger, prevCache }()
+
+	store := NewTaskStore()
+	spec := TaskSpec{ID: "task_cheap", Metadata: Metadata{Requester: "cheap"}}
+	setTaskState(store, spec.ID, "queued")
+	drivers := []Driver{stub("pricey", 0), stub("budget", 0)}
+	meta := map[string]DriverMeta{"pricey": {CostUSD: 0.5}, "budget": {CostUSD: 0.01}}
+	processTask(store, drivers, meta, spec.ID, spec, "", &Metrics{})
+
+	store.mu.Lock()
+	trace := store.traces[spec.ID]
+	store.mu.Unlock()
+	if !trace.BudgetDowngraded || len(trace.Selected) != 1 || trace.Selected[0] != "budget" {
+		t.Fatalf("expected routing downgraded to the cheapest driver, got %+v", trace)
+	}
+	if _, _, entries, _ := resultCacheGlobal.Stats(); entries != 0 {
+		t.Fatalf("expected downgraded results to stay out of the cache, got %d entries", entries)
+	}
+	if got := l.Aggregate([]string{"requester", "model"}, BillingFilter{Requester: "cheap", Model: "budget"}); len(got) != 1 || got[0].Calls != 1 {
+		t.Fatalf("expected the driver call in the ledger, got %+v", got)
+	}
+
+	spec = TaskSpec{ID: "task_fallback", Metadata: Metadata{Requester: "cheap"}, Constraints: []Constraint{
+		{Key: "models", Value: "down"},
+		{Key: "fallback_models", Value: "pricey,budget"},
+	}}
+	setTaskState(store, spec.ID, "queued")
+	processTask(store, append(drivers, failingDriver{id: "down"}), meta, spec.ID, spec, "", &Metrics{})
+	if got := l.Aggregate([]string{"model"}, BillingFilter{Requester: "cheap", Model: "pricey"}); len(got) != 0 {
+		t.Fatalf("expected downgraded fallbacks to skip the pricey driver, got %+v", got)
+	}
+	if got := l.Aggregate([]string{"model"}, BillingFilter{Requester: "cheap", Model: "budget"}); len(got) != 1 || got[0].Calls != 2 {
+		t.Fatalf("expected the cheapest fallback to run, got %+v", got)
+	}
+}
+
+func TestCostLedger_RotatesAndKeepsTotals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, _ := newTestLedger(t, path)
+	l.maxBytes = 300
+	alice := TaskSpec{Metadata: Metadata{Requester: "alice"}}
+	for i := 0; i < 5; i++ {
+		l.RecordDriverCall(alice, "t", "model_a", costResult("model_a", 0.1, 10), nil)
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Fatalf("expected the ledger to rotate: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() >= 300 {
+		t.Fatalf("expected a fresh ledger file, got %v %v", info, err)
+	}
+	check := func(l *CostLedger) {
+		t.Helper()
+		calls, costs := l.Stats()
+		rows := l.Aggregate([]string{"requester"}, BillingFilter{})
+		if calls != 5 || roundUSD(costs["model_a"]) != 0.5 || len(rows) != 1 || rows[0].Calls != 5 || rows[0].PromptTokens != 50 {
+			t.Fatalf("expected 5 calls worth 0.5, got %d %v %+v", calls, costs, rows)
+		}
+	}
+	check(l)
+	l.Close()
+
+	reopened, _ := newTestLedger(t, path)
+	check(reopened)
+	if spent := reopened.MonthSpend("alice"); roundUSD(spent) != 0.5 {
+		t.Fatalf("expected the month spend to survive rotation, got %v", spent)
+	}
+}
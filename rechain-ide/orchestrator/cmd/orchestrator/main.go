@@ -8,6 +8,7 @@ import (
 	"errors"
 	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -19,11 +20,19 @@ import (
 	"time"
 
 	"rechain-ide/orchestrator/internal"
+	"rechain-ide/shared/auth"
 	"rechain-ide/shared/logging"
+	"rechain-ide/shared/tracing"
 )
 
 const schemaVersion = "0.1.0"
 
+// maxTaskSpecBytes bounds POST /tasks bodies.
+const maxTaskSpecBytes = 4 << 20
+
+// maxPipelineSpecBytes bounds POST /pipelines bodies: 1 MiB per step.
+const maxPipelineSpecBytes = maxPipelineSteps << 20
+
 type TaskSpec struct {
 	SchemaVersion string       `json:"schema_version"`
 	ID            string       `json:"id"`
@@ -32,6 +41,9 @@ type TaskSpec struct {
 	Context       []ContextRef `json:"context"`
 	Constraints   []Constraint `json:"constraints"`
 	Metadata      Metadata     `json:"metadata"`
+	// Prompt is the rendered prompt for text-generation drivers, built by
+	// processTask; it is never part of the API.
+	Prompt string `json:"-"`
 }
 
 type ContextRef struct {
@@ -46,8 +58,10 @@ type Constraint struct {
 }
 
 type Metadata struct {
-	Requester string `json:"requester"`
-	Priority  string `json:"priority"`
+	Requester      string `json:"requester"`
+	Priority       string `json:"priority"`
+	CallbackURL    string `json:"callback_url,omitempty"`
+	CallbackSecret string `json:"callback_secret,omitempty"`
 }
 
 type TaskStatus struct {
@@ -73,11 +87,13 @@ type Metric struct {
 }
 
 type MergeResult struct {
-	SchemaVersion string  `json:"schema_version"`
-	Diff          string  `json:"diff"`
-	Rationale     string  `json:"rationale"`
-	Confidence    float64 `json:"confidence"`
-	QualityScore  float64 `json:"quality_score"`
+	SchemaVersion string                    `json:"schema_version"`
+	Diff          string                    `json:"diff"`
+	Rationale     string                    `json:"rationale"`
+	Confidence    float64                   `json:"confidence"`
+	QualityScore  float64                   `json:"quality_score"`
+	HunkMerge     *internal.HunkMergeResult `json:"hunk_merge,omitempty"`
+	Tests         []string                  `json:"tests,omitempty"`
 }
 
 type TraceModelResult struct {
@@ -89,18 +105,34 @@ type TraceModelResult struct {
 }
 
 type TaskTrace struct {
-	SchemaVersion string             `json:"schema_version"`
-	TaskID        string             `json:"task_id"`
-	ParentTaskID  string             `json:"parent_task_id,omitempty"`
-	State         string             `json:"state"`
-	StartedAt     string             `json:"started_at"`
-	FinishedAt    string             `json:"finished_at,omitempty"`
-	RoutingPolicy string             `json:"routing_policy"`
-	Selected      []string           `json:"selected_models,omitempty"`
-	Results       []TraceModelResult `json:"results,omitempty"`
-	MergeSource   string             `json:"merge_source,omitempty"`
-	Merge         *MergeResult       `json:"merge,omitempty"`
-	Error         string             `json:"error,omitempty"`
+	SchemaVersion    string              `json:"schema_version"`
+	TaskID           string              `json:"task_id"`
+	ParentTaskID     string              `json:"parent_task_id,omitempty"`
+	PipelineID       string              `json:"pipeline_id,omitempty"`
+	IdempotencyKey   string              `json:"idempotency_key,omitempty"`
+	Requester        string              `json:"requester,omitempty"`
+	State            string              `json:"state"`
+	StartedAt        string              `json:"started_at"`
+	FinishedAt       string              `json:"finished_at,omitempty"`
+	RoutingPolicy    string              `json:"routing_policy"`
+	Selected         []string            `json:"selected_models,omitempty"`
+	Results          []TraceModelResult  `json:"results,omitempty"`
+	MergeSource      string              `json:"merge_source,omitempty"`
+	CachedFrom       string              `json:"cached_from,omitempty"`
+	BudgetDowngraded bool                `json:"budget_downgraded,omitempty"`
+	Merge            *MergeResult        `json:"merge,omitempty"`
+	Interrupted      []string            `json:"interrupted_models,omitempty"`
+	QuorumSkipped    []string            `json:"quorum_skipped_models,omitempty"`
+	Hedges           []TraceHedge        `json:"hedges,omitempty"`
+	Verifications    []TraceVerification `json:"verifications,omitempty"`
+	Prompt           *TracePrompt        `json:"prompt,omitempty"`
+	Bandit           *TraceBandit        `json:"bandit,omitempty"`
+	Feedback         *TaskFeedback       `json:"feedback,omitempty"`
+	TraceID          string              `json:"trace_id,omitempty"`
+	ParentSpanID     string              `json:"parent_span_id,omitempty"`
+	RequestID        string              `json:"request_id,omitempty"`
+	Spans            []tracing.Span      `json:"spans,omitempty"`
+	Error            string              `json:"error,omitempty"`
 }
 
 type Artifact struct {
@@ -110,6 +142,9 @@ type Artifact struct {
 	Path          string `json:"path"`
 	Sha256        string `json:"sha256"`
 	CreatedAt     string `json:"created_at"`
+	ContentType   string `json:"content_type,omitempty"`
+	Size          int64  `json:"size,omitempty"`
+	ModelID       string `json:"model_id,omitempty"`
 }
 
 type TaskStore struct {
@@ -119,6 +154,26 @@ type TaskStore struct {
 	results   map[string]MergeResult
 	traces    map[string]TaskTrace
 	specs     map[string]TaskSpec
+	backend   TaskBackend
+	writer    *storeWriter
+	cancels   map[string]context.CancelFunc
+	events    *EventHub
+	blobs     *ArtifactStore
+	webhooks  *WebhookDispatcher
+	pipelines *PipelineManager
+	logs      *TaskLogs
+
+	// callbackSecrets holds callback_secret values, which are stripped from
+	// specs so they are never persisted; they live in memory only.
+	// signedCallbacks marks the tasks that had one and is persisted, so a
+	// webhook whose secret was lost in a restart fails instead of going out
+	// with the fallback secret.
+	callbackSecrets map[string]string
+	signedCallbacks map[string]bool
+
+	// prompts holds the rendered prompt text of each task, which traces
+	// leave out; only /tasks/{id}/debug serves it.
+	prompts map[string]string
 }
 
 func (s *TaskStore) TraceMetrics() (map[string]int, map[string]int) {
@@ -184,12 +239,16 @@ type Metrics struct {
 	failed         int
 	canceled       int
 	hfErrors       int
+	hfDiffErrors   int
+	reloads        int
+	reloadErrors   int
 	taskLatencyMs  []int64
 	routingCounts  map[string]int
 	routingByModel map[string]map[string]int
 	mergeChoice    map[string]int
 	modelLatencyMs map[string][]int64
 	retries        int
+	hedges         int
 	queueDelayMs   []int64
 }
 
@@ -248,6 +307,22 @@ func (m *Metrics) IncHFError() {
 	m.mu.Unlock()
 }
 
+func (m *Metrics) IncDriverReload(ok bool) {
+	m.mu.Lock()
+	if ok {
+		m.reloads++
+	} else {
+		m.reloadErrors++
+	}
+	m.mu.Unlock()
+}
+
+func (m *Metrics) IncHFDiffParseError() {
+	m.mu.Lock()
+	m.hfDiffErrors++
+	m.mu.Unlock()
+}
+
 func (m *Metrics) ObserveLatency(ms int64) {
 	m.mu.Lock()
 	m.taskLatencyMs = append(m.taskLatencyMs, ms)
@@ -263,6 +338,12 @@ func (m *Metrics) IncRetry() {
 	m.mu.Unlock()
 }
 
+func (m *Metrics) IncHedge() {
+	m.mu.Lock()
+	m.hedges++
+	m.mu.Unlock()
+}
+
 func (m *Metrics) ObserveQueueDelay(ms int64) {
 	m.mu.Lock()
 	m.queueDelayMs = append(m.queueDelayMs, ms)
@@ -287,6 +368,29 @@ func (m *Metrics) ObserveModelLatency(model string, ms int64) {
 	m.mu.Unlock()
 }
 
+// ModelLatencyPercentile returns the p-th percentile (0-100) of the recent
+// latency samples of a model, if at least minSamples were observed.
+func (m *Metrics) ModelLatencyPercentile(model string, p float64, minSamples int) (int64, bool) {
+	m.mu.Lock()
+	samples := append([]int64{}, m.modelLatencyMs[model]...)
+	m.mu.Unlock()
+	if len(samples) == 0 || len(samples) < minSamples {
+		return 0, false
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	if p < 0 {
+		p = 0
+	}
+	if p > 100 {
+		p = 100
+	}
+	idx := int(math.Ceil(p/100*float64(len(samples)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return samples[idx], true
+}
+
 func (m *Metrics) Snapshot() map[string]int {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -314,7 +418,11 @@ func (m *Metrics) Snapshot() map[string]int {
 		"failed":             m.failed,
 		"canceled":           m.canceled,
 		"hf_errors":          m.hfErrors,
+		"hf_diff_errors":     m.hfDiffErrors,
+		"driver_reloads":     m.reloads,
+		"driver_reload_errs": m.reloadErrors,
 		"retries":            m.retries,
+		"hedges":             m.hedges,
 		"latency_avg_ms":     avg,
 		"queue_delay_avg_ms": qavg,
 	}
@@ -364,7 +472,9 @@ func (m *Metrics) IncRouting(policy string) {
 	m.mu.Unlock()
 }
 
-func (m *Metrics) IncRoutingModel(policy string, model string) {
+// IncRoutingModel counts a driver selected under policy; decision is explore
+// or exploit for routing=bandit and static otherwise.
+func (m *Metrics) IncRoutingModel(policy string, model string, decision string) {
 	m.mu.Lock()
 	if m.routingByModel == nil {
 		m.routingByModel = map[string]map[string]int{}
@@ -375,7 +485,10 @@ func (m *Metrics) IncRoutingModel(policy string, model string) {
 	if policy == "" {
 		policy = "latency"
 	}
-	m.routingByModel[model][policy]++
+	if decision == "" {
+		decision = decisionStatic
+	}
+	m.routingByModel[model][policy+"|"+decision]++
 	m.mu.Unlock()
 }
 
@@ -404,11 +517,14 @@ func (m *Metrics) RoutingByModelSnapshot() map[string]map[string]int {
 
 func NewTaskStore() *TaskStore {
 	return &TaskStore{
-		statuses:  make(map[string]TaskStatus),
-		artifacts: make(map[string][]Artifact),
-		results:   make(map[string]MergeResult),
-		traces:    make(map[string]TaskTrace),
-		specs:     make(map[string]TaskSpec),
+		statuses:        make(map[string]TaskStatus),
+		artifacts:       make(map[string][]Artifact),
+		results:         make(map[string]MergeResult),
+		traces:          make(map[string]TaskTrace),
+		specs:           make(map[string]TaskSpec),
+		callbackSecrets: make(map[string]string),
+		signedCallbacks: make(map[string]bool),
+		prompts:         make(map[string]string),
 	}
 }
 
@@ -551,66 +667,15 @@ func (s *TaskStore) ReplayChain(taskID string) (ReplayChain, bool) {
 	}, true
 }
 
-type queuedTask struct {
-	id       string
-	spec     TaskSpec
-	enqueued time.Time
-}
-
-type TaskQueue struct {
-	high   chan queuedTask
-	normal chan queuedTask
-	low    chan queuedTask
-}
-
-func NewTaskQueue(size int) *TaskQueue {
-	if size <= 0 {
-		size = 200
-	}
-	return &TaskQueue{
-		high:   make(chan queuedTask, size),
-		normal: make(chan queuedTask, size),
-		low:    make(chan queuedTask, size),
-	}
-}
-
-func (q *TaskQueue) Enqueue(t queuedTask) error {
-	switch strings.ToLower(strings.TrimSpace(t.spec.Metadata.Priority)) {
-	case "high":
-		q.high <- t
-	case "low":
-		q.low <- t
-	default:
-		q.normal <- t
-	}
-	return nil
-}
+// maxReplayBatch caps the modes of one /replay/batch request; it is the
+// number of distinct replay modes.
+const maxReplayBatch = 5
 
-func (q *TaskQueue) Dequeue(ctx context.Context) (queuedTask, bool) {
-	for {
-		select {
-		case t := <-q.high:
-			return t, true
-		default:
-		}
-		select {
-		case t := <-q.high:
-			return t, true
-		case t := <-q.normal:
-			return t, true
-		case t := <-q.low:
-			return t, true
-		case <-ctx.Done():
-			return queuedTask{}, false
-		}
-	}
-}
-
-func (q *TaskQueue) Depth() int {
-	return len(q.high) + len(q.normal) + len(q.low)
-}
-
-func enqueueReplayTask(store *TaskStore, queue *TaskQueue, metrics *Metrics, parentID string, mode string) (string, TaskStatus, error) {
+// enqueueReplayTask queues a copy of the parent task. A non-empty requester
+// replaces the parent's, so replays are attributed to whoever started them.
+// Each replay is admitted against that requester's quota like a submission;
+// a refusal is returned as a *QuotaRejection.
+func enqueueReplayTask(store *TaskStore, queue *TaskQueue, quotas *QuotaManager, metrics *Metrics, parentID string, mode string, requester string) (string, TaskStatus, error) {
 	parentID = strings.TrimSpace(parentID)
 	if parentID == "" {
 		return "", TaskStatus{}, errors.New("missing parent task id")
@@ -624,6 +689,9 @@ func enqueueReplayTask(store *TaskStore, queue *TaskQueue, metrics *Metrics, par
 
 	replaySpec := parentSpec
 	replaySpec.ID = "task_" + randString(8)
+	if requester != "" {
+		replaySpec.Metadata.Requester = requester
+	}
 	mode = strings.ToLower(strings.TrimSpace(mode))
 	switch mode {
 	case "force-agent":
@@ -632,9 +700,14 @@ func enqueueReplayTask(store *TaskStore, queue *TaskQueue, metrics *Metrics, par
 		replaySpec.Constraints = upsertConstraint(replaySpec.Constraints, "force_merge_source", "agent_compiler_soft")
 	case "force-policy":
 		replaySpec.Constraints = upsertConstraint(replaySpec.Constraints, "force_merge_source", "policy_merge")
+	case "force-hunk":
+		replaySpec.Constraints = upsertConstraint(replaySpec.Constraints, "force_merge_source", "hunk_merge")
 	default:
 		mode = "default"
 	}
+	if rej := quotas.Admit(requesterKey(replaySpec)); rej != nil {
+		return "", TaskStatus{}, rej
+	}
 
 	now := time.Now().UTC().Format(time.RFC3339)
 	replayStatus := TaskStatus{
@@ -649,37 +722,97 @@ func enqueueReplayTask(store *TaskStore, queue *TaskQueue, metrics *Metrics, par
 		SchemaVersion: schemaVersion,
 		TaskID:        replaySpec.ID,
 		ParentTaskID:  parentID,
+		Requester:     replaySpec.Metadata.Requester,
 		State:         "queued",
 		StartedAt:     now,
 		RoutingPolicy: constraintString(replaySpec.Constraints, "routing"),
 	}
 	store.mu.Lock()
+	if store.signedCallbacks[parentID] {
+		store.signedCallbacks[replaySpec.ID] = true
+		if secret, ok := store.callbackSecrets[parentID]; ok {
+			store.callbackSecrets[replaySpec.ID] = secret
+		}
+	}
 	store.statuses[replaySpec.ID] = replayStatus
 	store.specs[replaySpec.ID] = replaySpec
 	store.traces[replaySpec.ID] = replayTrace
+	store.persistLocked(replaySpec.ID)
 	store.mu.Unlock()
 	if metrics != nil {
 		metrics.IncSubmitted()
 		metrics.IncReplayed()
 		metrics.IncReplayMode(mode)
 	}
-	_ = queue.Enqueue(queuedTask{id: replaySpec.ID, spec: replaySpec, enqueued: time.Now()})
+	if err := queue.Enqueue(queuedTask{id: replaySpec.ID, spec: replaySpec, enqueued: time.Now()}); err != nil {
+		quotas.Refund(requesterKey(replaySpec))
+		return replaySpec.ID, store.failQueued(replaySpec.ID, err.Error()), err
+	}
 	return replaySpec.ID, replayStatus, nil
 }
 
+// submitTask stores a new queued task and puts it on the queue; trace
+// carries the submission's origin (pipeline, idempotency key). It returns
+// errTaskExists if the ID is taken. When the queue refuses the task it is
+// marked failed and the error returned.
+func submitTask(store *TaskStore, queue *TaskQueue, metrics *Metrics, spec TaskSpec, trace TaskTrace) (TaskStatus, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	status := TaskStatus{
+		SchemaVersion: schemaVersion,
+		ID:            spec.ID,
+		State:         "queued",
+		Progress:      0.0,
+		StartedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	trace.SchemaVersion = schemaVersion
+	trace.TaskID = spec.ID
+	trace.Requester = spec.Metadata.Requester
+	trace.State = "queued"
+	trace.StartedAt = now
+	trace.RoutingPolicy = constraintString(spec.Constraints, "routing")
+	spec, secret := splitCallbackSecret(spec)
+
+	store.mu.Lock()
+	if _, exists := store.statuses[spec.ID]; exists {
+		store.mu.Unlock()
+		return TaskStatus{}, errTaskExists
+	}
+	if secret != "" {
+		store.callbackSecrets[spec.ID] = secret
+		store.signedCallbacks[spec.ID] = true
+	}
+	store.statuses[spec.ID] = status
+	store.specs[spec.ID] = spec
+	store.traces[spec.ID] = trace
+	store.persistLocked(spec.ID)
+	store.mu.Unlock()
+	metrics.IncSubmitted()
+	if hit, ok := resultCacheGlobal.Lookup(spec); ok {
+		return completeFromCache(store, metrics, spec.ID, trace, hit), nil
+	}
+	if err := queue.Enqueue(queuedTask{id: spec.ID, spec: spec, enqueued: time.Now()}); err != nil {
+		metrics.IncFailed()
+		return store.failQueued(spec.ID, err.Error()), err
+	}
+	return status, nil
+}
+
 type Driver interface {
 	ID() string
 	Run(ctx context.Context, spec TaskSpec) (ModelResult, error)
 }
 
 type DriverRegistry struct {
-	mu      sync.Mutex
-	drivers []Driver
-	meta    map[string]DriverMeta
+	mu       sync.Mutex
+	drivers  []Driver
+	meta     map[string]DriverMeta
+	breakers *CircuitBreakers
 }
 
 func NewDriverRegistry() *DriverRegistry {
-	return &DriverRegistry{drivers: []Driver{}, meta: map[string]DriverMeta{}}
+	return &DriverRegistry{drivers: []Driver{}, meta: map[string]DriverMeta{}, breakers: NewCircuitBreakers(5, 30*time.Second, 1)}
 }
 
 func (r *DriverRegistry) Register(d Driver, meta DriverMeta) {
@@ -699,6 +832,22 @@ func (r *DriverRegistry) List() []string {
 	return ids
 }
 
+// Breakers returns the circuit breakers of the registered drivers.
+func (r *DriverRegistry) Breakers() *CircuitBreakers {
+	return r.breakers
+}
+
+// Available returns the registered drivers whose circuit breaker is not open.
+func (r *DriverRegistry) Available() []Driver {
+	out := []Driver{}
+	for _, d := range r.Drivers() {
+		if r.breakers.Allow(d.ID()) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
 func (r *DriverRegistry) Drivers() []Driver {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -743,10 +892,7 @@ func (r *DriverRegistry) ModelEntries() []ModelRegistryEntry {
 	for _, d := range r.drivers {
 		id := d.ID()
 		meta := r.meta[id]
-		switch typed := d.(type) {
-		case HuggingFaceDriver:
-			ids := []string{typed.modelID}
-			ids = append(ids, typed.fallback...)
+		if ids, ok := driverModelIDs(d); ok {
 			for i, mid := range ids {
 				src := "fallback"
 				if i == 0 {
@@ -767,26 +913,38 @@ func (r *DriverRegistry) ModelEntries() []ModelRegistryEntry {
 					Description:  meta.Description,
 				})
 			}
-		default:
-			key := id + "|" + id + "|driver"
-			if seen[key] {
-				continue
-			}
-			seen[key] = true
-			out = append(out, ModelRegistryEntry{
-				ID:           id,
-				DriverID:     id,
-				Kind:         meta.Kind,
-				Source:       "driver",
-				CostUSD:      meta.CostUSD,
-				Capabilities: append([]string{}, meta.Capabilities...),
-				Description:  meta.Description,
-			})
+			continue
 		}
+		key := id + "|" + id + "|driver"
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, ModelRegistryEntry{
+			ID:           id,
+			DriverID:     id,
+			Kind:         meta.Kind,
+			Source:       "driver",
+			CostUSD:      meta.CostUSD,
+			Capabilities: append([]string{}, meta.Capabilities...),
+			Description:  meta.Description,
+		})
 	}
 	return out
 }
 
+// driverModelIDs lists the primary and fallback model IDs of drivers that
+// route to several upstream models.
+func driverModelIDs(d Driver) ([]string, bool) {
+	switch typed := d.(type) {
+	case HuggingFaceDriver:
+		return append([]string{typed.modelID}, typed.fallback...), true
+	case OpenAIDriver:
+		return append([]string{typed.model}, typed.fallback...), true
+	}
+	return nil, false
+}
+
 func (r *DriverRegistry) HFModelIDs(extra []string) []string {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -857,6 +1015,7 @@ type HuggingFaceDriver struct {
 	timeout     time.Duration
 	fallback    []string
 	pingTimeout time.Duration
+	workspace   string
 }
 
 var pingSvcGlobal *PingService
@@ -868,26 +1027,52 @@ func (d HuggingFaceDriver) Run(ctx context.Context, spec TaskSpec) (ModelResult,
 	start := time.Now()
 	models := []string{d.modelID}
 	models = append(models, d.fallback...)
+	var originals map[string]string
 
 	for i, modelID := range models {
+		hfModel := map[string]string{"hf_model": modelID}
+		available := false
 		if pingSvcGlobal != nil {
-			if !pingSvcGlobal.IsAvailable(modelID, d) {
-				if i == len(models)-1 {
-					return ModelResult{}, errors.New("hf ping failed for all models")
-				}
-				continue
-			}
-		} else if !d.pingAvailable(modelID) {
+			available = pingSvcGlobal.IsAvailable(modelID, d)
+		} else {
+			available = d.pingAvailable(modelID)
+		}
+		if !available {
+			logTask(ctx, logWarn, "ping", d.id, "hf model "+modelID+" unavailable, skipping", hfModel)
 			if i == len(models)-1 {
 				return ModelResult{}, errors.New("hf ping failed for all models")
 			}
 			continue
 		}
+		logTask(ctx, logDebug, "ping", d.id, "hf model "+modelID+" available", hfModel)
 		generated, err := d.callHF(ctx, modelID, spec)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ModelResult{}, ctx.Err()
+			}
+			logTask(ctx, logWarn, "hf_error", d.id, err.Error(), hfModel)
+			if metricsGlobal != nil {
+				metricsGlobal.IncHFError()
+			}
+			if i == len(models)-1 {
+				return ModelResult{}, err
+			}
+			continue
+		}
+
+		// A generation without a usable diff counts as a model failure so the
+		// next HF model, and then the task's fallback_models, get a chance.
+		if originals == nil {
+			originals = loadContextFiles(d.workspace, spec.Context)
+		}
+		diff, err := internal.ExtractDiff(generated, originals)
 		if err != nil {
 			if metricsGlobal != nil {
 				metricsGlobal.IncHFError()
+				metricsGlobal.IncHFDiffParseError()
 			}
+			err = errors.New("hf " + modelID + ": no valid diff in generation: " + err.Error())
+			logTask(ctx, logWarn, "hf_error", d.id, err.Error(), hfModel)
 			if i == len(models)-1 {
 				return ModelResult{}, err
 			}
@@ -895,12 +1080,12 @@ func (d HuggingFaceDriver) Run(ctx context.Context, spec TaskSpec) (ModelResult,
 		}
 
 		latencyMs := float64(time.Since(start).Milliseconds())
-		quality := estimateQuality(generated, "diff --git a/file b/file\n+stub change HF\n")
+		quality := estimateQuality(generated, diff)
 		return ModelResult{
 			SchemaVersion: schemaVersion,
 			ModelID:       d.id,
 			Output:        generated,
-			Diff:          "diff --git a/file b/file\n+stub change HF\n",
+			Diff:          diff,
 			Metrics: []Metric{
 				{Name: "latency_ms", Value: latencyMs},
 				{Name: "cost_usd", Value: 0.05},
@@ -936,7 +1121,7 @@ func (d HuggingFaceDriver) pingAvailable(modelID string) bool {
 func (d HuggingFaceDriver) callHF(ctx context.Context, modelID string, spec TaskSpec) (string, error) {
 	endpoint := strings.TrimRight(d.apiURL, "/") + "/" + url.PathEscape(modelID)
 	payload := map[string]interface{}{
-		"inputs": spec.Input,
+		"inputs": promptText(spec),
 		"parameters": map[string]interface{}{
 			"max_new_tokens": constraintInt(spec.Constraints, "max_new_tokens", 256),
 		},
@@ -967,7 +1152,7 @@ func (d HuggingFaceDriver) callHF(ctx context.Context, modelID string, spec Task
 
 	if resp.StatusCode >= 400 {
 		data, _ := io.ReadAll(resp.Body)
-		return "", errors.New("hf error: " + string(data))
+		return "", errors.New("hf error: status " + strconv.Itoa(resp.StatusCode) + ": " + string(data))
 	}
 
 	data, _ := io.ReadAll(resp.Body)
@@ -979,50 +1164,128 @@ type SearchResult struct {
 	SchemaVersion string   `json:"schema_version"`
 	Query         string   `json:"query"`
 	Matches       []string `json:"matches"`
+	Scores        []struct {
+		Path  string  `json:"path"`
+		Score float64 `json:"score"`
+		Text  string  `json:"text"`
+	} `json:"scores"`
 }
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
 	store := NewTaskStore()
 	registry := NewDriverRegistry()
+	registry.breakers = NewCircuitBreakers(
+		envInt("ORCH_BREAKER_FAILURES", 5),
+		time.Duration(envInt("ORCH_BREAKER_OPEN_MS", 30000))*time.Millisecond,
+		envInt("ORCH_BREAKER_HALF_OPEN_PROBES", 1),
+	)
+	breakersGlobal = registry.Breakers()
+	idempotency := NewIdempotencyIndex(time.Duration(envInt("ORCH_IDEMPOTENCY_TTL_MS", 86400000)) * time.Millisecond)
+	quotaCfg, err := quotaConfigFromEnv()
+	if err != nil {
+		log.Fatalf("load quotas: %v", err)
+	}
+	quotas := NewQuotaManager(quotaCfg)
+	var tokens *auth.Tokens
+	if path := strings.TrimSpace(os.Getenv("ORCH_AUTH_TOKENS_FILE")); path != "" {
+		tokens, err = auth.LoadTokens(path)
+		if err != nil {
+			log.Fatalf("load auth tokens %s: %v", path, err)
+		}
+	} else {
+		log.Printf("ORCH_AUTH_TOKENS_FILE not set; API authentication disabled")
+	}
+	quotasGlobal = quotas
 	metrics := &Metrics{}
 	metricsGlobal = metrics
-	queue := NewTaskQueue(envInt("ORCH_QUEUE_SIZE", 200))
+	store.events = NewEventHub(envInt("ORCH_EVENT_BACKLOG", 1024))
+	store.webhooks, err = webhookDispatcherFromEnv()
+	if err != nil {
+		log.Fatalf("webhooks: %v", err)
+	}
+	store.logs = taskLogsFromEnv()
+	promptBuilder, err := promptBuilderFromEnv()
+	if err != nil {
+		log.Fatalf("load prompt templates: %v", err)
+	}
+	promptBuilderGlobal = promptBuilder
+	queue := NewTaskQueue(envInt("ORCH_QUEUE_SIZE", 200), time.Duration(envInt("ORCH_QUEUE_AGING_MS", 2000))*time.Millisecond)
+	pipelines := NewPipelineManager(store, func(spec TaskSpec, pipelineID string) (TaskStatus, error) {
+		return submitTask(store, queue, metrics, spec, TaskTrace{PipelineID: pipelineID})
+	}, func(id string) {
+		store.Cancel(id, queue)
+	})
+	store.pipelines = pipelines
 	workers := envInt("ORCH_WORKERS", 4)
 
-	registry.Register(StubDriver{id: "model_a", latency: 120 * time.Millisecond, diff: "diff --git a/file b/file\n+stub change A\n", costUSD: 0.01, quality: 0.7}, DriverMeta{
-		ID:           "model_a",
-		Kind:         "stub",
-		CostUSD:      0.01,
-		Capabilities: []string{"patch", "review"},
-		Description:  "local stub driver A",
-	})
-	registry.Register(StubDriver{id: "model_b", latency: 140 * time.Millisecond, diff: "diff --git a/file b/file\n+stub change B\n", costUSD: 0.02, quality: 0.6}, DriverMeta{
-		ID:           "model_b",
-		Kind:         "stub",
-		CostUSD:      0.02,
-		Capabilities: []string{"patch", "testgen"},
-		Description:  "local stub driver B",
-	})
-	registry.Register(HuggingFaceDriver{
-		id:          "hf_gigachat3_702b_preview",
-		modelID:     envOr("HF_MODEL_ID", "ai-sage/GigaChat3-702B-A36B-preview"),
-		apiURL:      envOr("HF_API_URL", "https://router.huggingface.co/hf-inference/models"),
-		apiToken:    os.Getenv("HF_TOKEN"),
-		latency:     180 * time.Millisecond,
-		timeout:     time.Duration(envInt("HF_TIMEOUT_MS", 8000)) * time.Millisecond,
-		fallback:    splitCSV(os.Getenv("HF_FALLBACK_MODELS")),
-		pingTimeout: time.Duration(envInt("HF_PING_TIMEOUT_MS", 1500)) * time.Millisecond,
-	}, DriverMeta{
-		ID:           "hf_gigachat3_702b_preview",
-		Kind:         "huggingface",
-		CostUSD:      0.05,
-		Capabilities: []string{"patch", "review", "analysis"},
-		Description:  "HuggingFace Inference API driver (stubbed diff)",
-	})
+	var recovered []TaskSpec
+	if !strings.EqualFold(envOr("ORCH_STORE", "bolt"), "memory") {
+		storePath := envOr("ORCH_STORE_PATH", ".orch-data/tasks.db")
+		backend, err := OpenBoltTaskBackend(storePath)
+		if err != nil {
+			log.Fatalf("open task store %s: %v", storePath, err)
+		}
+		defer backend.Close()
+		recovered, err = store.AttachBackend(backend)
+		if err != nil {
+			log.Fatalf("load task store %s: %v", storePath, err)
+		}
+		defer store.Flush()
+		runs, err := backend.LoadPipelines()
+		if err != nil {
+			log.Fatalf("load pipelines %s: %v", storePath, err)
+		}
+		pipelines.Restore(runs)
+		log.Printf("task store %s loaded, %d task(s) to resume, %d pipeline(s)", storePath, len(recovered), len(runs))
+		store.restoreIdempotencyKeys(idempotency)
+	}
+
+	ledger := NewCostLedger()
+	if !strings.EqualFold(envOr("ORCH_STORE", "bolt"), "memory") {
+		ledgerPath := envOr("ORCH_LEDGER_PATH", ".orch-data/ledger.jsonl")
+		ledger, err = OpenCostLedger(ledgerPath, int64(envInt("ORCH_LEDGER_MAX_MB", 64))<<20)
+		if err != nil {
+			log.Fatalf("open cost ledger %s: %v", ledgerPath, err)
+		}
+		defer ledger.Close()
+	}
+	ledgerGlobal = ledger
+	quotas.monthSpend = ledger.MonthSpend
+
+	bandit := NewBanditRouter(envInt("ORCH_BANDIT_ARMS", 1), time.Now().UnixNano())
+	if !strings.EqualFold(envOr("ORCH_STORE", "bolt"), "memory") {
+		banditPath := envOr("ORCH_BANDIT_PATH", ".orch-data/bandit.json")
+		bandit, err = OpenBanditRouter(banditPath, envInt("ORCH_BANDIT_ARMS", 1))
+		if err != nil {
+			log.Fatalf("open bandit state %s: %v", banditPath, err)
+		}
+		defer bandit.Close()
+	}
+	banditGlobal = bandit
+
+	artifactDir := envOr("ORCH_ARTIFACT_DIR", ".orch-data/artifacts")
+	blobs, err := NewArtifactStore(artifactDir)
+	if err != nil {
+		log.Fatalf("open artifact dir %s: %v", artifactDir, err)
+	}
+	store.blobs = blobs
+
+	driversFile := strings.TrimSpace(os.Getenv("ORCH_DRIVERS_FILE"))
+	driverSet, err := loadDriverSet(driversFile)
+	if err != nil {
+		log.Fatalf("load drivers %s: %v", driversFile, err)
+	}
+	registry.Replace(driverSet)
+	reloader := &driverReloader{path: driversFile, registry: registry, metrics: metrics}
+	watchDriverReloads(reloader)
 
 	ragURL := strings.TrimRight(envOr("RAG_URL", "http://localhost:8083"), "/")
 	kernelURL := strings.TrimRight(envOr("KERNEL_URL", "http://localhost:8082"), "/")
+	resultCache := resultCacheFromEnv()
+	resultCacheGlobal = resultCache
+	verifier := verifierFromEnv(kernelURL)
+	verifierGlobal = verifier
 	web6URL := strings.TrimRight(envOr("WEB6_URL", "http://localhost:8084"), "/")
 	quantumURL := strings.TrimRight(envOr("QUANTUM_URL", "http://localhost:8085"), "/")
 	agentCompilerURL := strings.TrimRight(envOr("AGENT_COMPILER_URL", "http://localhost:8086"), "/")
@@ -1054,6 +1317,39 @@ func main() {
 		})
 	})
 
+	mux.HandleFunc("/admin/drivers/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		res, err := reloader.Reload()
+		if err != nil {
+			http.Error(w, "reload failed: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		writeJSON(w, res)
+	})
+
+	mux.HandleFunc("/quotas", func(w http.ResponseWriter, r *http.Request) {
+		usage := quotas.Usage()
+		if requester := strings.TrimSpace(r.URL.Query().Get("requester")); requester != "" {
+			usage = []QuotaUsage{quotas.UsageFor(requester)}
+		}
+		writeJSON(w, map[string]interface{}{
+			"default":    quotas.LimitsFor(""),
+			"requesters": usage,
+			"rejections": quotas.Rejections(),
+		})
+	})
+
+	mux.HandleFunc("/billing", func(w http.ResponseWriter, r *http.Request) {
+		serveBilling(w, r, ledger, quotas)
+	})
+
+	mux.HandleFunc("/routing/bandit", func(w http.ResponseWriter, r *http.Request) {
+		serveBandit(w, r, bandit)
+	})
+
 	mux.HandleFunc("/models", func(w http.ResponseWriter, r *http.Request) {
 		entries := registry.ModelEntries()
 		sort.Slice(entries, func(i, j int) bool {
@@ -1083,6 +1379,16 @@ func main() {
 			}
 		}
 		healthMap := pingSvc.HealthMap(modelIDs)
+		breakers := registry.Breakers().Snapshot(registry.List())
+		breakerByDriver := map[string]BreakerStatus{}
+		breakerSummary := map[string]int{}
+		for _, st := range breakerStates {
+			breakerSummary[st] = 0
+		}
+		for _, b := range breakers {
+			breakerByDriver[b.DriverID] = b
+			breakerSummary[b.State]++
+		}
 		out := []map[string]interface{}{}
 		okCount := 0
 		failCount := 0
@@ -1114,6 +1420,7 @@ func main() {
 				"ok_until_unix":   h.OkUntilUnix,
 				"fail_until_unix": h.FailUntilUnix,
 				"backoff_ms":      h.BackoffMs,
+				"breaker_state":   breakerByDriver[e.DriverID].State,
 			})
 		}
 		writeJSON(w, map[string]interface{}{
@@ -1124,7 +1431,9 @@ func main() {
 				"stale":   staleCount,
 				"unknown": unknownCount,
 			},
-			"models": out,
+			"models":          out,
+			"breakers":        breakers,
+			"breaker_summary": breakerSummary,
 		})
 	})
 
@@ -1412,9 +1721,19 @@ func main() {
 			"# HELP rechain_hf_errors_total HF driver errors",
 			"# TYPE rechain_hf_errors_total counter",
 			"rechain_hf_errors_total " + strconv.Itoa(taskSnap["hf_errors"]),
+			"# HELP rechain_hf_diff_parse_errors_total HF generations without a valid diff",
+			"# TYPE rechain_hf_diff_parse_errors_total counter",
+			"rechain_hf_diff_parse_errors_total " + strconv.Itoa(taskSnap["hf_diff_errors"]),
+			"# HELP rechain_driver_reloads_total Drivers file reloads by result",
+			"# TYPE rechain_driver_reloads_total counter",
+			"rechain_driver_reloads_total{result=\"ok\"} " + strconv.Itoa(taskSnap["driver_reloads"]),
+			"rechain_driver_reloads_total{result=\"error\"} " + strconv.Itoa(taskSnap["driver_reload_errs"]),
 			"# HELP rechain_task_retries_total Total task retries",
 			"# TYPE rechain_task_retries_total counter",
 			"rechain_task_retries_total " + strconv.Itoa(taskSnap["retries"]),
+			"# HELP rechain_hedged_requests_total Hedged driver requests started",
+			"# TYPE rechain_hedged_requests_total counter",
+			"rechain_hedged_requests_total " + strconv.Itoa(taskSnap["hedges"]),
 			"# HELP rechain_task_replay_total Total replayed tasks",
 			"# TYPE rechain_task_replay_total counter",
 			"rechain_task_replay_total " + strconv.Itoa(taskSnap["replayed"]),
@@ -1431,6 +1750,147 @@ func main() {
 			"# TYPE rechain_queue_delay_avg_ms gauge",
 			"rechain_queue_delay_avg_ms " + strconv.Itoa(taskSnap["queue_delay_avg_ms"]),
 		}
+		queueStats := queue.Stats()
+		lines = append(lines,
+			"# HELP rechain_queue_depth_by_priority Current queue depth per priority class",
+			"# TYPE rechain_queue_depth_by_priority gauge",
+		)
+		for _, p := range priorityClasses {
+			lines = append(lines, "rechain_queue_depth_by_priority{priority=\""+p+"\"} "+strconv.Itoa(queueStats[p].Depth))
+		}
+		lines = append(lines,
+			"# HELP rechain_queue_wait_avg_ms Average queue wait per priority class (last 100)",
+			"# TYPE rechain_queue_wait_avg_ms gauge",
+		)
+		for _, p := range priorityClasses {
+			lines = append(lines, "rechain_queue_wait_avg_ms{priority=\""+p+"\"} "+strconv.FormatInt(queueStats[p].WaitAvgMs, 10))
+		}
+		lines = append(lines,
+			"# HELP rechain_queue_wait_max_ms Max queue wait per priority class (last 100)",
+			"# TYPE rechain_queue_wait_max_ms gauge",
+		)
+		for _, p := range priorityClasses {
+			lines = append(lines, "rechain_queue_wait_max_ms{priority=\""+p+"\"} "+strconv.FormatInt(queueStats[p].WaitMaxMs, 10))
+		}
+		lines = append(lines,
+			"# HELP rechain_driver_breaker_state Driver circuit breaker state (1 for the current state)",
+			"# TYPE rechain_driver_breaker_state gauge",
+		)
+		breakerSnap := registry.Breakers().Snapshot(registry.List())
+		for _, b := range breakerSnap {
+			for _, st := range breakerStates {
+				v := "0"
+				if b.State == st {
+					v = "1"
+				}
+				lines = append(lines, "rechain_driver_breaker_state{driver=\""+promLabelValue(b.DriverID)+"\",state=\""+st+"\"} "+v)
+			}
+		}
+		lines = append(lines,
+			"# HELP rechain_driver_breaker_consecutive_failures Consecutive failed runs per driver",
+			"# TYPE rechain_driver_breaker_consecutive_failures gauge",
+		)
+		for _, b := range breakerSnap {
+			lines = append(lines, "rechain_driver_breaker_consecutive_failures{driver=\""+promLabelValue(b.DriverID)+"\"} "+strconv.Itoa(b.Failures))
+		}
+		lines = append(lines,
+			"# HELP rechain_driver_breaker_trips_total Times a driver breaker opened",
+			"# TYPE rechain_driver_breaker_trips_total counter",
+		)
+		for _, b := range breakerSnap {
+			lines = append(lines, "rechain_driver_breaker_trips_total{driver=\""+promLabelValue(b.DriverID)+"\"} "+strconv.Itoa(b.Trips))
+		}
+		quotaSnap := quotas.Rejections()
+		lines = append(lines,
+			"# HELP rechain_quota_rejections_total Submissions refused by rate limit, daily quota or monthly budget",
+			"# TYPE rechain_quota_rejections_total counter",
+		)
+		for _, reason := range []string{"rate", "daily_tasks", "daily_cost", "monthly_budget"} {
+			lines = append(lines, "rechain_quota_rejections_total{reason=\""+reason+"\"} "+strconv.Itoa(quotaSnap[reason]))
+		}
+		ledgerEntries, ledgerCosts := ledger.Stats()
+		lines = append(lines,
+			"# HELP rechain_ledger_entries Driver calls recorded in the cost ledger",
+			"# TYPE rechain_ledger_entries gauge",
+			"rechain_ledger_entries "+strconv.Itoa(ledgerEntries),
+			"# HELP rechain_ledger_cost_usd_total Driver spend recorded in the cost ledger",
+			"# TYPE rechain_ledger_cost_usd_total counter",
+		)
+		ledgerModels := make([]string, 0, len(ledgerCosts))
+		for model := range ledgerCosts {
+			ledgerModels = append(ledgerModels, model)
+		}
+		sort.Strings(ledgerModels)
+		for _, model := range ledgerModels {
+			lines = append(lines, "rechain_ledger_cost_usd_total{model=\""+promLabelValue(model)+"\"} "+strconv.FormatFloat(roundUSD(ledgerCosts[model]), 'f', -1, 64))
+		}
+		logTasks, logByLevel := store.logs.Stats()
+		lines = append(lines,
+			"# HELP rechain_task_logs Tasks with a retained event log",
+			"# TYPE rechain_task_logs gauge",
+			"rechain_task_logs "+strconv.Itoa(logTasks),
+			"# HELP rechain_task_log_entries_total Task log entries by level",
+			"# TYPE rechain_task_log_entries_total counter",
+		)
+		for _, level := range []string{logDebug, logInfo, logWarn, logError} {
+			lines = append(lines, "rechain_task_log_entries_total{level=\""+level+"\"} "+strconv.Itoa(logByLevel[level]))
+		}
+		idemReplayed, idemConflicts, idemKeys := idempotency.Stats()
+		lines = append(lines,
+			"# HELP rechain_idempotent_submissions_total Repeated task submissions by outcome",
+			"# TYPE rechain_idempotent_submissions_total counter",
+			"rechain_idempotent_submissions_total{result=\"replayed\"} "+strconv.Itoa(idemReplayed),
+			"rechain_idempotent_submissions_total{result=\"conflict\"} "+strconv.Itoa(idemConflicts),
+			"# HELP rechain_idempotency_keys Idempotency keys inside the retention window",
+			"# TYPE rechain_idempotency_keys gauge",
+			"rechain_idempotency_keys "+strconv.Itoa(idemKeys),
+		)
+		webhookOutcomes, webhookAttempts, webhookPending := store.webhooks.Stats()
+		lines = append(lines,
+			"# HELP rechain_webhook_deliveries_total Task completion webhooks by final state",
+			"# TYPE rechain_webhook_deliveries_total counter",
+			"rechain_webhook_deliveries_total{state=\"delivered\"} "+strconv.Itoa(webhookOutcomes[webhookDelivered]),
+			"rechain_webhook_deliveries_total{state=\"failed\"} "+strconv.Itoa(webhookOutcomes[webhookFailed]),
+			"# HELP rechain_webhook_attempts_total Webhook POST attempts by outcome",
+			"# TYPE rechain_webhook_attempts_total counter",
+			"rechain_webhook_attempts_total{outcome=\"ok\"} "+strconv.Itoa(webhookAttempts["ok"]),
+			"rechain_webhook_attempts_total{outcome=\"error\"} "+strconv.Itoa(webhookAttempts["error"]),
+			"# HELP rechain_webhook_pending Webhook deliveries waiting for a retry",
+			"# TYPE rechain_webhook_pending gauge",
+			"rechain_webhook_pending "+strconv.Itoa(webhookPending),
+		)
+		cacheLookups, cacheEvictions, cacheEntries, cacheBytes := resultCache.Stats()
+		lines = append(lines,
+			"# HELP rechain_result_cache_lookups_total Result cache lookups at submit time by result",
+			"# TYPE rechain_result_cache_lookups_total counter",
+		)
+		for _, result := range []string{cacheHit, cacheMiss, cacheBypass} {
+			lines = append(lines, "rechain_result_cache_lookups_total{result=\""+result+"\"} "+strconv.Itoa(cacheLookups[result]))
+		}
+		lines = append(lines,
+			"# HELP rechain_result_cache_evictions_total Result cache entries evicted by the size limits",
+			"# TYPE rechain_result_cache_evictions_total counter",
+			"rechain_result_cache_evictions_total "+strconv.Itoa(cacheEvictions),
+			"# HELP rechain_result_cache_entries Cached task results",
+			"# TYPE rechain_result_cache_entries gauge",
+			"rechain_result_cache_entries "+strconv.Itoa(cacheEntries),
+			"# HELP rechain_result_cache_bytes Approximate size of cached task results",
+			"# TYPE rechain_result_cache_bytes gauge",
+			"rechain_result_cache_bytes "+strconv.Itoa(cacheBytes),
+		)
+		verifyOutcomes, verifyFallbacks := verifier.Stats()
+		lines = append(lines,
+			"# HELP rechain_verifications_total Merge candidate verifications by result",
+			"# TYPE rechain_verifications_total counter",
+		)
+		for _, result := range []string{verifyPassed, verifyFailed, verifyError} {
+			lines = append(lines, "rechain_verifications_total{result=\""+result+"\"} "+strconv.Itoa(verifyOutcomes[result]))
+		}
+		lines = append(lines,
+			"# HELP rechain_verify_fallbacks_total Tasks completed with a fallback candidate after the winner failed verification",
+			"# TYPE rechain_verify_fallbacks_total counter",
+			"rechain_verify_fallbacks_total "+strconv.Itoa(verifyFallbacks),
+		)
 		for k, v := range routingSnap {
 			lines = append(lines,
 				"# HELP rechain_routing_total Routing policy usage",
@@ -1439,11 +1899,12 @@ func main() {
 			)
 		}
 		for model, policies := range metrics.RoutingByModelSnapshot() {
-			for policy, v := range policies {
+			for key, v := range policies {
+				policy, decision, _ := strings.Cut(key, "|")
 				lines = append(lines,
 					"# HELP rechain_routing_by_model_total Routing policy per model",
 					"# TYPE rechain_routing_by_model_total counter",
-					"rechain_routing_by_model_total{model=\""+model+"\",policy=\""+policy+"\"} "+strconv.Itoa(v),
+					"rechain_routing_by_model_total{model=\""+model+"\",policy=\""+policy+"\",decision=\""+decision+"\"} "+strconv.Itoa(v),
 				)
 			}
 		}
@@ -1503,8 +1964,15 @@ func main() {
 		w.Write([]byte(strings.Join(lines, "\n")))
 	})
 
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(w, r, store.events, store, "")
+	})
+
 	mux.HandleFunc("/queue-depth", func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, map[string]int{"queue_depth": queue.Depth()})
+		writeJSON(w, map[string]interface{}{
+			"queue_depth": queue.Depth(),
+			"by_priority": queue.Stats(),
+		})
 	})
 
 	mux.HandleFunc("/quality-score", func(w http.ResponseWriter, r *http.Request) {
@@ -1538,13 +2006,41 @@ func main() {
 	})
 
 	mux.HandleFunc("/tasks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			limit := 100
+			if raw := strings.TrimSpace(r.URL.Query().Get("limit")); raw != "" {
+				if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+					limit = n
+				}
+			}
+			writeJSON(w, map[string]interface{}{
+				"schema_version": schemaVersion,
+				"tasks": store.RecentTasks(
+					limit,
+					strings.TrimSpace(r.URL.Query().Get("state")),
+					strings.TrimSpace(r.URL.Query().Get("merge_source")),
+					strings.TrimSpace(r.URL.Query().Get("has_parent")),
+					strings.TrimSpace(r.URL.Query().Get("sort")),
+				),
+			})
+			return
+		}
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxTaskSpecBytes))
+		if err != nil {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errs := validateTaskSpecJSON(body); len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
 		var spec TaskSpec
-		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		if err := json.Unmarshal(body, &spec); err != nil {
 			http.Error(w, "invalid json", http.StatusBadRequest)
 			return
 		}
@@ -1552,34 +2048,148 @@ func main() {
 		if spec.SchemaVersion == "" {
 			spec.SchemaVersion = schemaVersion
 		}
-		if spec.ID == "" {
+		if name, ok := authenticatedRequester(r); ok {
+			spec.Metadata.Requester = name
+		}
+		if err := store.webhooks.ValidateCallbackURL(callbackURL(spec)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		clientID := spec.ID
+		fingerprint := specFingerprint(spec)
+		if clientID != "" {
+			existing, found, err := store.repeatOf(idempotency, clientID, fingerprint)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if found {
+				writeIdempotentReplay(w, existing)
+				return
+			}
+		} else {
 			spec.ID = "task_" + randString(8)
 		}
+		requester := requesterKey(spec)
+		key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+		if key != "" {
+			originalID, err := idempotency.Reserve(requester, key, fingerprint, clientID, spec.ID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if originalID != "" {
+				store.mu.Lock()
+				original, ok := store.statuses[originalID]
+				store.mu.Unlock()
+				if !ok {
+					http.Error(w, "request with this Idempotency-Key is still in progress", http.StatusConflict)
+					return
+				}
+				writeIdempotentReplay(w, original)
+				return
+			}
+		}
+		if rej := quotas.Admit(requester); rej != nil {
+			if key != "" {
+				idempotency.Release(requester, key, spec.ID)
+			}
+			writeQuotaRejection(w, rej)
+			return
+		}
 
-		now := time.Now().UTC().Format(time.RFC3339)
-		status := TaskStatus{
-			SchemaVersion: schemaVersion,
-			ID:            spec.ID,
-			State:         "queued",
-			Progress:      0.0,
-			StartedAt:     now,
-			UpdatedAt:     now,
+		status, err := submitTask(store, queue, metrics, spec, requestTrace(r, TaskTrace{IdempotencyKey: key}))
+		if errors.Is(err, errTaskExists) {
+			quotas.Refund(requester)
+			if key != "" {
+				idempotency.Release(requester, key, spec.ID)
+			}
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			quotas.Refund(requester)
+			if key != "" {
+				idempotency.Release(requester, key, spec.ID)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(status)
+			return
 		}
 
-		store.mu.Lock()
-		store.statuses[spec.ID] = status
-		store.specs[spec.ID] = spec
-		store.traces[spec.ID] = TaskTrace{
-			SchemaVersion: schemaVersion,
-			TaskID:        spec.ID,
-			State:         "queued",
-			StartedAt:     now,
-			RoutingPolicy: constraintString(spec.Constraints, "routing"),
+		writeJSON(w, status)
+	})
+
+	mux.HandleFunc("/schemas", serveSchemas)
+	mux.HandleFunc("/schemas/", serveSchemas)
+
+	mux.HandleFunc("/pipelines", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			writeJSON(w, map[string]interface{}{
+				"schema_version": schemaVersion,
+				"pipelines":      pipelines.List(),
+			})
+			return
 		}
-		store.mu.Unlock()
-		metrics.IncSubmitted()
-		_ = queue.Enqueue(queuedTask{id: spec.ID, spec: spec, enqueued: time.Now()})
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPipelineSpecBytes))
+		if err != nil {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		var spec PipelineSpec
+		if err := json.Unmarshal(body, &spec); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if name, ok := authenticatedRequester(r); ok {
+			spec.Metadata.Requester = name
+		}
+		if _, err := validatePipeline(spec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, st := range spec.Steps {
+			if err := store.webhooks.ValidateCallbackURL(callbackURL(TaskSpec{Constraints: st.Constraints})); err != nil {
+				http.Error(w, "step "+st.Name+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		requester := requesterKey(TaskSpec{Metadata: spec.Metadata})
+		if rej := quotas.AdmitN(requester, len(spec.Steps)); rej != nil {
+			writeQuotaRejection(w, rej)
+			return
+		}
+		status, err := pipelines.Submit(spec)
+		if err != nil {
+			for range spec.Steps {
+				quotas.Refund(requester)
+			}
+			code := http.StatusBadRequest
+			if errors.Is(err, errPipelineExists) {
+				code = http.StatusConflict
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		writeJSON(w, status)
+	})
 
+	mux.HandleFunc("/pipelines/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status, ok := pipelines.Status(strings.Trim(strings.TrimPrefix(r.URL.Path, "/pipelines/"), "/"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
 		writeJSON(w, status)
 	})
 
@@ -1618,6 +2228,11 @@ func main() {
 			return
 		}
 
+		if idx := strings.Index(path, "/artifacts/"); idx > 0 {
+			serveArtifact(w, r, store, path[:idx], strings.Trim(path[idx+len("/artifacts/"):], "/"))
+			return
+		}
+
 		if strings.HasSuffix(path, "/artifacts") {
 			id := strings.TrimSuffix(path, "/artifacts")
 			store.mu.Lock()
@@ -1627,6 +2242,39 @@ func main() {
 			return
 		}
 
+		if strings.HasSuffix(path, "/webhooks") {
+			id := strings.TrimSuffix(path, "/webhooks")
+			store.mu.Lock()
+			_, ok := store.statuses[id]
+			store.mu.Unlock()
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, map[string]interface{}{
+				"task_id":    id,
+				"deliveries": store.webhooks.Deliveries(id),
+			})
+			return
+		}
+
+		if strings.HasSuffix(path, "/events") {
+			id := strings.TrimSuffix(path, "/events")
+			id = strings.TrimSuffix(id, "/")
+			serveEvents(w, r, store.events, store, id)
+			return
+		}
+
+		if strings.HasSuffix(path, "/logs") {
+			serveTaskLogs(w, r, store, strings.TrimSuffix(path, "/logs"))
+			return
+		}
+
+		if strings.HasSuffix(path, "/feedback") {
+			serveTaskFeedback(w, r, store, bandit, strings.TrimSuffix(path, "/feedback"))
+			return
+		}
+
 		if strings.HasSuffix(path, "/result") {
 			id := strings.TrimSuffix(path, "/result")
 			store.mu.Lock()
@@ -1668,10 +2316,15 @@ func main() {
 		if strings.HasSuffix(path, "/debug") {
 			id := strings.TrimSuffix(path, "/debug")
 			id = strings.TrimSuffix(id, "/")
+			if !canActOn(r, store, id) {
+				http.Error(w, "forbidden: not your task", http.StatusForbidden)
+				return
+			}
 			store.mu.Lock()
 			status, okStatus := store.statuses[id]
 			trace, okTrace := store.traces[id]
 			result, okResult := store.results[id]
+			promptText := store.prompts[id]
 			artifacts := append([]Artifact{}, store.artifacts[id]...)
 			store.mu.Unlock()
 			if !okStatus {
@@ -1696,6 +2349,11 @@ func main() {
 			if okResult {
 				payload["result"] = result
 			}
+			if trace.Prompt != nil {
+				prompt := *trace.Prompt
+				prompt.Text = promptText
+				payload["prompt"] = prompt
+			}
 			if !okTrace {
 				payload["trace"] = TaskTrace{}
 			}
@@ -1804,23 +2462,22 @@ func main() {
 				return
 			}
 			id := strings.TrimSuffix(path, "/cancel")
-			store.mu.Lock()
-			status, ok := store.statuses[id]
-			if ok {
-				status.State = "canceled"
-				status.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-				store.statuses[id] = status
-				trace := store.traces[id]
-				trace.State = "canceled"
-				trace.FinishedAt = status.UpdatedAt
-				store.traces[id] = trace
-				metrics.IncCanceled()
+			if !canActOn(r, store, id) {
+				http.Error(w, "forbidden: not your task", http.StatusForbidden)
+				return
 			}
-			store.mu.Unlock()
-			if !ok {
+			status, err := store.Cancel(id, queue)
+			if errors.Is(err, errTaskNotFound) {
 				http.NotFound(w, r)
 				return
 			}
+			if errors.Is(err, errTaskFinished) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(status)
+				return
+			}
+			metrics.IncCanceled()
 			writeJSON(w, status)
 			return
 		}
@@ -1836,6 +2493,7 @@ func main() {
 				http.NotFound(w, r)
 				return
 			}
+			requester, _ := authenticatedRequester(r)
 			var req struct {
 				Modes []string `json:"modes"`
 			}
@@ -1849,6 +2507,10 @@ func main() {
 			if len(modes) == 0 {
 				modes = []string{"force-policy", "force-agent-soft"}
 			}
+			if len(modes) > maxReplayBatch {
+				http.Error(w, "too many modes: at most "+strconv.Itoa(maxReplayBatch)+" per batch", http.StatusBadRequest)
+				return
+			}
 			type replayItem struct {
 				Mode         string     `json:"mode"`
 				ReplayTaskID string     `json:"replay_task_id,omitempty"`
@@ -1857,7 +2519,7 @@ func main() {
 			}
 			items := []replayItem{}
 			for _, mode := range modes {
-				replayID, replayStatus, err := enqueueReplayTask(store, queue, metrics, parentID, mode)
+				replayID, replayStatus, err := enqueueReplayTask(store, queue, quotas, metrics, parentID, mode, requester)
 				item := replayItem{Mode: strings.ToLower(strings.TrimSpace(mode))}
 				if err != nil {
 					item.Error = err.Error()
@@ -1887,8 +2549,14 @@ func main() {
 				http.NotFound(w, r)
 				return
 			}
+			requester, _ := authenticatedRequester(r)
 			replayMode := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("mode")))
-			replayID, replayStatus, err := enqueueReplayTask(store, queue, metrics, parentID, replayMode)
+			replayID, replayStatus, err := enqueueReplayTask(store, queue, quotas, metrics, parentID, replayMode, requester)
+			var rej *QuotaRejection
+			if errors.As(err, &rej) {
+				writeQuotaRejection(w, rej)
+				return
+			}
 			if err != nil {
 				http.NotFound(w, r)
 				return
@@ -1921,7 +2589,12 @@ func main() {
 	addr := ":8081"
 	log.Printf("orchestrator listening on %s", addr)
 	startWorkers(workers, queue, store, registry, ragURL, metrics)
-	if err := http.ListenAndServe(addr, logging.WithRequestID(mux)); err != nil {
+	for _, spec := range recovered {
+		if err := queue.Enqueue(queuedTask{id: spec.ID, spec: spec, enqueued: time.Now()}); err != nil {
+			store.failQueued(spec.ID, "resume: "+err.Error())
+		}
+	}
+	if err := http.ListenAndServe(addr, logging.WithRequestID(tracing.WithTrace(auth.WithAuth(tokens, requiredRole, mux)))); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1940,6 +2613,10 @@ func startWorkers(count int, queue *TaskQueue, store *TaskStore, registry *Drive
 				now := time.Now().UTC().Format(time.RFC3339)
 				store.mu.Lock()
 				status := store.statuses[task.id]
+				if status.State != "queued" {
+					store.mu.Unlock()
+					continue
+				}
 				status.State = "running"
 				status.Progress = 0.1
 				status.StartedAt = now
@@ -1952,6 +2629,7 @@ func startWorkers(count int, queue *TaskQueue, store *TaskStore, registry *Drive
 					trace.RoutingPolicy = constraintString(task.spec.Constraints, "routing")
 				}
 				store.traces[task.id] = trace
+				store.persistLocked(task.id)
 				store.mu.Unlock()
 
 				if metrics != nil {
@@ -1960,7 +2638,7 @@ func startWorkers(count int, queue *TaskQueue, store *TaskStore, registry *Drive
 						metrics.ObserveQueueDelay(delay.Milliseconds())
 					}
 				}
-				processTask(store, registry.Drivers(), registry.Meta(), task.id, task.spec, ragURL, metrics)
+				processTask(store, registry.Available(), registry.Meta(), task.id, task.spec, ragURL, metrics)
 			}
 		}()
 	}
@@ -1971,6 +2649,7 @@ func processTask(store *TaskStore, drivers []Driver, meta map[string]DriverMeta,
 	trace := TaskTrace{
 		SchemaVersion: schemaVersion,
 		TaskID:        id,
+		Requester:     spec.Metadata.Requester,
 		State:         "running",
 		StartedAt:     start.UTC().Format(time.RFC3339),
 		RoutingPolicy: constraintString(spec.Constraints, "routing"),
@@ -1980,109 +2659,189 @@ func processTask(store *TaskStore, drivers []Driver, meta map[string]DriverMeta,
 	store.mu.Unlock()
 	if ok {
 		trace.ParentTaskID = existingTrace.ParentTaskID
+		trace.PipelineID = existingTrace.PipelineID
+		trace.IdempotencyKey = existingTrace.IdempotencyKey
+		trace.TraceID = existingTrace.TraceID
+		trace.ParentSpanID = existingTrace.ParentSpanID
+		trace.RequestID = existingTrace.RequestID
 		if existingTrace.StartedAt != "" {
 			trace.StartedAt = existingTrace.StartedAt
 		}
 	}
+	traceCtx, root, spans := tracing.NewTrace(logging.ContextWithRequestID(context.Background(), trace.RequestID), "task",
+		tracing.SpanContext{TraceID: trace.TraceID, SpanID: trace.ParentSpanID})
+	root.SetAttr("task_id", id)
+	trace.TraceID = spans.TraceID()
+	// endSpans closes the root span and attaches the span tree to the trace;
+	// it runs before every terminal store update.
+	endSpans := func(err error) {
+		root.End(err)
+		trace.Spans = spans.Tree()
+	}
+	traceCtx = withTaskLog(traceCtx, store.logs, id)
+	runCtx, stop := context.WithCancel(traceCtx)
+	defer stop()
+	if !store.beginRun(id, stop) {
+		return
+	}
+	defer store.endRun(id)
+	cacheKey := resultCacheGlobal.Key(spec)
 	timeoutMs := constraintInt(spec.Constraints, "budget_ms", 2000)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+	ctx, cancel := context.WithTimeout(runCtx, time.Duration(timeoutMs)*time.Millisecond)
 	defer cancel()
 
-	delay := queueDelayForPriority(spec.Metadata.Priority)
-	if delay > 0 {
-		time.Sleep(delay)
-		if metrics != nil {
-			metrics.ObserveQueueDelay(delay.Milliseconds())
-		}
-	}
-
+	// The prompt inlines only the files the task asked for; RAG matches reach
+	// it as ranked snippets, not as whole files.
+	promptSpec := spec
+	var snippets []RAGSnippet
 	if ragURL != "" {
-		if ctxs, err := fetchRAGContext(ctx, ragURL, spec.Input); err == nil && len(ctxs) > 0 {
+		ragCtx, span := tracing.Start(ctx, "rag", tracing.KindInternal)
+		ctxs, found, err := fetchRAGContext(ragCtx, ragURL, spec.Input)
+		if err != nil {
+			logTask(ctx, logWarn, "rag_error", "", "rag search failed, continuing without retrieved context: "+err.Error(), nil)
+		} else if len(ctxs) > 0 || len(found) > 0 {
 			spec.Context = append(spec.Context, ctxs...)
+			snippets = found
+			logTask(ctx, logDebug, "rag_context", "", "retrieved "+strconv.Itoa(len(ctxs))+" file(s) and "+strconv.Itoa(len(found))+" snippet(s)", nil)
+		}
+		span.SetAttr("matches", strconv.Itoa(len(ctxs)))
+		span.SetAttr("snippets", strconv.Itoa(len(found)))
+		span.End(err)
+	}
+	if promptBuilderGlobal != nil {
+		prompt, err := promptBuilderGlobal.Build(promptSpec, snippets)
+		if err != nil {
+			logTask(ctx, logWarn, "prompt_error", "", "sending the raw input: "+err.Error(), nil)
+		} else {
+			spec.Prompt = prompt.Text
+			store.setPromptText(id, prompt.Text)
+			prompt.Text = ""
+			trace.Prompt = &prompt
+			logTask(ctx, logDebug, "prompt", "", "rendered "+prompt.Template+": "+strconv.Itoa(prompt.Chars)+" of "+strconv.Itoa(prompt.BudgetChars)+" chars", nil)
 		}
 	}
 
 	selected := selectDrivers(spec, drivers, meta)
+	if budgetDowngrade(spec) {
+		selected = downgradeDrivers(selected, meta)
+		trace.BudgetDowngraded = true
+	}
 	for _, d := range selected {
 		trace.Selected = append(trace.Selected, d.ID())
 	}
-	results := make([]ModelResult, 0, len(selected))
-	for _, d := range selected {
-		res, err := runWithRetry(ctx, d, spec, metrics)
-		if err == nil {
-			results = append(results, res)
-			if metrics != nil {
-				metrics.ObserveModelLatency(res.ModelID, int64(metricValue(res, "latency_ms")))
-			}
+	if banditGlobal != nil {
+		trace.Bandit = &TraceBandit{Context: banditContext(spec)}
+		if banditRouting(spec) {
+			trace.Bandit.Decisions = banditGlobal.Decide(spec, allowedDrivers(drivers), selected)
 		}
 	}
+	if trace.BudgetDowngraded {
+		logTask(ctx, logWarn, "budget_downgrade", "", "requester is over its monthly budget; running the cheapest driver only", nil)
+	}
+	routing := trace.RoutingPolicy
+	if routing == "" {
+		routing = "default"
+	}
+	logTask(ctx, logInfo, "routing", "", "selected "+strings.Join(trace.Selected, ",")+" with routing "+routing, nil)
+	opts := fanOutOptionsFor(spec, drivers, selected)
+	if trace.BudgetDowngraded {
+		opts.hedgePool = nil
+	}
+	fanCtx, fanSpan := tracing.Start(ctx, "fanout", tracing.KindInternal)
+	report := runFanOut(fanCtx, store, id, selected, spec, metrics, opts)
+	results := report.results
+	trace.Hedges = report.hedges
+	trace.QuorumSkipped = report.skipped
+	attempted := report.failed
+	for _, r := range results {
+		attempted = append(attempted, r.ModelID)
+	}
+	for _, h := range report.hedges {
+		attempted = append(attempted, h.Hedge)
+	}
+	if runCtx.Err() != nil {
+		trace.Interrupted = append(trace.Interrupted, report.failed...)
+	}
 
-	if len(results) == 0 {
-		fallbackIDs := splitCSV(constraintString(spec.Constraints, "fallback_models"))
-		if len(fallbackIDs) > 0 {
-			for _, fid := range fallbackIDs {
-				d := findDriverByID(drivers, fid)
-				if d == nil {
-					continue
-				}
-				res, err := runWithRetry(ctx, d, spec, metrics)
-				if err == nil {
-					results = append(results, res)
-					if metrics != nil {
-						metrics.ObserveModelLatency(res.ModelID, int64(metricValue(res, "latency_ms")))
-					}
-				}
+	if len(results) == 0 && runCtx.Err() == nil {
+		fallbacks := []Driver{}
+		for _, fid := range splitCSV(constraintString(spec.Constraints, "fallback_models")) {
+			d := findDriverByID(drivers, fid)
+			if d == nil || containsString(attempted, fid) || !breakersGlobal.Allow(fid) {
+				continue
 			}
+			fallbacks = append(fallbacks, d)
 		}
-		if len(results) == 0 {
-			store.mu.Lock()
-			status := store.statuses[id]
-			status.State = "failed"
-			status.Progress = 1.0
-			status.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-			store.statuses[id] = status
-			trace.State = "failed"
-			trace.FinishedAt = time.Now().UTC().Format(time.RFC3339)
-			trace.Error = "no model results"
-			store.traces[id] = trace
-			store.mu.Unlock()
+		if trace.BudgetDowngraded {
+			fallbacks = downgradeDrivers(fallbacks, meta)
+		}
+		if len(fallbacks) > 0 {
+			fallbackIDs := []string{}
+			for _, d := range fallbacks {
+				fallbackIDs = append(fallbackIDs, d.ID())
+			}
+			logTask(ctx, logWarn, "fallback_models", "", "no results from the selected drivers; trying "+strings.Join(fallbackIDs, ","), nil)
+			fanSpan.SetAttr("fallback", "true")
+			report = runFanOut(fanCtx, store, id, fallbacks, spec, metrics, fanOutOptions{driverTimeout: opts.driverTimeout})
+			results = report.results
+			if runCtx.Err() != nil {
+				trace.Interrupted = append(trace.Interrupted, report.failed...)
+			}
+		}
+	}
+	fanSpan.SetAttr("results", strconv.Itoa(len(results)))
+	fanSpan.End(runCtx.Err())
+	chargeQuotaCost(spec, results)
+	if runCtx.Err() != nil {
+		logTask(runCtx, logWarn, "canceled", "", "task canceled while drivers were running", nil)
+		endSpans(runCtx.Err())
+		store.finishCanceled(id, trace)
+		metrics.ObserveLatency(time.Since(start).Milliseconds())
+		return
+	}
+	if len(results) == 0 {
+		trace.Error = "no model results"
+		logTask(ctx, logError, "no_results", "", "no driver returned a result; see the driver_error entries", nil)
+		endSpans(errors.New(trace.Error))
+		if store.completeRun(id, "failed", trace, nil, nil) {
 			metrics.IncFailed()
-			metrics.ObserveLatency(time.Since(start).Milliseconds())
-			return
 		}
+		metrics.ObserveLatency(time.Since(start).Milliseconds())
+		return
 	}
 
 	for _, r := range results {
-		trace.Results = append(trace.Results, TraceModelResult{
-			ModelID:      r.ModelID,
-			DiffLen:      len(r.Diff),
-			LatencyMs:    metricValue(r, "latency_ms"),
-			CostUSD:      metricValue(r, "cost_usd"),
-			QualityScore: metricValue(r, "quality_score"),
-		})
+		trace.Results = append(trace.Results, traceModelResult(r))
 	}
 
 	policy := constraintString(spec.Constraints, "routing")
 	metrics.IncRouting(policy)
 	for _, d := range selected {
-		metrics.IncRoutingModel(policy, d.ID())
+		decision := decisionStatic
+		if trace.Bandit != nil && trace.Bandit.Decisions[d.ID()] != "" {
+			decision = trace.Bandit.Decisions[d.ID()]
+		}
+		metrics.IncRoutingModel(policy, d.ID(), decision)
 	}
 
 	forceMergeSource := strings.ToLower(strings.TrimSpace(constraintString(spec.Constraints, "force_merge_source")))
+	mergeCtx, mergeSpan := tracing.Start(runCtx, "merge", tracing.KindInternal)
 	mergeSource := "agent_compiler"
 	var merge MergeResult
 	var err error
 	switch forceMergeSource {
 	case "agent_compiler":
-		merge, err = tryAgentCompiler(results, policy)
+		merge, err = tryAgentCompiler(mergeCtx, results, policy)
 		if err != nil {
 			err = errors.New("forced agent_compiler failed: " + err.Error())
 		}
 	case "agent_compiler_soft":
-		merge, err = tryAgentCompiler(results, policy)
+		merge, err = tryAgentCompiler(mergeCtx, results, policy)
 		if err != nil {
+			logTask(runCtx, logWarn, "merge_fallback", "", "agent compiler failed, falling back to policy_merge: "+err.Error(), nil)
 			mergeSource = "policy_merge"
 			merge, err = mergeResults(
+				mergeCtx,
 				results,
 				policy,
 				constraintFloat(spec.Constraints, "weight_cost", 0.3),
@@ -2093,9 +2852,16 @@ func processTask(store *TaskStore, drivers []Driver, meta map[string]DriverMeta,
 				metrics.IncForcedFallback()
 			}
 		}
+	case "hunk_merge":
+		mergeSource = "hunk_merge"
+		merge, err = hunkMergeResults(results)
+		if err != nil {
+			err = errors.New("forced hunk_merge failed: " + err.Error())
+		}
 	case "policy_merge":
 		mergeSource = "policy_merge"
 		merge, err = mergeResults(
+			mergeCtx,
 			results,
 			policy,
 			constraintFloat(spec.Constraints, "weight_cost", 0.3),
@@ -2103,10 +2869,19 @@ func processTask(store *TaskStore, drivers []Driver, meta map[string]DriverMeta,
 			constraintFloat(spec.Constraints, "weight_quality", 0.0),
 		)
 	default:
-		merge, err = tryAgentCompiler(results, policy)
+		if strings.EqualFold(constraintString(spec.Constraints, "merge_strategy"), "hunk") {
+			if merge, err = hunkMergeResults(results); err == nil {
+				mergeSource = "hunk_merge"
+				break
+			}
+			logTask(runCtx, logWarn, "merge_fallback", "", "hunk merge failed, falling back to agent_compiler: "+err.Error(), nil)
+		}
+		merge, err = tryAgentCompiler(mergeCtx, results, policy)
 		if err != nil {
+			logTask(runCtx, logWarn, "merge_fallback", "", "agent compiler failed, falling back to policy_merge: "+err.Error(), nil)
 			mergeSource = "policy_merge"
 			merge, err = mergeResults(
+				mergeCtx,
 				results,
 				policy,
 				constraintFloat(spec.Constraints, "weight_cost", 0.3),
@@ -2115,46 +2890,81 @@ func processTask(store *TaskStore, drivers []Driver, meta map[string]DriverMeta,
 			)
 		}
 	}
+	mergeSpan.SetAttr("source", mergeSource)
+	mergeSpan.End(err)
 	if err != nil {
-		store.mu.Lock()
-		status := store.statuses[id]
-		status.State = "failed"
-		status.Progress = 1.0
-		status.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-		store.statuses[id] = status
-		trace.State = "failed"
-		trace.FinishedAt = time.Now().UTC().Format(time.RFC3339)
 		trace.Error = "merge failed: " + err.Error()
-		store.traces[id] = trace
-		store.mu.Unlock()
-		metrics.IncFailed()
+		logTask(runCtx, logError, "merge_failed", "", trace.Error, nil)
+		endSpans(err)
+		if store.completeRun(id, "failed", trace, nil, nil) {
+			metrics.IncFailed()
+		}
 		metrics.ObserveLatency(time.Since(start).Milliseconds())
 		return
 	}
+	if trace.Bandit != nil {
+		rewards, _ := mergeRewards(merge, results, trace.Selected)
+		banditGlobal.Observe(spec, rewards, rewardMerge)
+	}
 
-	artifact := Artifact{
-		SchemaVersion: schemaVersion,
-		ID:            "artifact_" + randString(8),
-		Type:          "diff",
-		Path:          "artifacts/" + id + "/patch.diff",
-		Sha256:        "",
-		CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+	if verifierGlobal != nil && constraintBool(spec.Constraints, "verify", false) {
+		var verifyErr error
+		merged := merge
+		verifyCtx, span := tracing.Start(runCtx, "verify", tracing.KindInternal)
+		merge, mergeSource, trace.Verifications, verifyErr = verifierGlobal.VerifyMerge(verifyCtx, spec, merge, mergeSource, results)
+		span.End(verifyErr)
+		if trace.Bandit != nil {
+			banditGlobal.Observe(spec, verifyRewards(trace.Verifications, merged, results), rewardVerify)
+		}
+		for _, run := range trace.Verifications {
+			level, outcome := logInfo, "passed"
+			if !run.Passed {
+				level, outcome = logWarn, "failed"
+				if run.Error != "" {
+					outcome = "failed: " + run.Error
+				}
+			}
+			logTask(runCtx, level, "verify", "", "candidate "+run.Candidate+" "+outcome, nil)
+		}
+		if runCtx.Err() != nil {
+			logTask(runCtx, logWarn, "canceled", "", "task canceled during verification", nil)
+			endSpans(runCtx.Err())
+			store.finishCanceled(id, trace)
+			metrics.ObserveLatency(time.Since(start).Milliseconds())
+			return
+		}
+		if verifyErr != nil {
+			trace.Error = "verification failed: " + verifyErr.Error()
+			logTask(runCtx, logError, "verify_failed", "", trace.Error, nil)
+			endSpans(verifyErr)
+			if store.completeRun(id, "failed", trace, nil, nil) {
+				metrics.IncFailed()
+			}
+			metrics.ObserveLatency(time.Since(start).Milliseconds())
+			return
+		}
 	}
 
-	store.mu.Lock()
-	status := store.statuses[id]
-	status.State = "completed"
-	status.Progress = 1.0
-	status.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-	store.statuses[id] = status
-	store.artifacts[id] = []Artifact{artifact}
-	store.results[id] = merge
-	trace.State = "completed"
-	trace.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	store.publish(TaskEvent{Type: "merge", TaskID: id, Merge: &merge, MergeSource: mergeSource})
+
+	artifacts := buildTaskArtifacts(store.blobs, id, merge, results)
+
 	trace.MergeSource = mergeSource
 	trace.Merge = &merge
-	store.traces[id] = trace
-	store.mu.Unlock()
+	if trace.Bandit != nil {
+		_, trace.Bandit.Winners = mergeRewards(merge, results, nil)
+	}
+	logTask(runCtx, logInfo, "completed", "", "merged "+strconv.Itoa(len(results))+" result(s) via "+mergeSource, nil)
+	endSpans(nil)
+	if !store.completeRun(id, "completed", trace, &merge, artifacts) {
+		metrics.ObserveLatency(time.Since(start).Milliseconds())
+		return
+	}
+	if !trace.BudgetDowngraded {
+		// A downgraded run only tried the cheapest driver; it must not be
+		// served to requesters that are within budget.
+		resultCacheGlobal.Put(cacheKey, id, mergeSource, merge, results)
+	}
 	if metrics != nil {
 		metrics.IncMergeChoice(mergeSource)
 	}
@@ -2162,7 +2972,26 @@ func processTask(store *TaskStore, drivers []Driver, meta map[string]DriverMeta,
 	metrics.ObserveLatency(time.Since(start).Milliseconds())
 }
 
-func tryAgentCompiler(results []ModelResult, policy string) (MergeResult, error) {
+func traceModelResult(r ModelResult) TraceModelResult {
+	return TraceModelResult{
+		ModelID:      r.ModelID,
+		DiffLen:      len(r.Diff),
+		LatencyMs:    metricValue(r, "latency_ms"),
+		CostUSD:      metricValue(r, "cost_usd"),
+		QualityScore: metricValue(r, "quality_score"),
+	}
+}
+
+func publishDriverResult(store *TaskStore, taskID string, driverID string, res ModelResult, err error) {
+	if err != nil {
+		store.publish(TaskEvent{Type: "driver_error", TaskID: taskID, Result: &TraceModelResult{ModelID: driverID}, Error: err.Error()})
+		return
+	}
+	tr := traceModelResult(res)
+	store.publish(TaskEvent{Type: "driver_result", TaskID: taskID, Result: &tr})
+}
+
+func tryAgentCompiler(ctx context.Context, results []ModelResult, policy string) (MergeResult, error) {
 	base := strings.TrimRight(os.Getenv("AGENT_COMPILER_URL"), "/")
 	if base == "" {
 		return MergeResult{}, errors.New("agent compiler disabled")
@@ -2174,8 +3003,14 @@ func tryAgentCompiler(results []ModelResult, policy string) (MergeResult, error)
 		"results":        results,
 	}
 	body, _ := json.Marshal(payload)
-	client := &http.Client{Timeout: 1200 * time.Millisecond}
-	resp, err := client.Post(base+"/compile", "application/json", bytes.NewReader(body))
+	ctx, cancel := context.WithTimeout(ctx, 1200*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/compile", bytes.NewReader(body))
+	if err != nil {
+		return MergeResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := serviceClient.Do(req)
 	if err != nil {
 		return MergeResult{}, err
 	}
@@ -2184,9 +3019,10 @@ func tryAgentCompiler(results []ModelResult, policy string) (MergeResult, error)
 		return MergeResult{}, errors.New("agent compiler error")
 	}
 	var out struct {
-		Diff         string  `json:"diff"`
-		QualityScore float64 `json:"quality_score"`
-		Rationale    string  `json:"rationale"`
+		Diff         string   `json:"diff"`
+		QualityScore float64  `json:"quality_score"`
+		Rationale    string   `json:"rationale"`
+		Tests        []string `json:"tests"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
 		return MergeResult{}, err
@@ -2200,14 +3036,50 @@ func tryAgentCompiler(results []ModelResult, policy string) (MergeResult, error)
 		Rationale:     "agent compiler: " + out.Rationale,
 		Confidence:    0.6,
 		QualityScore:  out.QualityScore,
+		Tests:         out.Tests,
 	}, nil
 }
 
-func mergeResults(results []ModelResult, policy string, weightCost float64, weightLatency float64, weightQuality float64) (MergeResult, error) {
+// hunkMergeResults combines candidate diffs hunk by hunk, resolving overlaps
+// in favour of the candidate with the higher quality_score.
+func hunkMergeResults(results []ModelResult) (MergeResult, error) {
+	cands := make([]internal.Candidate, 0, len(results))
+	quality := map[string]float64{}
+	for _, r := range results {
+		q := metricValue(r, "quality_score")
+		cands = append(cands, internal.Candidate{ID: r.ModelID, Diff: r.Diff, Score: q})
+		quality[r.ModelID] = q
+	}
+	hm, err := internal.MergeHunks(cands)
+	if err != nil {
+		return MergeResult{}, err
+	}
+	if len(hm.Sources) == 0 {
+		return MergeResult{}, errors.New("no hunks to merge")
+	}
+	total := 0.0
+	for _, src := range hm.Sources {
+		total += quality[src.Candidate]
+	}
+	confidence := 0.7
+	if len(hm.Conflicts) > 0 {
+		confidence = 0.5
+	}
+	return MergeResult{
+		SchemaVersion: schemaVersion,
+		Diff:          hm.Diff,
+		Rationale:     hm.Report(),
+		Confidence:    confidence,
+		QualityScore:  total / float64(len(hm.Sources)),
+		HunkMerge:     &hm,
+	}, nil
+}
+
+func mergeResults(ctx context.Context, results []ModelResult, policy string, weightCost float64, weightLatency float64, weightQuality float64) (MergeResult, error) {
 	metric := "latency_ms"
 	if strings.EqualFold(policy, "cost") {
 		metric = "cost_usd"
-	} else if strings.EqualFold(policy, "quality") {
+	} else if strings.EqualFold(policy, "quality") || strings.EqualFold(policy, "bandit") {
 		metric = "quality_score"
 		mapped := make([]internal.ModelResult, 0, len(results))
 		for _, r := range results {
@@ -2228,7 +3100,7 @@ func mergeResults(results []ModelResult, policy string, weightCost float64, weig
 			QualityScore:  metricValueInternal(best, "quality_score"),
 		}, nil
 	} else if strings.EqualFold(policy, "quantum") {
-		if best, ok := tryQuantumOptimize(results); ok {
+		if best, ok := tryQuantumOptimize(ctx, results); ok {
 			return MergeResult{
 				SchemaVersion: schemaVersion,
 				Diff:          best.Diff,
@@ -2280,6 +3152,9 @@ func mergeResults(results []ModelResult, policy string, weightCost float64, weig
 }
 
 func selectDrivers(spec TaskSpec, drivers []Driver, meta map[string]DriverMeta) []Driver {
+	// Drivers with an open circuit breaker are not selected at all, including
+	// when listed in "models" or needed to reach min_models.
+	drivers = allowedDrivers(drivers)
 	preferred := constraintString(spec.Constraints, "models")
 	maxModels := constraintInt(spec.Constraints, "max_models", len(drivers))
 	minModels := constraintInt(spec.Constraints, "min_models", 0)
@@ -2302,6 +3177,10 @@ func selectDrivers(spec TaskSpec, drivers []Driver, meta map[string]DriverMeta)
 		} else {
 			out = append(out, drivers...)
 		}
+		if banditGlobal != nil && banditRouting(spec) {
+			out = banditGlobal.Rank(spec, out)
+			maxModels = constraintInt(spec.Constraints, "max_models", banditGlobal.arms)
+		}
 	}
 
 	if maxModels > 0 && len(out) > maxModels {
@@ -2396,6 +3275,24 @@ func constraintFloat(constraints []Constraint, key string, fallback float64) flo
 	return fallback
 }
 
+func constraintBool(constraints []Constraint, key string, fallback bool) bool {
+	for _, c := range constraints {
+		if c.Key == key {
+			switch v := c.Value.(type) {
+			case bool:
+				return v
+			case string:
+				if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+					return b
+				}
+			case float64:
+				return v != 0
+			}
+		}
+	}
+	return fallback
+}
+
 func upsertConstraint(constraints []Constraint, key string, value interface{}) []Constraint {
 	out := append([]Constraint{}, constraints...)
 	for i := range out {
@@ -2408,6 +3305,15 @@ func upsertConstraint(constraints []Constraint, key string, value interface{}) [
 	return out
 }
 
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
 func findDriverByID(drivers []Driver, id string) Driver {
 	for _, d := range drivers {
 		if d.ID() == id {
@@ -2802,24 +3708,21 @@ func startHFPingLoop(models []string, registry *DriverRegistry, pingSvc *PingSer
 	if interval <= 0 {
 		return
 	}
-	list := registry.HFModelIDs(models)
-	if len(list) == 0 {
-		return
-	}
-
-	var hf *HuggingFaceDriver
-	for _, d := range registry.Drivers() {
-		if h, ok := d.(HuggingFaceDriver); ok {
-			hf = &h
-			break
-		}
-	}
-	if hf == nil {
-		return
-	}
 
+	// Resolve models and the HF driver on every sweep so a drivers reload is
+	// picked up without restarting the loop.
 	runPingSweep := func() {
-		for _, modelID := range list {
+		var hf *HuggingFaceDriver
+		for _, d := range registry.Drivers() {
+			if h, ok := d.(HuggingFaceDriver); ok {
+				hf = &h
+				break
+			}
+		}
+		if hf == nil {
+			return
+		}
+		for _, modelID := range registry.HFModelIDs(models) {
 			_ = pingSvc.IsAvailable(modelID, *hf)
 		}
 	}
@@ -3004,7 +3907,7 @@ func metricValueInternal(r internal.ModelResult, name string) float64 {
 	return 0
 }
 
-func tryQuantumOptimize(results []ModelResult) (ModelResult, bool) {
+func tryQuantumOptimize(ctx context.Context, results []ModelResult) (ModelResult, bool) {
 	base := strings.TrimRight(os.Getenv("QUANTUM_URL"), "/")
 	if base == "" {
 		return ModelResult{}, false
@@ -3030,8 +3933,14 @@ func tryQuantumOptimize(results []ModelResult) (ModelResult, bool) {
 		"candidates":     candidates,
 	}
 	body, _ := json.Marshal(payload)
-	client := &http.Client{Timeout: 1200 * time.Millisecond}
-	resp, err := client.Post(base+"/optimize", "application/json", bytes.NewReader(body))
+	ctx, cancel := context.WithTimeout(ctx, 1200*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/optimize", bytes.NewReader(body))
+	if err != nil {
+		return ModelResult{}, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := serviceClient.Do(req)
 	if err != nil {
 		return ModelResult{}, false
 	}
@@ -3053,38 +3962,65 @@ func tryQuantumOptimize(results []ModelResult) (ModelResult, bool) {
 	return ModelResult{}, false
 }
 
-func fetchRAGContext(ctx context.Context, ragURL string, query string) ([]ContextRef, error) {
+// serviceClient carries calls to the rag, agent-compiler, quantum and kernel
+// services. It propagates traceparent and X-Request-Id and records a client
+// span per call; callers bound each call with a context deadline.
+var serviceClient = tracing.NewClient(0)
+
+// fetchRAGContext searches the rag service for the task input. It returns the
+// matching files as context refs and the matching chunks with their text.
+func fetchRAGContext(ctx context.Context, ragURL string, query string) ([]ContextRef, []RAGSnippet, error) {
 	if query == "" {
-		return nil, nil
+		return nil, nil, nil
 	}
 
-	u := ragURL + "/search?q=" + url.QueryEscape(query)
+	u := ragURL + "/search?snippets=true&q=" + url.QueryEscape(query)
+	ctx, cancel := context.WithTimeout(ctx, 800*time.Millisecond)
+	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	client := &http.Client{Timeout: 800 * time.Millisecond}
-	resp, err := client.Do(req)
+	resp, err := serviceClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("rag search failed")
+		return nil, nil, errors.New("rag search failed")
 	}
 
 	var s SearchResult
 	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	out := make([]ContextRef, 0, len(s.Matches))
 	for _, m := range s.Matches {
 		out = append(out, ContextRef{Type: "file", Path: m, Rev: ""})
 	}
-	return out, nil
+	snippets := []RAGSnippet{}
+	for _, sc := range s.Scores {
+		if sc.Text != "" {
+			snippets = append(snippets, parseRAGSnippet(sc.Path, sc.Score, sc.Text))
+		}
+	}
+	return out, snippets, nil
+}
+
+// requestTrace records the trace context and request ID of a task submission,
+// so the task's spans join the caller's trace. Without an incoming
+// traceparent the task continues the trace started for the request.
+func requestTrace(r *http.Request, trace TaskTrace) TaskTrace {
+	if sc, ok := tracing.ParseTraceparent(r.Header.Get("traceparent")); ok {
+		trace.TraceID, trace.ParentSpanID = sc.TraceID, sc.SpanID
+	} else if sc, ok := tracing.FromContext(r.Context()); ok {
+		trace.TraceID = sc.TraceID
+	}
+	trace.RequestID = logging.RequestIDFromContext(r.Context())
+	return trace
 }
 
 func writeJSON(w http.ResponseWriter, v interface{}) {
@@ -3128,6 +4064,18 @@ func envInt(key string, fallback int) int {
 	return n
 }
 
+func envFloat(key string, fallback float64) float64 {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
 func parseHFGeneratedText(data []byte) string {
 	if len(data) == 0 {
 		return ""
@@ -3147,29 +4095,43 @@ func parseHFGeneratedText(data []byte) string {
 	return string(data)
 }
 
-func queueDelayForPriority(priority string) time.Duration {
-	switch strings.ToLower(strings.TrimSpace(priority)) {
-	case "low":
-		return 150 * time.Millisecond
-	case "normal":
-		return 50 * time.Millisecond
-	case "high":
-		return 0
-	default:
-		return 50 * time.Millisecond
-	}
-}
-
 func runWithRetry(ctx context.Context, d Driver, spec TaskSpec, metrics *Metrics) (ModelResult, error) {
 	retries := constraintInt(spec.Constraints, "retries", 0)
 	backoff := time.Duration(constraintInt(spec.Constraints, "retry_backoff_ms", 200)) * time.Millisecond
+	if !breakersGlobal.Begin(d.ID()) {
+		logTask(ctx, logWarn, "circuit_open", d.ID(), "skipped: circuit breaker open", nil)
+		return ModelResult{}, errCircuitOpen
+	}
+	res, err := runAttempts(ctx, d, spec, metrics, retries, backoff)
+	breakersGlobal.Record(d.ID(), err)
+	return res, err
+}
+
+func runAttempts(ctx context.Context, d Driver, spec TaskSpec, metrics *Metrics, retries int, backoff time.Duration) (ModelResult, error) {
+	// spent is the usage failed attempts were billed for; it is added to the
+	// result, or returned with the error.
+	var spent ModelResult
 	var lastErr error
 	for attempt := 0; attempt <= retries; attempt++ {
-		res, err := d.Run(ctx, spec)
+		attemptField := map[string]string{"attempt": strconv.Itoa(attempt + 1)}
+		logTask(ctx, logDebug, "driver_attempt", d.ID(), "attempt "+strconv.Itoa(attempt+1)+" of "+strconv.Itoa(retries+1), attemptField)
+		actx, span := tracing.Start(ctx, "attempt "+strconv.Itoa(attempt+1), tracing.KindInternal)
+		res, err := d.Run(actx, spec)
+		span.End(err)
 		if err == nil {
+			addUsage(&res, spent)
 			return res, nil
 		}
+		addUsage(&spent, res)
 		lastErr = err
+		if ctx.Err() != nil {
+			logTask(ctx, logWarn, "driver_error", d.ID(), "attempt "+strconv.Itoa(attempt+1)+" interrupted: "+ctx.Err().Error(), attemptField)
+			return spent, ctx.Err()
+		}
+		logTask(ctx, logWarn, "driver_error", d.ID(), err.Error(), attemptField)
+		if attempt < retries {
+			logTask(ctx, logInfo, "retry", d.ID(), "retrying in "+backoff.String()+" after: "+err.Error(), attemptField)
+		}
 		if metrics != nil && attempt < retries {
 			metrics.IncRetry()
 		}
@@ -3177,12 +4139,12 @@ func runWithRetry(ctx context.Context, d Driver, spec TaskSpec, metrics *Metrics
 			select {
 			case <-time.After(backoff):
 			case <-ctx.Done():
-				return ModelResult{}, ctx.Err()
+				return spent, ctx.Err()
 			}
 		}
 	}
 	if lastErr == nil {
 		lastErr = errors.New("driver failed")
 	}
-	return ModelResult{}, lastErr
+	return spent, lastErr
 }
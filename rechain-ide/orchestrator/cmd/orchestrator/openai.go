@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"rechain-ide/orchestrator/internal"
+)
+
+var defaultSystemPrompts = map[string]string{
+	"patch":    "You are a senior software engineer. Reply with a single unified diff (git format) inside a ```diff block that implements the request. Do not include explanations outside the diff.",
+	"review":   "You are a meticulous code reviewer. Point out defects and risks, then reply with a unified diff (git format) inside a ```diff block that fixes them.",
+	"testgen":  "You write focused automated tests. Reply with a unified diff (git format) inside a ```diff block that adds tests for the request.",
+	"analysis": "You analyze codebases. Summarize your findings briefly, then reply with any suggested change as a unified diff (git format) inside a ```diff block.",
+}
+
+const defaultSystemPrompt = "You are a software engineering assistant. Reply with a unified diff (git format) inside a ```diff block."
+
+// OpenAIDriver runs tasks against any server exposing the OpenAI-compatible
+// /v1/chat/completions API (vLLM, llama.cpp, Ollama, ...).
+type OpenAIDriver struct {
+	id                  string
+	baseURL             string
+	apiKey              string
+	model               string
+	fallback            []string
+	timeout             time.Duration
+	systemPrompts       map[string]string
+	promptCostPer1K     float64
+	completionCostPer1K float64
+	workspace           string
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatCompletionRequest struct {
+	Model       string        `json:"model"`
+	Messages    []chatMessage `json:"messages"`
+	MaxTokens   int           `json:"max_tokens,omitempty"`
+	Temperature float64       `json:"temperature"`
+}
+
+type chatCompletionResponse struct {
+	Choices []struct {
+		Message      chatMessage `json:"message"`
+		FinishReason string      `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+func (d OpenAIDriver) ID() string { return d.id }
+
+func (d OpenAIDriver) systemPrompt(taskType string) string {
+	if p := d.systemPrompts[strings.ToLower(taskType)]; p != "" {
+		return p
+	}
+	if p := defaultSystemPrompts[strings.ToLower(taskType)]; p != "" {
+		return p
+	}
+	return defaultSystemPrompt
+}
+
+func (d OpenAIDriver) Run(ctx context.Context, spec TaskSpec) (ModelResult, error) {
+	start := time.Now()
+	originals := loadContextFiles(d.workspace, spec.Context)
+	models := append([]string{d.model}, d.fallback...)
+	// spent is what models that answered without a usable result billed.
+	var spent ModelResult
+	var lastErr error
+	for _, model := range models {
+		res, err := d.complete(ctx, model, spec, originals)
+		if err == nil {
+			addUsage(&res, spent)
+			res.Metrics = append([]Metric{{Name: "latency_ms", Value: float64(time.Since(start).Milliseconds())}}, res.Metrics...)
+			return res, nil
+		}
+		addUsage(&spent, res)
+		if ctx.Err() != nil {
+			return spent, ctx.Err()
+		}
+		lastErr = err
+	}
+	return spent, lastErr
+}
+
+// complete asks one model for a diff. Once the model answered, the usage it
+// billed is returned in the result's metrics even when there is an error.
+
+func (d OpenAIDriver) complete(ctx context.Context, model string, spec TaskSpec, originals map[string]string) (ModelResult, error) {
+	reqBody := chatCompletionRequest{
+		Model: model,
+		Messages: []chatMessage{
+			{Role: "system", Content: d.systemPrompt(spec.Type)},
+			{Role: "user", Content: chatUserPrompt(spec, originals)},
+		},
+		MaxTokens:   constraintInt(spec.Constraints, "max_tokens", constraintInt(spec.Constraints, "max_new_tokens", 1024)),
+		Temperature: constraintFloat(spec.Constraints, "temperature", 0.2),
+	}
+
+	body, _ := json.Marshal(reqBody)
+	endpoint := strings.TrimRight(d.baseURL, "/") + "/chat/completions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return ModelResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+d.apiKey)
+	}
+
+	client := &http.Client{Timeout: d.timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ModelResult{}, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if resp.StatusCode >= 400 {
+		return ModelResult{}, errors.New("openai " + model + ": status " + resp.Status + ": " + strings.TrimSpace(string(data)))
+	}
+
+	var out chatCompletionResponse
+	if err := json.Unmarshal(data, &out); err != nil {
+		return ModelResult{}, errors.New("openai " + model + ": decode response: " + err.Error())
+	}
+	cost := float64(out.Usage.PromptTokens)/1000*d.promptCostPer1K + float64(out.Usage.CompletionTokens)/1000*d.completionCostPer1K
+	billed := ModelResult{Metrics: []Metric{
+		{Name: "cost_usd", Value: cost},
+		{Name: "prompt_tokens", Value: float64(out.Usage.PromptTokens)},
+		{Name: "completion_tokens", Value: float64(out.Usage.CompletionTokens)},
+	}}
+	if out.Error != nil {
+		return billed, errors.New("openai " + model + ": " + out.Error.Message)
+	}
+	if len(out.Choices) == 0 {
+		return billed, errors.New("openai " + model + ": no choices in response")
+	}
+	content := out.Choices[0].Message.Content
+	diff, err := internal.ExtractDiff(content, originals)
+	if err != nil {
+		return billed, errors.New("openai " + model + ": no valid diff in completion: " + err.Error())
+	}
+
+	return ModelResult{
+		SchemaVersion: schemaVersion,
+		ModelID:       d.id,
+		Output:        content,
+		Diff:          diff,
+		Metrics: []Metric{
+			{Name: "cost_usd", Value: cost},
+			{Name: "quality_score", Value: estimateQuality(content, diff)},
+			{Name: "prompt_tokens", Value: float64(out.Usage.PromptTokens)},
+			{Name: "completion_tokens", Value: float64(out.Usage.CompletionTokens)},
+		},
+	}, nil
+}
+
+// chatUserPrompt is the task's rendered prompt or, without one, the task input
+// followed by the current contents of the task's file context refs, so
+// rewrites and hunks can be checked against them.
+func chatUserPrompt(spec TaskSpec, files map[string]string) string {
+	if spec.Prompt != "" {
+		return spec.Prompt
+	}
+	var b strings.Builder
+	b.WriteString(spec.Input)
+	seen := map[string]bool{}
+	for _, ref := range spec.Context {
+		path, ok := workspacePath(ref.Path)
+		if !ok || seen[path] {
+			continue
+		}
+		content, ok := files[path]
+		if !ok {
+			continue
+		}
+		seen[path] = true
+		b.WriteString("\n\nFile " + path + ":\n```\n" + content)
+		if !strings.HasSuffix(content, "\n") {
+			b.WriteString("\n")
+		}
+		b.WriteString("```")
+	}
+	return b.String()
+}
+
+// openAIDriverFromEnv configures the OpenAI-compatible driver when
+// OPENAI_BASE_URL is set. Per-type system prompts come from
+// OPENAI_SYSTEM_PROMPT_<TYPE>.
+func openAIDriverFromEnv() (OpenAIDriver, DriverMeta, bool) {
+	baseURL := strings.TrimSpace(os.Getenv("OPENAI_BASE_URL"))
+	if baseURL == "" {
+		return OpenAIDriver{}, DriverMeta{}, false
+	}
+	prompts := map[string]string{}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if t, ok := strings.CutPrefix(key, "OPENAI_SYSTEM_PROMPT_"); ok && value != "" {
+			prompts[strings.ToLower(t)] = value
+		}
+	}
+	d := OpenAIDriver{
+		id:                  envOr("OPENAI_DRIVER_ID", "openai_compat"),
+		baseURL:             baseURL,
+		apiKey:              os.Getenv("OPENAI_API_KEY"),
+		model:               envOr("OPENAI_MODEL", "default"),
+		fallback:            splitCSV(os.Getenv("OPENAI_FALLBACK_MODELS")),
+		timeout:             time.Duration(envInt("OPENAI_TIMEOUT_MS", 60000)) * time.Millisecond,
+		systemPrompts:       prompts,
+		promptCostPer1K:     envFloat("OPENAI_COST_PROMPT_PER_1K", 0),
+		completionCostPer1K: envFloat("OPENAI_COST_COMPLETION_PER_1K", 0),
+		workspace:           envOr("ORCH_WORKSPACE_ROOT", "."),
+	}
+	return d, DriverMeta{
+		ID:           d.id,
+		Kind:         "openai",
+		CostUSD:      d.promptCostPer1K + d.completionCostPer1K,
+		Capabilities: []string{"patch", "review", "testgen", "analysis"},
+		Description:  "OpenAI-compatible chat completions driver (" + d.model + ")",
+	}, true
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeChatServer struct {
+	*httptest.Server
+	last chatCompletionRequest
+	auth string
+}
+
+func newFakeChatServer(t *testing.T, content string, status int) *fakeChatServer {
+	t.Helper()
+	f := &fakeChatServer{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		f.auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&f.last)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"error":{"message":"model overloaded"}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": content}, "finish_reason": "stop"}},
+			"usage":   map[string]int{"prompt_tokens": 1200, "completion_tokens": 300, "total_tokens": 1500},
+		})
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestOpenAIDriver_Run(t *testing.T) {
+	srv := newFakeChatServer(t, "```diff\n--- a/README.md\n+++ b/README.md\n@@ -1 +1 @@\n-old\n+new\n```", http.StatusOK)
+	d := OpenAIDriver{
+		id:                  "local_vllm",
+		baseURL:             srv.URL + "/v1",
+		apiKey:              "secret",
+		model:               "qwen2.5-coder",
+		timeout:             time.Second,
+		systemPrompts:       map[string]string{"review": "custom review prompt"},
+		promptCostPer1K:     0.01,
+		completionCostPer1K: 0.03,
+	}
+	spec := TaskSpec{Type: "review", Input: "tidy readme", Constraints: []Constraint{
+		{Key: "max_tokens", Value: float64(512)},
+		{Key: "temperature", Value: 0.7},
+	}}
+
+	res, err := d.Run(context.Background(), spec)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if srv.auth != "Bearer secret" {
+		t.Fatalf("expected bearer auth, got %q", srv.auth)
+	}
+	if srv.last.Model != "qwen2.5-coder" || srv.last.MaxTokens != 512 || srv.last.Temperature != 0.7 {
+		t.Fatalf("unexpected request: %+v", srv.last)
+	}
+	if len(srv.last.Messages) != 2 || srv.last.Messages[0].Content != "custom review prompt" || srv.last.Messages[1].Content != "tidy readme" {
+		t.Fatalf("unexpected messages: %+v", srv.last.Messages)
+	}
+	if res.ModelID != "local_vllm" || !strings.Contains(res.Diff, "+new") {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if cost := metricValue(res, "cost_usd"); math.Abs(cost-0.021) > 1e-9 {
+		t.Fatalf("expected token-based cost 0.021, got %v", cost)
+	}
+	if metricValue(res, "completion_tokens") != 300 {
+		t.Fatalf("expected completion token metric, got %+v", res.Metrics)
+	}
+}
+
+func TestOpenAIDriver_SystemPromptPerType(t *testing.T) {
+	d := OpenAIDriver{systemPrompts: map[string]string{"patch": "custom patch"}}
+	if d.systemPrompt("PATCH") != "custom patch" {
+		t.Fatal("expected configured prompt to override the default")
+	}
+	if d.systemPrompt("testgen") != defaultSystemPrompts["testgen"] {
+		t.Fatal("expected built-in testgen prompt")
+	}
+	if d.systemPrompt("unknown") != defaultSystemPrompt {
+		t.Fatal("expected generic prompt for unknown types")
+	}
+}
+
+func TestOpenAIDriver_Errors(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		status  int
+		wantErr string
+	}{
+		{name: "http error", status: http.StatusServiceUnavailable, wantErr: "model overloaded"},
+		{name: "no diff", content: "I would refactor this.", status: http.StatusOK, wantErr: "no valid diff"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newFakeChatServer(t, tc.content, tc.status)
+			d := OpenAIDriver{id: "local", baseURL: srv.URL + "/v1", timeout: time.Second}
+			if _, err := d.Run(context.Background(), TaskSpec{Type: "patch", Input: "x"}); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestOpenAIDriver_FallsBackToNextModel(t *testing.T) {
+	tried := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req chatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		tried = append(tried, req.Model)
+		if req.Model != "small" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":{"message":"model overloaded"}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": "--- a/a.txt\n+++ b/a.txt\n@@ -1 +1 @@\n-a\n+b\n"}}},
+		})
+	}))
+	defer srv.Close()
+	d := OpenAIDriver{id: "local", baseURL: srv.URL + "/v1", model: "big", fallback: []string{"medium", "small"}, timeout: time.Second}
+	res, err := d.Run(context.Background(), TaskSpec{Type: "patch", Input: "x"})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if strings.Join(tried, ",") != "big,medium,small" || !strings.Contains(res.Diff, "+b") {
+		t.Fatalf("expected models tried in order, got %v and %+v", tried, res)
+	}
+	if metricValue(res, "latency_ms") < 0 || len(res.Metrics) == 0 || res.Metrics[0].Name != "latency_ms" {
+		t.Fatalf("expected latency over all attempts, got %+v", res.Metrics)
+	}
+
+	d.fallback = nil
+	if _, err := d.Run(context.Background(), TaskSpec{Type: "patch", Input: "x"}); err == nil || !strings.Contains(err.Error(), "openai big") {
+		t.Fatalf("expected the primary model error without fallbacks, got %v", err)
+	}
+}
+
+func TestOpenAIDriver_BillsModelsThatGaveNoDiff(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req chatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		content := "I would rather not."
+		if req.Model == "small" {
+			content = "--- a/a.txt\n+++ b/a.txt\n@@ -1 +1 @@\n-a\n+b\n"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": content}}},
+			"usage":   map[string]int{"prompt_tokens": 1000, "completion_tokens": 100},
+		})
+	}))
+	defer srv.Close()
+	d := OpenAIDriver{id: "local", baseURL: srv.URL + "/v1", model: "big", fallback: []string{"small"}, timeout: time.Second, promptCostPer1K: 0.01, completionCostPer1K: 0.1}
+	res, err := d.Run(context.Background(), TaskSpec{Type: "patch", Input: "x"})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if metricValue(res, "prompt_tokens") != 2000 || metricValue(res, "completion_tokens") != 200 || math.Abs(metricValue(res, "cost_usd")-0.04) > 1e-9 {
+		t.Fatalf("expected usage summed over both models, got %+v", res.Metrics)
+	}
+
+	d.fallback = nil
+	res, err = d.Run(context.Background(), TaskSpec{Type: "patch", Input: "x"})
+	if err == nil || metricValue(res, "prompt_tokens") != 1000 {
+		t.Fatalf("expected the billed usage with the error, got %+v %v", res.Metrics, err)
+	}
+	ledger := NewCostLedger()
+	ledger.RecordDriverCall(TaskSpec{}, "t", d.ID(), res, err)
+	if rows := ledger.Aggregate([]string{"model"}, BillingFilter{}); len(rows) != 1 || rows[0].FailedCalls != 1 || rows[0].CostUSD != 0.02 {
+		t.Fatalf("expected the failed call booked with its cost, got %+v", rows)
+	}
+}
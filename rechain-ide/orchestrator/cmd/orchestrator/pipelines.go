@@ -0,0 +1,562 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pipelineFailFast = "fail_fast"
+	pipelineContinue = "continue"
+
+	stepWaiting = "waiting"
+	stepSkipped = "skipped"
+
+	// maxPipelineSteps bounds the steps of one pipeline.
+	maxPipelineSteps = 32
+)
+
+// stepRefPattern matches {{steps.<name>.<field>}} in step inputs.
+var stepRefPattern = regexp.MustCompile(`\{\{\s*steps\.([A-Za-z0-9_-]+)\.([a-z_]+)\s*\}\}`)
+
+var errPipelineExists = errors.New("pipeline already exists")
+
+var stepRefFields = []string{"diff", "rationale", "confidence", "merge_source", "task_id", "state"}
+
+// PipelineStepSpec is one task of a pipeline. Input may reference the results
+// of upstream steps with {{steps.<name>.<field>}}.
+type PipelineStepSpec struct {
+	Name        string       `json:"name"`
+	Type        string       `json:"type"`
+	Input       string       `json:"input"`
+	Context     []ContextRef `json:"context"`
+	Constraints []Constraint `json:"constraints"`
+	DependsOn   []string     `json:"depends_on,omitempty"`
+}
+
+type PipelineSpec struct {
+	ID       string             `json:"id"`
+	Policy   string             `json:"policy"`
+	Metadata Metadata           `json:"metadata"`
+	Steps    []PipelineStepSpec `json:"steps"`
+}
+
+type PipelineStep struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	DependsOn  []string `json:"depends_on,omitempty"`
+	State      string   `json:"state"`
+	TaskID     string   `json:"task_id,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	StartedAt  string   `json:"started_at,omitempty"`
+	FinishedAt string   `json:"finished_at,omitempty"`
+}
+
+// PipelineStatus is the aggregate view served by /pipelines/{id}.
+type PipelineStatus struct {
+	SchemaVersion string         `json:"schema_version"`
+	ID            string         `json:"id"`
+	State         string         `json:"state"`
+	Policy        string         `json:"policy"`
+	Progress      float64        `json:"progress"`
+	CreatedAt     string         `json:"created_at"`
+	UpdatedAt     string         `json:"updated_at"`
+	FinishedAt    string         `json:"finished_at,omitempty"`
+	Counts        map[string]int `json:"counts"`
+	Steps         []PipelineStep `json:"steps"`
+}
+
+// PipelineRecord is the persisted form of a pipeline run; Status carries the
+// steps.
+type PipelineRecord struct {
+	Spec   PipelineSpec   `json:"spec"`
+	Order  []string       `json:"order"`
+	Status PipelineStatus `json:"status"`
+}
+
+type pipelineRun struct {
+	spec    PipelineSpec
+	steps   map[string]*PipelineStep
+	order   []string
+	status  PipelineStatus
+	secrets map[string]string
+}
+
+// PipelineManager schedules the steps of submitted pipelines as tasks: a
+// step is submitted once all its dependencies completed. Runs are saved
+// through the store's backend, when it has one, after every change and
+// restored with Restore. Each step holds one daily task slot of the
+// requester's quota, reserved at submission; steps that never run give it
+// back.
+type PipelineManager struct {
+	mu        sync.Mutex
+	pipelines map[string]*pipelineRun
+	store     *TaskStore
+	submit    func(spec TaskSpec, pipelineID string) (TaskStatus, error)
+	cancel    func(taskID string)
+	wg        sync.WaitGroup
+}
+
+func NewPipelineManager(store *TaskStore, submit func(TaskSpec, string) (TaskStatus, error), cancel func(string)) *PipelineManager {
+	return &PipelineManager{pipelines: map[string]*pipelineRun{}, store: store, submit: submit, cancel: cancel}
+}
+
+// validatePipeline checks step names, dependencies and template references
+// and returns the steps in dependency order.
+func validatePipeline(spec PipelineSpec) ([]string, error) {
+	if len(spec.Steps) == 0 {
+		return nil, errors.New("pipeline has no steps")
+	}
+	if len(spec.Steps) > maxPipelineSteps {
+		return nil, errors.New("pipeline has more than " + strconv.Itoa(maxPipelineSteps) + " steps")
+	}
+	switch spec.Policy {
+	case "", pipelineFailFast, pipelineContinue:
+	default:
+		return nil, errors.New("unknown policy " + spec.Policy + " (want fail_fast or continue)")
+	}
+	byName := map[string]PipelineStepSpec{}
+	for i, st := range spec.Steps {
+		name := strings.TrimSpace(st.Name)
+		if name == "" {
+			return nil, errors.New("step " + strconv.Itoa(i) + ": missing name")
+		}
+		if _, dup := byName[name]; dup {
+			return nil, errors.New("duplicate step " + name)
+		}
+		if errs := validateConstraints(st.Constraints); len(errs) > 0 {
+			return nil, errors.New("step " + name + ": " + errs[0].Field + ": " + errs[0].Message)
+		}
+		if err := validateCallbackURL(callbackURL(TaskSpec{Constraints: st.Constraints})); err != nil {
+			return nil, errors.New("step " + name + ": " + err.Error())
+		}
+		byName[name] = st
+	}
+	for _, st := range spec.Steps {
+		for _, dep := range st.DependsOn {
+			if _, ok := byName[dep]; !ok {
+				return nil, errors.New("step " + st.Name + ": unknown dependency " + dep)
+			}
+			if dep == st.Name {
+				return nil, errors.New("step " + st.Name + " depends on itself")
+			}
+		}
+	}
+
+	order := []string{}
+	done := map[string]bool{}
+	for len(order) < len(spec.Steps) {
+		progressed := false
+		for _, st := range spec.Steps {
+			if done[st.Name] {
+				continue
+			}
+			ready := true
+			for _, dep := range st.DependsOn {
+				ready = ready && done[dep]
+			}
+			if ready {
+				done[st.Name] = true
+				order = append(order, st.Name)
+				progressed = true
+			}
+		}
+		if !progressed {
+			return nil, errors.New("pipeline steps contain a dependency cycle")
+		}
+	}
+
+	for _, st := range spec.Steps {
+		for _, m := range stepRefPattern.FindAllStringSubmatch(st.Input, -1) {
+			if !containsString(stepRefFields, m[2]) {
+				return nil, errors.New("step " + st.Name + ": unknown field " + m[2] + " in " + m[0])
+			}
+			if !dependsOn(byName, st.Name, m[1]) {
+				return nil, errors.New("step " + st.Name + ": " + m[0] + " references a step it does not depend on")
+			}
+		}
+	}
+	return order, nil
+}
+
+// dependsOn reports whether step transitively depends on upstream.
+func dependsOn(steps map[string]PipelineStepSpec, step string, upstream string) bool {
+	for _, dep := range steps[step].DependsOn {
+		if dep == upstream || dependsOn(steps, dep, upstream) {
+			return true
+		}
+	}
+	return false
+}
+
+// Submit validates and starts a pipeline. Steps without dependencies are
+// submitted immediately.
+func (m *PipelineManager) Submit(spec PipelineSpec) (PipelineStatus, error) {
+	order, err := validatePipeline(spec)
+	if err != nil {
+		return PipelineStatus{}, err
+	}
+	if spec.ID == "" {
+		spec.ID = "pipe_" + randString(8)
+	}
+	if spec.Policy == "" {
+		spec.Policy = pipelineFailFast
+	}
+	// Callback secrets stay in memory, like those of tasks.
+	secrets := map[string]string{}
+	spec.Steps = append([]PipelineStepSpec{}, spec.Steps...)
+	for i, st := range spec.Steps {
+		stripped, secret := splitCallbackSecret(TaskSpec{Constraints: st.Constraints, Metadata: spec.Metadata})
+		spec.Steps[i].Constraints = stripped.Constraints
+		if secret != "" {
+			secrets[st.Name] = secret
+		}
+	}
+	spec.Metadata.CallbackSecret = ""
+	now := time.Now().UTC().Format(time.RFC3339)
+	run := &pipelineRun{spec: spec, steps: map[string]*PipelineStep{}, order: order, secrets: secrets}
+	run.status = PipelineStatus{SchemaVersion: schemaVersion, ID: spec.ID, State: "running", Policy: spec.Policy, CreatedAt: now, UpdatedAt: now}
+	for _, st := range spec.Steps {
+		run.steps[st.Name] = &PipelineStep{Name: st.Name, Type: st.Type, DependsOn: st.DependsOn, State: stepWaiting}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.pipelines[spec.ID]; exists {
+		return PipelineStatus{}, errPipelineExists
+	}
+	m.pipelines[spec.ID] = run
+	m.advanceLocked(run)
+	return m.statusLocked(run), nil
+}
+
+// Restore loads pipeline runs saved before a restart. Steps whose tasks
+// finished while no run was loaded take the task's final state, steps whose
+// task is gone fail, and every run advances.
+func (m *PipelineManager) Restore(records []PipelineRecord) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, rec := range records {
+		run := &pipelineRun{spec: rec.Spec, steps: map[string]*PipelineStep{}, order: rec.Order, status: rec.Status}
+		run.status.Steps = nil
+		for i := range rec.Status.Steps {
+			st := rec.Status.Steps[i]
+			run.steps[st.Name] = &st
+		}
+		complete := rec.Spec.ID != "" && len(run.steps) == len(run.order)
+		for _, name := range run.order {
+			complete = complete && run.steps[name] != nil
+		}
+		if !complete {
+			log.Printf("pipelines: skipping incomplete pipeline record %s", rec.Spec.ID)
+			continue
+		}
+		for _, name := range run.order {
+			st := run.steps[name]
+			if st.TaskID == "" || isTerminalState(st.State) {
+				continue
+			}
+			m.store.mu.Lock()
+			status, ok := m.store.statuses[st.TaskID]
+			trace := m.store.traces[st.TaskID]
+			m.store.mu.Unlock()
+			switch {
+			case !ok:
+				st.State = "failed"
+				st.Error = "step task was lost in a restart"
+				st.FinishedAt = now
+			case isTerminalState(status.State):
+				st.State = status.State
+				st.Error = trace.Error
+				st.FinishedAt = now
+			}
+		}
+		m.pipelines[rec.Spec.ID] = run
+		m.advanceLocked(run)
+	}
+}
+
+// taskFinished is called by the store, with its lock held, when a step task
+// reaches a terminal state; the pipeline advances asynchronously.
+func (m *PipelineManager) taskFinished(pipelineID string, taskID string, state string, reason string) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		run, ok := m.pipelines[pipelineID]
+		if !ok {
+			return
+		}
+		for _, st := range run.steps {
+			if st.TaskID != taskID || isTerminalState(st.State) || st.State == stepSkipped {
+				continue
+			}
+			st.State = state
+			st.Error = reason
+			st.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+		}
+		m.advanceLocked(run)
+	}()
+}
+
+// advanceLocked submits every step whose dependencies completed, skips steps
+// that can no longer run, applies the failure policy and updates the
+// aggregate state. Callers must hold m.mu.
+func (m *PipelineManager) advanceLocked(run *pipelineRun) {
+	failed := false
+	for _, st := range run.steps {
+		if st.State == "failed" || st.State == "canceled" {
+			failed = true
+		}
+	}
+	if failed && run.spec.Policy == pipelineFailFast {
+		for _, name := range run.order {
+			st := run.steps[name]
+			switch {
+			case st.State == stepWaiting:
+				st.State = stepSkipped
+				st.Error = "skipped: pipeline failed fast"
+				m.refundStep(run)
+			case st.TaskID != "" && !isTerminalState(st.State):
+				st.State = "canceled"
+				st.Error = "canceled: pipeline failed fast"
+				st.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+				if m.cancel != nil {
+					m.cancel(st.TaskID)
+				}
+			}
+		}
+	}
+
+	for _, name := range run.order {
+		st := run.steps[name]
+		if st.State != stepWaiting {
+			continue
+		}
+		ready := true
+		blocked := ""
+		for _, dep := range st.DependsOn {
+			switch run.steps[dep].State {
+			case "completed":
+			case "failed", "canceled", stepSkipped:
+				blocked = dep
+			default:
+				ready = false
+			}
+		}
+		if blocked != "" {
+			st.State = stepSkipped
+			st.Error = "skipped: dependency " + blocked + " did not complete"
+			m.refundStep(run)
+			continue
+		}
+		if !ready {
+			continue
+		}
+		m.startStepLocked(run, st)
+	}
+
+	m.refreshLocked(run)
+	m.saveLocked(run)
+}
+
+// refundStep returns the quota slot reserved for a step that will not run.
+func (m *PipelineManager) refundStep(run *pipelineRun) {
+	quotasGlobal.Refund(requesterKey(TaskSpec{Metadata: run.spec.Metadata}))
+}
+
+// saveLocked queues the run for the backend. Callers must hold m.mu.
+func (m *PipelineManager) saveLocked(run *pipelineRun) {
+	raw, err := json.Marshal(PipelineRecord{Spec: run.spec, Order: run.order, Status: m.statusLocked(run)})
+	if err != nil {
+		log.Printf("pipelines: encode pipeline %s failed: %v", run.spec.ID, err)
+		return
+	}
+	m.store.savePipeline(run.spec.ID, raw)
+}
+
+func (m *PipelineManager) startStepLocked(run *pipelineRun, st *PipelineStep) {
+	var stepSpec PipelineStepSpec
+	for _, s := range run.spec.Steps {
+		if s.Name == st.Name {
+			stepSpec = s
+		}
+	}
+	spec := TaskSpec{
+		SchemaVersion: schemaVersion,
+		ID:            "task_" + randString(8),
+		Type:          stepSpec.Type,
+		Input:         m.renderInput(run, stepSpec.Input),
+		Context:       stepSpec.Context,
+		Constraints:   stepSpec.Constraints,
+		Metadata:      run.spec.Metadata,
+	}
+	if secret := run.secrets[st.Name]; secret != "" {
+		spec.Constraints = upsertConstraint(spec.Constraints, "callback_secret", secret)
+	}
+	st.TaskID = spec.ID
+	st.StartedAt = time.Now().UTC().Format(time.RFC3339)
+	status, err := m.submit(spec, run.spec.ID)
+	st.State = status.State
+	if err != nil {
+		st.State = "failed"
+		st.Error = err.Error()
+		st.FinishedAt = st.StartedAt
+		m.refundStep(run)
+	}
+}
+
+// renderInput replaces {{steps.<name>.<field>}} with the upstream step's
+// merge result.
+func (m *PipelineManager) renderInput(run *pipelineRun, input string) string {
+	return stepRefPattern.ReplaceAllStringFunc(input, func(ref string) string {
+		match := stepRefPattern.FindStringSubmatch(ref)
+		st, ok := run.steps[match[1]]
+		if !ok {
+			return ref
+		}
+		switch match[2] {
+		case "task_id":
+			return st.TaskID
+		case "state":
+			return st.State
+		}
+		m.store.mu.Lock()
+		result := m.store.results[st.TaskID]
+		trace := m.store.traces[st.TaskID]
+		m.store.mu.Unlock()
+		switch match[2] {
+		case "diff":
+			return result.Diff
+		case "rationale":
+			return result.Rationale
+		case "confidence":
+			return strconv.FormatFloat(result.Confidence, 'f', -1, 64)
+		case "merge_source":
+			return trace.MergeSource
+		}
+		return ref
+	})
+}
+
+// refreshLocked picks up queued/running transitions of step tasks and
+// recomputes the aggregate state.
+func (m *PipelineManager) refreshLocked(run *pipelineRun) {
+	counts := map[string]int{}
+	for _, name := range run.order {
+		st := run.steps[name]
+		if st.TaskID != "" && !isTerminalState(st.State) {
+			m.store.mu.Lock()
+			if status, ok := m.store.statuses[st.TaskID]; ok && !isTerminalState(status.State) {
+				st.State = status.State
+			}
+			m.store.mu.Unlock()
+		}
+		counts[st.State]++
+	}
+	total := len(run.order)
+	finished := counts["completed"] + counts["failed"] + counts["canceled"] + counts[stepSkipped]
+	state := "running"
+	switch {
+	case finished < total:
+		if counts["failed"]+counts["canceled"] > 0 && run.spec.Policy == pipelineFailFast {
+			state = "failed"
+		}
+	case counts["completed"] == total:
+		state = "completed"
+	default:
+		state = "failed"
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	if state != run.status.State || run.status.Counts == nil || !sameCounts(counts, run.status.Counts) {
+		run.status.UpdatedAt = now
+	}
+	if state != "running" && run.status.FinishedAt == "" && finished == total {
+		run.status.FinishedAt = now
+	}
+	run.status.State = state
+	run.status.Counts = counts
+	run.status.Progress = float64(finished) / float64(total)
+}
+
+func sameCounts(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *PipelineManager) statusLocked(run *pipelineRun) PipelineStatus {
+	out := run.status
+	out.Counts = map[string]int{}
+	for k, v := range run.status.Counts {
+		out.Counts[k] = v
+	}
+	out.Steps = make([]PipelineStep, 0, len(run.order))
+	for _, name := range run.order {
+		out.Steps = append(out.Steps, *run.steps[name])
+	}
+	return out
+}
+
+func (m *PipelineManager) Status(id string) (PipelineStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	run, ok := m.pipelines[id]
+	if !ok {
+		return PipelineStatus{}, false
+	}
+	m.refreshLocked(run)
+	return m.statusLocked(run), true
+}
+
+// List returns all pipelines, newest first.
+func (m *PipelineManager) List() []PipelineStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]PipelineStatus, 0, len(m.pipelines))
+	for _, run := range m.pipelines {
+		m.refreshLocked(run)
+		out = append(out, m.statusLocked(run))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].CreatedAt != out[j].CreatedAt {
+			return out[i].CreatedAt > out[j].CreatedAt
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Wait blocks until pending step transitions have been applied.
+func (m *PipelineManager) Wait() {
+	m.wg.Wait()
+}
+
+// notifyPipelineLocked tells the pipeline manager that a step task finished.
+// Callers must hold s.mu.
+func (s *TaskStore) notifyPipelineLocked(id string) {
+	if s.pipelines == nil {
+		return
+	}
+	status := s.statuses[id]
+	trace := s.traces[id]
+	if trace.PipelineID == "" || !isTerminalState(status.State) {
+		return
+	}
+	s.pipelines.taskFinished(trace.PipelineID, id, status.State, trace.Error)
+}
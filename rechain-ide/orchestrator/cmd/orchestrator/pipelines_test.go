@@ -0,0 +1,235 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestPipelines() (*PipelineManager, *TaskStore) {
+	store := NewTaskStore()
+	queue := NewTaskQueue(100, time.Second)
+	pipelines := NewPipelineManager(store, func(spec TaskSpec, pipelineID string) (TaskStatus, error) {
+		return submitTask(store, queue, &Metrics{}, spec, TaskTrace{PipelineID: pipelineID})
+	}, func(id string) {
+		store.Cancel(id, queue)
+	})
+	store.pipelines = pipelines
+	return pipelines, store
+}
+
+func stepByName(t *testing.T, status PipelineStatus, name string) PipelineStep {
+	t.Helper()
+	for _, st := range status.Steps {
+		if st.Name == name {
+			return st
+		}
+	}
+	t.Fatalf("no step %s in %+v", name, status.Steps)
+	return PipelineStep{}
+}
+
+func finishStep(p *PipelineManager, store *TaskStore, taskID string, state string, diff string) {
+	var result *MergeResult
+	if state == "completed" {
+		result = &MergeResult{Diff: diff}
+	}
+	store.mu.Lock()
+	trace := store.traces[taskID]
+	store.mu.Unlock()
+	store.completeRun(taskID, state, trace, result, nil)
+	p.Wait()
+}
+
+func TestValidatePipeline(t *testing.T) {
+	cases := []struct {
+		name  string
+		steps []PipelineStepSpec
+		err   string
+	}{
+		{"empty", nil, "no steps"},
+		{"too many steps", make([]PipelineStepSpec, maxPipelineSteps+1), "more than"},
+		{"duplicate", []PipelineStepSpec{{Name: "a"}, {Name: "a"}}, "duplicate step"},
+		{"unknown dependency", []PipelineStepSpec{{Name: "a", DependsOn: []string{"x"}}}, "unknown dependency"},
+		{"cycle", []PipelineStepSpec{{Name: "a", DependsOn: []string{"b"}}, {Name: "b", DependsOn: []string{"a"}}}, "cycle"},
+		{"reference without dependency", []PipelineStepSpec{{Name: "a"}, {Name: "b", Input: "{{steps.a.diff}}"}}, "does not depend"},
+		{"unknown field", []PipelineStepSpec{{Name: "a"}, {Name: "b", Input: "{{steps.a.output}}", DependsOn: []string{"a"}}}, "unknown field"},
+		{"transitive reference", []PipelineStepSpec{{Name: "a"}, {Name: "b", DependsOn: []string{"a"}}, {Name: "c", Input: "{{ steps.a.diff }}", DependsOn: []string{"b"}}}, ""},
+	}
+	for _, tc := range cases {
+		_, err := validatePipeline(PipelineSpec{Steps: tc.steps})
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestPipeline_ChainsStepsWithTemplatedInput(t *testing.T) {
+	p, store := newTestPipelines()
+	status, err := p.Submit(PipelineSpec{Metadata: Metadata{Requester: "ci"}, Steps: []PipelineStepSpec{
+		{Name: "patch", Type: "patch", Input: "add logging"},
+		{Name: "testgen", Type: "testgen", Input: "tests for:\n{{steps.patch.diff}}", DependsOn: []string{"patch"}},
+		{Name: "review", Type: "review", Input: "review {{steps.patch.diff}} and {{steps.testgen.diff}}", DependsOn: []string{"testgen"}},
+	}})
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	if got := stepByName(t, status, "testgen").State; got != stepWaiting {
+		t.Fatalf("testgen should wait for patch, got %s", got)
+	}
+
+	finishStep(p, store, stepByName(t, status, "patch").TaskID, "completed", "PATCH-DIFF")
+	status, _ = p.Status(status.ID)
+	testgen := stepByName(t, status, "testgen")
+	if testgen.State != "queued" {
+		t.Fatalf("testgen should be queued, got %s", testgen.State)
+	}
+	store.mu.Lock()
+	spec := store.specs[testgen.TaskID]
+	trace := store.traces[testgen.TaskID]
+	store.mu.Unlock()
+	if spec.Input != "tests for:\nPATCH-DIFF" || spec.Type != "testgen" || spec.Metadata.Requester != "ci" || trace.PipelineID != status.ID {
+		t.Fatalf("unexpected testgen task: %+v / %+v", spec, trace)
+	}
+
+	finishStep(p, store, testgen.TaskID, "completed", "TEST-DIFF")
+	status, _ = p.Status(status.ID)
+	review := stepByName(t, status, "review")
+	store.mu.Lock()
+	input := store.specs[review.TaskID].Input
+	store.mu.Unlock()
+	if input != "review PATCH-DIFF and TEST-DIFF" {
+		t.Fatalf("unexpected review input %q", input)
+	}
+	finishStep(p, store, review.TaskID, "completed", "")
+	status, _ = p.Status(status.ID)
+	if status.State != "completed" || status.Progress != 1 || status.FinishedAt == "" {
+		t.Fatalf("expected completed pipeline, got %+v", status)
+	}
+}
+
+func TestPipeline_FailurePolicies(t *testing.T) {
+	steps := []PipelineStepSpec{
+		{Name: "a", Type: "patch"},
+		{Name: "b", Type: "patch"},
+		{Name: "c", Type: "review", DependsOn: []string{"a"}},
+	}
+	cases := []struct {
+		policy    string
+		wantB     string
+		wantState string
+	}{
+		{pipelineFailFast, "canceled", "failed"},
+		{pipelineContinue, "queued", "running"},
+	}
+	for _, tc := range cases {
+		p, store := newTestPipelines()
+		status, err := p.Submit(PipelineSpec{Policy: tc.policy, Steps: steps})
+		if err != nil {
+			t.Fatalf("%s: submit: %v", tc.policy, err)
+		}
+		finishStep(p, store, stepByName(t, status, "a").TaskID, "failed", "")
+		status, _ = p.Status(status.ID)
+		if got := stepByName(t, status, "c").State; got != stepSkipped {
+			t.Errorf("%s: dependent step should be skipped, got %s", tc.policy, got)
+		}
+		if got := stepByName(t, status, "b").State; got != tc.wantB {
+			t.Errorf("%s: independent step state %s, want %s", tc.policy, got, tc.wantB)
+		}
+		if status.State != tc.wantState {
+			t.Errorf("%s: pipeline state %s, want %s", tc.policy, status.State, tc.wantState)
+		}
+		if tc.policy == pipelineContinue {
+			finishStep(p, store, stepByName(t, status, "b").TaskID, "completed", "")
+			status, _ = p.Status(status.ID)
+			if status.State != "failed" || status.Counts["completed"] != 1 || status.Counts[stepSkipped] != 1 {
+				t.Errorf("continue: expected failed pipeline with one completed step, got %+v", status)
+			}
+		}
+	}
+}
+
+func TestPipeline_RefundsStepsThatNeverRun(t *testing.T) {
+	quotas, _ := newTestQuotas(QuotaConfig{Default: QuotaLimits{DailyTasks: 4}})
+	prev := quotasGlobal
+	quotasGlobal = quotas
+	defer func() { quotasGlobal = prev }()
+
+	steps := []PipelineStepSpec{
+		{Name: "a", Type: "patch"},
+		{Name: "b", Type: "review", DependsOn: []string{"a"}},
+		{Name: "c", Type: "review", DependsOn: []string{"b"}},
+	}
+	if rej := quotas.AdmitN("ci", len(steps)); rej != nil {
+		t.Fatalf("admit: %+v", rej)
+	}
+	if rej := quotas.AdmitN("ci", 2); rej == nil || rej.Reason != "daily_tasks" {
+		t.Fatalf("expected a pipeline that does not fit to be refused, got %+v", rej)
+	}
+	p, store := newTestPipelines()
+	status, err := p.Submit(PipelineSpec{Metadata: Metadata{Requester: "ci"}, Steps: steps})
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	finishStep(p, store, stepByName(t, status, "a").TaskID, "failed", "")
+	if got := quotas.Usage()[0].TasksToday; got != 1 {
+		t.Fatalf("expected both skipped steps to be refunded, %d slots still taken", got)
+	}
+}
+
+func TestPipeline_ResumesAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.db")
+	open := func() (*PipelineManager, *TaskStore, TaskBackend) {
+		backend, err := OpenBoltTaskBackend(path)
+		if err != nil {
+			t.Fatalf("open backend: %v", err)
+		}
+		p, store := newTestPipelines()
+		if _, err := store.AttachBackend(backend); err != nil {
+			t.Fatalf("attach backend: %v", err)
+		}
+		runs, err := backend.LoadPipelines()
+		if err != nil {
+			t.Fatalf("load pipelines: %v", err)
+		}
+		p.Restore(runs)
+		return p, store, backend
+	}
+
+	p, store, backend := open()
+	status, err := p.Submit(PipelineSpec{ID: "pipe_restart", Steps: []PipelineStepSpec{
+		{Name: "patch", Type: "patch", Input: "add logging", Constraints: []Constraint{{Key: "callback_secret", Value: "s3cret"}}},
+		{Name: "review", Type: "review", Input: "review {{steps.patch.diff}}", DependsOn: []string{"patch"}},
+	}})
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	patchID := stepByName(t, status, "patch").TaskID
+	store.Flush()
+	backend.Close()
+
+	p, store, backend = open()
+	defer backend.Close()
+	status, ok := p.Status("pipe_restart")
+	if !ok || stepByName(t, status, "patch").TaskID != patchID || stepByName(t, status, "review").State != stepWaiting {
+		t.Fatalf("expected the pipeline to survive the restart, got %+v", status)
+	}
+	for _, c := range p.pipelines["pipe_restart"].spec.Steps[0].Constraints {
+		if c.Key == "callback_secret" {
+			t.Fatal("callback secret was saved with the pipeline")
+		}
+	}
+	finishStep(p, store, patchID, "completed", "PATCH-DIFF")
+	status, _ = p.Status("pipe_restart")
+	review := stepByName(t, status, "review")
+	store.mu.Lock()
+	input := store.specs[review.TaskID].Input
+	store.mu.Unlock()
+	if review.State != "queued" || input != "review PATCH-DIFF" {
+		t.Fatalf("expected the downstream step to start after the restart, got %+v with input %q", review, input)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// promptTypes are the task types with their own template; other types use
+// the default template.
+var promptTypes = []string{"patch", "review", "testgen", "analysis"}
+
+// The built-in templates; files of the same name in ORCH_PROMPT_DIR replace
+// them.
+//
+//go:embed prompts/*.tmpl
+var promptFS embed.FS
+
+// minPromptSection is the smallest truncated file or snippet worth sending.
+const minPromptSection = 200
+
+// RAGSnippet is a chunk of code returned by the rag service for a task input.
+type RAGSnippet struct {
+	Path  string
+	Start int
+	Text  string
+	Score float64
+}
+
+// PromptSection records one context file or snippet considered for a prompt.
+type PromptSection struct {
+	Kind      string `json:"kind"`
+	Path      string `json:"path"`
+	Start     int    `json:"start,omitempty"`
+	Chars     int    `json:"chars"`
+	Included  bool   `json:"included"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// TracePrompt is the rendered prompt sent to text-generation drivers, with
+// how the context was packed into the budget. Traces keep only the summary;
+// Text is filled in for /tasks/{id}/debug.
+type TracePrompt struct {
+	Template        string          `json:"template"`
+	Text            string          `json:"text,omitempty"`
+	Chars           int             `json:"chars"`
+	EstimatedTokens int             `json:"estimated_tokens"`
+	BudgetChars     int             `json:"budget_chars"`
+	Sections        []PromptSection `json:"sections,omitempty"`
+}
+
+type promptFile struct {
+	Path      string
+	Content   string
+	Truncated bool
+}
+
+type promptSnippet struct {
+	Path      string
+	Start     int
+	Text      string
+	Truncated bool
+}
+
+type promptData struct {
+	Type     string
+	Input    string
+	Files    []promptFile
+	Snippets []promptSnippet
+}
+
+// PromptBuilder renders task prompts from per-type templates, inlining the
+// task's context files and RAG snippets under a character budget.
+type PromptBuilder struct {
+	templates map[string]*template.Template
+	sources   map[string]string
+	workspace string
+	maxChars  int
+}
+
+// promptBuilderGlobal renders the prompt of every task in processTask.
+var promptBuilderGlobal *PromptBuilder
+
+// NewPromptBuilder loads the built-in templates and, when dir is set, the
+// <type>.tmpl and default.tmpl files found there.
+func NewPromptBuilder(dir string, workspace string, maxChars int) (*PromptBuilder, error) {
+	b := &PromptBuilder{
+		templates: map[string]*template.Template{},
+		sources:   map[string]string{},
+		workspace: workspace,
+		maxChars:  maxChars,
+	}
+	for _, name := range append([]string{"default"}, promptTypes...) {
+		raw, err := promptFS.ReadFile("prompts/" + name + ".tmpl")
+		source := "builtin:" + name
+		if dir != "" {
+			path := filepath.Join(dir, name+".tmpl")
+			if data, ferr := os.ReadFile(path); ferr == nil {
+				raw, err, source = data, nil, path
+			} else if !os.IsNotExist(ferr) {
+				return nil, ferr
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(string(raw))
+		if err != nil {
+			return nil, errors.New("prompt template " + source + ": " + err.Error())
+		}
+		b.templates[name] = tmpl
+		b.sources[name] = source
+	}
+	return b, nil
+}
+
+func promptBuilderFromEnv() (*PromptBuilder, error) {
+	return NewPromptBuilder(
+		strings.TrimSpace(os.Getenv("ORCH_PROMPT_DIR")),
+		envOr("ORCH_WORKSPACE_ROOT", "."),
+		envInt("ORCH_PROMPT_MAX_CHARS", 24000),
+	)
+}
+
+// budget is the character budget of spec: the smaller of prompt_max_chars and
+// prompt_max_tokens (at about four characters per token), else the default.
+func (b *PromptBuilder) budget(spec TaskSpec) int {
+	budget := 0
+	if chars := constraintInt(spec.Constraints, "prompt_max_chars", 0); chars > 0 {
+		budget = chars
+	}
+	if tokens := constraintInt(spec.Constraints, "prompt_max_tokens", 0); tokens > 0 && (budget == 0 || tokens*4 < budget) {
+		budget = tokens * 4
+	}
+	if budget == 0 {
+		budget = b.maxChars
+	}
+	return budget
+}
+
+// Build renders the prompt of spec. The task's own context files come first,
+// in spec order, then RAG snippets by score; each is added whole while it fits the budget,
+// truncated when at least minPromptSection characters of it still fit, and
+// skipped otherwise. The task input is never cut, so a prompt whose template
+// and input alone exceed the budget carries no context.
+func (b *PromptBuilder) Build(spec TaskSpec, snippets []RAGSnippet) (TracePrompt, error) {
+	name := strings.ToLower(strings.TrimSpace(spec.Type))
+	tmpl, ok := b.templates[name]
+	if !ok {
+		name = "default"
+		tmpl = b.templates[name]
+	}
+	budget := b.budget(spec)
+	data := promptData{Type: spec.Type, Input: spec.Input}
+	render := func() (string, error) {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+	text, err := render()
+	if err != nil {
+		return TracePrompt{}, errors.New("render prompt " + b.sources[name] + ": " + err.Error())
+	}
+
+	var sections []PromptSection
+	// try adds a section with set and keeps it if the rendered prompt fits,
+	// possibly after cutting its content; otherwise undo removes it again.
+	try := func(sec PromptSection, content string, set func(content string, truncated bool), undo func()) {
+		set(content, false)
+		full, err := render()
+		if err == nil && (budget <= 0 || len(full) <= budget) {
+			sec.Included = true
+			text = full
+			sections = append(sections, sec)
+			return
+		}
+		keep := 0
+		if err == nil {
+			keep = len(content) - (len(full) - budget) - len("\n...")
+		}
+		// The template may add a marker for truncated sections, so shrink once
+		// more by whatever that costs.
+		for attempt := 0; attempt < 2 && keep >= minPromptSection; attempt++ {
+			set(cutUTF8(content, keep)+"\n...", true)
+			cut, err := render()
+			if err != nil {
+				break
+			}
+			if len(cut) <= budget {
+				sec.Included, sec.Truncated = true, true
+				text = cut
+				sections = append(sections, sec)
+				return
+			}
+			keep -= len(cut) - budget
+		}
+		undo()
+		sections = append(sections, sec)
+	}
+
+	files := loadContextFiles(b.workspace, spec.Context)
+	seen := map[string]bool{}
+	for _, ref := range spec.Context {
+		path, ok := workspacePath(ref.Path)
+		if !ok || seen[path] {
+			continue
+		}
+		content, ok := files[path]
+		if !ok {
+			continue
+		}
+		seen[path] = true
+		content = strings.TrimRight(content, "\n")
+		try(PromptSection{Kind: "file", Path: path, Chars: len(content)}, content,
+			func(c string, truncated bool) {
+				f := promptFile{Path: path, Content: c, Truncated: truncated}
+				if n := len(data.Files); n > 0 && data.Files[n-1].Path == path {
+					data.Files[n-1] = f
+				} else {
+					data.Files = append(data.Files, f)
+				}
+			},
+			func() { data.Files = data.Files[:len(data.Files)-1] })
+	}
+
+	ordered := append([]RAGSnippet{}, snippets...)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Score > ordered[j].Score })
+	seenChunks := map[string]bool{}
+	for _, sn := range ordered {
+		sn := sn
+		chunk := strings.TrimRight(sn.Text, "\n")
+		key := sn.Path + ":" + strconv.Itoa(sn.Start)
+		if strings.TrimSpace(chunk) == "" || seenChunks[key] {
+			continue
+		}
+		seenChunks[key] = true
+		try(PromptSection{Kind: "rag", Path: sn.Path, Start: sn.Start, Chars: len(chunk)}, chunk,
+			func(c string, truncated bool) {
+				s := promptSnippet{Path: sn.Path, Start: sn.Start, Text: c, Truncated: truncated}
+				if n := len(data.Snippets); n > 0 && data.Snippets[n-1].Path == sn.Path && data.Snippets[n-1].Start == sn.Start {
+					data.Snippets[n-1] = s
+				} else {
+					data.Snippets = append(data.Snippets, s)
+				}
+			},
+			func() { data.Snippets = data.Snippets[:len(data.Snippets)-1] })
+	}
+
+	return TracePrompt{
+		Template:        b.sources[name],
+		Text:            text,
+		Chars:           len(text),
+		EstimatedTokens: (len(text) + 3) / 4,
+		BudgetChars:     budget,
+		Sections:        sections,
+	}, nil
+}
+
+// cutUTF8 shortens s to at most n bytes without splitting a UTF-8 sequence.
+func cutUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && n < len(s) && s[n]&0xC0 == 0x80 {
+		n--
+	}
+	return s[:n]
+}
+
+// parseRAGSnippet splits a rag score path of the form "<path>:<start line>".
+func parseRAGSnippet(path string, score float64, text string) RAGSnippet {
+	sn := RAGSnippet{Path: path, Text: text, Score: score}
+	if i := strings.LastIndex(path, ":"); i > 0 {
+		if start, err := strconv.Atoi(path[i+1:]); err == nil {
+			sn.Path, sn.Start = path[:i], start
+		}
+	}
+	return sn
+}
+
+// promptText is what text-generation drivers send: the rendered prompt when
+// one was built for the task, else the raw input.
+func promptText(spec TaskSpec) string {
+	if spec.Prompt != "" {
+		return spec.Prompt
+	}
+	return spec.Input
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPromptBuilder_PacksContextUnderBudget(t *testing.T) {
+	workspace := t.TempDir()
+	small := "package a\n\nfunc A() {}\n"
+	large := "package b\n\n" + strings.Repeat("// filler line for the budget\n", 40)
+	os.WriteFile(filepath.Join(workspace, "a.go"), []byte(small), 0o644)
+	os.WriteFile(filepath.Join(workspace, "b.go"), []byte(large), 0o644)
+	b, err := NewPromptBuilder("", workspace, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := TaskSpec{
+		Type:        "review",
+		Input:       "check error handling",
+		Context:     []ContextRef{{Type: "file", Path: "a.go"}, {Type: "file", Path: "b.go"}, {Type: "file", Path: "../etc/passwd"}},
+		Constraints: []Constraint{{Key: "prompt_max_chars", Value: float64(1200)}, {Key: "prompt_max_tokens", Value: float64(1000)}},
+	}
+	snippets := []RAGSnippet{
+		{Path: "/repo/low.go", Start: 1, Text: "low score snippet", Score: 0.1},
+		{Path: "/repo/high.go", Start: 41, Text: "high score snippet", Score: 0.9},
+	}
+	p, err := b.Build(spec, snippets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Template != "builtin:review" || p.BudgetChars != 1200 || p.Chars > 1200 || p.Chars != len(p.Text) {
+		t.Fatalf("unexpected prompt %+v", p)
+	}
+	if !strings.Contains(p.Text, "meticulous code reviewer") || !strings.Contains(p.Text, "check error handling") || !strings.Contains(p.Text, "File a.go:\n```\n"+strings.TrimRight(small, "\n")+"\n```") {
+		t.Fatalf("expected the review template with a.go inlined, got:\n%s", p.Text)
+	}
+	if len(p.Sections) != 4 {
+		t.Fatalf("expected two files and two snippets considered, got %+v", p.Sections)
+	}
+	if s := p.Sections[1]; s.Path != "b.go" || !s.Included || !s.Truncated || !strings.Contains(p.Text, "File b.go (truncated):") {
+		t.Fatalf("expected b.go to be truncated into the remaining budget, got %+v", s)
+	}
+	if s := p.Sections[2]; s.Kind != "rag" || s.Path != "/repo/high.go" || s.Included {
+		t.Fatalf("expected no room left for snippets, got %+v", p.Sections[2:])
+	}
+
+	spec.Type = "migration"
+	spec.Constraints = []Constraint{{Key: "prompt_max_tokens", Value: float64(500)}}
+	p, _ = b.Build(spec, snippets)
+	if p.Template != "builtin:default" || p.BudgetChars != 2000 {
+		t.Fatalf("expected the default template and a token budget, got %s %d", p.Template, p.BudgetChars)
+	}
+	if strings.Index(p.Text, "high score snippet") > strings.Index(p.Text, "low score snippet") || !strings.Contains(p.Text, "/repo/high.go:41") {
+		t.Fatalf("expected snippets by score with their location, got:\n%s", p.Text)
+	}
+}
+
+func TestPromptBuilder_TemplatesFromDir(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "patch.tmpl"), []byte("PATCH {{.Input}}{{range .Files}} [{{.Path}}]{{end}}"), 0o644)
+	b, err := NewPromptBuilder(dir, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := b.Build(TaskSpec{Type: "Patch", Input: "add logging"}, nil)
+	if err != nil || p.Text != "PATCH add logging" || p.Template != filepath.Join(dir, "patch.tmpl") {
+		t.Fatalf("expected the template from the directory, got %+v %v", p, err)
+	}
+	if p, _ := b.Build(TaskSpec{Type: "testgen", Input: "x"}, nil); p.Template != "builtin:testgen" {
+		t.Fatalf("expected built-in templates for the other types, got %s", p.Template)
+	}
+
+	os.WriteFile(filepath.Join(dir, "review.tmpl"), []byte("{{.Input"), 0o644)
+	if _, err := NewPromptBuilder(dir, "", 0); err == nil || !strings.Contains(err.Error(), "review.tmpl") {
+		t.Fatalf("expected a parse error naming the file, got %v", err)
+	}
+}
+
+type promptRecorder struct {
+	mu     sync.Mutex
+	prompt string
+}
+
+func (d *promptRecorder) ID() string { return "recorder" }
+
+func (d *promptRecorder) Run(ctx context.Context, spec TaskSpec) (ModelResult, error) {
+	d.mu.Lock()
+	d.prompt = promptText(spec)
+	d.mu.Unlock()
+	return stub("recorder", 0).Run(ctx, spec)
+}
+
+func TestProcessTask_SendsRenderedPrompt(t *testing.T) {
+	rag := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("snippets") != "true" {
+			t.Errorf("expected snippets to be requested, got %s", r.URL.RawQuery)
+		}
+		writeJSON(w, map[string]interface{}{"matches": []string{"log.go"}, "scores": []map[string]interface{}{
+			{"path": "/repo/log.go:11", "score": 0.7, "text": "func Logf(format string, args ...any) {}"},
+		}})
+	}))
+	defer rag.Close()
+	workspace := t.TempDir()
+	os.WriteFile(filepath.Join(workspace, "log.go"), []byte("package log\n\nfunc Logf(format string, args ...any) {}\n"), 0644)
+	builder, err := NewPromptBuilder("", workspace, 4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := promptBuilderGlobal
+	promptBuilderGlobal = builder
+	defer func() { promptBuilderGlobal = prev }()
+
+	store := NewTaskStore()
+	spec := TaskSpec{ID: "task_prompt", Type: "patch", Input: "add logging"}
+	setTaskState(store, spec.ID, "queued")
+	driver := &promptRecorder{}
+	processTask(store, []Driver{driver}, map[string]DriverMeta{}, spec.ID, spec, rag.URL, &Metrics{})
+
+	store.mu.Lock()
+	trace := store.traces[spec.ID]
+	text := store.prompts[spec.ID]
+	store.mu.Unlock()
+	if trace.Prompt == nil || trace.Prompt.Chars != len(driver.prompt) || driver.prompt != text {
+		t.Fatalf("expected the driver to get the traced prompt, got %q", driver.prompt)
+	}
+	if trace.Prompt.Text != "" {
+		t.Fatalf("expected the trace to keep only the prompt summary, got %q", trace.Prompt.Text)
+	}
+	if !strings.Contains(driver.prompt, "Related code found by search:\n\n/repo/log.go:11\n```\nfunc Logf") {
+		t.Fatalf("expected the rag snippet inlined, got:\n%s", driver.prompt)
+	}
+	if strings.Contains(driver.prompt, "File log.go") || len(trace.Prompt.Sections) != 1 {
+		t.Fatalf("expected rag matches only as snippets, not whole files, got %+v:\n%s", trace.Prompt.Sections, driver.prompt)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errQueueFull = errors.New("task queue full")
+
+var priorityClasses = []string{"high", "normal", "low"}
+
+const waitSamples = 100
+
+type queuedTask struct {
+	id       string
+	spec     TaskSpec
+	enqueued time.Time
+}
+
+// TaskQueue is a priority queue with three classes. A task's effective class
+// improves by one for every aging interval it waits, so low priority work
+// cannot starve. Among tasks of the same effective class the requester that
+// was served least recently goes first, then the oldest task.
+type TaskQueue struct {
+	mu       sync.Mutex
+	size     int
+	aging    time.Duration
+	lanes    [3][]queuedTask
+	served   map[string]uint64
+	seq      uint64
+	waits    [3][]int64
+	dequeued [3]int
+	notify   chan struct{}
+	now      func() time.Time
+}
+
+type QueueClassStats struct {
+	Depth     int   `json:"depth"`
+	Dequeued  int   `json:"dequeued"`
+	WaitAvgMs int64 `json:"wait_avg_ms"`
+	WaitMaxMs int64 `json:"wait_max_ms"`
+}
+
+func NewTaskQueue(size int, aging time.Duration) *TaskQueue {
+	if size <= 0 {
+		size = 200
+	}
+	return &TaskQueue{
+		size:   size,
+		aging:  aging,
+		served: map[string]uint64{},
+		notify: make(chan struct{}, 1),
+		now:    time.Now,
+	}
+}
+
+func priorityClass(priority string) int {
+	switch strings.ToLower(strings.TrimSpace(priority)) {
+	case "high":
+		return 0
+	case "low":
+		return 2
+	default:
+		return 1
+	}
+}
+
+func requesterKey(spec TaskSpec) string {
+	r := strings.TrimSpace(spec.Metadata.Requester)
+	if r == "" {
+		return "anonymous"
+	}
+	return r
+}
+
+func (q *TaskQueue) Enqueue(t queuedTask) error {
+	q.mu.Lock()
+	c := priorityClass(t.spec.Metadata.Priority)
+	if len(q.lanes[c]) >= q.size {
+		q.mu.Unlock()
+		return errQueueFull
+	}
+	q.lanes[c] = append(q.lanes[c], t)
+	if _, ok := q.served[requesterKey(t.spec)]; !ok {
+		// A requester with nothing else queued ranks as served just now,
+		// not as never served, so one that keeps a single task queued
+		// cannot jump ahead of requesters that are waiting.
+		q.served[requesterKey(t.spec)] = q.seq
+	}
+	q.mu.Unlock()
+	q.signal()
+	return nil
+}
+
+func (q *TaskQueue) Dequeue(ctx context.Context) (queuedTask, bool) {
+	for {
+		q.mu.Lock()
+		t, ok := q.popLocked()
+		more := q.depthLocked() > 0
+		q.mu.Unlock()
+		if ok {
+			if more {
+				q.signal()
+			}
+			return t, true
+		}
+		select {
+		case <-q.notify:
+		case <-ctx.Done():
+			return queuedTask{}, false
+		}
+	}
+}
+
+// Remove drops a still-queued task. It reports false when the task is not in
+// the queue, e.g. because a worker already picked it up.
+func (q *TaskQueue) Remove(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for c := range q.lanes {
+		for i, t := range q.lanes[c] {
+			if t.id == id {
+				q.lanes[c] = append(q.lanes[c][:i], q.lanes[c][i+1:]...)
+				q.pruneLocked(requesterKey(t.spec))
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (q *TaskQueue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.depthLocked()
+}
+
+// Stats returns depth and wait time (last 100 dequeues) per priority class.
+func (q *TaskQueue) Stats() map[string]QueueClassStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := map[string]QueueClassStats{}
+	for c, name := range priorityClasses {
+		st := QueueClassStats{Depth: len(q.lanes[c]), Dequeued: q.dequeued[c]}
+		if n := len(q.waits[c]); n > 0 {
+			sum := int64(0)
+			for _, v := range q.waits[c] {
+				sum += v
+				if v > st.WaitMaxMs {
+					st.WaitMaxMs = v
+				}
+			}
+			st.WaitAvgMs = sum / int64(n)
+		}
+		out[name] = st
+	}
+	return out
+}
+
+func (q *TaskQueue) depthLocked() int {
+	return len(q.lanes[0]) + len(q.lanes[1]) + len(q.lanes[2])
+}
+
+// pruneLocked forgets when a requester was last served once it has nothing
+// queued, so the map only holds requesters that are waiting; Enqueue ranks
+// it again from the current sequence number when it comes back.
+func (q *TaskQueue) pruneLocked(requester string) {
+	for c := range q.lanes {
+		for _, t := range q.lanes[c] {
+			if requesterKey(t.spec) == requester {
+				return
+			}
+		}
+	}
+	delete(q.served, requester)
+}
+
+func (q *TaskQueue) effectiveClass(c int, waited time.Duration) int {
+	if q.aging <= 0 {
+		return c
+	}
+	c -= int(waited / q.aging)
+	if c < 0 {
+		return 0
+	}
+	return c
+}
+
+func (q *TaskQueue) popLocked() (queuedTask, bool) {
+	now := q.now()
+	bestClass, bestIdx := -1, -1
+	var bestEff int
+	var bestServed uint64
+	var bestAt time.Time
+	for c := range q.lanes {
+		for i, t := range q.lanes[c] {
+			eff := q.effectiveClass(c, now.Sub(t.enqueued))
+			served := q.served[requesterKey(t.spec)]
+			better := bestIdx < 0 ||
+				eff < bestEff ||
+				(eff == bestEff && served < bestServed) ||
+				(eff == bestEff && served == bestServed && t.enqueued.Before(bestAt))
+			if better {
+				bestClass, bestIdx = c, i
+				bestEff, bestServed, bestAt = eff, served, t.enqueued
+			}
+		}
+	}
+	if bestIdx < 0 {
+		return queuedTask{}, false
+	}
+	t := q.lanes[bestClass][bestIdx]
+	q.lanes[bestClass] = append(q.lanes[bestClass][:bestIdx], q.lanes[bestClass][bestIdx+1:]...)
+
+	q.seq++
+	q.served[requesterKey(t.spec)] = q.seq
+	q.pruneLocked(requesterKey(t.spec))
+	q.dequeued[bestClass]++
+	q.waits[bestClass] = append(q.waits[bestClass], now.Sub(t.enqueued).Milliseconds())
+	if len(q.waits[bestClass]) > waitSamples {
+		q.waits[bestClass] = q.waits[bestClass][len(q.waits[bestClass])-waitSamples:]
+	}
+	return t, true
+}
+
+func (q *TaskQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func queueTask(id string, priority string, requester string, enqueued time.Time) queuedTask {
+	return queuedTask{
+		id:       id,
+		spec:     TaskSpec{ID: id, Metadata: Metadata{Priority: priority, Requester: requester}},
+		enqueued: enqueued,
+	}
+}
+
+func drainIDs(t *testing.T, q *TaskQueue) []string {
+	t.Helper()
+	ids := []string{}
+	for q.Depth() > 0 {
+		task, ok := q.Dequeue(context.Background())
+		if !ok {
+			t.Fatal("dequeue failed with items in queue")
+		}
+		ids = append(ids, task.id)
+	}
+	return ids
+}
+
+func assertOrder(t *testing.T, got []string, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestTaskQueue_PriorityOrder(t *testing.T) {
+	now := time.Now()
+	q := NewTaskQueue(10, time.Hour)
+	q.now = func() time.Time { return now }
+	_ = q.Enqueue(queueTask("low", "low", "ci", now.Add(-3*time.Second)))
+	_ = q.Enqueue(queueTask("normal", "", "ci", now.Add(-2*time.Second)))
+	_ = q.Enqueue(queueTask("high", "high", "ci", now.Add(-1*time.Second)))
+
+	assertOrder(t, drainIDs(t, q), []string{"high", "normal", "low"})
+}
+
+func TestTaskQueue_AgingPromotesLowPriority(t *testing.T) {
+	now := time.Now()
+	q := NewTaskQueue(10, time.Second)
+	q.now = func() time.Time { return now }
+	_ = q.Enqueue(queueTask("old_low", "low", "a", now.Add(-2500*time.Millisecond)))
+	_ = q.Enqueue(queueTask("new_high", "high", "b", now))
+
+	assertOrder(t, drainIDs(t, q), []string{"old_low", "new_high"})
+}
+
+func TestTaskQueue_RequesterFairness(t *testing.T) {
+	now := time.Now()
+	q := NewTaskQueue(10, time.Hour)
+	q.now = func() time.Time { return now }
+	_ = q.Enqueue(queueTask("ci_1", "normal", "ci", now.Add(-5*time.Second)))
+	_ = q.Enqueue(queueTask("ci_2", "normal", "ci", now.Add(-4*time.Second)))
+	_ = q.Enqueue(queueTask("ci_3", "normal", "ci", now.Add(-3*time.Second)))
+	_ = q.Enqueue(queueTask("dev_1", "normal", "dev", now.Add(-2*time.Second)))
+
+	assertOrder(t, drainIDs(t, q), []string{"ci_1", "dev_1", "ci_2", "ci_3"})
+	if len(q.served) != 0 {
+		t.Fatalf("expected requesters without queued tasks to be forgotten, got %v", q.served)
+	}
+
+	_ = q.Enqueue(queueTask("dev_2", "normal", "dev", now))
+	q.Remove("dev_2")
+	if len(q.served) != 0 {
+		t.Fatalf("expected removal to prune the requester, got %v", q.served)
+	}
+}
+
+func TestTaskQueue_ReturningRequesterWaitsItsTurn(t *testing.T) {
+	now := time.Now()
+	q := NewTaskQueue(20, time.Hour)
+	q.now = func() time.Time { return now }
+	for i := 0; i < 4; i++ {
+		at := now.Add(time.Duration(i-10) * time.Second)
+		_ = q.Enqueue(queueTask("b"+strconv.Itoa(i), "normal", "b", at))
+		_ = q.Enqueue(queueTask("c"+strconv.Itoa(i), "normal", "c", at))
+	}
+	_ = q.Enqueue(queueTask("a0", "normal", "a", now))
+
+	// a keeps exactly one task queued: each time one is taken, the next
+	// arrives.
+	got := []string{}
+	next := 1
+	for len(got) < 9 {
+		task, ok := q.Dequeue(context.Background())
+		if !ok {
+			t.Fatal("dequeue failed with items in queue")
+		}
+		got = append(got, task.id)
+		if requesterKey(task.spec) == "a" {
+			_ = q.Enqueue(queueTask("a"+strconv.Itoa(next), "normal", "a", now))
+			next++
+		}
+	}
+	assertOrder(t, got, []string{"b0", "c0", "a0", "b1", "c1", "a1", "b2", "c2", "a2"})
+}
+
+func TestTaskQueue_StatsAndCapacity(t *testing.T) {
+	now := time.Now()
+	q := NewTaskQueue(1, time.Hour)
+	q.now = func() time.Time { return now }
+	if err := q.Enqueue(queueTask("h1", "high", "a", now.Add(-40*time.Millisecond))); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if err := q.Enqueue(queueTask("h2", "high", "a", now)); err != errQueueFull {
+		t.Fatalf("expected errQueueFull, got %v", err)
+	}
+	_ = q.Enqueue(queueTask("l1", "low", "a", now))
+
+	stats := q.Stats()
+	if stats["high"].Depth != 1 || stats["low"].Depth != 1 || stats["normal"].Depth != 0 {
+		t.Fatalf("unexpected depth stats: %+v", stats)
+	}
+	drainIDs(t, q)
+	stats = q.Stats()
+	if stats["high"].Dequeued != 1 || stats["high"].WaitAvgMs != 40 || stats["high"].WaitMaxMs != 40 {
+		t.Fatalf("unexpected wait stats: %+v", stats["high"])
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// quotasGlobal lets processTask charge driver cost to the requester's daily
+// budget.
+var quotasGlobal *QuotaManager
+
+// Actions taken once a requester spent its monthly budget.
+const (
+	overBudgetBlock     = "block"
+	overBudgetDowngrade = "downgrade"
+)
+
+// QuotaLimits bounds one requester. In per-requester overrides a zero field
+// inherits the default and a negative one means unlimited; in the default a
+// zero field means unlimited.
+type QuotaLimits struct {
+	RatePerMinute    float64 `json:"rate_per_minute" yaml:"rate_per_minute"`
+	Burst            int     `json:"burst" yaml:"burst"`
+	DailyTasks       int     `json:"daily_tasks" yaml:"daily_tasks"`
+	DailyCostUSD     float64 `json:"daily_cost_usd" yaml:"daily_cost_usd"`
+	MonthlyBudgetUSD float64 `json:"monthly_budget_usd" yaml:"monthly_budget_usd"`
+	OverBudget       string  `json:"over_budget,omitempty" yaml:"over_budget"`
+}
+
+type QuotaConfig struct {
+	Default    QuotaLimits            `json:"default" yaml:"default"`
+	Requesters map[string]QuotaLimits `json:"requesters,omitempty" yaml:"requesters"`
+}
+
+// QuotaUsage is a requester's current standing, as served by /quotas.
+type QuotaUsage struct {
+	Requester    string      `json:"requester"`
+	Limits       QuotaLimits `json:"limits"`
+	Tokens       float64     `json:"tokens"`
+	Day          string      `json:"day"`
+	TasksToday   int         `json:"tasks_today"`
+	CostTodayUSD float64     `json:"cost_today_usd"`
+	CostMonthUSD float64     `json:"cost_month_usd"`
+	ResetsAt     string      `json:"resets_at"`
+	Rejected     int         `json:"rejected_today"`
+}
+
+// QuotaRejection explains why a submission was refused.
+type QuotaRejection struct {
+	Requester  string
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (r *QuotaRejection) Error() string {
+	return "quota exceeded: " + r.Reason
+}
+
+type requesterQuota struct {
+	tokens   float64
+	refilled time.Time
+	day      string
+	tasks    int
+	costUSD  float64
+	rejected int
+}
+
+// QuotaManager enforces a token-bucket submission rate and daily task and
+// cost quotas per requester. Daily counters reset at UTC midnight. Monthly
+// budgets are checked against monthSpend, the requester's spend in the
+// current UTC month as booked in the cost ledger.
+type QuotaManager struct {
+	mu         sync.Mutex
+	cfg        QuotaConfig
+	requesters map[string]*requesterQuota
+	rejections map[string]int
+	now        func() time.Time
+	monthSpend func(requester string) float64
+}
+
+func NewQuotaManager(cfg QuotaConfig) *QuotaManager {
+	return &QuotaManager{cfg: cfg, requesters: map[string]*requesterQuota{}, rejections: map[string]int{}, now: time.Now}
+}
+
+// quotaConfigFromEnv builds the default limits from ORCH_RATE_PER_MIN,
+// ORCH_RATE_BURST, ORCH_DAILY_TASKS, ORCH_DAILY_COST_USD,
+// ORCH_MONTHLY_BUDGET_USD and ORCH_OVER_BUDGET, then applies ORCH_QUOTAS_FILE
+// (YAML, or JSON by extension) when set.
+func quotaConfigFromEnv() (QuotaConfig, error) {
+	cfg := QuotaConfig{Default: QuotaLimits{
+		RatePerMinute:    envFloat("ORCH_RATE_PER_MIN", 0),
+		Burst:            envInt("ORCH_RATE_BURST", 0),
+		DailyTasks:       envInt("ORCH_DAILY_TASKS", 0),
+		DailyCostUSD:     envFloat("ORCH_DAILY_COST_USD", 0),
+		MonthlyBudgetUSD: envFloat("ORCH_MONTHLY_BUDGET_USD", 0),
+		OverBudget:       strings.TrimSpace(os.Getenv("ORCH_OVER_BUDGET")),
+	}}
+	path := strings.TrimSpace(os.Getenv("ORCH_QUOTAS_FILE"))
+	if path == "" {
+		return cfg, validateQuotaConfig(cfg)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return QuotaConfig{}, err
+	}
+	file := QuotaConfig{Default: cfg.Default}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return QuotaConfig{}, errors.New("parse " + path + ": " + err.Error())
+	}
+	if err := validateQuotaConfig(file); err != nil {
+		return QuotaConfig{}, errors.New(path + ": " + err.Error())
+	}
+	return file, nil
+}
+
+func validateQuotaConfig(cfg QuotaConfig) error {
+	check := func(name string, l QuotaLimits) error {
+		switch l.OverBudget {
+		case "", overBudgetBlock, overBudgetDowngrade:
+			return nil
+		}
+		return errors.New(name + ": over_budget must be block or downgrade, got " + strconv.Quote(l.OverBudget))
+	}
+	if err := check("default", cfg.Default); err != nil {
+		return err
+	}
+	for name, l := range cfg.Requesters {
+		if err := check(name, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LimitsFor resolves the effective limits of a requester. Zero means
+// unlimited in the result.
+func (q *QuotaManager) LimitsFor(requester string) QuotaLimits {
+	limits := q.cfg.Default
+	if o, ok := q.cfg.Requesters[requester]; ok {
+		if o.RatePerMinute != 0 {
+			limits.RatePerMinute = o.RatePerMinute
+		}
+		if o.Burst != 0 {
+			limits.Burst = o.Burst
+		}
+		if o.DailyTasks != 0 {
+			limits.DailyTasks = o.DailyTasks
+		}
+		if o.DailyCostUSD != 0 {
+			limits.DailyCostUSD = o.DailyCostUSD
+		}
+		if o.MonthlyBudgetUSD != 0 {
+			limits.MonthlyBudgetUSD = o.MonthlyBudgetUSD
+		}
+		if o.OverBudget != "" {
+			limits.OverBudget = o.OverBudget
+		}
+	}
+	if limits.MonthlyBudgetUSD < 0 {
+		limits.MonthlyBudgetUSD = 0
+	}
+	if limits.MonthlyBudgetUSD == 0 {
+		limits.OverBudget = ""
+	} else if limits.OverBudget == "" {
+		limits.OverBudget = overBudgetBlock
+	}
+	if limits.RatePerMinute < 0 {
+		limits.RatePerMinute = 0
+	}
+	if limits.Burst < 0 {
+		limits.Burst = 0
+	}
+	if limits.DailyTasks < 0 {
+		limits.DailyTasks = 0
+	}
+	if limits.DailyCostUSD < 0 {
+		limits.DailyCostUSD = 0
+	}
+	if limits.RatePerMinute > 0 && limits.Burst == 0 {
+		limits.Burst = int(math.Max(1, math.Ceil(limits.RatePerMinute/60)))
+	}
+	return limits
+}
+
+func (q *QuotaManager) getLocked(requester string, limits QuotaLimits, now time.Time) *requesterQuota {
+	rq, ok := q.requesters[requester]
+	if !ok {
+		rq = &requesterQuota{tokens: float64(limits.Burst), refilled: now}
+		q.requesters[requester] = rq
+	}
+	day := now.UTC().Format("2006-01-02")
+	if rq.day != day {
+		rq.day = day
+		rq.tasks = 0
+		rq.costUSD = 0
+		rq.rejected = 0
+	}
+	if limits.RatePerMinute > 0 {
+		rq.tokens = math.Min(float64(limits.Burst), rq.tokens+now.Sub(rq.refilled).Minutes()*limits.RatePerMinute)
+	}
+	rq.refilled = now
+	return rq
+}
+
+func nextUTCMidnight(now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+func nextUTCMonth(now time.Time) time.Time {
+	y, m, _ := now.UTC().Date()
+	return time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (q *QuotaManager) spentThisMonth(requester string) float64 {
+	if q.monthSpend == nil {
+		return 0
+	}
+	return q.monthSpend(requester)
+}
+
+// Admit charges one submission to requester, or explains why it is refused.
+func (q *QuotaManager) Admit(requester string) *QuotaRejection {
+	return q.AdmitN(requester, 1)
+}
+
+// AdmitN charges one submission of n tasks, e.g. a pipeline's steps: it
+// takes one rate token and n daily task slots, or none of them.
+func (q *QuotaManager) AdmitN(requester string, n int) *QuotaRejection {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	limits := q.LimitsFor(requester)
+	rq := q.getLocked(requester, limits, now)
+
+	reject := func(reason string, after time.Duration) *QuotaRejection {
+		rq.rejected++
+		q.rejections[reason]++
+		if after < time.Second {
+			after = time.Second
+		}
+		return &QuotaRejection{Requester: requester, Reason: reason, RetryAfter: after}
+	}
+	if limits.DailyTasks > 0 && rq.tasks+n > limits.DailyTasks {
+		return reject("daily_tasks", nextUTCMidnight(now).Sub(now))
+	}
+	if limits.DailyCostUSD > 0 && rq.costUSD >= limits.DailyCostUSD {
+		return reject("daily_cost", nextUTCMidnight(now).Sub(now))
+	}
+	if limits.MonthlyBudgetUSD > 0 && limits.OverBudget == overBudgetBlock && q.spentThisMonth(requester) >= limits.MonthlyBudgetUSD {
+		return reject("monthly_budget", nextUTCMonth(now).Sub(now))
+	}
+	if limits.RatePerMinute > 0 {
+		if rq.tokens < 1 {
+			wait := time.Duration((1 - rq.tokens) / limits.RatePerMinute * float64(time.Minute))
+			return reject("rate", wait)
+		}
+		rq.tokens--
+	}
+	rq.tasks += n
+	return nil
+}
+
+// Refund returns one daily task slot of a submission that was admitted but
+// could not be queued, or of a pipeline step that never ran.
+func (q *QuotaManager) Refund(requester string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if rq, ok := q.requesters[requester]; ok && rq.tasks > 0 {
+		rq.tasks--
+	}
+}
+
+// AddCost charges driver spend to the requester's daily cost quota.
+func (q *QuotaManager) AddCost(requester string, usd float64) {
+	if q == nil || usd <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	rq := q.getLocked(requester, q.LimitsFor(requester), now)
+	rq.costUSD += usd
+}
+
+// Usage reports every requester seen so far plus those with configured
+// overrides, sorted by name.
+func (q *QuotaManager) Usage() []QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	names := map[string]bool{}
+	for name := range q.requesters {
+		names[name] = true
+	}
+	for name := range q.cfg.Requesters {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	out := make([]QuotaUsage, 0, len(sorted))
+	for _, name := range sorted {
+		out = append(out, q.usageLocked(name, now))
+	}
+	return out
+}
+
+// UsageFor reports a single requester.
+func (q *QuotaManager) UsageFor(requester string) QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usageLocked(requester, q.now())
+}
+
+func (q *QuotaManager) usageLocked(requester string, now time.Time) QuotaUsage {
+	limits := q.LimitsFor(requester)
+	if _, ok := q.requesters[requester]; !ok {
+		return QuotaUsage{
+			Requester:    requester,
+			Limits:       limits,
+			Tokens:       float64(limits.Burst),
+			Day:          now.UTC().Format("2006-01-02"),
+			CostMonthUSD: q.spentThisMonth(requester),
+			ResetsAt:     nextUTCMidnight(now).Format(time.RFC3339),
+		}
+	}
+	rq := q.getLocked(requester, limits, now)
+	return QuotaUsage{
+		Requester:    requester,
+		Limits:       limits,
+		Tokens:       math.Round(rq.tokens*100) / 100,
+		Day:          rq.day,
+		TasksToday:   rq.tasks,
+		CostTodayUSD: rq.costUSD,
+		CostMonthUSD: q.spentThisMonth(requester),
+		ResetsAt:     nextUTCMidnight(now).Format(time.RFC3339),
+		Rejected:     rq.rejected,
+	}
+}
+
+// Rejections returns the number of refused submissions by reason.
+func (q *QuotaManager) Rejections() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := map[string]int{}
+	for k, v := range q.rejections {
+		out[k] = v
+	}
+	return out
+}
+
+func writeQuotaRejection(w http.ResponseWriter, rej *QuotaRejection) {
+	secs := int(math.Ceil(rej.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":               "quota exceeded: " + rej.Reason,
+		"reason":              rej.Reason,
+		"requester":           rej.Requester,
+		"retry_after_seconds": secs,
+	})
+}
+
+// chargeQuotaCost adds the cost_usd reported by every successful driver run
+// to the requester's daily spend.
+func chargeQuotaCost(spec TaskSpec, results []ModelResult) {
+	total := 0.0
+	for _, r := range results {
+		total += metricValue(r, "cost_usd")
+	}
+	quotasGlobal.AddCost(requesterKey(spec), total)
+}
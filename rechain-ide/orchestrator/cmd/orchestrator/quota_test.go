@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestQuotas(cfg QuotaConfig) (*QuotaManager, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+	q := NewQuotaManager(cfg)
+	q.now = clock.now
+	return q, clock
+}
+
+func TestQuotaManager_LimitsFor(t *testing.T) {
+	q := NewQuotaManager(QuotaConfig{
+		Default: QuotaLimits{RatePerMinute: 60, DailyTasks: 100},
+		Requesters: map[string]QuotaLimits{
+			"ci":    {RatePerMinute: 600, Burst: 50},
+			"batch": {DailyTasks: -1, DailyCostUSD: 5},
+		},
+	})
+	cases := []struct {
+		requester string
+		want      QuotaLimits
+	}{
+		{"anonymous", QuotaLimits{RatePerMinute: 60, Burst: 1, DailyTasks: 100}},
+		{"ci", QuotaLimits{RatePerMinute: 600, Burst: 50, DailyTasks: 100}},
+		{"batch", QuotaLimits{RatePerMinute: 60, Burst: 1, DailyCostUSD: 5}},
+	}
+	for _, tc := range cases {
+		if got := q.LimitsFor(tc.requester); got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.requester, got, tc.want)
+		}
+	}
+}
+
+func TestQuotaManager_TokenBucket(t *testing.T) {
+	q, clock := newTestQuotas(QuotaConfig{Default: QuotaLimits{RatePerMinute: 30, Burst: 2}})
+
+	for i := 0; i < 2; i++ {
+		if rej := q.Admit("alice"); rej != nil {
+			t.Fatalf("submission %d within burst rejected: %+v", i, rej)
+		}
+	}
+	rej := q.Admit("alice")
+	if rej == nil || rej.Reason != "rate" {
+		t.Fatalf("expected rate rejection, got %+v", rej)
+	}
+	if rej.RetryAfter != 2*time.Second {
+		t.Fatalf("expected retry after one token interval, got %s", rej.RetryAfter)
+	}
+	if q.Admit("bob") != nil {
+		t.Fatal("buckets must be per requester")
+	}
+	clock.advance(2 * time.Second)
+	if rej := q.Admit("alice"); rej != nil {
+		t.Fatalf("expected refill after 2s, got %+v", rej)
+	}
+}
+
+func TestQuotaManager_DailyQuotas(t *testing.T) {
+	q, clock := newTestQuotas(QuotaConfig{
+		Default:    QuotaLimits{DailyTasks: 2},
+		Requesters: map[string]QuotaLimits{"spender": {DailyTasks: -1, DailyCostUSD: 1}},
+	})
+
+	q.Admit("alice")
+	q.Admit("alice")
+	rej := q.Admit("alice")
+	if rej == nil || rej.Reason != "daily_tasks" || rej.RetryAfter != 12*time.Hour {
+		t.Fatalf("expected daily_tasks rejection until midnight, got %+v", rej)
+	}
+	q.Refund("alice")
+	if rej := q.Admit("alice"); rej != nil {
+		t.Fatalf("refunded slot should be reusable, got %+v", rej)
+	}
+
+	if rej := q.Admit("spender"); rej != nil {
+		t.Fatalf("unexpected rejection: %+v", rej)
+	}
+	q.AddCost("spender", 1.25)
+	if rej := q.Admit("spender"); rej == nil || rej.Reason != "daily_cost" {
+		t.Fatalf("expected daily_cost rejection, got %+v", rej)
+	}
+
+	clock.advance(12 * time.Hour)
+	if q.Admit("alice") != nil || q.Admit("spender") != nil {
+		t.Fatal("daily quotas must reset at UTC midnight")
+	}
+	if got := q.Rejections(); got["daily_tasks"] != 1 || got["daily_cost"] != 1 {
+		t.Fatalf("unexpected rejection counts: %v", got)
+	}
+}
+
+func TestWriteQuotaRejection(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeQuotaRejection(rec, &QuotaRejection{Requester: "alice", Reason: "rate", RetryAfter: 1500 * time.Millisecond})
+	if rec.Code != 429 {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("expected Retry-After rounded up to 2, got %q", got)
+	}
+}
+
+func TestEnqueueReplayTask_ChargesQuota(t *testing.T) {
+	q, _ := newTestQuotas(QuotaConfig{Default: QuotaLimits{DailyTasks: 2}})
+	store := NewTaskStore()
+	store.mu.Lock()
+	store.specs["task_parent"] = TaskSpec{ID: "task_parent", Metadata: Metadata{Requester: "alice"}}
+	store.mu.Unlock()
+	queue := NewTaskQueue(1, time.Hour)
+
+	if _, _, err := enqueueReplayTask(store, queue, q, nil, "task_parent", "force-policy", "bob"); err != nil {
+		t.Fatalf("first replay: %v", err)
+	}
+	if _, _, err := enqueueReplayTask(store, queue, q, nil, "task_parent", "force-policy", "bob"); err != errQueueFull {
+		t.Fatalf("expected a full queue, got %v", err)
+	}
+	if got := q.Usage(); got[0].Requester != "bob" || got[0].TasksToday != 1 {
+		t.Fatalf("expected the unqueued replay to be refunded, got %+v", got)
+	}
+	queue.Remove(queue.lanes[1][0].id)
+	enqueueReplayTask(store, queue, q, nil, "task_parent", "", "bob")
+	_, _, err := enqueueReplayTask(store, queue, q, nil, "task_parent", "", "bob")
+	rej, ok := err.(*QuotaRejection)
+	if !ok || rej.Requester != "bob" || rej.Reason != "daily_tasks" {
+		t.Fatalf("expected the replayer's daily quota to refuse, got %v", err)
+	}
+}
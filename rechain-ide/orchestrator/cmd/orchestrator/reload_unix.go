@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchDriverReloads reloads the drivers file whenever the process receives
+// SIGHUP.
+func watchDriverReloads(reloader *driverReloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			res, err := reloader.Reload()
+			if err != nil {
+				log.Printf("drivers: reload on SIGHUP failed: %v", err)
+				continue
+			}
+			log.Printf("drivers: reloaded %s on SIGHUP: %v", res.Path, res.Drivers)
+		}
+	}()
+}
@@ -0,0 +1,7 @@
+//go:build windows
+
+package main
+
+// watchDriverReloads is a no-op on Windows, which has no SIGHUP; use
+// POST /admin/drivers/reload instead.
+func watchDriverReloads(reloader *driverReloader) {}
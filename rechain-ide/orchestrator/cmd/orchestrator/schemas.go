@@ -0,0 +1,109 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"rechain-ide/orchestrator/internal"
+)
+
+// The schemas are copies of schemas/jsonschema at the repo root; a test
+// keeps them in sync.
+//
+//go:embed schemas/*.schema.json
+var schemaFS embed.FS
+
+var bundledSchemas = mustLoadSchemas()
+
+type bundledSchema struct {
+	raw    []byte
+	schema *internal.Schema
+}
+
+func mustLoadSchemas() map[string]bundledSchema {
+	entries, err := schemaFS.ReadDir("schemas")
+	if err != nil {
+		panic(err)
+	}
+	out := map[string]bundledSchema{}
+	for _, e := range entries {
+		raw, err := schemaFS.ReadFile("schemas/" + e.Name())
+		if err != nil {
+			panic(err)
+		}
+		s, err := internal.ParseSchema(raw)
+		if err != nil {
+			panic("schema " + e.Name() + ": " + err.Error())
+		}
+		out[strings.TrimSuffix(e.Name(), ".schema.json")] = bundledSchema{raw: raw, schema: s}
+	}
+	return out
+}
+
+// validateTaskSpecJSON checks a submitted body against the task_spec schema
+// and the constraint registry.
+func validateTaskSpecJSON(body []byte) []internal.FieldError {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return []internal.FieldError{{Field: "(root)", Message: "invalid json: " + err.Error()}}
+	}
+	errs := bundledSchemas["task_spec"].schema.Validate(doc)
+	if len(errs) > 0 {
+		return errs
+	}
+	var spec TaskSpec
+	if err := json.Unmarshal(body, &spec); err != nil {
+		return []internal.FieldError{{Field: "(root)", Message: err.Error()}}
+	}
+	return validateConstraints(spec.Constraints)
+}
+
+func writeValidationErrors(w http.ResponseWriter, errs []internal.FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "invalid task spec",
+		"errors": errs,
+	})
+}
+
+// serveSchemas serves the index at /schemas and each schema at
+// /schemas/{name}.
+func serveSchemas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimSuffix(strings.Trim(strings.TrimPrefix(r.URL.Path, "/schemas"), "/"), ".schema.json")
+	if name == "" {
+		names := make([]string, 0, len(bundledSchemas))
+		for n := range bundledSchemas {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		index := []map[string]string{}
+		for _, n := range names {
+			index = append(index, map[string]string{"name": n, "url": "/schemas/" + n})
+		}
+		writeJSON(w, map[string]interface{}{
+			"schema_version": schemaVersion,
+			"schemas":        index,
+			"constraints":    constraintRegistry,
+		})
+		return
+	}
+	if name == "constraints" {
+		writeJSON(w, constraintRegistry)
+		return
+	}
+	s, ok := bundledSchemas[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(s.raw)
+}
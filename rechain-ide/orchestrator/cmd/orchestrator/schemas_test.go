@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"rechain-ide/orchestrator/internal"
+)
+
+func TestValidateTaskSpecJSON(t *testing.T) {
+	cases := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{"vscode submission", `{"schema_version":"0.1.0","type":"patch","input":"add logging","context":[{"type":"file","path":"a.go","rev":""}],"constraints":[{"key":"models","value":"model_a"},{"key":"retries","value":2},{"key":"budget_usd","value":0.05},{"key":"hedge","value":true}],"metadata":{"requester":"vscode","priority":"normal"}}`, ""},
+		{"go client with empty id and nil slices", `{"schema_version":"0.1.0","id":"","type":"patch","input":"x","context":null,"constraints":null,"metadata":{"requester":"","priority":""}}`, ""},
+		{"string budget_ms", `{"type":"patch","input":"x","constraints":[{"key":"budget_ms","value":"2000"}]}`, "constraints[0].value"},
+		{"fractional integer", `{"type":"patch","input":"x","constraints":[{"key":"quorum","value":1.5}]}`, "constraints[0].value"},
+		{"unknown routing policy", `{"type":"patch","input":"x","constraints":[{"key":"routing","value":"random"}]}`, "constraints[0].value"},
+		{"unknown constraint", `{"type":"patch","input":"x","constraints":[{"key":"budget_msec","value":10}]}`, "constraints[0].key"},
+		{"duplicate constraint", `{"type":"patch","input":"x","constraints":[{"key":"retries","value":1},{"key":"retries","value":2}]}`, "constraints[1].key"},
+		{"missing type", `{"input":"x"}`, "type"},
+		{"unknown field", `{"type":"patch","input":"x","budget":1}`, "budget"},
+		{"bad priority", `{"type":"patch","input":"x","metadata":{"priority":"asap"}}`, "metadata.priority"},
+		{"id with slash", `{"id":"a/b","type":"patch","input":"x"}`, "id"},
+		{"context without path", `{"type":"patch","input":"x","context":[{"type":"file"}]}`, "context[0].path"},
+		{"not json", `{"type":`, "(root)"},
+	}
+	for _, tc := range cases {
+		errs := validateTaskSpecJSON([]byte(tc.body))
+		if tc.field == "" {
+			if len(errs) > 0 {
+				t.Errorf("%s: unexpected errors %v", tc.name, errs)
+			}
+			continue
+		}
+		if len(errs) == 0 || errs[0].Field != tc.field {
+			t.Errorf("%s: expected error on %s, got %v", tc.name, tc.field, errs)
+		}
+	}
+}
+
+// TestRoutingPoliciesValidate checks that every routing policy the merge and
+// selection code branches on is accepted by the constraint registry.
+func TestRoutingPoliciesValidate(t *testing.T) {
+	fset := token.NewFileSet()
+	policies := map[string]bool{}
+	for _, name := range []string{"main.go", "bandit.go"} {
+		file, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatalf("parse %s: %v", name, err)
+		}
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || (fn.Name.Name != "mergeResults" && fn.Name.Name != "selectDrivers" && fn.Name.Name != "banditRouting") {
+				continue
+			}
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok || len(call.Args) != 2 {
+					return true
+				}
+				if sel, ok := call.Fun.(*ast.SelectorExpr); !ok || sel.Sel.Name != "EqualFold" {
+					return true
+				}
+				if lit, ok := call.Args[1].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					policy, _ := strconv.Unquote(lit.Value)
+					policies[policy] = true
+				}
+				return true
+			})
+		}
+	}
+	if len(policies) < 6 {
+		t.Fatalf("expected to find the routing branches, got %v", policies)
+	}
+	policies["latency"] = true
+	for policy := range policies {
+		if errs := validateConstraints([]Constraint{{Key: "routing", Value: policy}}); len(errs) > 0 {
+			t.Errorf("routing=%s is handled but rejected: %v", policy, errs)
+		}
+	}
+}
+
+func TestSchemasMatchResultTypes(t *testing.T) {
+	docs := map[string]interface{}{
+		"model_result": ModelResult{SchemaVersion: schemaVersion, ModelID: "model_a", Output: "ok", Diff: "diff", Metrics: []Metric{{Name: "latency_ms", Value: 12}}},
+		"merge_result": MergeResult{SchemaVersion: schemaVersion, Diff: "diff", Rationale: "best", Confidence: 0.6, HunkMerge: &internal.HunkMergeResult{}},
+	}
+	for name, v := range docs {
+		raw, _ := json.Marshal(v)
+		var doc interface{}
+		json.Unmarshal(raw, &doc)
+		if errs := bundledSchemas[name].schema.Validate(doc); len(errs) > 0 {
+			t.Errorf("%s does not match its schema: %v", name, errs)
+		}
+	}
+}
+
+func TestBundledSchemasMatchRepoCopies(t *testing.T) {
+	repoDir := filepath.Join("..", "..", "..", "..", "schemas", "jsonschema")
+	if _, err := os.Stat(repoDir); err != nil {
+		t.Skip("repo schemas not available")
+	}
+	for name, s := range bundledSchemas {
+		repo, err := os.ReadFile(filepath.Join(repoDir, name+".schema.json"))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(repo, s.raw) {
+			t.Errorf("%s: embedded schema differs from schemas/jsonschema", name)
+		}
+	}
+}
+
+func TestServeSchemas(t *testing.T) {
+	rec := httptest.NewRecorder()
+	serveSchemas(rec, httptest.NewRequest("GET", "/schemas/task_spec", nil))
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/schema+json" {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	rec = httptest.NewRecorder()
+	serveSchemas(rec, httptest.NewRequest("GET", "/schemas", nil))
+	var index struct {
+		Schemas     []map[string]string `json:"schemas"`
+		Constraints []ConstraintDef     `json:"constraints"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &index)
+	if len(index.Schemas) != 3 || len(index.Constraints) != len(constraintRegistry) {
+		t.Fatalf("unexpected index: %+v", index)
+	}
+}
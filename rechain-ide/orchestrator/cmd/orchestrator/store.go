@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	tasksBucket     = "tasks"
+	pipelinesBucket = "pipelines"
+)
+
+// TaskRecord is the persisted form of everything the store knows about a task.
+type TaskRecord struct {
+	Spec      TaskSpec     `json:"spec"`
+	Status    TaskStatus   `json:"status"`
+	Trace     TaskTrace    `json:"trace"`
+	Result    *MergeResult `json:"result,omitempty"`
+	Artifacts []Artifact   `json:"artifacts,omitempty"`
+	Prompt    string       `json:"prompt,omitempty"`
+	// CallbackSigned is set when the task had its own callback secret.
+	CallbackSigned bool `json:"callback_signed,omitempty"`
+}
+
+// TaskBackend is the durable storage behind TaskStore and PipelineManager.
+type TaskBackend interface {
+	// SaveAll writes JSON-encoded records, keyed by bucket and then by task
+	// or pipeline ID, at once.
+	SaveAll(batch map[string]map[string][]byte) error
+	LoadAll() ([]TaskRecord, error)
+	LoadPipelines() ([]PipelineRecord, error)
+	Close() error
+}
+
+type boltTaskBackend struct {
+	db *bbolt.DB
+}
+
+func OpenBoltTaskBackend(path string) (TaskBackend, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, errors.New("empty store path")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 500 * time.Millisecond})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range []string{tasksBucket, pipelinesBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltTaskBackend{db: db}, nil
+}
+
+func (b *boltTaskBackend) SaveAll(batch map[string]map[string][]byte) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		for name, records := range batch {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				return errors.New("unknown bucket " + name)
+			}
+			for id, raw := range records {
+				if err := bucket.Put([]byte(id), raw); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltTaskBackend) LoadAll() ([]TaskRecord, error) {
+	out := []TaskRecord{}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(tasksBucket)).ForEach(func(k, v []byte) error {
+			var rec TaskRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				log.Printf("store: skipping corrupt task record %s: %v", string(k), err)
+				return nil
+			}
+			out = append(out, rec)
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (b *boltTaskBackend) LoadPipelines() ([]PipelineRecord, error) {
+	out := []PipelineRecord{}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(pipelinesBucket)).ForEach(func(k, v []byte) error {
+			var rec PipelineRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				log.Printf("store: skipping corrupt pipeline record %s: %v", string(k), err)
+				return nil
+			}
+			out = append(out, rec)
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (b *boltTaskBackend) Close() error {
+	return b.db.Close()
+}
+
+// AttachBackend loads persisted tasks into memory and makes every later
+// mutation write through to the backend. Tasks that were queued or running
+// when the previous process stopped are reset to queued and returned so the
+// caller can put them back on the queue.
+func (s *TaskStore) AttachBackend(backend TaskBackend) ([]TaskSpec, error) {
+	records, err := backend.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Status.StartedAt < records[j].Status.StartedAt })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backend = backend
+	s.writer = newStoreWriter(backend)
+	pending := []TaskSpec{}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, rec := range records {
+		id := rec.Status.ID
+		if id == "" {
+			continue
+		}
+		if rec.Spec.ID == "" {
+			rec.Spec.ID = id
+		}
+		if rec.Prompt != "" {
+			s.prompts[id] = rec.Prompt
+		}
+		if rec.CallbackSigned {
+			s.signedCallbacks[id] = true
+		}
+		switch rec.Status.State {
+		case "queued", "running":
+			rec.Status.State = "queued"
+			rec.Status.Progress = 0.0
+			rec.Status.UpdatedAt = now
+			rec.Trace.State = "queued"
+			pending = append(pending, rec.Spec)
+		}
+		s.statuses[id] = rec.Status
+		s.specs[id] = rec.Spec
+		s.traces[id] = rec.Trace
+		if rec.Result != nil {
+			s.results[id] = *rec.Result
+		}
+		if len(rec.Artifacts) > 0 {
+			s.artifacts[id] = rec.Artifacts
+		}
+		if rec.Status.State == "queued" {
+			s.saveLocked(id)
+		}
+	}
+	return pending, nil
+}
+
+// persistLocked saves a task whose state changed and announces it to event
+// subscribers. Callers must hold s.mu.
+func (s *TaskStore) persistLocked(id string) {
+	s.publishLocked(id)
+	s.saveLocked(id)
+}
+
+// finishLocked is persistLocked for a task that just reached a terminal
+// state: its callback URL and pipeline are notified too. Only the state
+// transitions call it, so later edits of a finished task's record never send
+// another webhook. Callers must hold s.mu.
+func (s *TaskStore) finishLocked(id string) {
+	s.publishLocked(id)
+	s.notifyWebhookLocked(id)
+	s.notifyPipelineLocked(id)
+	s.saveLocked(id)
+}
+
+// saveLocked queues the current in-memory view of a task for the backend.
+// Callers must hold s.mu; the record is encoded here but written by the
+// store writer, so disk I/O never holds the lock.
+func (s *TaskStore) saveLocked(id string) {
+	if s.writer == nil {
+		return
+	}
+	rec := TaskRecord{
+		Spec:           s.specs[id],
+		Status:         s.statuses[id],
+		Trace:          s.traces[id],
+		Artifacts:      s.artifacts[id],
+		Prompt:         s.prompts[id],
+		CallbackSigned: s.signedCallbacks[id],
+	}
+	if res, ok := s.results[id]; ok {
+		rec.Result = &res
+	}
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("store: encode task %s failed: %v", id, err)
+		return
+	}
+	s.writer.put(tasksBucket, id, raw)
+}
+
+// savePipeline queues a pipeline record for the backend, if there is one.
+func (s *TaskStore) savePipeline(id string, raw []byte) {
+	s.mu.Lock()
+	w := s.writer
+	s.mu.Unlock()
+	if w != nil {
+		w.put(pipelinesBucket, id, raw)
+	}
+}
+
+// setPromptText keeps the rendered prompt of a task for /tasks/{id}/debug;
+// it is saved with the task's next persisted change.
+func (s *TaskStore) setPromptText(id string, text string) {
+	s.mu.Lock()
+	s.prompts[id] = text
+	s.mu.Unlock()
+}
+
+// Flush waits until every change persisted so far has reached the backend.
+func (s *TaskStore) Flush() {
+	s.mu.Lock()
+	w := s.writer
+	s.mu.Unlock()
+	if w != nil {
+		w.flush()
+	}
+}
+
+// storeWriter saves records in the background, in order. Records queued
+// while a write is in flight are coalesced per ID, newest first, and saved
+// together in the next transaction, so a burst of state changes costs one
+// sync instead of one per change.
+type storeWriter struct {
+	backend TaskBackend
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending map[string]map[string][]byte
+	busy    bool
+}
+
+func newStoreWriter(backend TaskBackend) *storeWriter {
+	w := &storeWriter{backend: backend, pending: map[string]map[string][]byte{}}
+	w.cond = sync.NewCond(&w.mu)
+	go w.run()
+	return w
+}
+
+func (w *storeWriter) put(bucket string, id string, raw []byte) {
+	w.mu.Lock()
+	if w.pending[bucket] == nil {
+		w.pending[bucket] = map[string][]byte{}
+	}
+	w.pending[bucket][id] = raw
+	w.cond.Broadcast()
+	w.mu.Unlock()
+}
+
+func (w *storeWriter) run() {
+	w.mu.Lock()
+	for {
+		for len(w.pending) == 0 {
+			w.cond.Wait()
+		}
+		batch := w.pending
+		w.pending = map[string]map[string][]byte{}
+		w.busy = true
+		w.mu.Unlock()
+		if err := w.backend.SaveAll(batch); err != nil {
+			log.Printf("store: persist %d task(s) and %d pipeline(s) failed: %v", len(batch[tasksBucket]), len(batch[pipelinesBucket]), err)
+		}
+		w.mu.Lock()
+		w.busy = false
+		w.cond.Broadcast()
+	}
+}
+
+func (w *storeWriter) flush() {
+	w.mu.Lock()
+	for len(w.pending) > 0 || w.busy {
+		w.cond.Wait()
+	}
+	w.mu.Unlock()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBoltTaskStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.db")
+	backend, err := OpenBoltTaskBackend(path)
+	if err != nil {
+		t.Fatalf("open backend: %v", err)
+	}
+	store := NewTaskStore()
+	if _, err := store.AttachBackend(backend); err != nil {
+		t.Fatalf("attach backend: %v", err)
+	}
+
+	put := func(id string, parent string, state string, startedAt string) {
+		store.mu.Lock()
+		store.specs[id] = TaskSpec{ID: id, Type: "patch", Input: "input " + id}
+		store.statuses[id] = TaskStatus{SchemaVersion: schemaVersion, ID: id, State: state, StartedAt: startedAt, UpdatedAt: startedAt}
+		store.traces[id] = TaskTrace{SchemaVersion: schemaVersion, TaskID: id, ParentTaskID: parent, State: state, StartedAt: startedAt}
+		if state == "completed" {
+			store.results[id] = MergeResult{SchemaVersion: schemaVersion, Diff: "diff " + id, QualityScore: 0.8}
+			store.artifacts[id] = []Artifact{{ID: "artifact_" + id, Type: "diff"}}
+		}
+		store.persistLocked(id)
+		store.mu.Unlock()
+	}
+	put("task_root", "", "completed", "2024-01-01T00:00:00Z")
+	put("task_replay", "task_root", "running", "2024-01-01T00:00:02Z")
+	put("task_queued", "", "queued", "2024-01-01T00:00:01Z")
+	store.Flush()
+	if err := backend.Close(); err != nil {
+		t.Fatalf("close backend: %v", err)
+	}
+
+	backend, err = OpenBoltTaskBackend(path)
+	if err != nil {
+		t.Fatalf("reopen backend: %v", err)
+	}
+	defer backend.Close()
+	restored := NewTaskStore()
+	pending, err := restored.AttachBackend(backend)
+	if err != nil {
+		t.Fatalf("reattach backend: %v", err)
+	}
+
+	if len(pending) != 2 || pending[0].ID != "task_queued" || pending[1].ID != "task_replay" {
+		t.Fatalf("expected queued then running task to resume, got %+v", pending)
+	}
+	if got := restored.statuses["task_replay"].State; got != "queued" {
+		t.Fatalf("expected running task to be reset to queued, got %s", got)
+	}
+	if got := restored.results["task_root"].Diff; got != "diff task_root" {
+		t.Fatalf("expected merge result to survive restart, got %q", got)
+	}
+	if len(restored.artifacts["task_root"]) != 1 {
+		t.Fatalf("expected artifacts to survive restart, got %+v", restored.artifacts["task_root"])
+	}
+	chain, ok := restored.ReplayChain("task_replay")
+	if !ok {
+		t.Fatal("expected replay chain after restart")
+	}
+	if len(chain.Lineage) != 2 || chain.Lineage[0].ID != "task_root" {
+		t.Fatalf("unexpected lineage after restart: %+v", chain.Lineage)
+	}
+	if tasks := restored.RecentTasks(10, "", "", "", ""); len(tasks) != 3 {
+		t.Fatalf("expected 3 recent tasks after restart, got %d", len(tasks))
+	}
+}
+
+// slowBackend blocks every save until release is closed.
+type slowBackend struct {
+	release chan struct{}
+	mu      sync.Mutex
+	saved   map[string]TaskRecord
+	batches int
+}
+
+func (b *slowBackend) SaveAll(batch map[string]map[string][]byte) error {
+	<-b.release
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.batches++
+	for id, raw := range batch[tasksBucket] {
+		var rec TaskRecord
+		json.Unmarshal(raw, &rec)
+		b.saved[id] = rec
+	}
+	return nil
+}
+
+func (b *slowBackend) LoadAll() ([]TaskRecord, error)           { return nil, nil }
+func (b *slowBackend) LoadPipelines() ([]PipelineRecord, error) { return nil, nil }
+func (b *slowBackend) Close() error                             { return nil }
+
+func TestPersistDoesNotWaitForTheBackend(t *testing.T) {
+	backend := &slowBackend{release: make(chan struct{}), saved: map[string]TaskRecord{}}
+	store := NewTaskStore()
+	if _, err := store.AttachBackend(backend); err != nil {
+		t.Fatalf("attach backend: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for _, state := range []string{"queued", "running", "completed"} {
+			setTaskState(store, "task_slow", state)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("state changes blocked on a slow backend")
+	}
+
+	close(backend.release)
+	store.Flush()
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if got := backend.saved["task_slow"].Status.State; got != "completed" {
+		t.Fatalf("expected the newest state to be saved last, got %q", got)
+	}
+	if backend.batches > 2 {
+		t.Fatalf("expected queued changes to be coalesced, got %d batches", backend.batches)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logDebug = "debug"
+	logInfo  = "info"
+	logWarn  = "warn"
+	logError = "error"
+)
+
+// logLevels orders the task log levels for filtering.
+var logLevels = map[string]int{logDebug: 0, logInfo: 1, logWarn: 2, logError: 3}
+
+// TaskLogEntry is one structured event of a task run.
+type TaskLogEntry struct {
+	Seq     int               `json:"seq"`
+	At      string            `json:"at"`
+	Level   string            `json:"level"`
+	Event   string            `json:"event"`
+	Model   string            `json:"model,omitempty"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+type taskLog struct {
+	entries []TaskLogEntry
+	seq     int
+	dropped int
+}
+
+// TaskLogs keeps a bounded event log per task: driver attempts and errors,
+// retries, pings, RAG and merge fallbacks. Each task keeps its newest
+// maxEntries entries with messages cut to maxMessage bytes, and the logs of
+// the oldest tasks are dropped beyond maxTasks. Logs live in memory only.
+type TaskLogs struct {
+	maxEntries int
+	maxTasks   int
+	maxMessage int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	logs    map[string]*taskLog
+	order   []string
+	byLevel map[string]int
+}
+
+func NewTaskLogs(maxEntries int, maxTasks int, maxMessage int) *TaskLogs {
+	return &TaskLogs{
+		maxEntries: maxEntries,
+		maxTasks:   maxTasks,
+		maxMessage: maxMessage,
+		now:        time.Now,
+		logs:       map[string]*taskLog{},
+		byLevel:    map[string]int{},
+	}
+}
+
+func taskLogsFromEnv() *TaskLogs {
+	return NewTaskLogs(
+		envInt("ORCH_TASK_LOG_MAX_ENTRIES", 200),
+		envInt("ORCH_TASK_LOG_MAX_TASKS", 1000),
+		envInt("ORCH_TASK_LOG_MAX_MESSAGE", 2000),
+	)
+}
+
+// Log appends an entry to the task's log.
+func (l *TaskLogs) Log(taskID string, level string, event string, model string, message string, fields map[string]string) {
+	if l == nil || taskID == "" {
+		return
+	}
+	if l.maxMessage > 0 && len(message) > l.maxMessage {
+		message = cutUTF8(message, l.maxMessage) + "..."
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tl, ok := l.logs[taskID]
+	if !ok {
+		tl = &taskLog{}
+		l.logs[taskID] = tl
+		l.order = append(l.order, taskID)
+		for l.maxTasks > 0 && len(l.order) > l.maxTasks {
+			delete(l.logs, l.order[0])
+			l.order = l.order[1:]
+		}
+	}
+	tl.seq++
+	tl.entries = append(tl.entries, TaskLogEntry{
+		Seq:     tl.seq,
+		At:      l.now().UTC().Format(time.RFC3339Nano),
+		Level:   level,
+		Event:   event,
+		Model:   model,
+		Message: message,
+		Fields:  fields,
+	})
+	if l.maxEntries > 0 && len(tl.entries) > l.maxEntries {
+		n := len(tl.entries) - l.maxEntries
+		tl.entries = append([]TaskLogEntry{}, tl.entries[n:]...)
+		tl.dropped += n
+	}
+	l.byLevel[level]++
+}
+
+// Entries returns the task's entries at or above minLevel (all when empty)
+// and how many older entries were dropped.
+func (l *TaskLogs) Entries(taskID string, minLevel string) ([]TaskLogEntry, int) {
+	out := []TaskLogEntry{}
+	if l == nil {
+		return out, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tl, ok := l.logs[taskID]
+	if !ok {
+		return out, 0
+	}
+	for _, e := range tl.entries {
+		if logLevels[e.Level] >= logLevels[minLevel] {
+			out = append(out, e)
+		}
+	}
+	return out, tl.dropped
+}
+
+// Stats returns the number of logged tasks and the entries logged per level.
+func (l *TaskLogs) Stats() (int, map[string]int) {
+	byLevel := map[string]int{}
+	if l == nil {
+		return 0, byLevel
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, v := range l.byLevel {
+		byLevel[k] = v
+	}
+	return len(l.logs), byLevel
+}
+
+type taskLogKey struct{}
+
+type taskLogRef struct {
+	logs   *TaskLogs
+	taskID string
+}
+
+// withTaskLog makes logTask calls under ctx write to the log of taskID.
+func withTaskLog(ctx context.Context, logs *TaskLogs, taskID string) context.Context {
+	return context.WithValue(ctx, taskLogKey{}, taskLogRef{logs: logs, taskID: taskID})
+}
+
+// logTask appends an entry to the log of the task running under ctx; without
+// one it does nothing, so drivers can log unconditionally.
+func logTask(ctx context.Context, level string, event string, model string, message string, fields map[string]string) {
+	ref, ok := ctx.Value(taskLogKey{}).(taskLogRef)
+	if !ok {
+		return
+	}
+	ref.logs.Log(ref.taskID, level, event, model, message, fields)
+}
+
+// serveTaskLogs answers GET /tasks/{id}/logs, optionally filtered by a
+// minimum level and by event names (comma-separated).
+func serveTaskLogs(w http.ResponseWriter, r *http.Request, store *TaskStore, id string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	store.mu.Lock()
+	_, ok := store.statuses[id]
+	store.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	level := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("level")))
+	if _, known := logLevels[level]; level != "" && !known {
+		http.Error(w, "invalid level: "+level, 400)
+		return
+	}
+	entries, dropped := store.logs.Entries(id, level)
+	if events := splitCSV(r.URL.Query().Get("event")); len(events) > 0 {
+		filtered := []TaskLogEntry{}
+		for _, e := range entries {
+			if containsString(events, e.Event) {
+				filtered = append(filtered, e)
+			}
+		}
+		entries = filtered
+	}
+	writeJSON(w, map[string]interface{}{
+		"task_id": id,
+		"level":   level,
+		"entries": entries,
+		"dropped": dropped,
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskLogs_Bounds(t *testing.T) {
+	logs := NewTaskLogs(2, 2, 8)
+	for _, msg := range []string{"one", "two", "three"} {
+		logs.Log("task_a", logInfo, "step", "", msg, nil)
+	}
+	logs.Log("task_a", logDebug, "step", "", "a very long message", nil)
+	entries, dropped := logs.Entries("task_a", "")
+	if len(entries) != 2 || dropped != 2 || entries[0].Message != "three" || entries[1].Seq != 4 {
+		t.Fatalf("expected the newest entries with sequence numbers kept, got %+v dropped=%d", entries, dropped)
+	}
+	if entries[1].Message != "a very l..." {
+		t.Fatalf("expected a truncated message, got %q", entries[1].Message)
+	}
+	utf8Logs := NewTaskLogs(2, 2, 8)
+	utf8Logs.Log("task_a", logInfo, "step", "", "aéééé", nil)
+	if got, _ := utf8Logs.Entries("task_a", ""); len(got) != 1 || got[0].Message != "aééé..." {
+		t.Fatalf("expected truncation on a rune boundary, got %+v", got)
+	}
+	if got, _ := logs.Entries("task_a", logInfo); len(got) != 1 || got[0].Message != "three" {
+		t.Fatalf("expected level filtering, got %+v", got)
+	}
+
+	logs.Log("task_b", logWarn, "step", "", "b", nil)
+	logs.Log("task_c", logError, "step", "", "c", nil)
+	if got, _ := logs.Entries("task_a", ""); len(got) != 0 {
+		t.Fatalf("expected the oldest task's log to be evicted, got %+v", got)
+	}
+	tasks, byLevel := logs.Stats()
+	if tasks != 2 || byLevel[logInfo] != 3 || byLevel[logError] != 1 {
+		t.Fatalf("unexpected stats tasks=%d %v", tasks, byLevel)
+	}
+}
+
+func TestProcessTask_LogsDriverFailures(t *testing.T) {
+	store := NewTaskStore()
+	store.logs = NewTaskLogs(100, 10, 0)
+	spec := TaskSpec{ID: "task_down", Constraints: []Constraint{
+		{Key: "retries", Value: float64(1)},
+		{Key: "retry_backoff_ms", Value: float64(0)},
+	}}
+	setTaskState(store, spec.ID, "queued")
+	processTask(store, []Driver{failingDriver{id: "down"}}, map[string]DriverMeta{}, spec.ID, spec, "", &Metrics{})
+
+	get := func(query string) (int, []TaskLogEntry) {
+		rec := httptest.NewRecorder()
+		serveTaskLogs(rec, httptest.NewRequest(http.MethodGet, "/tasks/"+spec.ID+"/logs"+query, nil), store, spec.ID)
+		var body struct {
+			Entries []TaskLogEntry `json:"entries"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body.Entries
+	}
+	_, warnings := get("?level=warn")
+	events := []string{}
+	for _, e := range warnings {
+		events = append(events, e.Event)
+	}
+	if strings.Join(events, ",") != "driver_error,driver_error,driver_failed,no_results" {
+		t.Fatalf("unexpected warnings %v", events)
+	}
+	if warnings[0].Model != "down" || warnings[0].Message != "upstream down" || warnings[1].Fields["attempt"] != "2" {
+		t.Fatalf("expected the driver error per attempt, got %+v", warnings[:2])
+	}
+	if _, retries := get("?event=retry,driver_attempt"); len(retries) != 3 || retries[1].Event != "retry" {
+		t.Fatalf("expected attempts and the retry at debug level, got %+v", retries)
+	}
+	if code, _ := get("?level=verbose"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown level, got %d", code)
+	}
+	rec := httptest.NewRecorder()
+	serveTaskLogs(rec, httptest.NewRequest(http.MethodGet, "/tasks/missing/logs", nil), store, "missing")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown task, got %d", rec.Code)
+	}
+}
+
+func TestHuggingFaceDriver_LogsFallbacks(t *testing.T) {
+	srv := fakeHF(t, map[string]string{
+		"primary":  "Sorry, I cannot help with that.",
+		"fallback": "```diff\n--- a/README.md\n+++ b/README.md\n@@ -1 +1 @@\n-old\n+new\n```",
+	})
+	d := HuggingFaceDriver{id: "hf", modelID: "primary", fallback: []string{"fallback"}, apiURL: srv.URL, timeout: time.Second, pingTimeout: time.Second}
+	logs := NewTaskLogs(100, 10, 0)
+	if _, err := d.Run(withTaskLog(context.Background(), logs, "task_hf"), TaskSpec{Input: "readme"}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	entries, _ := logs.Entries("task_hf", "")
+	events := []string{}
+	for _, e := range entries {
+		events = append(events, e.Event+":"+e.Fields["hf_model"])
+	}
+	if strings.Join(events, ",") != "ping:primary,hf_error:primary,ping:fallback" {
+		t.Fatalf("unexpected hf log %v", events)
+	}
+	if entries[1].Level != logWarn || !strings.Contains(entries[1].Message, "no valid diff") {
+		t.Fatalf("expected the parse error as a warning, got %+v", entries[1])
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"rechain-ide/shared/tracing"
+)
+
+func findSpan(spans []tracing.Span, name string) (tracing.Span, bool) {
+	for _, s := range spans {
+		if s.Name == name {
+			return s, true
+		}
+		if c, ok := findSpan(s.Children, name); ok {
+			return c, true
+		}
+	}
+	return tracing.Span{}, false
+}
+
+func TestProcessTask_PropagatesTraceToServices(t *testing.T) {
+	var mu sync.Mutex
+	headers := map[string]http.Header{}
+	record := func(name string, next http.HandlerFunc) http.Handler {
+		return tracing.WithTrace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			headers[name] = r.Header.Clone()
+			mu.Unlock()
+			next(w, r)
+		}))
+	}
+	rag := httptest.NewServer(record("rag", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"matches": []string{"a.go"}})
+	}))
+	defer rag.Close()
+	compiler := httptest.NewServer(record("compile", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Results []ModelResult `json:"results"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		writeJSON(w, map[string]interface{}{"diff": req.Results[0].Diff, "rationale": "first"})
+	}))
+	defer compiler.Close()
+	t.Setenv("AGENT_COMPILER_URL", compiler.URL)
+
+	store := NewTaskStore()
+	spec := TaskSpec{ID: "task_traced", Input: "add logging"}
+	setTaskState(store, spec.ID, "queued")
+	traceID, parentID := tracing.NewTraceID(), tracing.NewSpanID()
+	store.mu.Lock()
+	tr := store.traces[spec.ID]
+	tr.TraceID, tr.ParentSpanID, tr.RequestID = traceID, parentID, "req-123"
+	store.traces[spec.ID] = tr
+	store.mu.Unlock()
+
+	processTask(store, []Driver{stub("model_a", 0)}, map[string]DriverMeta{}, spec.ID, spec, rag.URL, &Metrics{})
+
+	store.mu.Lock()
+	trace := store.traces[spec.ID]
+	store.mu.Unlock()
+	if trace.State != "completed" || trace.TraceID != traceID {
+		t.Fatalf("unexpected trace %+v", trace)
+	}
+	for _, name := range []string{"rag", "compile"} {
+		sc, ok := tracing.ParseTraceparent(headers[name].Get("traceparent"))
+		if !ok || sc.TraceID != traceID {
+			t.Fatalf("%s: expected the task trace to be propagated, got %q", name, headers[name].Get("traceparent"))
+		}
+		if rid := headers[name].Get("X-Request-Id"); rid != "req-123" {
+			t.Fatalf("%s: expected the request ID to be forwarded, got %q", name, rid)
+		}
+	}
+
+	if len(trace.Spans) != 1 || trace.Spans[0].Name != "task" || trace.Spans[0].ParentID != parentID {
+		t.Fatalf("expected a single task root under the caller's span, got %+v", trace.Spans)
+	}
+	for _, name := range []string{"rag", "GET /search", "fanout", "driver model_a", "attempt 1", "merge"} {
+		if _, ok := findSpan(trace.Spans, name); !ok {
+			t.Fatalf("missing span %q in %+v", name, trace.Spans)
+		}
+	}
+	call, _ := findSpan(trace.Spans, "POST /compile")
+	if call.Kind != tracing.KindClient || call.Attributes["status_code"] != "200" || len(call.Children) != 1 || call.Children[0].Kind != tracing.KindServer {
+		t.Fatalf("expected a client span with the server time as a child, got %+v", call)
+	}
+	if merge, _ := findSpan(trace.Spans, "merge"); merge.Attributes["source"] != "agent_compiler" || len(merge.Children) != 1 {
+		t.Fatalf("expected the compile call under the merge span, got %+v", merge)
+	}
+}
+
+func TestRequestTrace(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/tasks", strings.NewReader("{}"))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	var got TaskTrace
+	tracing.WithTrace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = requestTrace(r, TaskTrace{IdempotencyKey: "k"})
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	if got.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || got.ParentSpanID != "00f067aa0ba902b7" || got.IdempotencyKey != "k" {
+		t.Fatalf("expected the incoming trace context, got %+v", got)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/tasks", nil)
+	req.Header.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	tracing.WithTrace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = requestTrace(r, TaskTrace{})
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	if len(got.TraceID) != 32 || got.TraceID == strings.Repeat("0", 32) || got.ParentSpanID != "" {
+		t.Fatalf("expected an invalid traceparent to start a new trace, got %+v", got)
+	}
+}
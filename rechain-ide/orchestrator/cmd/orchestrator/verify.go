@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rechain-ide/orchestrator/internal"
+	"rechain-ide/shared/tracing"
+)
+
+const (
+	verifyPassed = "passed"
+	verifyFailed = "failed"
+	verifyError  = "error"
+)
+
+// verifySkipDirs are not copied into the scratch workspace.
+var verifySkipDirs = map[string]bool{".git": true, "node_modules": true, ".orch-data": true, ".rag-cache": true}
+
+// TraceVerifyCommand is one test command run through the kernel.
+type TraceVerifyCommand struct {
+	Command    string `json:"command"`
+	Passed     bool   `json:"passed"`
+	ExitCode   int    `json:"exit_code"`
+	Output     string `json:"output_excerpt,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// TraceVerification records the verification of one merge candidate: the
+// merged winner first, then each fallback that was tried.
+type TraceVerification struct {
+	Candidate  string               `json:"candidate"`
+	Passed     bool                 `json:"passed"`
+	Commands   []TraceVerifyCommand `json:"commands,omitempty"`
+	DurationMs int64                `json:"duration_ms"`
+	Error      string               `json:"error,omitempty"`
+}
+
+type verifyCandidate struct {
+	label  string
+	source string
+	merge  MergeResult
+}
+
+// Verifier applies a candidate diff to a scratch copy of the workspace and
+// runs test commands in it through the kernel /run endpoint.
+type Verifier struct {
+	kernelURL     string
+	workspace     string
+	scratch       string
+	timeout       time.Duration
+	outputBytes   int
+	maxCandidates int
+	maxBytes      int64
+	commands      []string
+	client        *http.Client
+
+	mu        sync.Mutex
+	outcomes  map[string]int
+	fallbacks int
+}
+
+// verifierGlobal is the verifier processTask uses; nil disables the
+// verification stage.
+var verifierGlobal *Verifier
+
+func NewVerifier(kernelURL string, workspace string, scratch string, timeout time.Duration, outputBytes int, maxCandidates int, maxBytes int64, commands []string) *Verifier {
+	if maxCandidates <= 0 {
+		maxCandidates = 1
+	}
+	return &Verifier{
+		kernelURL:     strings.TrimRight(kernelURL, "/"),
+		workspace:     workspace,
+		scratch:       scratch,
+		timeout:       timeout,
+		outputBytes:   outputBytes,
+		maxCandidates: maxCandidates,
+		maxBytes:      maxBytes,
+		commands:      commands,
+		client:        &http.Client{Timeout: timeout + 2*time.Second, Transport: serviceClient.Transport},
+		outcomes:      map[string]int{},
+	}
+}
+
+func verifierFromEnv(kernelURL string) *Verifier {
+	return NewVerifier(
+		kernelURL,
+		envOr("ORCH_WORKSPACE_ROOT", "."),
+		envOr("ORCH_VERIFY_SCRATCH_DIR", filepath.Join(os.TempDir(), "rechain-verify")),
+		time.Duration(envInt("ORCH_VERIFY_TIMEOUT_MS", 5000))*time.Millisecond,
+		envInt("ORCH_VERIFY_OUTPUT_BYTES", 2048),
+		envInt("ORCH_VERIFY_MAX_CANDIDATES", 3),
+		int64(envInt("ORCH_VERIFY_MAX_WORKSPACE_MB", 256))<<20,
+		splitCSV(os.Getenv("ORCH_VERIFY_COMMANDS")),
+	)
+}
+
+// verifyCommands picks the test commands for a task: the verify_commands
+// constraint, then the tests suggested by the agent compiler, then the
+// configured defaults.
+func (v *Verifier) verifyCommands(spec TaskSpec, merge MergeResult) []string {
+	if cmds := splitCSV(constraintString(spec.Constraints, "verify_commands")); len(cmds) > 0 {
+		return cmds
+	}
+	if len(merge.Tests) > 0 {
+		return merge.Tests
+	}
+	return v.commands
+}
+
+// VerifyMerge verifies the merged winner and, if it fails, the next-best
+// candidate results in quality order. It returns the first candidate that
+// passes together with its merge source. When no test commands are known the
+// winner is returned unverified.
+func (v *Verifier) VerifyMerge(ctx context.Context, spec TaskSpec, merge MergeResult, source string, results []ModelResult) (MergeResult, string, []TraceVerification, error) {
+	commands := v.verifyCommands(spec, merge)
+	if len(commands) == 0 {
+		return merge, source, nil, nil
+	}
+	var runs []TraceVerification
+	for i, c := range verifyCandidates(merge, source, results, v.maxCandidates) {
+		if ctx.Err() != nil {
+			return MergeResult{}, "", runs, ctx.Err()
+		}
+		run := v.Verify(ctx, c.label, c.merge.Diff, commands)
+		runs = append(runs, run)
+		if run.Passed {
+			if i > 0 {
+				v.mu.Lock()
+				v.fallbacks++
+				v.mu.Unlock()
+			}
+			return c.merge, c.source, runs, nil
+		}
+	}
+	return MergeResult{}, "", runs, errors.New("no candidate passed verification (" + strconv.Itoa(len(runs)) + " tried)")
+}
+
+// verifyCandidates orders the candidates to verify: the merged winner, then
+// distinct model diffs by descending quality_score, at most max in total.
+func verifyCandidates(merge MergeResult, source string, results []ModelResult, max int) []verifyCandidate {
+	cands := []verifyCandidate{{label: source, source: source, merge: merge}}
+	seen := map[string]bool{strings.TrimSpace(merge.Diff): true}
+	ordered := append([]ModelResult{}, results...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return metricValue(ordered[i], "quality_score") > metricValue(ordered[j], "quality_score")
+	})
+	for _, r := range ordered {
+		if len(cands) >= max {
+			break
+		}
+		diff := strings.TrimSpace(r.Diff)
+		if diff == "" || seen[diff] {
+			continue
+		}
+		seen[diff] = true
+		cands = append(cands, verifyCandidate{
+			label:  "model:" + r.ModelID,
+			source: "verified_fallback",
+			merge: MergeResult{
+				SchemaVersion: schemaVersion,
+				Diff:          r.Diff,
+				Rationale:     "verified fallback: " + r.ModelID,
+				Confidence:    0.5,
+				QualityScore:  metricValue(r, "quality_score"),
+			},
+		})
+	}
+	return cands
+}
+
+// Verify applies diff to a fresh scratch copy of the workspace and runs the
+// commands in it, stopping at the first failure.
+func (v *Verifier) Verify(ctx context.Context, label string, diff string, commands []string) TraceVerification {
+	start := time.Now()
+	run := TraceVerification{Candidate: label}
+	ctx, span := tracing.Start(ctx, "verify "+label, tracing.KindInternal)
+	defer func() {
+		run.DurationMs = time.Since(start).Milliseconds()
+		outcome := verifyFailed
+		if run.Passed {
+			outcome = verifyPassed
+		} else if len(run.Commands) == 0 {
+			outcome = verifyError
+		}
+		v.mu.Lock()
+		v.outcomes[outcome]++
+		v.mu.Unlock()
+		span.SetAttr("outcome", outcome)
+		span.End(nil)
+	}()
+
+	if err := os.MkdirAll(v.scratch, 0o755); err != nil {
+		run.Error = "scratch dir: " + err.Error()
+		return run
+	}
+	dir, err := os.MkdirTemp(v.scratch, "verify-")
+	if err != nil {
+		run.Error = "scratch dir: " + err.Error()
+		return run
+	}
+	defer os.RemoveAll(dir)
+	if err := copyWorkspace(v.workspace, dir, v.scratch, v.maxBytes); err != nil {
+		run.Error = "copy workspace: " + err.Error()
+		return run
+	}
+	if err := applyWorkspaceDiff(dir, diff); err != nil {
+		run.Error = "apply diff: " + err.Error()
+		return run
+	}
+	run.Passed = true
+	for _, command := range commands {
+		res := v.runCommand(ctx, dir, command)
+		run.Commands = append(run.Commands, res)
+		if !res.Passed {
+			run.Passed = false
+			break
+		}
+	}
+	return run
+}
+
+func (v *Verifier) runCommand(ctx context.Context, dir string, command string) TraceVerifyCommand {
+	start := time.Now()
+	out := TraceVerifyCommand{Command: command, ExitCode: -1}
+	defer func() { out.DurationMs = time.Since(start).Milliseconds() }()
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		out.Error = "empty command"
+		return out
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"schema_version": schemaVersion,
+		"id":             "verify-" + randString(8),
+		"command":        fields[0],
+		"args":           fields[1:],
+		"timeout_ms":     v.timeout.Milliseconds(),
+		"dir":            dir,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.kernelURL+"/run", bytes.NewReader(body))
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		out.Error = "kernel status " + strconv.Itoa(resp.StatusCode) + ": " + strings.TrimSpace(string(msg))
+		return out
+	}
+	var res struct {
+		Allowed  bool   `json:"allowed"`
+		Output   string `json:"output"`
+		Error    string `json:"error"`
+		ExitCode int    `json:"exit_code"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		out.Error = "kernel response: " + err.Error()
+		return out
+	}
+	out.Output = outputExcerpt(res.Output, v.outputBytes)
+	out.Error = res.Error
+	if !res.Allowed {
+		if out.Error == "" {
+			out.Error = "command not allowed"
+		}
+		return out
+	}
+	out.ExitCode = res.ExitCode
+	out.Passed = res.ExitCode == 0 && res.Error == ""
+	return out
+}
+
+// Stats returns verification counts by outcome and how many tasks were
+// completed with a fallback candidate.
+func (v *Verifier) Stats() (map[string]int, int) {
+	outcomes := map[string]int{}
+	if v == nil {
+		return outcomes, 0
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for k, n := range v.outcomes {
+		outcomes[k] = n
+	}
+	return outcomes, v.fallbacks
+}
+
+// outputExcerpt keeps the tail of command output, where test failures are
+// reported.
+func outputExcerpt(s string, max int) string {
+	if max <= 0 || len(s) <= max {
+		return s
+	}
+	return "..." + s[len(s)-max:]
+}
+
+// copyWorkspace copies the files and symlinks under src into dst with their
+// modes, skipping VCS and data directories as well as the scratch root
+// itself. It gives up once the files add up to more than maxBytes (0 means
+// no limit).
+func copyWorkspace(src string, dst string, scratch string, maxBytes int64) error {
+	skip, _ := filepath.Abs(scratch)
+	var copied int64
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != src && verifySkipDirs[d.Name()] {
+				return filepath.SkipDir
+			}
+			if abs, _ := filepath.Abs(path); abs == skip {
+				return filepath.SkipDir
+			}
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0o700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !d.Type().IsRegular():
+			return nil
+		}
+		copied += info.Size()
+		if maxBytes > 0 && copied > maxBytes {
+			return errors.New("workspace is larger than " + strconv.FormatInt(maxBytes, 10) + " bytes")
+		}
+		return copyFile(path, target, info.Mode().Perm())
+	})
+}
+
+func copyFile(src string, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// noSymlinks rejects a workspace path that is, or passes through, a symlink,
+// so a diff cannot write outside the scratch copy.
+func noSymlinks(root string, rel string) error {
+	cur := root
+	for _, part := range strings.Split(rel, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		cur = filepath.Join(cur, part)
+		info, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return errors.New(rel + ": path goes through a symlink")
+		}
+	}
+	return nil
+}
+
+// applyWorkspaceDiff applies a unified diff to the files under root.
+func applyWorkspaceDiff(root string, diff string) error {
+	files, err := internal.ParseUnifiedDiff(diff)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("diff touches no files")
+	}
+	for _, f := range files {
+		rel, ok := workspacePath(f.Path())
+		if !ok {
+			return errors.New(f.Path() + ": path outside workspace")
+		}
+		target := filepath.Join(root, filepath.FromSlash(rel))
+		if f.NewPath == "/dev/null" {
+			// Removing a symlink removes the link, so only its parents
+			// must be real directories.
+			parent := ""
+			if i := strings.LastIndex(rel, "/"); i >= 0 {
+				parent = rel[:i]
+			}
+			if err := noSymlinks(root, parent); err != nil {
+				return err
+			}
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+			continue
+		}
+		source := target
+		if f.OldPath != "" && f.OldPath != "/dev/null" && f.OldPath != f.NewPath {
+			oldRel, ok := workspacePath(f.OldPath)
+			if !ok {
+				return errors.New(f.OldPath + ": path outside workspace")
+			}
+			if err := noSymlinks(root, oldRel); err != nil {
+				return err
+			}
+			source = filepath.Join(root, filepath.FromSlash(oldRel))
+		}
+		if err := noSymlinks(root, rel); err != nil {
+			return err
+		}
+		original := ""
+		mode := fs.FileMode(0o644)
+		if f.OldPath != "/dev/null" {
+			info, err := os.Stat(source)
+			if err != nil {
+				return err
+			}
+			mode = info.Mode().Perm()
+			data, err := os.ReadFile(source)
+			if err != nil {
+				return err
+			}
+			original = string(data)
+		}
+		updated, err := internal.ApplyDiff(f, original)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, []byte(updated), mode); err != nil {
+			return err
+		}
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+		if source != target {
+			if err := os.Remove(source); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"rechain-ide/orchestrator/internal"
+)
+
+// newFakeKernel fails any run whose working directory contains a file with
+// the word "broken" in it.
+func newFakeKernel(t *testing.T, calls *[]string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var spec struct {
+			Command string   `json:"command"`
+			Args    []string `json:"args"`
+			Dir     string   `json:"dir"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		*calls = append(*calls, spec.Command+" "+strings.Join(spec.Args, " "))
+		data, err := os.ReadFile(filepath.Join(spec.Dir, "calc.go"))
+		if err != nil {
+			writeJSON(w, map[string]interface{}{"allowed": true, "exit_code": 1, "output": err.Error(), "error": "exit status 1"})
+			return
+		}
+		if strings.Contains(string(data), "broken") {
+			writeJSON(w, map[string]interface{}{"allowed": true, "exit_code": 1, "output": "--- FAIL: TestCalc\nFAIL", "error": "exit status 1"})
+			return
+		}
+		writeJSON(w, map[string]interface{}{"allowed": true, "exit_code": 0, "output": "ok"})
+	}))
+}
+
+func testVerifier(t *testing.T, kernelURL string, commands []string) *Verifier {
+	t.Helper()
+	workspace := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workspace, "calc.go"), []byte("package calc\n\nfunc Add(a, b int) int { return a - b }\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return NewVerifier(kernelURL, workspace, t.TempDir(), time.Second, 16, 3, 0, commands)
+}
+
+func calcDiff(t *testing.T, body string) string {
+	t.Helper()
+	return internal.UnifiedDiff("calc.go", "package calc\n\nfunc Add(a, b int) int { return a - b }\n", "package calc\n\nfunc Add(a, b int) int { "+body+" }\n")
+}
+
+func TestVerifyMerge_FallsBackToNextBestCandidate(t *testing.T) {
+	var calls []string
+	kernel := newFakeKernel(t, &calls)
+	defer kernel.Close()
+	v := testVerifier(t, kernel.URL, nil)
+
+	broken := calcDiff(t, "return broken")
+	fixed := calcDiff(t, "return a + b")
+	results := []ModelResult{
+		{ModelID: "low", Diff: calcDiff(t, "return 0"), Metrics: []Metric{{Name: "quality_score", Value: 0.2}}},
+		{ModelID: "high", Diff: fixed, Metrics: []Metric{{Name: "quality_score", Value: 0.9}}},
+		{ModelID: "winner", Diff: broken, Metrics: []Metric{{Name: "quality_score", Value: 0.5}}},
+	}
+	merge := MergeResult{SchemaVersion: schemaVersion, Diff: broken, Tests: []string{"go test ./..."}}
+
+	got, source, runs, err := v.VerifyMerge(context.Background(), TaskSpec{}, merge, "agent_compiler", results)
+	if err != nil {
+		t.Fatalf("expected a fallback to pass, got %v", err)
+	}
+	if source != "verified_fallback" || got.Diff != fixed {
+		t.Fatalf("expected the high-quality fallback, got %s %q", source, got.Diff)
+	}
+	if len(runs) != 2 || runs[0].Candidate != "agent_compiler" || runs[0].Passed || runs[1].Candidate != "model:high" || !runs[1].Passed {
+		t.Fatalf("unexpected verification trace: %+v", runs)
+	}
+	failed := runs[0].Commands[0]
+	if failed.ExitCode != 1 || failed.Output != "...L: TestCalc\nFAIL" {
+		t.Fatalf("expected failing exit code and output tail, got %+v", failed)
+	}
+	if len(calls) != 2 || calls[0] != "go test ./..." {
+		t.Fatalf("unexpected kernel calls: %v", calls)
+	}
+	outcomes, fallbacks := v.Stats()
+	if outcomes[verifyPassed] != 1 || outcomes[verifyFailed] != 1 || fallbacks != 1 {
+		t.Fatalf("unexpected stats %v fallbacks=%d", outcomes, fallbacks)
+	}
+}
+
+func TestVerifyMerge_CommandSourcesAndFailure(t *testing.T) {
+	var calls []string
+	kernel := newFakeKernel(t, &calls)
+	defer kernel.Close()
+
+	broken := calcDiff(t, "return broken")
+	merge := MergeResult{SchemaVersion: schemaVersion, Diff: broken, Tests: []string{"go test ./..."}}
+	results := []ModelResult{{ModelID: "only", Diff: broken}}
+
+	unconfigured := testVerifier(t, kernel.URL, nil)
+	got, source, runs, err := unconfigured.VerifyMerge(context.Background(), TaskSpec{}, MergeResult{Diff: broken}, "policy_merge", results)
+	if err != nil || source != "policy_merge" || got.Diff != broken || len(runs) != 0 {
+		t.Fatalf("expected no verification without commands, got %s %+v %v", source, runs, err)
+	}
+
+	v := testVerifier(t, kernel.URL, []string{"make check"})
+	spec := TaskSpec{Constraints: []Constraint{{Key: "verify_commands", Value: "go vet ./...,go test -run TestCalc ./..."}}}
+	_, _, runs, err = v.VerifyMerge(context.Background(), spec, merge, "agent_compiler", results)
+	if err == nil {
+		t.Fatal("expected verification to fail when every candidate fails")
+	}
+	if len(runs) != 1 || len(runs[0].Commands) != 1 {
+		t.Fatalf("expected duplicate diffs to be verified once and to stop at the first failure, got %+v", runs)
+	}
+	if calls[len(calls)-1] != "go vet ./..." {
+		t.Fatalf("expected verify_commands to take precedence, got %v", calls)
+	}
+
+	unapplicable := MergeResult{Diff: internal.UnifiedDiff("calc.go", "unrelated\n", "changed\n"), Tests: []string{"go test ./..."}}
+	_, _, runs, _ = v.VerifyMerge(context.Background(), TaskSpec{}, unapplicable, "hunk_merge", nil)
+	if len(runs) != 1 || runs[0].Passed || !strings.HasPrefix(runs[0].Error, "apply diff:") {
+		t.Fatalf("expected an apply error, got %+v", runs)
+	}
+}
+
+func TestCopyWorkspace_KeepsModesAndSymlinks(t *testing.T) {
+	src := t.TempDir()
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh\necho ok\n"), 0o755)
+	os.WriteFile(filepath.Join(src, "calc.go"), []byte("package calc\n"), 0o600)
+	os.Symlink("calc.go", filepath.Join(src, "alias.go"))
+	os.Symlink(outside, filepath.Join(src, "shared"))
+
+	dst := t.TempDir()
+	if err := copyWorkspace(src, dst, t.TempDir(), 0); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	for name, want := range map[string]os.FileMode{"run.sh": 0o755, "calc.go": 0o600} {
+		if info, err := os.Stat(filepath.Join(dst, name)); err != nil || info.Mode().Perm() != want {
+			t.Fatalf("%s: expected mode %v, got %v (%v)", name, want, info, err)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "alias.go")); err != nil || link != "calc.go" {
+		t.Fatalf("expected the symlink to be copied, got %q %v", link, err)
+	}
+
+	diff := internal.UnifiedDiff("run.sh", "#!/bin/sh\necho ok\n", "#!/bin/sh\necho fixed\n")
+	if err := applyWorkspaceDiff(dst, diff); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if info, _ := os.Stat(filepath.Join(dst, "run.sh")); info.Mode().Perm() != 0o755 {
+		t.Fatalf("expected the patched script to stay executable, got %v", info.Mode())
+	}
+	escape := internal.UnifiedDiff("shared/x.go", "", "package x\n")
+	if err := applyWorkspaceDiff(dst, escape); err == nil || !strings.Contains(err.Error(), "symlink") {
+		t.Fatalf("expected a write through a symlink to be refused, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "x.go")); !os.IsNotExist(err) {
+		t.Fatal("the diff wrote outside the scratch workspace")
+	}
+
+	if err := copyWorkspace(src, t.TempDir(), t.TempDir(), 16); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("expected the size limit to stop the copy, got %v", err)
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed    = "failed"
+)
+
+// WebhookAttempt is one POST to a callback URL.
+type WebhookAttempt struct {
+	Attempt    int    `json:"attempt"`
+	At         string `json:"at"`
+	StatusCode int    `json:"status_code,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// WebhookDelivery tracks the notification of one terminal task state.
+type WebhookDelivery struct {
+	ID            string           `json:"id"`
+	TaskID        string           `json:"task_id"`
+	Event         string           `json:"event"`
+	URL           string           `json:"url"`
+	Signed        bool             `json:"signed"`
+	State         string           `json:"state"`
+	Attempts      []WebhookAttempt `json:"attempts"`
+	NextAttemptAt string           `json:"next_attempt_at,omitempty"`
+	Error         string           `json:"error,omitempty"`
+}
+
+// WebhookTraceSummary is the part of TaskTrace a callback receiver needs.
+type WebhookTraceSummary struct {
+	Requester     string   `json:"requester,omitempty"`
+	ParentTaskID  string   `json:"parent_task_id,omitempty"`
+	RoutingPolicy string   `json:"routing_policy"`
+	Selected      []string `json:"selected_models,omitempty"`
+	Succeeded     []string `json:"succeeded_models,omitempty"`
+	MergeSource   string   `json:"merge_source,omitempty"`
+	StartedAt     string   `json:"started_at"`
+	FinishedAt    string   `json:"finished_at,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// WebhookPayload is the body POSTed to callback_url.
+type WebhookPayload struct {
+	SchemaVersion string              `json:"schema_version"`
+	Event         string              `json:"event"`
+	DeliveryID    string              `json:"delivery_id"`
+	TaskID        string              `json:"task_id"`
+	Status        TaskStatus          `json:"status"`
+	Result        *MergeResult        `json:"result,omitempty"`
+	Trace         WebhookTraceSummary `json:"trace"`
+}
+
+type webhookJob struct {
+	delivery *WebhookDelivery
+	body     []byte
+	secret   string
+}
+
+// WebhookDispatcher POSTs final task states to the callback_url of the task,
+// retrying with exponential backoff. Deliveries are kept in memory; the
+// oldest tasks' deliveries are dropped beyond maxTasks.
+type WebhookDispatcher struct {
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	secret      string
+	maxTasks    int
+	policy      *callbackPolicy
+
+	mu         sync.Mutex
+	deliveries map[string][]*WebhookDelivery
+	order      []string
+	outcomes   map[string]int
+	attempts   map[string]int
+	wg         sync.WaitGroup
+}
+
+func NewWebhookDispatcher(timeout time.Duration, maxAttempts int, backoff time.Duration, maxBackoff time.Duration, secret string, maxTasks int) *WebhookDispatcher {
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+	return &WebhookDispatcher{
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		maxBackoff:  maxBackoff,
+		secret:      secret,
+		maxTasks:    maxTasks,
+		deliveries:  map[string][]*WebhookDelivery{},
+		outcomes:    map[string]int{},
+		attempts:    map[string]int{},
+	}
+}
+
+func webhookDispatcherFromEnv() (*WebhookDispatcher, error) {
+	d := NewWebhookDispatcher(
+		time.Duration(envInt("ORCH_WEBHOOK_TIMEOUT_MS", 5000))*time.Millisecond,
+		envInt("ORCH_WEBHOOK_MAX_ATTEMPTS", 5),
+		time.Duration(envInt("ORCH_WEBHOOK_BACKOFF_MS", 500))*time.Millisecond,
+		time.Duration(envInt("ORCH_WEBHOOK_BACKOFF_MAX_MS", 30000))*time.Millisecond,
+		os.Getenv("ORCH_WEBHOOK_SECRET"),
+		envInt("ORCH_WEBHOOK_MAX_TASKS", 1000),
+	)
+	policy, err := parseCallbackPolicy(os.Getenv("ORCH_WEBHOOK_ALLOW_HOSTS"), os.Getenv("ORCH_WEBHOOK_DENY_HOSTS"))
+	if err != nil {
+		return nil, err
+	}
+	d.restrict(policy)
+	return d, nil
+}
+
+// errCallbackRefused marks deliveries the host policy refused; they are not
+// retried.
+var errCallbackRefused = errors.New("webhook refused")
+
+// restrict makes the dispatcher refuse callback hosts the policy rejects,
+// both when a task is submitted and when a delivery connects.
+func (d *WebhookDispatcher) restrict(policy *callbackPolicy) {
+	d.policy = policy
+	d.client.Transport = &http.Transport{DialContext: policy.dial, TLSHandshakeTimeout: 10 * time.Second}
+}
+
+// callbackURL returns the task's callback_url constraint, or the one in
+// metadata.
+func callbackURL(spec TaskSpec) string {
+	if u := strings.TrimSpace(constraintString(spec.Constraints, "callback_url")); u != "" {
+		return u
+	}
+	return strings.TrimSpace(spec.Metadata.CallbackURL)
+}
+
+func callbackSecret(spec TaskSpec) string {
+	if s := constraintString(spec.Constraints, "callback_secret"); s != "" {
+		return s
+	}
+	return spec.Metadata.CallbackSecret
+}
+
+// splitCallbackSecret removes the callback secret from spec, so it is neither
+// persisted nor shown to drivers, and returns it separately.
+func splitCallbackSecret(spec TaskSpec) (TaskSpec, string) {
+	secret := callbackSecret(spec)
+	if secret == "" {
+		return spec, ""
+	}
+	constraints := []Constraint{}
+	for _, c := range spec.Constraints {
+		if c.Key != "callback_secret" {
+			constraints = append(constraints, c)
+		}
+	}
+	spec.Constraints = constraints
+	spec.Metadata.CallbackSecret = ""
+	return spec, secret
+}
+
+// validateCallbackURL rejects callback URLs that are not absolute http(s).
+func validateCallbackURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return errors.New("invalid callback_url: " + err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid callback_url: must be an absolute http(s) URL")
+	}
+	return nil
+}
+
+// ValidateCallbackURL checks raw like validateCallbackURL and, for a literal
+// address or a listed host, against the dispatcher's host policy.
+func (d *WebhookDispatcher) ValidateCallbackURL(raw string) error {
+	if err := validateCallbackURL(raw); err != nil || raw == "" || d == nil || d.policy == nil {
+		return err
+	}
+	u, _ := url.Parse(raw)
+	if err := d.policy.checkHost(u.Hostname()); err != nil {
+		return errors.New("invalid callback_url: " + err.Error())
+	}
+	return nil
+}
+
+// callbackPolicy decides which hosts webhooks may be sent to. Loopback,
+// private, link-local and unspecified addresses are refused unless a host
+// name or CIDR in allow matches; hosts and CIDRs in deny are always refused.
+type callbackPolicy struct {
+	allowHosts map[string]bool
+	allowNets  []*net.IPNet
+	denyHosts  map[string]bool
+	denyNets   []*net.IPNet
+}
+
+// parseCallbackPolicy reads comma-separated host names and CIDRs.
+func parseCallbackPolicy(allow string, deny string) (*callbackPolicy, error) {
+	p := &callbackPolicy{allowHosts: map[string]bool{}, denyHosts: map[string]bool{}}
+	for _, item := range splitCSV(allow) {
+		if err := addCallbackRule(item, p.allowHosts, &p.allowNets); err != nil {
+			return nil, err
+		}
+	}
+	for _, item := range splitCSV(deny) {
+		if err := addCallbackRule(item, p.denyHosts, &p.denyNets); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func addCallbackRule(item string, hosts map[string]bool, nets *[]*net.IPNet) error {
+	item = strings.ToLower(strings.TrimSpace(item))
+	if !strings.Contains(item, "/") {
+		hosts[strings.TrimSuffix(item, ".")] = true
+		return nil
+	}
+	_, n, err := net.ParseCIDR(item)
+	if err != nil {
+		return errors.New("invalid webhook host rule " + item + ": " + err.Error())
+	}
+	*nets = append(*nets, n)
+	return nil
+}
+
+func inNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost vets a callback host by name: denied names, localhost and
+// literal addresses the policy refuses are rejected without a lookup.
+func (p *callbackPolicy) checkHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case p.denyHosts[host]:
+		return errors.New("host " + host + " is denied")
+	case p.allowHosts[host]:
+		return nil
+	case host == "localhost" || strings.HasSuffix(host, ".localhost"):
+		return errors.New("host " + host + " is loopback")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+	return nil
+}
+
+// checkIP vets an address a callback host resolved to.
+func (p *callbackPolicy) checkIP(ip net.IP) error {
+	switch {
+	case inNets(p.denyNets, ip):
+		return errors.New("address " + ip.String() + " is denied")
+	case inNets(p.allowNets, ip):
+		return nil
+	case ip.IsLoopback(), ip.IsPrivate(), ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast(), ip.IsUnspecified():
+		return errors.New("address " + ip.String() + " is not public")
+	}
+	return nil
+}
+
+// dial connects to a callback host after vetting every address it resolves
+// to, so a public name cannot point deliveries at an internal service.
+func (p *callbackPolicy) dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkHost(host); err != nil {
+		return nil, fmt.Errorf("%w: %v", errCallbackRefused, err)
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if p.allowHosts[strings.ToLower(strings.TrimSuffix(host, "."))] {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if err := p.checkIP(ip.IP); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", errCallbackRefused, host, err)
+		}
+	}
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].IP.String(), port))
+}
+
+// signWebhook returns the X-Rechain-Signature value for body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhookLocked queues the callback for a task that just reached a
+// terminal state. Each terminal state is delivered once. Callers must hold
+// s.mu.
+func (s *TaskStore) notifyWebhookLocked(id string) {
+	if s.webhooks == nil {
+		return
+	}
+	status := s.statuses[id]
+	if !isTerminalState(status.State) {
+		return
+	}
+	spec := s.specs[id]
+	target := callbackURL(spec)
+	if target == "" || validateCallbackURL(target) != nil {
+		return
+	}
+	trace := s.traces[id]
+	payload := WebhookPayload{
+		SchemaVersion: schemaVersion,
+		Event:         "task." + status.State,
+		TaskID:        id,
+		Status:        status,
+		Trace: WebhookTraceSummary{
+			Requester:     trace.Requester,
+			ParentTaskID:  trace.ParentTaskID,
+			RoutingPolicy: trace.RoutingPolicy,
+			Selected:      trace.Selected,
+			MergeSource:   trace.MergeSource,
+			StartedAt:     trace.StartedAt,
+			FinishedAt:    trace.FinishedAt,
+			Error:         trace.Error,
+		},
+	}
+	for _, r := range trace.Results {
+		payload.Trace.Succeeded = append(payload.Trace.Succeeded, r.ModelID)
+	}
+	if res, ok := s.results[id]; ok {
+		payload.Result = &res
+	}
+	secret, ok := s.callbackSecrets[id]
+	if !ok {
+		secret = callbackSecret(spec)
+	}
+	if secret == "" && s.signedCallbacks[id] {
+		// Never fall back to the global secret for a task that brought its
+		// own.
+		s.webhooks.Fail(payload, target, "callback secret unavailable")
+		return
+	}
+	s.webhooks.Enqueue(payload, target, secret)
+}
+
+// Enqueue starts delivering payload unless this task state was already
+// delivered (or is being delivered).
+func (d *WebhookDispatcher) Enqueue(payload WebhookPayload, target string, secret string) {
+	if secret == "" {
+		secret = d.secret
+	}
+	delivery := d.add(payload, target, secret != "")
+	if delivery == nil {
+		return
+	}
+
+	payload.DeliveryID = delivery.ID
+	body, err := json.Marshal(payload)
+	if err != nil {
+		d.finish(delivery, webhookFailed)
+		return
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.deliver(webhookJob{delivery: delivery, body: body, secret: secret})
+	}()
+}
+
+// Fail records a delivery of payload that is not attempted, failed with
+// reason, unless this task state was already delivered.
+func (d *WebhookDispatcher) Fail(payload WebhookPayload, target string, reason string) {
+	delivery := d.add(payload, target, false)
+	if delivery == nil {
+		return
+	}
+	d.mu.Lock()
+	delivery.Error = reason
+	d.mu.Unlock()
+	d.finish(delivery, webhookFailed)
+}
+
+// add records a pending delivery of payload, or returns nil when this task
+// state already has one.
+func (d *WebhookDispatcher) add(payload WebhookPayload, target string, signed bool) *WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	existing, seen := d.deliveries[payload.TaskID]
+	for _, delivery := range existing {
+		if delivery.Event == payload.Event {
+			return nil
+		}
+	}
+	if !seen {
+		d.order = append(d.order, payload.TaskID)
+		for d.maxTasks > 0 && len(d.order) > d.maxTasks {
+			delete(d.deliveries, d.order[0])
+			d.order = d.order[1:]
+		}
+	}
+	delivery := &WebhookDelivery{
+		ID:     "whd_" + randString(10),
+		TaskID: payload.TaskID,
+		Event:  payload.Event,
+		URL:    target,
+		Signed: signed,
+		State:  webhookPending,
+	}
+	d.deliveries[payload.TaskID] = append(d.deliveries[payload.TaskID], delivery)
+	return delivery
+}
+
+func (d *WebhookDispatcher) deliver(job webhookJob) {
+	wait := d.backoff
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		rec, retryable := d.post(job, attempt)
+		d.mu.Lock()
+		job.delivery.Attempts = append(job.delivery.Attempts, rec)
+		outcome := "error"
+		if rec.Error == "" {
+			outcome = "ok"
+		}
+		d.attempts[outcome]++
+		last := rec.Error == "" || !retryable || attempt == d.maxAttempts
+		if !last {
+			job.delivery.NextAttemptAt = time.Now().Add(wait).UTC().Format(time.RFC3339Nano)
+		}
+		d.mu.Unlock()
+		if rec.Error == "" {
+			d.finish(job.delivery, webhookDelivered)
+			return
+		}
+		if last {
+			break
+		}
+		time.Sleep(wait)
+		wait *= 2
+		if d.maxBackoff > 0 && wait > d.maxBackoff {
+			wait = d.maxBackoff
+		}
+	}
+	d.finish(job.delivery, webhookFailed)
+}
+
+// post makes one delivery attempt. Client errors other than 408 and 429, and
+// hosts the policy refuses, are not retried.
+func (d *WebhookDispatcher) post(job webhookJob, attempt int) (WebhookAttempt, bool) {
+	rec := WebhookAttempt{Attempt: attempt, At: time.Now().UTC().Format(time.RFC3339Nano)}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), d.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.delivery.URL, bytes.NewReader(job.body))
+	if err != nil {
+		rec.Error = err.Error()
+		return rec, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "rechain-orchestrator-webhook")
+	req.Header.Set("X-Rechain-Event", job.delivery.Event)
+	req.Header.Set("X-Rechain-Delivery", job.delivery.ID)
+	req.Header.Set("X-Rechain-Attempt", strconv.Itoa(attempt))
+	if job.secret != "" {
+		req.Header.Set("X-Rechain-Signature", signWebhook(job.secret, job.body))
+	}
+	resp, err := d.client.Do(req)
+	rec.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		rec.Error = err.Error()
+		return rec, !errors.Is(err, errCallbackRefused)
+	}
+	resp.Body.Close()
+	rec.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return rec, false
+	}
+	rec.Error = "unexpected status " + strconv.Itoa(resp.StatusCode)
+	retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return rec, retryable
+}
+
+func (d *WebhookDispatcher) finish(delivery *WebhookDelivery, state string) {
+	d.mu.Lock()
+	delivery.State = state
+	delivery.NextAttemptAt = ""
+	d.outcomes[state]++
+	d.mu.Unlock()
+}
+
+// Deliveries returns copies of the deliveries recorded for a task.
+func (d *WebhookDispatcher) Deliveries(taskID string) []WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := []WebhookDelivery{}
+	for _, delivery := range d.deliveries[taskID] {
+		c := *delivery
+		c.Attempts = append([]WebhookAttempt{}, delivery.Attempts...)
+		out = append(out, c)
+	}
+	return out
+}
+
+// Stats returns finished deliveries by state, attempts by outcome and the
+// number of deliveries still pending.
+func (d *WebhookDispatcher) Stats() (map[string]int, map[string]int, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	outcomes := map[string]int{}
+	for k, v := range d.outcomes {
+		outcomes[k] = v
+	}
+	attempts := map[string]int{}
+	for k, v := range d.attempts {
+		attempts[k] = v
+	}
+	pending := 0
+	for _, list := range d.deliveries {
+		for _, delivery := range list {
+			if delivery.State == webhookPending {
+				pending++
+			}
+		}
+	}
+	return outcomes, attempts, pending
+}
+
+// Wait blocks until every queued delivery finished.
+func (d *WebhookDispatcher) Wait() {
+	d.wg.Wait()
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery_RetriesAndSigns(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	var got WebhookPayload
+	var signature string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &got)
+		signature = r.Header.Get("X-Rechain-Signature")
+		if want := signWebhook("s3cret", body); signature != want {
+			t.Errorf("signature %q, want %q", signature, want)
+		}
+	}))
+	defer srv.Close()
+
+	store := NewTaskStore()
+	store.webhooks = NewWebhookDispatcher(time.Second, 3, 10*time.Millisecond, 50*time.Millisecond, "", 0)
+	store.mu.Lock()
+	store.specs["task_hook"] = TaskSpec{ID: "task_hook", Constraints: []Constraint{
+		{Key: "callback_url", Value: srv.URL},
+		{Key: "callback_secret", Value: "s3cret"},
+	}}
+	store.mu.Unlock()
+	setTaskState(store, "task_hook", "running")
+	trace := TaskTrace{TaskID: "task_hook", Selected: []string{"model_a"}, MergeSource: "best_single"}
+	store.completeRun("task_hook", "completed", trace, &MergeResult{Diff: "diff"}, nil)
+	store.completeRun("task_hook", "completed", trace, &MergeResult{Diff: "diff"}, nil)
+	store.webhooks.Wait()
+
+	if calls != 2 {
+		t.Fatalf("expected one retry after a 502, got %d calls", calls)
+	}
+	if got.Event != "task.completed" || got.Status.State != "completed" || got.Result == nil || got.Trace.MergeSource != "best_single" {
+		t.Fatalf("unexpected payload: %+v", got)
+	}
+	deliveries := store.webhooks.Deliveries("task_hook")
+	if len(deliveries) != 1 {
+		t.Fatalf("expected the terminal state to be delivered once, got %d", len(deliveries))
+	}
+	d := deliveries[0]
+	if d.State != webhookDelivered || !d.Signed || len(d.Attempts) != 2 || d.Attempts[0].StatusCode != 502 || d.ID != got.DeliveryID {
+		t.Fatalf("unexpected delivery record: %+v", d)
+	}
+}
+
+func TestWebhookDelivery_GivesUp(t *testing.T) {
+	cases := []struct {
+		name     string
+		status   int
+		attempts int
+	}{
+		{"client error is not retried", http.StatusBadRequest, 1},
+		{"rate limited is retried", http.StatusTooManyRequests, 3},
+		{"server error exhausts attempts", http.StatusInternalServerError, 3},
+	}
+	for _, tc := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Rechain-Signature") != "" {
+				t.Errorf("%s: unsigned delivery carried a signature", tc.name)
+			}
+			w.WriteHeader(tc.status)
+		}))
+		d := NewWebhookDispatcher(time.Second, 3, time.Millisecond, 5*time.Millisecond, "", 0)
+		d.Enqueue(WebhookPayload{TaskID: "task_x", Event: "task.failed"}, srv.URL, "")
+		d.Wait()
+		srv.Close()
+
+		got := d.Deliveries("task_x")[0]
+		if got.State != webhookFailed || len(got.Attempts) != tc.attempts {
+			t.Errorf("%s: state %s after %d attempts, want failed after %d", tc.name, got.State, len(got.Attempts), tc.attempts)
+		}
+	}
+}
+
+func TestValidateCallbackURL(t *testing.T) {
+	for raw, ok := range map[string]bool{
+		"":                          true,
+		"https://ci.example/hook":   true,
+		"http://10.0.0.5:9000/done": true,
+		"ftp://ci.example/hook":     false,
+		"/relative":                 false,
+		"https://":                  false,
+	} {
+		if err := validateCallbackURL(raw); (err == nil) != ok {
+			t.Errorf("%q: got err %v", raw, err)
+		}
+	}
+}
+
+func TestCallbackPolicy(t *testing.T) {
+	policy, err := parseCallbackPolicy("hooks.internal, 10.1.0.0/16", "evil.example,203.0.113.0/24")
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+	d := NewWebhookDispatcher(time.Second, 3, time.Millisecond, 5*time.Millisecond, "", 0)
+	d.restrict(policy)
+	for raw, ok := range map[string]bool{
+		"https://ci.example/hook":         true,
+		"http://hooks.internal:8080/done": true,
+		"http://10.1.2.3/done":            true,
+		"http://10.0.0.5:9000/done":       false,
+		"http://127.0.0.1:8080/hook":      false,
+		"http://[::1]/hook":               false,
+		"http://localhost/hook":           false,
+		"http://169.254.169.254/latest":   false,
+		"https://evil.example/hook":       false,
+		"http://203.0.113.9/hook":         false,
+		"ftp://ci.example/hook":           false,
+	} {
+		if err := d.ValidateCallbackURL(raw); (err == nil) != ok {
+			t.Errorf("%q: got err %v", raw, err)
+		}
+	}
+	if _, err := parseCallbackPolicy("10.0.0.0/33", ""); err == nil {
+		t.Error("expected an invalid CIDR to be rejected")
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("a loopback callback was delivered")
+	}))
+	defer srv.Close()
+	d.Enqueue(WebhookPayload{TaskID: "task_local", Event: "task.completed"}, srv.URL, "")
+	d.Wait()
+	got := d.Deliveries("task_local")[0]
+	if got.State != webhookFailed || len(got.Attempts) != 1 || !strings.Contains(got.Attempts[0].Error, "webhook refused") {
+		t.Fatalf("expected one refused attempt, got %+v", got)
+	}
+}
+
+func TestWebhookDispatcher_BoundsDeliveries(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	d := NewWebhookDispatcher(time.Second, 1, time.Millisecond, time.Millisecond, "", 2)
+	for _, id := range []string{"task_1", "task_2", "task_3"} {
+		d.Enqueue(WebhookPayload{TaskID: id, Event: "task.completed"}, srv.URL, "")
+	}
+	d.Wait()
+	if len(d.Deliveries("task_1")) != 0 || len(d.Deliveries("task_2")) != 1 || len(d.Deliveries("task_3")) != 1 {
+		t.Fatalf("expected only the newest 2 tasks to be kept, got %d tasks", len(d.deliveries))
+	}
+	if outcomes, _, _ := d.Stats(); outcomes[webhookDelivered] != 3 {
+		t.Fatalf("expected evicted deliveries to stay counted, got %+v", outcomes)
+	}
+}
+
+func TestSubmitTask_KeepsCallbackSecretOutOfSpec(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.db")
+	backend, err := OpenBoltTaskBackend(path)
+	if err != nil {
+		t.Fatalf("open backend: %v", err)
+	}
+	store := NewTaskStore()
+	store.AttachBackend(backend)
+	spec := TaskSpec{ID: "task_secret", Metadata: Metadata{CallbackSecret: "meta"}, Constraints: []Constraint{
+		{Key: "callback_url", Value: "https://ci.example/hook"},
+		{Key: "callback_secret", Value: "s3cret"},
+	}}
+	if _, err := submitTask(store, NewTaskQueue(10, time.Hour), &Metrics{}, spec, TaskTrace{}); err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	store.Flush()
+	records, err := backend.LoadAll()
+	backend.Close()
+	if err != nil || len(records) != 1 {
+		t.Fatalf("load records: %v", err)
+	}
+	if got := callbackSecret(records[0].Spec); got != "" {
+		t.Fatalf("expected no persisted secret, got %q", got)
+	}
+	if callbackURL(records[0].Spec) != "https://ci.example/hook" || store.callbackSecrets["task_secret"] != "s3cret" {
+		t.Fatalf("expected the callback URL persisted and the secret kept in memory, got %+v", records[0].Spec)
+	}
+
+	// After a restart the secret is gone; the webhook must not go out with
+	// the fallback secret.
+	restarted := NewTaskStore()
+	restarted.webhooks = NewWebhookDispatcher(time.Second, 1, time.Millisecond, time.Millisecond, "fallback", 0)
+	backend, err = OpenBoltTaskBackend(path)
+	if err != nil {
+		t.Fatalf("reopen backend: %v", err)
+	}
+	defer backend.Close()
+	if _, err := restarted.AttachBackend(backend); err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	defer restarted.Flush()
+	restarted.completeRun("task_secret", "completed", TaskTrace{TaskID: "task_secret"}, &MergeResult{Diff: "diff"}, nil)
+	restarted.webhooks.Wait()
+	deliveries := restarted.webhooks.Deliveries("task_secret")
+	if len(deliveries) != 1 || deliveries[0].State != webhookFailed || deliveries[0].Error != "callback secret unavailable" || len(deliveries[0].Attempts) != 0 {
+		t.Fatalf("expected a failed delivery without attempts, got %+v", deliveries)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxContextFileBytes = 512 * 1024
+
+// loadContextFiles reads the "file" context refs of a task from the workspace
+// root, keyed by their slash-separated relative path. Missing, oversized and
+// out-of-tree files are skipped.
+func loadContextFiles(root string, refs []ContextRef) map[string]string {
+	files := map[string]string{}
+	if root == "" {
+		return files
+	}
+	for _, ref := range refs {
+		if ref.Type != "" && ref.Type != "file" {
+			continue
+		}
+		rel, ok := workspacePath(ref.Path)
+		if !ok {
+			continue
+		}
+		if _, seen := files[rel]; seen {
+			continue
+		}
+		full := filepath.Join(root, filepath.FromSlash(rel))
+		info, err := os.Stat(full)
+		if err != nil || !info.Mode().IsRegular() || info.Size() > maxContextFileBytes {
+			continue
+		}
+		data, err := os.ReadFile(full)
+		if err != nil {
+			continue
+		}
+		files[rel] = string(data)
+	}
+	return files
+}
+
+// workspacePath normalizes a context path and rejects paths that would leave
+// the workspace root.
+func workspacePath(p string) (string, bool) {
+	p = strings.TrimSpace(filepath.ToSlash(p))
+	if p == "" || strings.HasPrefix(p, "/") || filepath.IsAbs(p) {
+		return "", false
+	}
+	clean := filepath.ToSlash(filepath.Clean(p))
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", false
+	}
+	return clean, true
+}
@@ -2,6 +2,13 @@ module rechain-ide/orchestrator
 
 go 1.21
 
+require (
+	go.etcd.io/bbolt v1.3.9
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 require rechain-ide/shared v0.0.0
 
+require golang.org/x/sys v0.4.0 // indirect
+
 replace rechain-ide/shared => ../shared
@@ -0,0 +1,405 @@
+﻿package internal
+
+import (
+  "errors"
+  "fmt"
+  "regexp"
+  "strconv"
+  "strings"
+)
+
+// DiffHunk is one @@ section of a unified diff. Lines keep their ' ', '+',
+// '-' or '\' prefix.
+type DiffHunk struct {
+  OldStart int
+  OldLines int
+  NewStart int
+  NewLines int
+  Section  string
+  Lines    []string
+}
+
+// FileDiff is the part of a unified diff that touches a single file.
+type FileDiff struct {
+  OldPath string
+  NewPath string
+  Extra   []string
+  Hunks   []DiffHunk
+}
+
+var hunkHeaderRe = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@ ?(.*)$`)
+
+var extendedHeaderPrefixes = []string{
+  "index ", "new file mode", "deleted file mode", "old mode", "new mode",
+  "similarity index", "dissimilarity index", "rename from", "rename to",
+  "copy from", "copy to",
+}
+
+// Path returns the path a file diff applies to, without a/ or b/ prefixes.
+func (f FileDiff) Path() string {
+  if f.NewPath != "" && f.NewPath != "/dev/null" {
+    return f.NewPath
+  }
+  return f.OldPath
+}
+
+// ParseUnifiedDiff parses text that starts with a unified diff. Parsing stops
+// at the first line that cannot belong to the diff, so trailing prose is
+// ignored. Hunk line counts are recomputed from the hunk bodies.
+func ParseUnifiedDiff(text string) ([]FileDiff, error) {
+  lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+  files := []FileDiff{}
+  var cur *FileDiff
+  flush := func() {
+    if cur != nil {
+      files = append(files, *cur)
+      cur = nil
+    }
+  }
+
+  i := 0
+  for i < len(lines) {
+    line := lines[i]
+    switch {
+    case strings.HasPrefix(line, "diff --git "):
+      flush()
+      oldPath, newPath := parseGitHeader(line)
+      cur = &FileDiff{OldPath: oldPath, NewPath: newPath}
+      i++
+    case cur != nil && len(cur.Hunks) == 0 && hasExtendedHeaderPrefix(line):
+      cur.Extra = append(cur.Extra, line)
+      i++
+    case isFileHeader(lines, i):
+      if cur == nil || len(cur.Hunks) > 0 {
+        flush()
+        cur = &FileDiff{}
+      }
+      cur.OldPath = stripDiffPath(strings.TrimPrefix(line, "--- "))
+      cur.NewPath = stripDiffPath(strings.TrimPrefix(lines[i+1], "+++ "))
+      i += 2
+    case strings.HasPrefix(line, "@@"):
+      if cur == nil || (cur.OldPath == "" && cur.NewPath == "") {
+        return nil, errors.New("hunk without file header")
+      }
+      hunk, next, err := parseHunk(lines, i)
+      if err != nil {
+        return nil, fmt.Errorf("%s: %v", cur.Path(), err)
+      }
+      cur.Hunks = append(cur.Hunks, hunk)
+      i = next
+    default:
+      if cur == nil && len(files) == 0 {
+        i++
+        continue
+      }
+      flush()
+      i = len(lines)
+    }
+  }
+  flush()
+
+  if len(files) == 0 {
+    return nil, errors.New("no file diffs found")
+  }
+  for _, f := range files {
+    if f.Path() == "" {
+      return nil, errors.New("file diff without path")
+    }
+    if len(f.Hunks) == 0 && !hasRenameOrMode(f.Extra) {
+      return nil, fmt.Errorf("%s: no hunks", f.Path())
+    }
+  }
+  return files, nil
+}
+
+func parseHunk(lines []string, start int) (DiffHunk, int, error) {
+  m := hunkHeaderRe.FindStringSubmatch(lines[start])
+  if m == nil {
+    return DiffHunk{}, start, fmt.Errorf("malformed hunk header %q", lines[start])
+  }
+  h := DiffHunk{
+    OldStart: atoiDefault(m[1], 0),
+    OldLines: atoiDefault(m[2], 1),
+    NewStart: atoiDefault(m[3], 0),
+    NewLines: atoiDefault(m[4], 1),
+    Section:  m[5],
+  }
+  wantOld, wantNew := h.OldLines, h.NewLines
+  gotOld, gotNew := 0, 0
+  blanks := 0
+  i := start + 1
+scan:
+  for ; i < len(lines); i++ {
+    line := lines[i]
+    if line == "" {
+      // Blank context lines often lose their leading space in model output.
+      if gotOld >= wantOld && gotNew >= wantNew {
+        return finishHunk(h, gotOld, gotNew, i)
+      }
+      line = " "
+      blanks++
+    } else if line[0] == ' ' || line[0] == '-' || line[0] == '+' || line[0] == '\\' {
+      blanks = 0
+    }
+    if isFileHeader(lines, i) {
+      break scan
+    }
+    switch line[0] {
+    case ' ':
+      gotOld++
+      gotNew++
+    case '-':
+      gotOld++
+    case '+':
+      gotNew++
+    case '\\':
+    default:
+      break scan
+    }
+    h.Lines = append(h.Lines, line)
+  }
+  // The header overstated the hunk: blank lines at its end separated the diff
+  // from whatever followed rather than being context.
+  h.Lines = h.Lines[:len(h.Lines)-blanks]
+  gotOld -= blanks
+  gotNew -= blanks
+  return finishHunk(h, gotOld, gotNew, i)
+}
+
+func finishHunk(h DiffHunk, gotOld int, gotNew int, next int) (DiffHunk, int, error) {
+  changes := 0
+  for _, l := range h.Lines {
+    if l[0] == '+' || l[0] == '-' {
+      changes++
+    }
+  }
+  if changes == 0 {
+    return DiffHunk{}, next, errors.New("hunk without changes")
+  }
+  h.OldLines, h.NewLines = gotOld, gotNew
+  return h, next, nil
+}
+
+func isFileHeader(lines []string, i int) bool {
+  if strings.HasPrefix(lines[i], "diff --git ") {
+    return true
+  }
+  return strings.HasPrefix(lines[i], "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ ")
+}
+
+func parseGitHeader(line string) (string, string) {
+  rest := strings.TrimPrefix(line, "diff --git ")
+  if idx := strings.Index(rest, " b/"); idx != -1 {
+    return stripDiffPath(rest[:idx]), stripDiffPath(rest[idx+1:])
+  }
+  parts := strings.Fields(rest)
+  if len(parts) == 2 {
+    return stripDiffPath(parts[0]), stripDiffPath(parts[1])
+  }
+  return "", ""
+}
+
+func stripDiffPath(p string) string {
+  p = strings.TrimSpace(p)
+  if idx := strings.Index(p, "\t"); idx != -1 {
+    p = p[:idx]
+  }
+  if p == "/dev/null" {
+    return p
+  }
+  if strings.HasPrefix(p, "a/") || strings.HasPrefix(p, "b/") {
+    return p[2:]
+  }
+  return p
+}
+
+func hasExtendedHeaderPrefix(line string) bool {
+  for _, p := range extendedHeaderPrefixes {
+    if strings.HasPrefix(line, p) {
+      return true
+    }
+  }
+  return false
+}
+
+func hasRenameOrMode(extra []string) bool {
+  for _, l := range extra {
+    if strings.HasPrefix(l, "rename ") || strings.HasSuffix(l, "mode") || strings.Contains(l, " mode ") {
+      return true
+    }
+  }
+  return false
+}
+
+func atoiDefault(s string, fallback int) int {
+  if s == "" {
+    return fallback
+  }
+  n, err := strconv.Atoi(s)
+  if err != nil {
+    return fallback
+  }
+  return n
+}
+
+// FormatUnifiedDiff renders file diffs as a git-style unified diff.
+func FormatUnifiedDiff(files []FileDiff) string {
+  var b strings.Builder
+  for _, f := range files {
+    oldPath, newPath := f.OldPath, f.NewPath
+    if oldPath == "" {
+      oldPath = newPath
+    }
+    if newPath == "" {
+      newPath = oldPath
+    }
+    gitOld, gitNew := oldPath, newPath
+    if gitOld == "/dev/null" {
+      gitOld = newPath
+    }
+    if gitNew == "/dev/null" {
+      gitNew = oldPath
+    }
+    b.WriteString("diff --git a/" + gitOld + " b/" + gitNew + "\n")
+    for _, l := range f.Extra {
+      b.WriteString(l + "\n")
+    }
+    if len(f.Hunks) == 0 {
+      continue
+    }
+    b.WriteString("--- " + diffSide("a/", oldPath) + "\n")
+    b.WriteString("+++ " + diffSide("b/", newPath) + "\n")
+    for _, h := range f.Hunks {
+      b.WriteString(formatHunkHeader(h) + "\n")
+      for _, l := range h.Lines {
+        b.WriteString(l + "\n")
+      }
+    }
+  }
+  return b.String()
+}
+
+func diffSide(prefix string, path string) string {
+  if path == "/dev/null" {
+    return path
+  }
+  return prefix + path
+}
+
+func formatHunkHeader(h DiffHunk) string {
+  header := "@@ -" + formatRange(h.OldStart, h.OldLines) + " +" + formatRange(h.NewStart, h.NewLines) + " @@"
+  if h.Section != "" {
+    header += " " + h.Section
+  }
+  return header
+}
+
+func formatRange(start int, count int) string {
+  if count == 1 {
+    return strconv.Itoa(start)
+  }
+  return strconv.Itoa(start) + "," + strconv.Itoa(count)
+}
+
+// CheckApplies verifies that the context and removed lines of every hunk are
+// present in the original file, allowing the hunk to have drifted.
+func CheckApplies(f FileDiff, original string) error {
+  src := splitLines(original)
+  for _, h := range f.Hunks {
+    old := []string{}
+    for _, l := range h.Lines {
+      if l[0] == ' ' || l[0] == '-' {
+        old = append(old, l[1:])
+      }
+    }
+    if len(old) == 0 {
+      continue
+    }
+    if findBlock(src, old, h.OldStart-1) < 0 {
+      return fmt.Errorf("%s: hunk @@ -%d does not match the original file", f.Path(), h.OldStart)
+    }
+  }
+  return nil
+}
+
+// ApplyDiff applies the hunks of f to original and returns the new content.
+// Hunks are located the same way CheckApplies does, so they may have drifted,
+// but must apply in order without overlapping.
+func ApplyDiff(f FileDiff, original string) (string, error) {
+  src := splitLines(original)
+  out := []string{}
+  cursor := 0
+  for _, h := range f.Hunks {
+    old := []string{}
+    repl := []string{}
+    for _, l := range h.Lines {
+      switch l[0] {
+      case ' ':
+        old = append(old, l[1:])
+        repl = append(repl, l[1:])
+      case '-':
+        old = append(old, l[1:])
+      case '+':
+        repl = append(repl, l[1:])
+      }
+    }
+    at := h.OldStart
+    if len(old) > 0 {
+      at = findBlock(src[cursor:], old, h.OldStart-1-cursor)
+      if at < 0 {
+        return "", fmt.Errorf("%s: hunk @@ -%d does not match the original file", f.Path(), h.OldStart)
+      }
+      at += cursor
+    }
+    if at < cursor {
+      at = cursor
+    }
+    if at > len(src) {
+      at = len(src)
+    }
+    out = append(out, src[cursor:at]...)
+    out = append(out, repl...)
+    cursor = at + len(old)
+  }
+  out = append(out, src[cursor:]...)
+  if len(out) == 0 {
+    return "", nil
+  }
+  return strings.Join(out, "\n") + "\n", nil
+}
+
+// findBlock returns the index where block occurs in src, searching outward
+// from hint, or -1.
+func findBlock(src []string, block []string, hint int) int {
+  matches := func(at int) bool {
+    if at < 0 || at+len(block) > len(src) {
+      return false
+    }
+    for i := range block {
+      if strings.TrimRight(src[at+i], " \t") != strings.TrimRight(block[i], " \t") {
+        return false
+      }
+    }
+    return true
+  }
+  if hint < 0 {
+    hint = 0
+  }
+  for off := 0; off <= len(src); off++ {
+    if matches(hint + off) {
+      return hint + off
+    }
+    if off > 0 && matches(hint-off) {
+      return hint - off
+    }
+  }
+  return -1
+}
+
+func splitLines(text string) []string {
+  if text == "" {
+    return []string{}
+  }
+  text = strings.ReplaceAll(text, "\r\n", "\n")
+  return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
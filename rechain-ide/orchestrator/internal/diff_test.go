@@ -0,0 +1,134 @@
+﻿package internal
+
+import (
+  "strings"
+  "testing"
+)
+
+const mainGo = "package main\n\nfunc main() {\n  println(\"hi\")\n}\n"
+
+func TestExtractDiff(t *testing.T) {
+  originals := map[string]string{"cmd/app/main.go": mainGo}
+  cases := []struct {
+    name    string
+    text    string
+    want    []string
+    wantErr string
+  }{
+    {
+      name: "fenced diff block",
+      text: "Here is the fix:\n```diff\ndiff --git a/cmd/app/main.go b/cmd/app/main.go\n--- a/cmd/app/main.go\n+++ b/cmd/app/main.go\n@@ -3,3 +3,3 @@\n func main() {\n-  println(\"hi\")\n+  println(\"hello\")\n }\n```\nDone.",
+      want: []string{"diff --git a/cmd/app/main.go b/cmd/app/main.go", "@@ -3,3 +3,3 @@", "+  println(\"hello\")"},
+    },
+    {
+      name: "bare diff with trailing prose and miscounted hunk",
+      text: "diff --git a/cmd/app/main.go b/cmd/app/main.go\n--- a/cmd/app/main.go\n+++ b/cmd/app/main.go\n@@ -4,9 +4,9 @@\n-  println(\"hi\")\n+  println(\"bye\")\n\nThis changes the greeting.",
+      want: []string{"@@ -4 +4 @@", "+  println(\"bye\")"},
+    },
+    {
+      name: "whole-file rewrite named in caption",
+      text: "Updated `main.go`:\n```go\npackage main\n\nfunc main() {\n  println(\"hey\")\n}\n```",
+      want: []string{"--- a/cmd/app/main.go", "-  println(\"hi\")", "+  println(\"hey\")"},
+    },
+    {
+      name: "new file from info string",
+      text: "```go cmd/app/util.go\npackage main\n\nfunc util() {}\n```",
+      want: []string{"new file mode 100644", "--- /dev/null", "+++ b/cmd/app/util.go", "@@ -0,0 +1,3 @@"},
+    },
+    {
+      name:    "prose only",
+      text:    "I am not sure how to fix this.",
+      wantErr: "no diff",
+    },
+    {
+      name:    "hunk without file header",
+      text:    "```diff\n@@ -1 +1 @@\n-a\n+b\n```",
+      wantErr: "without file header",
+    },
+    {
+      name:    "hunk does not match original",
+      text:    "```diff\n--- a/cmd/app/main.go\n+++ b/cmd/app/main.go\n@@ -1 +1 @@\n-package other\n+package main2\n```",
+      wantErr: "does not match",
+    },
+  }
+
+  for _, tc := range cases {
+    t.Run(tc.name, func(t *testing.T) {
+      got, err := ExtractDiff(tc.text, originals)
+      if tc.wantErr != "" {
+        if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+          t.Fatalf("expected error containing %q, got %v (diff %q)", tc.wantErr, err, got)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+      }
+      for _, w := range tc.want {
+        if !strings.Contains(got, w) {
+          t.Fatalf("expected %q in diff:\n%s", w, got)
+        }
+      }
+      if _, err := ParseUnifiedDiff(got); err != nil {
+        t.Fatalf("extracted diff does not parse: %v", err)
+      }
+    })
+  }
+}
+
+func TestUnifiedDiff_HunksWithContext(t *testing.T) {
+  old := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+  updated := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nK\nl\n"
+
+  files, err := ParseUnifiedDiff(UnifiedDiff("x.txt", old, updated))
+  if err != nil {
+    t.Fatalf("parse: %v", err)
+  }
+  if len(files) != 1 || len(files[0].Hunks) != 2 {
+    t.Fatalf("expected two hunks, got %+v", files)
+  }
+  first, second := files[0].Hunks[0], files[0].Hunks[1]
+  if first.OldStart != 1 || first.OldLines != 5 || second.OldStart != 8 || second.OldLines != 5 {
+    t.Fatalf("unexpected hunk ranges: %+v %+v", first, second)
+  }
+  if err := CheckApplies(files[0], old); err != nil {
+    t.Fatalf("generated diff should apply: %v", err)
+  }
+  if UnifiedDiff("x.txt", old, old) != "" {
+    t.Fatal("expected no diff for identical content")
+  }
+}
+
+func TestApplyDiff(t *testing.T) {
+  old := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+  updated := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nl\nm\n"
+
+  files, err := ParseUnifiedDiff(UnifiedDiff("x.txt", old, updated))
+  if err != nil {
+    t.Fatalf("parse: %v", err)
+  }
+  got, err := ApplyDiff(files[0], old)
+  if err != nil {
+    t.Fatalf("apply: %v", err)
+  }
+  if got != updated {
+    t.Fatalf("unexpected result %q", got)
+  }
+
+  drifted := "header\n" + old
+  if got, err := ApplyDiff(files[0], drifted); err != nil || got != "header\n"+updated {
+    t.Fatalf("expected drifted hunks to apply, got %q, %v", got, err)
+  }
+
+  created, err := ParseUnifiedDiff(UnifiedDiff("new.txt", "", "one\ntwo\n"))
+  if err != nil {
+    t.Fatalf("parse new file: %v", err)
+  }
+  if got, err := ApplyDiff(created[0], ""); err != nil || got != "one\ntwo\n" {
+    t.Fatalf("expected new file content, got %q, %v", got, err)
+  }
+
+  if _, err := ApplyDiff(files[0], "unrelated\n"); err == nil {
+    t.Fatal("expected mismatched original to fail")
+  }
+}
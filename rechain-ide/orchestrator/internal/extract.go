@@ -0,0 +1,395 @@
+﻿package internal
+
+import (
+  "errors"
+  "regexp"
+  "strings"
+)
+
+const (
+  diffContextLines = 3
+  maxLCSCells      = 4000000
+)
+
+var (
+  bareGitDiffRe     = regexp.MustCompile(`(?m)^diff --git `)
+  bareUnifiedDiffRe = regexp.MustCompile(`(?m)^--- .*\n\+\+\+ `)
+  backtickPathRe    = regexp.MustCompile("`([^`\\s]+)`")
+)
+
+type fencedBlock struct {
+  info    string
+  caption string
+  body    string
+}
+
+// ExtractDiff pulls a unified diff out of free-form model output. It accepts
+// fenced diff blocks, bare diff sections, and fenced whole-file rewrites of
+// files in originals (path -> current content), which are converted to diffs.
+// Hunks that touch a file in originals must match its content.
+func ExtractDiff(text string, originals map[string]string) (string, error) {
+  text = strings.ReplaceAll(text, "\r\n", "\n")
+  blocks := fencedBlocks(text)
+  files := []FileDiff{}
+  var parseErr error
+
+  for _, b := range blocks {
+    if !b.isDiff() {
+      continue
+    }
+    parsed, err := ParseUnifiedDiff(b.body)
+    if err != nil {
+      parseErr = err
+      continue
+    }
+    files = append(files, parsed...)
+  }
+
+  if len(files) == 0 && parseErr == nil {
+    if idx := bareDiffStart(text); idx >= 0 {
+      parsed, err := ParseUnifiedDiff(text[idx:])
+      if err != nil {
+        parseErr = err
+      } else {
+        files = parsed
+      }
+    }
+  }
+
+  if len(files) == 0 && parseErr == nil {
+    files = rewriteDiffs(blocks, originals)
+  }
+
+  if len(files) == 0 {
+    if parseErr != nil {
+      return "", parseErr
+    }
+    return "", errors.New("no diff or file rewrite found")
+  }
+  for _, f := range files {
+    if f.OldPath == "/dev/null" {
+      continue
+    }
+    if path, ok := matchOriginal(originals, f.OldPath); ok {
+      if err := CheckApplies(f, originals[path]); err != nil {
+        return "", err
+      }
+    }
+  }
+  return FormatUnifiedDiff(files), nil
+}
+
+// UnifiedDiff returns the git-style diff that turns oldText into newText, or
+// an empty string when they are equal.
+func UnifiedDiff(path string, oldText string, newText string) string {
+  f, ok := diffFile(path, oldText, newText)
+  if !ok {
+    return ""
+  }
+  return FormatUnifiedDiff([]FileDiff{f})
+}
+
+func fencedBlocks(text string) []fencedBlock {
+  lines := strings.Split(text, "\n")
+  blocks := []fencedBlock{}
+  caption := ""
+  for i := 0; i < len(lines); i++ {
+    trimmed := strings.TrimSpace(lines[i])
+    if !strings.HasPrefix(trimmed, "```") {
+      if trimmed != "" {
+        caption = trimmed
+      }
+      continue
+    }
+    b := fencedBlock{info: strings.TrimSpace(strings.TrimPrefix(trimmed, "```")), caption: caption}
+    body := []string{}
+    for i++; i < len(lines); i++ {
+      if strings.TrimSpace(lines[i]) == "```" {
+        break
+      }
+      body = append(body, lines[i])
+    }
+    // An unterminated fence (truncated generation) keeps everything after it.
+    b.body = strings.Join(body, "\n")
+    if len(body) > 0 {
+      b.body += "\n"
+    }
+    blocks = append(blocks, b)
+    caption = ""
+  }
+  return blocks
+}
+
+func (b fencedBlock) lang() string {
+  fields := strings.Fields(b.info)
+  if len(fields) == 0 {
+    return ""
+  }
+  return strings.ToLower(fields[0])
+}
+
+func (b fencedBlock) isDiff() bool {
+  switch b.lang() {
+  case "diff", "patch", "udiff":
+    return true
+  }
+  body := strings.TrimLeft(b.body, "\n")
+  return strings.HasPrefix(body, "diff --git ") || (strings.HasPrefix(body, "--- ") && bareUnifiedDiffRe.MatchString(body))
+}
+
+func bareDiffStart(text string) int {
+  if loc := bareGitDiffRe.FindStringIndex(text); loc != nil {
+    return loc[0]
+  }
+  if loc := bareUnifiedDiffRe.FindStringIndex(text); loc != nil {
+    return loc[0]
+  }
+  return -1
+}
+
+// rewriteDiffs converts fenced code blocks holding complete files into diffs.
+// The file is named by the fence info string (```go path/to/file.go), by a
+// path on the line before the fence, or implied when there is exactly one
+// original and one code block. Only info-string paths may create new files.
+func rewriteDiffs(blocks []fencedBlock, originals map[string]string) []FileDiff {
+  code := []fencedBlock{}
+  for _, b := range blocks {
+    if !b.isDiff() && strings.TrimSpace(b.body) != "" {
+      code = append(code, b)
+    }
+  }
+  files := []FileDiff{}
+  for _, b := range code {
+    path, known := "", false
+    explicit := infoPath(b.info)
+    if explicit != "" {
+      path, known = matchOriginal(originals, explicit)
+      if !known {
+        path = explicit
+      }
+    } else if p, ok := captionPath(b.caption, originals); ok {
+      path, known = p, true
+    } else if len(code) == 1 && len(originals) == 1 {
+      for p := range originals {
+        path, known = p, true
+      }
+    }
+    if path == "" {
+      continue
+    }
+    old := ""
+    if known {
+      old = originals[path]
+    }
+    if f, ok := diffFile(path, old, b.body); ok {
+      files = append(files, f)
+    }
+  }
+  return files
+}
+
+func infoPath(info string) string {
+  fields := strings.Fields(info)
+  for i, f := range fields {
+    for _, prefix := range []string{"path=", "file=", "title=", "filename="} {
+      if strings.HasPrefix(f, prefix) {
+        f = strings.Trim(strings.TrimPrefix(f, prefix), `"'`)
+      }
+    }
+    if i == 0 && !strings.ContainsAny(f, "/.") {
+      continue
+    }
+    if strings.Contains(f, ".") || strings.Contains(f, "/") {
+      return f
+    }
+  }
+  return ""
+}
+
+func captionPath(caption string, originals map[string]string) (string, bool) {
+  if caption == "" {
+    return "", false
+  }
+  for _, m := range backtickPathRe.FindAllStringSubmatch(caption, -1) {
+    if p, ok := matchOriginal(originals, m[1]); ok {
+      return p, true
+    }
+  }
+  for _, field := range strings.Fields(caption) {
+    field = strings.Trim(field, "*:`'\"()")
+    if p, ok := matchOriginal(originals, field); ok {
+      return p, true
+    }
+  }
+  return "", false
+}
+
+// matchOriginal finds the originals key for a path the model wrote, which may
+// be shorter or longer than the repository-relative key.
+func matchOriginal(originals map[string]string, path string) (string, bool) {
+  path = strings.TrimPrefix(strings.TrimSpace(path), "./")
+  if path == "" {
+    return "", false
+  }
+  if _, ok := originals[path]; ok {
+    return path, true
+  }
+  for key := range originals {
+    if strings.HasSuffix(key, "/"+path) || strings.HasSuffix(path, "/"+key) {
+      return key, true
+    }
+  }
+  return "", false
+}
+
+type diffOp struct {
+  kind byte
+  text string
+}
+
+func diffFile(path string, oldText string, newText string) (FileDiff, bool) {
+  ops := lineOps(splitLines(oldText), splitLines(newText))
+  hunks := buildHunks(ops, diffContextLines)
+  if len(hunks) == 0 {
+    return FileDiff{}, false
+  }
+  f := FileDiff{OldPath: path, NewPath: path, Hunks: hunks}
+  if oldText == "" {
+    f.OldPath = "/dev/null"
+    f.Extra = []string{"new file mode 100644"}
+  }
+  return f, true
+}
+
+func lineOps(a []string, b []string) []diffOp {
+  pre := 0
+  for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+    pre++
+  }
+  suf := 0
+  for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+    suf++
+  }
+  ops := []diffOp{}
+  for _, l := range a[:pre] {
+    ops = append(ops, diffOp{' ', l})
+  }
+  ops = append(ops, lcsOps(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+  for _, l := range a[len(a)-suf:] {
+    ops = append(ops, diffOp{' ', l})
+  }
+  return ops
+}
+
+// lcsOps diffs the differing middle of two files. Very large inputs fall back
+// to replacing the whole middle rather than building the full LCS table.
+func lcsOps(a []string, b []string) []diffOp {
+  ops := []diffOp{}
+  if len(a) == 0 || len(b) == 0 || len(a)*len(b) > maxLCSCells {
+    for _, l := range a {
+      ops = append(ops, diffOp{'-', l})
+    }
+    for _, l := range b {
+      ops = append(ops, diffOp{'+', l})
+    }
+    return ops
+  }
+  n, m := len(a), len(b)
+  table := make([][]int32, n+1)
+  for i := range table {
+    table[i] = make([]int32, m+1)
+  }
+  for i := n - 1; i >= 0; i-- {
+    for j := m - 1; j >= 0; j-- {
+      if a[i] == b[j] {
+        table[i][j] = table[i+1][j+1] + 1
+      } else if table[i+1][j] >= table[i][j+1] {
+        table[i][j] = table[i+1][j]
+      } else {
+        table[i][j] = table[i][j+1]
+      }
+    }
+  }
+  i, j := 0, 0
+  for i < n && j < m {
+    switch {
+    case a[i] == b[j]:
+      ops = append(ops, diffOp{' ', a[i]})
+      i++
+      j++
+    case table[i+1][j] >= table[i][j+1]:
+      ops = append(ops, diffOp{'-', a[i]})
+      i++
+    default:
+      ops = append(ops, diffOp{'+', b[j]})
+      j++
+    }
+  }
+  for ; i < n; i++ {
+    ops = append(ops, diffOp{'-', a[i]})
+  }
+  for ; j < m; j++ {
+    ops = append(ops, diffOp{'+', b[j]})
+  }
+  return ops
+}
+
+func buildHunks(ops []diffOp, context int) []DiffHunk {
+  changes := []int{}
+  for i, op := range ops {
+    if op.kind != ' ' {
+      changes = append(changes, i)
+    }
+  }
+  if len(changes) == 0 {
+    return nil
+  }
+
+  // Line numbers (0-based) on each side before ops[i].
+  oldAt := make([]int, len(ops)+1)
+  newAt := make([]int, len(ops)+1)
+  for i, op := range ops {
+    oldAt[i+1], newAt[i+1] = oldAt[i], newAt[i]
+    if op.kind != '+' {
+      oldAt[i+1]++
+    }
+    if op.kind != '-' {
+      newAt[i+1]++
+    }
+  }
+
+  hunks := []DiffHunk{}
+  for g := 0; g < len(changes); {
+    first, last := changes[g], changes[g]
+    g++
+    for g < len(changes) && changes[g]-last <= 2*context+1 {
+      last = changes[g]
+      g++
+    }
+    from := first - context
+    if from < 0 {
+      from = 0
+    }
+    to := last + context + 1
+    if to > len(ops) {
+      to = len(ops)
+    }
+    h := DiffHunk{
+      OldLines: oldAt[to] - oldAt[from],
+      NewLines: newAt[to] - newAt[from],
+    }
+    h.OldStart = oldAt[from]
+    if h.OldLines > 0 {
+      h.OldStart++
+    }
+    h.NewStart = newAt[from]
+    if h.NewLines > 0 {
+      h.NewStart++
+    }
+    for _, op := range ops[from:to] {
+      h.Lines = append(h.Lines, string(op.kind)+op.text)
+    }
+    hunks = append(hunks, h)
+  }
+  return hunks
+}
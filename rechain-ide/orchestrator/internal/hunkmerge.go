@@ -0,0 +1,219 @@
+﻿package internal
+
+import (
+  "errors"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+type Candidate struct {
+  ID    string
+  Diff  string
+  Score float64
+}
+
+// HunkSource records which candidate a hunk of the combined diff came from and
+// which other candidates proposed the identical hunk.
+type HunkSource struct {
+  File      string   `json:"file"`
+  OldStart  int      `json:"old_start"`
+  OldLines  int      `json:"old_lines"`
+  Candidate string   `json:"candidate"`
+  AgreedBy  []string `json:"agreed_by,omitempty"`
+}
+
+// HunkConflict is a hunk dropped because it overlaps a hunk from a
+// higher-scored candidate.
+type HunkConflict struct {
+  File        string  `json:"file"`
+  Candidate   string  `json:"candidate"`
+  OldStart    int     `json:"old_start"`
+  OldLines    int     `json:"old_lines"`
+  Winner      string  `json:"winner"`
+  WinnerFrom  int     `json:"winner_old_start"`
+  Score       float64 `json:"score"`
+  WinnerScore float64 `json:"winner_score"`
+}
+
+type HunkMergeResult struct {
+  Diff      string         `json:"-"`
+  Sources   []HunkSource   `json:"sources"`
+  Conflicts []HunkConflict `json:"conflicts,omitempty"`
+  Invalid   []string       `json:"invalid_candidates,omitempty"`
+}
+
+type scoredHunk struct {
+  cand  Candidate
+  hunk  DiffHunk
+  file  FileDiff
+  agree []string
+}
+
+// MergeHunks combines candidate diffs hunk by hunk. Candidates are visited in
+// descending score order (ties by ID); a hunk is kept unless its original line
+// range overlaps a hunk already kept for the same file, in which case it is
+// reported as a conflict. Identical hunks from several candidates are kept
+// once. New and deleted files are taken whole from a single candidate.
+func MergeHunks(cands []Candidate) (HunkMergeResult, error) {
+  ordered := append([]Candidate{}, cands...)
+  sort.SliceStable(ordered, func(i, j int) bool {
+    if ordered[i].Score != ordered[j].Score {
+      return ordered[i].Score > ordered[j].Score
+    }
+    return ordered[i].ID < ordered[j].ID
+  })
+
+  res := HunkMergeResult{}
+  kept := map[string][]*scoredHunk{}
+  headers := map[string]FileDiff{}
+  fileOrder := []string{}
+  parsedAny := false
+
+  for _, c := range ordered {
+    files, err := ParseUnifiedDiff(c.Diff)
+    if err != nil {
+      res.Invalid = append(res.Invalid, c.ID)
+      continue
+    }
+    parsedAny = true
+    for _, f := range files {
+      key := fileKey(f)
+      if _, ok := headers[key]; !ok {
+        headers[key] = FileDiff{OldPath: f.OldPath, NewPath: f.NewPath, Extra: f.Extra}
+        fileOrder = append(fileOrder, key)
+      }
+      whole := f.OldPath == "/dev/null" || f.NewPath == "/dev/null"
+      for _, h := range f.Hunks {
+        kept[key] = placeHunk(&res, kept[key], &scoredHunk{cand: c, hunk: h, file: f}, key, whole)
+      }
+    }
+  }
+  if !parsedAny {
+    return HunkMergeResult{}, errors.New("no candidate diff could be parsed")
+  }
+
+  merged := []FileDiff{}
+  for _, key := range fileOrder {
+    hunks := kept[key]
+    if len(hunks) == 0 {
+      continue
+    }
+    sort.Slice(hunks, func(i, j int) bool { return hunks[i].hunk.OldStart < hunks[j].hunk.OldStart })
+    f := headers[key]
+    // Headers (renames, modes) come from the candidate whose hunk leads.
+    f.OldPath, f.NewPath, f.Extra = hunks[0].file.OldPath, hunks[0].file.NewPath, hunks[0].file.Extra
+    offset := 0
+    for _, sh := range hunks {
+      h := sh.hunk
+      h.NewStart = h.OldStart + offset
+      if h.NewLines > 0 && h.OldLines == 0 {
+        h.NewStart++
+      }
+      if h.NewLines == 0 && h.OldLines > 0 {
+        h.NewStart--
+      }
+      offset += h.NewLines - h.OldLines
+      f.Hunks = append(f.Hunks, h)
+      res.Sources = append(res.Sources, HunkSource{File: key, OldStart: h.OldStart, OldLines: h.OldLines, Candidate: sh.cand.ID, AgreedBy: sh.agree})
+    }
+    merged = append(merged, f)
+  }
+  res.Diff = FormatUnifiedDiff(merged)
+  return res, nil
+}
+
+func placeHunk(res *HunkMergeResult, kept []*scoredHunk, h *scoredHunk, file string, whole bool) []*scoredHunk {
+  for _, k := range kept {
+    if k.cand.ID == h.cand.ID {
+      if whole {
+        return append(kept, h)
+      }
+      continue
+    }
+    if sameHunk(k.hunk, h.hunk) {
+      k.agree = append(k.agree, h.cand.ID)
+      return kept
+    }
+    if whole || overlaps(k.hunk, h.hunk) {
+      res.Conflicts = append(res.Conflicts, HunkConflict{
+        File:        file,
+        Candidate:   h.cand.ID,
+        OldStart:    h.hunk.OldStart,
+        OldLines:    h.hunk.OldLines,
+        Winner:      k.cand.ID,
+        WinnerFrom:  k.hunk.OldStart,
+        Score:       h.cand.Score,
+        WinnerScore: k.cand.Score,
+      })
+      return kept
+    }
+  }
+  return append(kept, h)
+}
+
+func fileKey(f FileDiff) string {
+  if f.OldPath != "" && f.OldPath != "/dev/null" {
+    return f.OldPath
+  }
+  return f.NewPath
+}
+
+func sameHunk(a DiffHunk, b DiffHunk) bool {
+  if a.OldStart != b.OldStart || len(a.Lines) != len(b.Lines) {
+    return false
+  }
+  for i := range a.Lines {
+    if a.Lines[i] != b.Lines[i] {
+      return false
+    }
+  }
+  return true
+}
+
+// overlaps reports whether two hunks touch a common original line. Pure
+// insertions occupy the line they are inserted after.
+func overlaps(a DiffHunk, b DiffHunk) bool {
+  aStart, aEnd := hunkRange(a)
+  bStart, bEnd := hunkRange(b)
+  return aStart < bEnd && bStart < aEnd
+}
+
+func hunkRange(h DiffHunk) (int, int) {
+  if h.OldLines == 0 {
+    return h.OldStart, h.OldStart + 1
+  }
+  return h.OldStart, h.OldStart + h.OldLines
+}
+
+// Report renders the merge outcome for MergeResult.Rationale.
+func (r HunkMergeResult) Report() string {
+  byCand := map[string]int{}
+  for _, s := range r.Sources {
+    byCand[s.Candidate]++
+  }
+  ids := make([]string, 0, len(byCand))
+  for id := range byCand {
+    ids = append(ids, id)
+  }
+  sort.Strings(ids)
+  parts := []string{}
+  for _, id := range ids {
+    parts = append(parts, id+"="+strconv.Itoa(byCand[id]))
+  }
+
+  var b strings.Builder
+  b.WriteString("hunk merge: " + strconv.Itoa(len(r.Sources)) + " hunk(s) from " + strings.Join(parts, ", "))
+  if len(r.Conflicts) == 0 {
+    b.WriteString("; no conflicts")
+  } else {
+    b.WriteString("; " + strconv.Itoa(len(r.Conflicts)) + " conflict(s):")
+    for _, c := range r.Conflicts {
+      b.WriteString(" " + c.File + "@" + strconv.Itoa(c.OldStart) + " " + c.Candidate + " lost to " + c.Winner + "@" + strconv.Itoa(c.WinnerFrom) + ";")
+    }
+  }
+  if len(r.Invalid) > 0 {
+    b.WriteString(" unparseable: " + strings.Join(r.Invalid, ", "))
+  }
+  return strings.TrimSuffix(b.String(), ";")
+}
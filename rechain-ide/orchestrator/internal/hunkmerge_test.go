@@ -0,0 +1,134 @@
+﻿package internal
+
+import (
+  "strings"
+  "testing"
+)
+
+func fileDiff(path string, hunks ...string) string {
+  return "diff --git a/" + path + " b/" + path + "\n--- a/" + path + "\n+++ b/" + path + "\n" + strings.Join(hunks, "")
+}
+
+func TestMergeHunks(t *testing.T) {
+  hunkA := "@@ -2,3 +2,3 @@\n one\n-two\n+TWO\n three\n"
+  hunkB := "@@ -10,3 +10,4 @@\n ten\n eleven\n+eleven and a half\n twelve\n"
+  hunkC := "@@ -3,2 +3,2 @@\n two\n-three\n+THREE\n"
+
+  cases := []struct {
+    name          string
+    cands         []Candidate
+    wantHunks     []string
+    wantSources   []string
+    wantConflicts []string
+    wantInvalid   []string
+  }{
+    {
+      name: "different files are combined",
+      cands: []Candidate{
+        {ID: "a", Diff: fileDiff("x.go", hunkA), Score: 0.9},
+        {ID: "b", Diff: fileDiff("y.go", hunkB), Score: 0.5},
+      },
+      wantHunks:   []string{"diff --git a/x.go b/x.go", "+TWO", "diff --git a/y.go b/y.go", "+eleven and a half"},
+      wantSources: []string{"a", "b"},
+    },
+    {
+      name: "non-overlapping hunks in one file are combined with shifted new ranges",
+      cands: []Candidate{
+        {ID: "a", Diff: fileDiff("x.go", hunkB), Score: 0.9},
+        {ID: "b", Diff: fileDiff("x.go", "@@ -2,2 +2,3 @@\n one\n+inserted\n two\n"), Score: 0.5},
+      },
+      wantHunks:   []string{"@@ -2,2 +2,3 @@", "@@ -10,3 +11,4 @@"},
+      wantSources: []string{"b", "a"},
+    },
+    {
+      name: "overlap goes to the higher score",
+      cands: []Candidate{
+        {ID: "low", Diff: fileDiff("x.go", hunkC), Score: 0.4},
+        {ID: "high", Diff: fileDiff("x.go", hunkA), Score: 0.8},
+      },
+      wantHunks:     []string{"+TWO"},
+      wantSources:   []string{"high"},
+      wantConflicts: []string{"x.go low->high"},
+    },
+    {
+      name: "identical hunks are kept once",
+      cands: []Candidate{
+        {ID: "a", Diff: fileDiff("x.go", hunkA), Score: 0.5},
+        {ID: "b", Diff: fileDiff("x.go", hunkA), Score: 0.5},
+      },
+      wantHunks:   []string{"+TWO"},
+      wantSources: []string{"a"},
+    },
+    {
+      name: "new files come whole from one candidate",
+      cands: []Candidate{
+        {ID: "a", Diff: "diff --git a/n.go b/n.go\nnew file mode 100644\n--- /dev/null\n+++ b/n.go\n@@ -0,0 +1,2 @@\n+package n\n+// a\n", Score: 0.7},
+        {ID: "b", Diff: "diff --git a/n.go b/n.go\nnew file mode 100644\n--- /dev/null\n+++ b/n.go\n@@ -0,0 +1,1 @@\n+package n\n", Score: 0.6},
+      },
+      wantHunks:     []string{"--- /dev/null", "+// a"},
+      wantSources:   []string{"a"},
+      wantConflicts: []string{"n.go b->a"},
+    },
+    {
+      name: "unparseable candidates are reported",
+      cands: []Candidate{
+        {ID: "stub", Diff: "diff --git a/file b/file\n+stub\n", Score: 0.9},
+        {ID: "a", Diff: fileDiff("x.go", hunkA), Score: 0.1},
+      },
+      wantHunks:   []string{"+TWO"},
+      wantSources: []string{"a"},
+      wantInvalid: []string{"stub"},
+    },
+  }
+
+  for _, tc := range cases {
+    t.Run(tc.name, func(t *testing.T) {
+      res, err := MergeHunks(tc.cands)
+      if err != nil {
+        t.Fatalf("merge: %v", err)
+      }
+      for _, h := range tc.wantHunks {
+        if !strings.Contains(res.Diff, h) {
+          t.Fatalf("expected %q in merged diff:\n%s", h, res.Diff)
+        }
+      }
+      if _, err := ParseUnifiedDiff(res.Diff); err != nil {
+        t.Fatalf("merged diff does not parse: %v", err)
+      }
+      sources := []string{}
+      for _, s := range res.Sources {
+        sources = append(sources, s.Candidate)
+      }
+      if strings.Join(sources, ",") != strings.Join(tc.wantSources, ",") {
+        t.Fatalf("expected sources %v, got %v", tc.wantSources, sources)
+      }
+      conflicts := []string{}
+      for _, c := range res.Conflicts {
+        conflicts = append(conflicts, c.File+" "+c.Candidate+"->"+c.Winner)
+      }
+      if strings.Join(conflicts, ",") != strings.Join(tc.wantConflicts, ",") {
+        t.Fatalf("expected conflicts %v, got %v", tc.wantConflicts, conflicts)
+      }
+      if strings.Join(res.Invalid, ",") != strings.Join(tc.wantInvalid, ",") {
+        t.Fatalf("expected invalid %v, got %v", tc.wantInvalid, res.Invalid)
+      }
+    })
+  }
+}
+
+func TestMergeHunks_NoParseableCandidates(t *testing.T) {
+  if _, err := MergeHunks([]Candidate{{ID: "stub", Diff: "+x"}}); err == nil {
+    t.Fatal("expected error")
+  }
+}
+
+func TestHunkMergeResult_Report(t *testing.T) {
+  res := HunkMergeResult{
+    Sources:   []HunkSource{{File: "x.go", Candidate: "a"}, {File: "y.go", Candidate: "b"}},
+    Conflicts: []HunkConflict{{File: "x.go", OldStart: 3, Candidate: "b", Winner: "a", WinnerFrom: 2}},
+  }
+  want := "hunk merge: 2 hunk(s) from a=1, b=1; 1 conflict(s): x.go@3 b lost to a@2"
+  if got := res.Report(); got != want {
+    t.Fatalf("expected %q, got %q", want, got)
+  }
+}
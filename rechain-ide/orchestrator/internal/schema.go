@@ -0,0 +1,213 @@
+﻿package internal
+
+import (
+  "encoding/json"
+  "math"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// Schema is the subset of JSON Schema (draft 2020-12) the bundled schemas
+// use: type, properties, required, additionalProperties, items, enum,
+// minimum/maximum, minLength, minItems, pattern and local $ref into $defs.
+type Schema struct {
+  Ref                  string             `json:"$ref,omitempty"`
+  Defs                 map[string]*Schema `json:"$defs,omitempty"`
+  Type                 json.RawMessage    `json:"type,omitempty"`
+  Properties           map[string]*Schema `json:"properties,omitempty"`
+  Required             []string           `json:"required,omitempty"`
+  AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+  Items                *Schema            `json:"items,omitempty"`
+  Enum                 []interface{}      `json:"enum,omitempty"`
+  Minimum              *float64           `json:"minimum,omitempty"`
+  Maximum              *float64           `json:"maximum,omitempty"`
+  MinLength            *int               `json:"minLength,omitempty"`
+  MinItems             *int               `json:"minItems,omitempty"`
+  Pattern              string             `json:"pattern,omitempty"`
+
+  types   []string
+  pattern *regexp.Regexp
+}
+
+// FieldError is one validation failure. Field is a path such as
+// "constraints[2].value"; the document root is "(root)".
+type FieldError struct {
+  Field   string `json:"field"`
+  Message string `json:"message"`
+}
+
+func ParseSchema(data []byte) (*Schema, error) {
+  var s Schema
+  if err := json.Unmarshal(data, &s); err != nil {
+    return nil, err
+  }
+  if err := s.compile(); err != nil {
+    return nil, err
+  }
+  return &s, nil
+}
+
+func (s *Schema) compile() error {
+  if len(s.Type) > 0 {
+    var one string
+    if err := json.Unmarshal(s.Type, &one); err == nil {
+      s.types = []string{one}
+    } else if err := json.Unmarshal(s.Type, &s.types); err != nil {
+      return err
+    }
+  }
+  if s.Pattern != "" {
+    re, err := regexp.Compile(s.Pattern)
+    if err != nil {
+      return err
+    }
+    s.pattern = re
+  }
+  children := []*Schema{s.Items}
+  for _, c := range s.Properties {
+    children = append(children, c)
+  }
+  for _, c := range s.Defs {
+    children = append(children, c)
+  }
+  for _, c := range children {
+    if c == nil {
+      continue
+    }
+    if err := c.compile(); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Validate checks a decoded JSON document (as produced by json.Unmarshal
+// into interface{}) and returns every failure in document order.
+func (s *Schema) Validate(doc interface{}) []FieldError {
+  errs := []FieldError{}
+  s.validate(s, doc, "", &errs)
+  return errs
+}
+
+func (s *Schema) validate(root *Schema, v interface{}, path string, errs *[]FieldError) {
+  if s.Ref != "" {
+    name := strings.TrimPrefix(s.Ref, "#/$defs/")
+    if def, ok := root.Defs[name]; ok {
+      def.validate(root, v, path, errs)
+    } else {
+      addError(errs, path, "unresolved $ref "+s.Ref)
+    }
+    return
+  }
+  if len(s.types) > 0 && !matchesType(s.types, v) {
+    addError(errs, path, "must be "+strings.Join(s.types, " or ")+", got "+jsonType(v))
+    return
+  }
+  if len(s.Enum) > 0 && !inEnum(s.Enum, v) {
+    allowed := make([]string, 0, len(s.Enum))
+    for _, e := range s.Enum {
+      raw, _ := json.Marshal(e)
+      allowed = append(allowed, string(raw))
+    }
+    addError(errs, path, "must be one of "+strings.Join(allowed, ", "))
+  }
+  switch val := v.(type) {
+  case map[string]interface{}:
+    for _, name := range s.Required {
+      if _, ok := val[name]; !ok {
+        addError(errs, join(path, name), "is required")
+      }
+    }
+    keys := make([]string, 0, len(val))
+    for k := range val {
+      keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+      if prop, ok := s.Properties[k]; ok {
+        prop.validate(root, val[k], join(path, k), errs)
+      } else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+        addError(errs, join(path, k), "unknown field")
+      }
+    }
+  case []interface{}:
+    if s.MinItems != nil && len(val) < *s.MinItems {
+      addError(errs, path, "must have at least "+strconv.Itoa(*s.MinItems)+" item(s)")
+    }
+    if s.Items != nil {
+      for i, item := range val {
+        s.Items.validate(root, item, path+"["+strconv.Itoa(i)+"]", errs)
+      }
+    }
+  case string:
+    if s.MinLength != nil && len([]rune(val)) < *s.MinLength {
+      addError(errs, path, "must be at least "+strconv.Itoa(*s.MinLength)+" character(s)")
+    }
+    if s.pattern != nil && !s.pattern.MatchString(val) {
+      addError(errs, path, "must match "+s.Pattern)
+    }
+  case float64:
+    if s.Minimum != nil && val < *s.Minimum {
+      addError(errs, path, "must be >= "+strconv.FormatFloat(*s.Minimum, 'f', -1, 64))
+    }
+    if s.Maximum != nil && val > *s.Maximum {
+      addError(errs, path, "must be <= "+strconv.FormatFloat(*s.Maximum, 'f', -1, 64))
+    }
+  }
+}
+
+func matchesType(types []string, v interface{}) bool {
+  for _, t := range types {
+    got := jsonType(v)
+    if t == got || (t == "number" && got == "integer") {
+      return true
+    }
+  }
+  return false
+}
+
+func jsonType(v interface{}) string {
+  switch val := v.(type) {
+  case nil:
+    return "null"
+  case bool:
+    return "boolean"
+  case string:
+    return "string"
+  case float64:
+    if val == math.Trunc(val) && !math.IsInf(val, 0) {
+      return "integer"
+    }
+    return "number"
+  case []interface{}:
+    return "array"
+  case map[string]interface{}:
+    return "object"
+  }
+  return "unknown"
+}
+
+func inEnum(enum []interface{}, v interface{}) bool {
+  for _, e := range enum {
+    if e == v {
+      return true
+    }
+  }
+  return false
+}
+
+func join(path string, name string) string {
+  if path == "" {
+    return name
+  }
+  return path + "." + name
+}
+
+func addError(errs *[]FieldError, path string, msg string) {
+  if path == "" {
+    path = "(root)"
+  }
+  *errs = append(*errs, FieldError{Field: path, Message: msg})
+}
@@ -0,0 +1,60 @@
+﻿package internal
+
+import (
+  "encoding/json"
+  "testing"
+)
+
+const testSchema = `{
+  "type": "object",
+  "required": ["name", "tags"],
+  "additionalProperties": false,
+  "properties": {
+    "name": {"type": "string", "minLength": 2, "pattern": "^[a-z]+$"},
+    "size": {"type": "integer", "minimum": 1, "maximum": 10},
+    "kind": {"enum": ["a", "b"]},
+    "tags": {"type": ["array", "null"], "minItems": 1, "items": {"$ref": "#/$defs/tag"}}
+  },
+  "$defs": {
+    "tag": {"type": "object", "required": ["key"], "properties": {"key": {"type": "string"}}}
+  }
+}`
+
+func TestSchemaValidate(t *testing.T) {
+  schema, err := ParseSchema([]byte(testSchema))
+  if err != nil {
+    t.Fatalf("parse: %v", err)
+  }
+  cases := []struct {
+    name string
+    doc  string
+    want []FieldError
+  }{
+    {"valid", `{"name":"abc","size":3,"kind":"a","tags":[{"key":"x"}]}`, nil},
+    {"null allowed by type list", `{"name":"abc","tags":null}`, nil},
+    {"root type", `[]`, []FieldError{{"(root)", "must be object, got array"}}},
+    {"missing and unknown", `{"name":"abc","extra":1}`, []FieldError{{"tags", "is required"}, {"extra", "unknown field"}}},
+    {"string rules", `{"name":"A","tags":[{"key":"x"}]}`, []FieldError{{"name", "must be at least 2 character(s)"}, {"name", "must match ^[a-z]+$"}}},
+    {"integer", `{"name":"ab","size":2.5,"tags":[{"key":"x"}]}`, []FieldError{{"size", "must be integer, got number"}}},
+    {"range", `{"name":"ab","size":11,"tags":[{"key":"x"}]}`, []FieldError{{"size", "must be <= 10"}}},
+    {"enum", `{"name":"ab","kind":"c","tags":[{"key":"x"}]}`, []FieldError{{"kind", "must be one of \"a\", \"b\""}}},
+    {"ref items", `{"name":"ab","tags":[{"key":1},{}]}`, []FieldError{{"tags[0].key", "must be string, got integer"}, {"tags[1].key", "is required"}}},
+    {"min items", `{"name":"ab","tags":[]}`, []FieldError{{"tags", "must have at least 1 item(s)"}}},
+  }
+  for _, tc := range cases {
+    var doc interface{}
+    if err := json.Unmarshal([]byte(tc.doc), &doc); err != nil {
+      t.Fatalf("%s: bad test doc: %v", tc.name, err)
+    }
+    got := schema.Validate(doc)
+    if len(got) != len(tc.want) {
+      t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+      continue
+    }
+    for i := range got {
+      if got[i] != tc.want[i] {
+        t.Errorf("%s: error %d = %v, want %v", tc.name, i, got[i], tc.want[i])
+      }
+    }
+  }
+}
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"rechain-ide/shared/logging"
+	"rechain-ide/shared/tracing"
 
 	"go.etcd.io/bbolt"
 )
@@ -46,6 +47,7 @@ type Score struct {
 	Path   string  `json:"path"`
 	Score  float64 `json:"score"`
 	Source string  `json:"source,omitempty"`
+	Text   string  `json:"text,omitempty"`
 }
 
 type EmbedRequest struct {
@@ -556,7 +558,7 @@ func main() {
 
 	addr := ":8083"
 	log.Printf("rag listening on %s", addr)
-	if err := http.ListenAndServe(addr, logging.WithRequestID(mux)); err != nil {
+	if err := http.ListenAndServe(addr, logging.WithRequestID(tracing.WithTrace(mux))); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -633,6 +635,13 @@ func handleSearchMode(w http.ResponseWriter, r *http.Request, store *Store, cfg
 		}
 	}
 	scores = rerankScores(scores, q, constraintIntFromQuery(r, "k", 10))
+	// Chunk text is only returned on request (snippets=true) to keep the
+	// default response small.
+	if !strings.EqualFold(r.URL.Query().Get("snippets"), "true") {
+		for i := range scores {
+			scores[i].Text = ""
+		}
+	}
 
 	resp := SearchResult{
 		SchemaVersion: schemaVersion,
@@ -718,7 +727,7 @@ func scoreChunks(q string, chunks []Chunk) []Score {
 	out := []Score{}
 	for _, c := range chunks {
 		if strings.Contains(strings.ToLower(c.Text), ql) {
-			out = append(out, Score{Path: c.Path + ":" + strconv.Itoa(c.Start), Score: 0.6, Source: "lexical"})
+			out = append(out, Score{Path: c.Path + ":" + strconv.Itoa(c.Start), Score: 0.6, Source: "lexical", Text: c.Text})
 		}
 	}
 	return out
@@ -761,7 +770,7 @@ func scoreChunksByEmbedding(q string, chunks []Chunk, vectors map[int][]float64)
 		if sim <= 0 {
 			continue
 		}
-		out = append(out, Score{Path: c.Path + ":" + strconv.Itoa(c.Start), Score: sim, Source: "semantic"})
+		out = append(out, Score{Path: c.Path + ":" + strconv.Itoa(c.Start), Score: sim, Source: "semantic", Text: c.Text})
 	}
 	return out
 }
@@ -0,0 +1,178 @@
+﻿package auth
+
+import (
+  "bytes"
+  "context"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+)
+
+// Role is an access level. Higher roles include everything lower roles may do.
+type Role int
+
+const (
+  RoleNone Role = iota
+  RoleViewer
+  RoleSubmitter
+  RoleAdmin
+)
+
+func (r Role) String() string {
+  switch r {
+  case RoleViewer:
+    return "viewer"
+  case RoleSubmitter:
+    return "submitter"
+  case RoleAdmin:
+    return "admin"
+  }
+  return "none"
+}
+
+func ParseRole(s string) (Role, error) {
+  switch strings.ToLower(strings.TrimSpace(s)) {
+  case "viewer":
+    return RoleViewer, nil
+  case "submitter":
+    return RoleSubmitter, nil
+  case "admin":
+    return RoleAdmin, nil
+  }
+  return RoleNone, errors.New("unknown role " + s)
+}
+
+// Principal is the identity an API token authenticates as.
+type Principal struct {
+  Name string `json:"name"`
+  Role Role   `json:"-"`
+}
+
+func (p Principal) Can(need Role) bool {
+  return p.Role >= need
+}
+
+// TokenEntry is one line of a tokens file. Either the token itself or its
+// hex SHA-256 may be stored.
+type TokenEntry struct {
+  Token       string `json:"token,omitempty"`
+  TokenSHA256 string `json:"token_sha256,omitempty"`
+  Principal   string `json:"principal"`
+  Role        string `json:"role"`
+}
+
+type tokensFile struct {
+  Tokens []TokenEntry `json:"tokens"`
+}
+
+// Tokens maps API tokens to principals. Tokens are kept only as hashes.
+type Tokens struct {
+  byHash map[string]Principal
+}
+
+func NewTokens(entries []TokenEntry) (*Tokens, error) {
+  t := &Tokens{byHash: map[string]Principal{}}
+  for i, e := range entries {
+    name := strings.TrimSpace(e.Principal)
+    if name == "" {
+      return nil, errors.New("token entry " + strconv.Itoa(i) + ": empty principal")
+    }
+    role, err := ParseRole(e.Role)
+    if err != nil {
+      return nil, errors.New("token entry " + strconv.Itoa(i) + ": " + err.Error())
+    }
+    hash := strings.ToLower(strings.TrimSpace(e.TokenSHA256))
+    if e.Token != "" {
+      hash = hashToken(e.Token)
+    }
+    if len(hash) != sha256.Size*2 {
+      return nil, errors.New("token entry " + strconv.Itoa(i) + ": token or token_sha256 required")
+    }
+    if _, dup := t.byHash[hash]; dup {
+      return nil, errors.New("token entry " + strconv.Itoa(i) + ": duplicate token")
+    }
+    t.byHash[hash] = Principal{Name: name, Role: role}
+  }
+  return t, nil
+}
+
+// LoadTokens reads a JSON tokens file: {"tokens":[{"token":"...","principal":"alice","role":"submitter"}]}.
+func LoadTokens(path string) (*Tokens, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  var f tokensFile
+  dec := json.NewDecoder(bytes.NewReader(data))
+  dec.DisallowUnknownFields()
+  if err := dec.Decode(&f); err != nil {
+    return nil, errors.New("parse " + path + ": " + err.Error())
+  }
+  return NewTokens(f.Tokens)
+}
+
+func (t *Tokens) Lookup(token string) (Principal, bool) {
+  if t == nil || token == "" {
+    return Principal{}, false
+  }
+  p, ok := t.byHash[hashToken(token)]
+  return p, ok
+}
+
+func hashToken(token string) string {
+  sum := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(sum[:])
+}
+
+// TokenFromRequest returns the bearer token, or the X-Api-Token header.
+func TokenFromRequest(r *http.Request) string {
+  if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+    return strings.TrimSpace(h[7:])
+  }
+  return strings.TrimSpace(r.Header.Get("X-Api-Token"))
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+  return context.WithValue(ctx, principalKey{}, p)
+}
+
+func FromContext(ctx context.Context) (Principal, bool) {
+  p, ok := ctx.Value(principalKey{}).(Principal)
+  return p, ok
+}
+
+// WithAuth authenticates requests against tokens and rejects those whose
+// principal lacks the role required(r) returns: 401 without a valid token,
+// 403 with too low a role. The principal is stored in the request context.
+// Paths that require RoleNone are open: they are served whatever the token,
+// with the principal attached only when the token is valid. A nil tokens set
+// disables authentication.
+func WithAuth(tokens *Tokens, required func(*http.Request) Role, next http.Handler) http.Handler {
+  if tokens == nil {
+    return next
+  }
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    need := required(r)
+    p, ok := tokens.Lookup(TokenFromRequest(r))
+    switch {
+    case need == RoleNone && !ok:
+      next.ServeHTTP(w, r)
+      return
+    case !ok:
+      w.Header().Set("WWW-Authenticate", `Bearer realm="rechain"`)
+      http.Error(w, "unauthorized", http.StatusUnauthorized)
+      return
+    case !p.Can(need):
+      http.Error(w, "forbidden: requires "+need.String()+" role", http.StatusForbidden)
+      return
+    }
+    next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+  })
+}
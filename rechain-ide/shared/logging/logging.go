@@ -1,6 +1,7 @@
 ﻿package logging
 
 import (
+  "context"
   "crypto/rand"
   "encoding/hex"
   "log"
@@ -18,6 +19,11 @@ func (lrw *ResponseWriter) WriteHeader(code int) {
   lrw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer (Flush for SSE).
+func (lrw *ResponseWriter) Unwrap() http.ResponseWriter {
+  return lrw.ResponseWriter
+}
+
 func WithRequestID(next http.Handler) http.Handler {
   return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
     rid := r.Header.Get("X-Request-Id")
@@ -28,7 +34,7 @@ func WithRequestID(next http.Handler) http.Handler {
 
     lrw := &ResponseWriter{ResponseWriter: w, Status: http.StatusOK}
     start := time.Now()
-    next.ServeHTTP(lrw, r)
+    next.ServeHTTP(lrw, r.WithContext(ContextWithRequestID(r.Context(), rid)))
     log.Printf("rid=%s method=%s path=%s status=%d dur=%s", rid, r.Method, r.URL.Path, lrw.Status, time.Since(start))
   })
 }
@@ -40,3 +46,16 @@ func NewRequestID() string {
   }
   return hex.EncodeToString(buf)
 }
+
+type requestIDKey struct{}
+
+// ContextWithRequestID stores the request ID so outbound calls can forward it.
+func ContextWithRequestID(ctx context.Context, rid string) context.Context {
+  return context.WithValue(ctx, requestIDKey{}, rid)
+}
+
+// RequestIDFromContext returns the request ID stored by WithRequestID.
+func RequestIDFromContext(ctx context.Context) string {
+  rid, _ := ctx.Value(requestIDKey{}).(string)
+  return rid
+}
@@ -0,0 +1,370 @@
+﻿package tracing
+
+import (
+  "context"
+  "crypto/rand"
+  "encoding/hex"
+  "errors"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "rechain-ide/shared/logging"
+)
+
+// Span kinds.
+const (
+  KindInternal = "internal"
+  KindClient   = "client"
+  KindServer   = "server"
+)
+
+// SpanContext identifies a span across process boundaries, as carried by the
+// W3C traceparent header.
+type SpanContext struct {
+  TraceID string
+  SpanID  string
+  Flags   string
+}
+
+// ParseTraceparent parses a version 00 traceparent header.
+func ParseTraceparent(h string) (SpanContext, bool) {
+  parts := strings.Split(strings.TrimSpace(h), "-")
+  if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+    return SpanContext{}, false
+  }
+  if !isHex(parts[1], 32) || !isHex(parts[2], 16) || !isHex(parts[3], 2) {
+    return SpanContext{}, false
+  }
+  if parts[0] == "00" && len(parts) != 4 {
+    return SpanContext{}, false
+  }
+  if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+    return SpanContext{}, false
+  }
+  return SpanContext{TraceID: parts[1], SpanID: parts[2], Flags: parts[3]}, true
+}
+
+// Traceparent formats the span context as a traceparent header value.
+func (sc SpanContext) Traceparent() string {
+  flags := sc.Flags
+  if flags == "" {
+    flags = "01"
+  }
+  return "00-" + sc.TraceID + "-" + sc.SpanID + "-" + flags
+}
+
+func isHex(s string, n int) bool {
+  if len(s) != n {
+    return false
+  }
+  for _, c := range s {
+    if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+      return false
+    }
+  }
+  return true
+}
+
+func NewTraceID() string { return randomHex(16) }
+
+func NewSpanID() string { return randomHex(8) }
+
+func randomHex(n int) string {
+  buf := make([]byte, n)
+  if _, err := rand.Read(buf); err != nil {
+    return strings.Repeat("0", 2*n-1) + "1"
+  }
+  return hex.EncodeToString(buf)
+}
+
+// Span is one timed operation of a trace. OffsetMs is the start relative to
+// the first span of the recorder.
+type Span struct {
+  Name       string            `json:"name"`
+  Kind       string            `json:"kind"`
+  SpanID     string            `json:"span_id"`
+  ParentID   string            `json:"parent_id,omitempty"`
+  StartedAt  string            `json:"started_at"`
+  OffsetMs   float64           `json:"offset_ms"`
+  DurationMs float64           `json:"duration_ms"`
+  Status     string            `json:"status"`
+  Error      string            `json:"error,omitempty"`
+  Attributes map[string]string `json:"attributes,omitempty"`
+  Children   []Span            `json:"children,omitempty"`
+  start      time.Time
+}
+
+// Recorder collects the finished spans of one trace in memory.
+type Recorder struct {
+  traceID string
+  start   time.Time
+
+  mu    sync.Mutex
+  spans []Span
+}
+
+func (r *Recorder) TraceID() string { return r.traceID }
+
+func (r *Recorder) add(s Span) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  s.OffsetMs = ms(s.start.Sub(r.start))
+  r.spans = append(r.spans, s)
+}
+
+// Tree returns the finished spans nested under their parents, ordered by
+// start time. Spans whose parent was not recorded are roots.
+func (r *Recorder) Tree() []Span {
+  if r == nil {
+    return nil
+  }
+  r.mu.Lock()
+  spans := append([]Span{}, r.spans...)
+  r.mu.Unlock()
+  sort.SliceStable(spans, func(i, j int) bool { return spans[i].start.Before(spans[j].start) })
+  known := map[string]bool{}
+  children := map[string][]Span{}
+  for _, s := range spans {
+    known[s.SpanID] = true
+  }
+  roots := []Span{}
+  for _, s := range spans {
+    if s.ParentID != "" && known[s.ParentID] {
+      children[s.ParentID] = append(children[s.ParentID], s)
+    } else {
+      roots = append(roots, s)
+    }
+  }
+  var build func(s Span) Span
+  build = func(s Span) Span {
+    for _, c := range children[s.SpanID] {
+      s.Children = append(s.Children, build(c))
+    }
+    return s
+  }
+  for i := range roots {
+    roots[i] = build(roots[i])
+  }
+  return roots
+}
+
+// ActiveSpan is a started span. All methods are safe on a nil span.
+type ActiveSpan struct {
+  rec  *Recorder
+  sc   SpanContext
+  span Span
+  mu   sync.Mutex
+  done bool
+}
+
+func (s *ActiveSpan) Context() SpanContext {
+  if s == nil {
+    return SpanContext{}
+  }
+  return s.sc
+}
+
+func (s *ActiveSpan) SetAttr(key string, value string) {
+  if s == nil {
+    return
+  }
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.span.Attributes == nil {
+    s.span.Attributes = map[string]string{}
+  }
+  s.span.Attributes[key] = value
+}
+
+// End finishes the span, marking it as an error when err is non-nil. Only the
+// first call counts.
+func (s *ActiveSpan) End(err error) {
+  if s == nil {
+    return
+  }
+  s.mu.Lock()
+  if s.done {
+    s.mu.Unlock()
+    return
+  }
+  s.done = true
+  s.span.DurationMs = ms(time.Since(s.span.start))
+  s.span.Status = "ok"
+  if err != nil {
+    s.span.Status = "error"
+    s.span.Error = err.Error()
+  }
+  span := s.span
+  s.mu.Unlock()
+  if s.rec != nil {
+    s.rec.add(span)
+  }
+}
+
+type recorderKey struct{}
+type spanKey struct{}
+
+// FromContext returns the current span context.
+func FromContext(ctx context.Context) (SpanContext, bool) {
+  sc, ok := ctx.Value(spanKey{}).(SpanContext)
+  return sc, ok
+}
+
+// ContextWithSpan makes sc the current span of ctx without recording it, e.g.
+// for a parent received from another service.
+func ContextWithSpan(ctx context.Context, sc SpanContext) context.Context {
+  return context.WithValue(ctx, spanKey{}, sc)
+}
+
+// NewTrace starts a recorder and its root span. The root continues parent
+// when it has a trace ID and starts a new trace otherwise.
+func NewTrace(ctx context.Context, name string, parent SpanContext) (context.Context, *ActiveSpan, *Recorder) {
+  if parent.TraceID == "" {
+    parent = SpanContext{TraceID: NewTraceID()}
+  }
+  rec := &Recorder{traceID: parent.TraceID, start: time.Now()}
+  ctx = context.WithValue(ctx, recorderKey{}, rec)
+  ctx, span := Start(ContextWithSpan(ctx, parent), name, KindInternal)
+  return ctx, span, rec
+}
+
+// Start begins a child of the current span. Without a recorder in ctx the
+// span still gets an ID to propagate but is not recorded; without a current
+// span it starts a new trace.
+func Start(ctx context.Context, name string, kind string) (context.Context, *ActiveSpan) {
+  parent, _ := FromContext(ctx)
+  sc := SpanContext{TraceID: parent.TraceID, SpanID: NewSpanID(), Flags: parent.Flags}
+  if sc.TraceID == "" {
+    sc.TraceID = NewTraceID()
+  }
+  rec, _ := ctx.Value(recorderKey{}).(*Recorder)
+  now := time.Now()
+  s := &ActiveSpan{rec: rec, sc: sc, span: Span{
+    Name:      name,
+    Kind:      kind,
+    SpanID:    sc.SpanID,
+    ParentID:  parent.SpanID,
+    StartedAt: now.UTC().Format(time.RFC3339Nano),
+    start:     now,
+  }}
+  return ContextWithSpan(ctx, sc), s
+}
+
+// Transport records a client span per request, sends the span as the
+// traceparent header and forwards the request ID of the context. A
+// Server-Timing "app" duration in the response is recorded as a server child
+// span, so client time can be told apart from time spent in the service.
+type Transport struct {
+  Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+  base := t.Base
+  if base == nil {
+    base = http.DefaultTransport
+  }
+  ctx, span := Start(req.Context(), req.Method+" "+req.URL.Path, KindClient)
+  span.SetAttr("peer", req.URL.Host)
+  out := req.Clone(ctx)
+  out.Header.Set("traceparent", span.Context().Traceparent())
+  if rid := logging.RequestIDFromContext(ctx); rid != "" && out.Header.Get("X-Request-Id") == "" {
+    out.Header.Set("X-Request-Id", rid)
+  }
+  resp, err := base.RoundTrip(out)
+  if err != nil {
+    span.End(err)
+    return resp, err
+  }
+  span.SetAttr("status_code", strconv.Itoa(resp.StatusCode))
+  if dur, ok := serverTiming(resp.Header.Get("Server-Timing")); ok && span.rec != nil {
+    span.rec.add(Span{
+      Name:       "server " + req.URL.Path,
+      Kind:       KindServer,
+      SpanID:     NewSpanID(),
+      ParentID:   span.sc.SpanID,
+      StartedAt:  span.span.StartedAt,
+      DurationMs: dur,
+      Status:     "ok",
+      start:      span.span.start,
+    })
+  }
+  if resp.StatusCode >= 500 {
+    span.End(errors.New("status " + strconv.Itoa(resp.StatusCode)))
+  } else {
+    span.End(nil)
+  }
+  return resp, nil
+}
+
+// NewClient returns an http.Client whose requests are traced.
+func NewClient(timeout time.Duration) *http.Client {
+  return &http.Client{Timeout: timeout, Transport: &Transport{}}
+}
+
+// serverTiming returns the dur of the "app" metric of a Server-Timing header.
+func serverTiming(h string) (float64, bool) {
+  for _, metric := range strings.Split(h, ",") {
+    params := strings.Split(metric, ";")
+    if strings.TrimSpace(params[0]) != "app" {
+      continue
+    }
+    for _, p := range params[1:] {
+      p = strings.TrimSpace(p)
+      if strings.HasPrefix(p, "dur=") {
+        if v, err := strconv.ParseFloat(strings.TrimPrefix(p, "dur="), 64); err == nil {
+          return v, true
+        }
+      }
+    }
+  }
+  return 0, false
+}
+
+type timingWriter struct {
+  http.ResponseWriter
+  start   time.Time
+  written bool
+}
+
+func (w *timingWriter) WriteHeader(code int) {
+  if !w.written {
+    w.written = true
+    w.Header().Set("Server-Timing", "app;dur="+strconv.FormatFloat(ms(time.Since(w.start)), 'f', 3, 64))
+  }
+  w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+  if !w.written {
+    w.WriteHeader(http.StatusOK)
+  }
+  return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (Flush for SSE).
+func (w *timingWriter) Unwrap() http.ResponseWriter {
+  return w.ResponseWriter
+}
+
+// WithTrace continues the trace of an incoming traceparent header (or starts
+// one) with a server span that becomes the current span of the request
+// context, so outbound calls through Transport join the same trace. The time
+// until the response header is reported as Server-Timing "app".
+func WithTrace(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    parent, ok := ParseTraceparent(r.Header.Get("traceparent"))
+    if !ok {
+      parent = SpanContext{TraceID: NewTraceID()}
+    }
+    ctx := ContextWithSpan(r.Context(), SpanContext{TraceID: parent.TraceID, SpanID: NewSpanID(), Flags: parent.Flags})
+    next.ServeHTTP(&timingWriter{ResponseWriter: w, start: time.Now()}, r.WithContext(ctx))
+  })
+}
+
+func ms(d time.Duration) float64 {
+  return float64(d.Microseconds()) / 1000
+}
@@ -1,12 +1,14 @@
 ﻿package main
 
 import (
+  "bufio"
   "bytes"
   "encoding/json"
   "flag"
   "fmt"
   "io"
   "net/http"
+  "strings"
   "time"
 )
 
@@ -81,6 +83,11 @@ func main() {
     return
   }
 
+  if final, err := waitForEvents(*server, status.ID); err == nil {
+    fmt.Println(final)
+    return
+  }
+
   for {
     time.Sleep(200 * time.Millisecond)
     r, err := http.Get(*server + "/tasks/" + status.ID)
@@ -97,9 +104,50 @@ func main() {
       return
     }
 
-    if s.State == "completed" || s.State == "canceled" {
+    if isTerminal(s.State) {
       fmt.Println(string(data))
       return
     }
   }
 }
+
+func isTerminal(state string) bool {
+  return state == "completed" || state == "failed" || state == "canceled"
+}
+
+// waitForEvents follows /tasks/{id}/events and returns the final TaskStatus
+// JSON. Any error makes the caller fall back to polling.
+func waitForEvents(server string, id string) (string, error) {
+  resp, err := http.Get(server + "/tasks/" + id + "/events")
+  if err != nil {
+    return "", err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return "", fmt.Errorf("events: status %d", resp.StatusCode)
+  }
+
+  reader := bufio.NewReader(resp.Body)
+  for {
+    line, err := reader.ReadString('\n')
+    if err != nil {
+      return "", err
+    }
+    if !strings.HasPrefix(line, "data: ") {
+      continue
+    }
+    var ev struct {
+      Status *json.RawMessage `json:"status"`
+    }
+    if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil || ev.Status == nil {
+      continue
+    }
+    var s TaskStatus
+    if err := json.Unmarshal(*ev.Status, &s); err != nil {
+      continue
+    }
+    if isTerminal(s.State) {
+      return string(*ev.Status), nil
+    }
+  }
+}